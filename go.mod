@@ -18,8 +18,9 @@ require (
 	github.com/shenwei356/pand v0.0.6
 	github.com/shenwei356/unik/v5 v5.0.1
 	github.com/shenwei356/util v0.5.0
-	github.com/shenwei356/xopen v0.2.2 // indirect
+	github.com/shenwei356/xopen v0.2.2
 	github.com/spf13/cobra v1.4.0
+	github.com/spf13/pflag v1.0.5
 	github.com/tatsushid/go-prettytable v0.0.0-20141013043238-ed2d14c29939
 	github.com/twotwotwo/sorts v0.0.0-20160814051341-bf5c1f2b8553
 	github.com/vbauerster/mpb/v5 v5.4.0
@@ -38,7 +39,6 @@ require (
 	github.com/rivo/uniseg v0.2.0 // indirect
 	github.com/shenwei356/kmers v0.1.0 // indirect
 	github.com/shenwei356/natsort v0.0.0-20190418160752-600d539c017d // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/ulikunitz/xz v0.5.10 // indirect
 	github.com/will-rowe/nthash v0.4.0 // indirect
 	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
@@ -0,0 +1,338 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/bio/seq"
+	"github.com/shenwei356/bio/seqio/fastx"
+	"github.com/shenwei356/kmcp/kmcp/search"
+	"github.com/shenwei356/util/pathutil"
+	"github.com/spf13/cobra"
+)
+
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Benchmark searching with synthetic reads",
+	Long: `Benchmark searching with synthetic reads
+
+This command runs a standardized search workload against a database,
+and reports the loading time, searching speed and memory usage,
+with index files loaded via mmap (default mode of "kmcp search") and
+loaded into main memory (-w/--load-whole-db), respectively.
+It gives reproducible performance numbers across hardware.
+
+Synthetic reads are sampled from given reference sequences (better be
+the ones used to build the database) with a fixed random seed,
+and substitution errors are introduced at given rates.
+
+Attention:
+  1. All reference sequences are stored in main memory.
+  2. The memory is the one allocated by the Go runtime, pages of
+     index files mapped via mmap are not included.
+
+Output format:
+    1. mode,         "mmap" or "ram"
+    2. errorRate,    Substitution error rate of reads
+    3. loadTime,     Time of loading the database (seconds)
+    4. reads,        Number of reads
+    5. matched,      Number of matched reads
+    6. searchTime,   Time of searching (seconds)
+    7. readsPerSec,  Number of reads searched per second
+    8. memory,       Memory allocated by the Go runtime (MB)
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+		seq.ValidateSeq = false
+
+		var err error
+
+		dbDir := getFlagString(cmd, "db-dir")
+		if dbDir == "" {
+			checkError(fmt.Errorf("flag -d/--db-dir needed"))
+		}
+		outFile := getFlagString(cmd, "out-file")
+		nReads := getFlagPositiveInt(cmd, "num-reads")
+		readLen := getFlagPositiveInt(cmd, "read-len")
+		errorRates := getFlagFloat64Slice(cmd, "error-rates")
+		for _, e := range errorRates {
+			if e < 0 || e >= 1 {
+				checkError(fmt.Errorf("the value of -e/--error-rates (%f) should be in range of [0, 1)", e))
+			}
+		}
+		if len(errorRates) == 0 {
+			checkError(fmt.Errorf("flag -e/--error-rates needed"))
+		}
+		seed := getFlagInt64(cmd, "seed")
+		queryCov := getFlagFloat64(cmd, "min-query-cov")
+		if queryCov < 0 || queryCov > 1 {
+			checkError(fmt.Errorf("value of -t/--min-query-cov should be in range [0, 1]"))
+		}
+
+		// ---------------------------------------------------------------
+		// database
+
+		subFiles, err := ioutil.ReadDir(dbDir)
+		if err != nil {
+			checkError(fmt.Errorf("read database error: %s", err))
+		}
+
+		dbDirs := make([]string, 0, 8)
+		for _, file := range subFiles {
+			if !file.IsDir() {
+				continue
+			}
+			path := filepath.Join(dbDir, file.Name())
+			existed, err := pathutil.Exists(filepath.Join(path, search.DBInfoFile))
+			if err != nil {
+				checkError(fmt.Errorf("read database error: %s", err))
+			}
+			if existed {
+				dbDirs = append(dbDirs, path)
+			}
+		}
+		if len(dbDirs) == 0 {
+			checkError(fmt.Errorf("invalid kmcp database: %s", dbDir))
+		}
+
+		// ---------------------------------------------------------------
+		// reference sequences
+
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", true)
+		if opt.Verbose {
+			if len(files) == 1 && isStdin(files[0]) {
+				log.Info("no files given, reading from stdin")
+			} else {
+				log.Infof("%d input file(s) given", len(files))
+			}
+		}
+
+		refs := make([][]byte, 0, 1024)
+		var sumLen int
+		var fastxReader *fastx.Reader
+		var record *fastx.Record
+		for _, file := range files {
+			fastxReader, err = fastx.NewDefaultReader(file)
+			checkError(errors.Wrap(err, file))
+
+			for {
+				record, err = fastxReader.Read()
+				if err != nil {
+					if err == io.EOF {
+						break
+					}
+					checkError(errors.Wrap(err, file))
+					break
+				}
+				if len(record.Seq.Seq) < readLen {
+					continue
+				}
+				refs = append(refs, []byte(strings.ToUpper(string(record.Seq.Seq))))
+				sumLen += len(record.Seq.Seq) - readLen + 1
+			}
+		}
+		if len(refs) == 0 {
+			checkError(fmt.Errorf("no sequences longer than -l/--read-len (%d) given", readLen))
+		}
+		if opt.Verbose {
+			log.Infof("%d reference sequences loaded", len(refs))
+		}
+
+		// ---------------------------------------------------------------
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		outfh.WriteString("mode\terrorRate\tloadTime\treads\tmatched\tsearchTime\treadsPerSec\tmemory\n")
+
+		for _, mode := range []string{"mmap", "ram"} {
+			for _, errorRate := range errorRates {
+				reads := simulateReads(refs, sumLen, nReads, readLen, errorRate, seed)
+
+				if opt.Verbose {
+					log.Infof("benchmarking in mode %s with %d reads (error rate: %f) ...", mode, len(reads), errorRate)
+				}
+				r := benchSearch(dbDirs, mode == "ram", opt.NumCPUs, queryCov, reads)
+
+				outfh.WriteString(fmt.Sprintf("%s\t%s\t%.3f\t%d\t%d\t%.3f\t%.0f\t%.1f\n",
+					mode, strconv.FormatFloat(errorRate, 'f', -1, 64),
+					r.loadTime.Seconds(), len(reads), r.matched, r.searchTime.Seconds(),
+					float64(len(reads))/r.searchTime.Seconds(), float64(r.memory)/(1<<20)))
+				outfh.Flush()
+			}
+		}
+	},
+}
+
+// simulateReads samples reads from references uniformly
+// and introduces substitution errors at the given rate.
+func simulateReads(refs [][]byte, sumLen int, n int, readLen int, errorRate float64, seed int64) [][]byte {
+	r := rand.New(rand.NewSource(seed))
+
+	// cumulative numbers of start positions, for sampling a reference by its length.
+	cumLens := make([]int, len(refs))
+	var s int
+	for i, ref := range refs {
+		s += len(ref) - readLen + 1
+		cumLens[i] = s
+	}
+
+	bases := []byte("ACGT")
+	reads := make([][]byte, n)
+	var pos, i, j int
+	var read []byte
+	var b byte
+	for k := range reads {
+		pos = r.Intn(sumLen)
+		i = sort.SearchInts(cumLens, pos+1)
+		if i > 0 {
+			pos -= cumLens[i-1]
+		}
+
+		read = make([]byte, readLen)
+		copy(read, refs[i][pos:pos+readLen])
+		if errorRate > 0 {
+			for j = range read {
+				if r.Float64() >= errorRate {
+					continue
+				}
+				for {
+					b = bases[r.Intn(4)]
+					if b != read[j] {
+						read[j] = b
+						break
+					}
+				}
+			}
+		}
+		reads[k] = read
+	}
+	return reads
+}
+
+type benchResult struct {
+	loadTime   time.Duration
+	searchTime time.Duration
+	matched    int
+	memory     uint64
+}
+
+// benchSearch searches reads with a new search engine,
+// in which index files are loaded into main memory or via mmap.
+func benchSearch(dbDirs []string, inRAM bool, threads int, queryCov float64, reads [][]byte) benchResult {
+	var r benchResult
+
+	runtime.GC()
+
+	timeStart := time.Now()
+	sg, err := search.Open(dbDirs, search.SearchOptions{
+		LoadWholeFile: inRAM,
+		UseMMap:       true,
+		Threads:       threads,
+
+		DeduplicateThreshold: 256,
+
+		SortBy: "qcov",
+
+		MinQLen:     30,
+		MinMatched:  10,
+		MinQueryCov: queryCov,
+		MaxFPR:      0.05,
+	})
+	checkError(err)
+	r.loadTime = time.Since(timeStart)
+
+	done := make(chan int)
+	go func() {
+		for result := range sg.OutCh {
+			checkError(result.Err)
+			if result.Matches != nil {
+				r.matched++
+			}
+			search.RecycleQueryResult(result)
+		}
+		done <- 1
+	}()
+
+	timeStart = time.Now()
+	var clone *seq.Seq
+	for i, read := range reads {
+		clone = search.NewSeq()
+		clone.Alphabet = seq.DNAredundant
+		clone.Seq = append(clone.Seq[:0], read...)
+
+		query := search.NewQuery()
+		query.Idx = uint64(i)
+		query.ID = []byte(strconv.Itoa(i))
+		query.Seq = clone
+		sg.InCh <- query
+	}
+	sg.Done()
+	<-done
+	r.searchTime = time.Since(timeStart)
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	r.memory = m.Sys
+
+	checkError(sg.Close())
+	return r
+}
+
+func init() {
+	RootCmd.AddCommand(benchCmd)
+
+	benchCmd.Flags().StringP("db-dir", "d", "",
+		formatFlagUsage(`Database directory created by "kmcp index".`))
+	benchCmd.Flags().IntP("num-reads", "n", 100000,
+		formatFlagUsage(`Number of synthetic reads.`))
+	benchCmd.Flags().IntP("read-len", "l", 150,
+		formatFlagUsage(`Length of synthetic reads.`))
+	benchCmd.Flags().Float64SliceP("error-rates", "e", []float64{0, 0.01},
+		formatFlagUsage(`Substitution error rates of synthetic reads, a workload is run for each value.`))
+	benchCmd.Flags().Int64P("seed", "s", 11,
+		formatFlagUsage(`Seed of the random number generator, for reproducible workloads.`))
+	benchCmd.Flags().Float64P("min-query-cov", "t", 0.55,
+		formatFlagUsage(`Minimal query coverage, i.e., proportion of matched k-mers and unique k-mers of a query.`))
+	benchCmd.Flags().StringP("out-file", "o", "-",
+		formatFlagUsage(`Out file, supports and recommends a ".gz" suffix ("-" for stdout).`))
+
+	benchCmd.SetUsageTemplate(usageTemplate("-d <kmcp db> [-n <reads>] [-l <len>] [-e <rates>] [-o <out.tsv>] <reference seq files>"))
+}
@@ -0,0 +1,150 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var buildCmd = &cobra.Command{
+	Use:   "build",
+	Short: "Build a database from FASTA/Q sequences in one step",
+	Long: `Build a database from FASTA/Q sequences in one step
+
+This command runs "kmcp compute" and "kmcp index" in one step, for quick
+building of small databases. K-mer files (.unik) are saved in a temporary
+directory which is removed after indexing, unless --unik-dir is given.
+
+All flags of "kmcp compute" and "kmcp index" are supported, except:
+  1. -O/--out-dir is the output directory of the database.
+  2. -I/--in-dir and -r/--file-regexp are for input sequence files.
+  3. The shorthand of -n/--num-hash of "kmcp index" is removed,
+     as -n is used by -n/--split-number of "kmcp compute".
+
+Attention:
+  1. The temporary directory is not removed if the command exits with errors.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		outDir := getFlagString(cmd, "out-dir")
+		if outDir == "" {
+			checkError(fmt.Errorf("flag -O/--out-dir is needed"))
+		}
+		force := getFlagBool(cmd, "force")
+		unikDir := getFlagString(cmd, "unik-dir")
+		tmpDir := getFlagString(cmd, "tmp-dir")
+
+		keepUnik := unikDir != ""
+		if keepUnik {
+			if filepath.Clean(unikDir) == filepath.Clean(outDir) {
+				checkError(fmt.Errorf("values of --unik-dir and -O/--out-dir should be different"))
+			}
+		} else {
+			var err error
+			unikDir, err = ioutil.TempDir(tmpDir, "kmcp-build-")
+			if err != nil {
+				checkError(fmt.Errorf("failed to create temporary directory: %s", err))
+			}
+			defer os.RemoveAll(unikDir)
+		}
+
+		timeStart := time.Now()
+		if opt.Verbose {
+			log.Infof("directory of k-mer files: %s", unikDir)
+			log.Info()
+		}
+
+		// ---------------------------------------------------------------
+		// compute
+
+		checkError(computeCmd.Flags().Set("out-dir", unikDir))
+		checkError(computeCmd.Flags().Set("force", strconv.FormatBool(force || !keepUnik)))
+		computeCmd.InheritedFlags() // global flags are merged into local flags
+		computeCmd.Run(computeCmd, args)
+
+		// ---------------------------------------------------------------
+		// index
+
+		checkError(indexCmd.Flags().Set("in-dir", unikDir))
+		checkError(indexCmd.Flags().Set("out-dir", outDir))
+		checkError(indexCmd.Flags().Set("force", strconv.FormatBool(force)))
+		indexCmd.InheritedFlags()
+		indexCmd.Run(indexCmd, []string{})
+
+		if opt.Verbose {
+			log.Infof("database saved to: %s", outDir)
+			log.Infof("total elapsed time: %s", time.Since(timeStart))
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(buildCmd)
+
+	buildCmd.Flags().StringP("out-dir", "O", "",
+		formatFlagUsage(`Output directory of the database.`))
+	buildCmd.Flags().BoolP("force", "", false,
+		formatFlagUsage(`Overwrite existed output directory.`))
+	buildCmd.Flags().StringP("unik-dir", "", "",
+		formatFlagUsage(`Directory to save k-mer files (.unik) in. If not given, they are saved in a temporary directory and removed after indexing.`))
+	buildCmd.Flags().StringP("tmp-dir", "", os.TempDir(),
+		formatFlagUsage(`Parent directory of the temporary directory of k-mer files.`))
+
+	buildCmd.SetUsageTemplate(usageTemplate("-O <out dir> [-k <k>] [-n <chunks>] [-f <fpr>] { -I <seqs dir> | <seq files> }"))
+}
+
+// shareFlagsWithBuild adds flags of compute and index to build,
+// so values parsed by build are seen by the two commands.
+// It must be called after all init() functions, where flags of
+// the two commands are defined.
+func shareFlagsWithBuild() {
+	flags := buildCmd.Flags()
+	add := func(f *pflag.Flag) {
+		if flags.Lookup(f.Name) != nil {
+			return
+		}
+		if f.Shorthand != "" && flags.ShorthandLookup(f.Shorthand) != nil {
+			f2 := *f // the value is still shared
+			f2.Shorthand = ""
+			flags.AddFlag(&f2)
+			return
+		}
+		flags.AddFlag(f)
+	}
+
+	computeCmd.Flags().VisitAll(add) // -I/--in-dir and -r/--file-regexp are for sequence files
+	indexCmd.Flags().VisitAll(func(f *pflag.Flag) {
+		switch f.Name {
+		case "in-dir", "file-regexp":
+			return
+		}
+		add(f)
+	})
+}
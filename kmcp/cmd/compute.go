@@ -36,6 +36,7 @@ import (
 	"github.com/shenwei356/bio/seq"
 	"github.com/shenwei356/bio/seqio/fastx"
 	"github.com/shenwei356/bio/sketches"
+	"github.com/shenwei356/kmcp/kmcp/search"
 	"github.com/shenwei356/unik/v5"
 	"github.com/shenwei356/util/pathutil"
 	"github.com/spf13/cobra"
@@ -172,6 +173,7 @@ Examples:
 		kMax := ks[len(ks)-1]
 
 		circular0 := getFlagBool(cmd, "circular")
+		skipMasked := getFlagBool(cmd, "skip-masked")
 
 		outDir := getFlagString(cmd, "out-dir")
 		force := getFlagBool(cmd, "force")
@@ -272,8 +274,8 @@ Examples:
 					checkError(fmt.Errorf("value of flag -s/--split-size should > value of -l/--split-overlap"))
 				}
 			} else { // split by number
-				if splitNumber0 > 65535 {
-					checkError(fmt.Errorf(("value of flag -s/--split-number should not be greater than 65535")))
+				if splitNumber0 > 1<<32-1 {
+					checkError(fmt.Errorf(("value of flag -n/--split-number should not be greater than 4294967295")))
 				}
 			}
 			bySeq = true
@@ -306,6 +308,22 @@ Examples:
 			checkError(fmt.Errorf("flag --minimizer-w and --syncmer-s can not be given simultaneously"))
 		}
 
+		alphabet := strings.ToLower(getFlagString(cmd, "alphabet"))
+		var abTable *search.AlphabetTable
+		if !search.IsDNAAlphabet(alphabet) {
+			abTable, err = search.NewAlphabetTable(alphabet)
+			checkError(err)
+			if minimizer || syncmer {
+				checkError(fmt.Errorf("flag --minimizer-w and --syncmer-s are not supported for amino acid alphabet"))
+			}
+			if circular0 {
+				checkError(fmt.Errorf("flag --circular is not supported for amino acid alphabet"))
+			}
+		} else {
+			alphabet = search.AlphabetDNA
+		}
+		protein := abTable != nil
+
 		// ---------------------------------------------------------------
 		// out dir
 
@@ -381,7 +399,13 @@ Examples:
 
 			log.Infof("  k-mer size(s): %s", strings.Join(IntSlice2StringSlice(ks), ", "))
 
+			if protein {
+				log.Infof("  alphabet: %s", alphabet)
+			}
 			log.Infof("  circular genome: %v", circular0)
+			if skipMasked {
+				log.Infof("  skip k-mers overlapping soft-masked bases: %v", skipMasked)
+			}
 			if minimizer {
 				log.Infof("  minimizer window: %d", minimizerW)
 			}
@@ -429,7 +453,7 @@ Examples:
 		var doneDuration chan int
 
 		if opt.Verbose {
-			pbs = mpb.New(mpb.WithWidth(40), mpb.WithOutput(os.Stderr))
+			pbs = mpb.New(mpb.WithWidth(40), mpb.WithOutput(progressBarOutput()))
 			bar = pbs.AddBar(int64(len(files)),
 				mpb.BarStyle("[=>-]<+"),
 				mpb.PrependDecorators(
@@ -529,7 +553,11 @@ Examples:
 				var allSeqs [][]byte
 				var bigSeq []byte
 				var record1 *fastx.Record
-				nnn := bytes.Repeat([]byte{'N'}, kMax-1)
+				gap := byte('N')
+				if protein {
+					gap = 'X'
+				}
+				nnn := bytes.Repeat([]byte{gap}, kMax-1)
 
 				var ignoreSeq bool
 				var re *regexp.Regexp
@@ -653,6 +681,10 @@ Examples:
 						}
 					}
 
+					if skipMasked {
+						search.HardMask(record.Seq.Seq, protein)
+					}
+
 					slider = record.Seq.Slider(splitSize, step, circular0, greedy)
 
 					if bySeq {
@@ -673,6 +705,11 @@ Examples:
 						}
 
 						for _, k = range ks {
+							if protein {
+								codes = abTable.AppendProteinKmers(codes, _seq.Seq, k, scaled, maxHash)
+								continue
+							}
+
 							if syncmer {
 								sketch, err = sketches.NewSyncmerSketch(_seq, k, syncmerS, circular)
 							} else if minimizer {
@@ -786,6 +823,7 @@ Examples:
 							SyncmerS:     syncmerS,
 							Minimizer:    minimizer,
 							MinimizerW:   minimizerW,
+							Alphabet:     alphabet,
 							SplitSeq:     splitSeq,
 							SplitNum:     splitNumber,
 							SplitSize:    splitSize0,
@@ -859,6 +897,7 @@ Examples:
 					SyncmerS:     syncmerS,
 					Minimizer:    minimizer,
 					MinimizerW:   minimizerW,
+					Alphabet:     alphabet,
 					SplitSeq:     splitSeq,
 					SplitNum:     splitNumber,
 					SplitSize:    splitSize0,
@@ -912,7 +951,9 @@ func writeKmers(k int, codes []uint64, n uint64,
 	var writer *unik.Writer
 	var mode uint32
 
-	mode |= unik.UnikCanonical
+	if search.IsDNAAlphabet(meta.Alphabet) { // amino acid k-mers have no reverse complement
+		mode |= unik.UnikCanonical
+	}
 	mode |= unik.UnikHashed
 
 	writer, err = unik.NewWriter(outfh, k, mode)
@@ -959,6 +1000,9 @@ func init() {
 	computeCmd.Flags().BoolP("circular", "", false,
 		formatFlagUsage(`Input sequences are circular.`))
 
+	computeCmd.Flags().BoolP("skip-masked", "", false,
+		formatFlagUsage(`Skip k-mers overlapping lowercase (soft-masked) bases, e.g., repeats masked by RepeatMasker. Bases are case-insensitive by default.`))
+
 	computeCmd.Flags().IntP("scale", "D", 1,
 		formatFlagUsage(`Scale of the FracMinHash (Scaled MinHash), or down-sample factor for Syncmers and Minimizer.`))
 
@@ -968,6 +1012,9 @@ func init() {
 	computeCmd.Flags().IntP("syncmer-s", "S", 0,
 		formatFlagUsage(`Length of the s-mer in Closed Syncmers.`))
 
+	computeCmd.Flags().StringP("alphabet", "", search.AlphabetDNA,
+		formatFlagUsage(`Alphabet of input sequences. Available values: dna, protein, murphy15, murphy10, dayhoff6. Amino acid sequences are converted to the reduced alphabet before hashing.`))
+
 	// computeCmd.Flags().BoolP("exact-number", "e", false, `save exact number of unique k-mers for indexing (recommended)`)
 
 	computeCmd.Flags().BoolP("compress", "c", false,
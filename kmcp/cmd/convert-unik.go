@@ -0,0 +1,233 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/bio/seq"
+	"github.com/shenwei356/bio/sketches"
+	"github.com/shenwei356/unik/v5"
+	"github.com/spf13/cobra"
+)
+
+var convertUnikCmd = &cobra.Command{
+	Use:   "convert-unik",
+	Short: "Convert plain k-mers in .unik files to ntHash values for indexing",
+	Long: `Convert plain k-mers in .unik files to ntHash values for indexing
+
+This command re-emits k-mers in .unik files created by other tools (e.g., "unikmer count")
+as ntHash values, the hash scheme used by "kmcp compute", so they can be indexed with
+"kmcp index" without recomputing from sequence files.
+
+Attention:
+  1. Only DNA k-mers in plain 2-bit codes (k <= 32) are supported.
+  2. Hashed k-mers (e.g., those created by "kmcp compute") can not be rehashed,
+     as hash values are not invertible, and neither can a database, where
+     k-mers are only stored in bloom filters. Please recompute from sequences.
+  3. The numbers of k-mers before and after conversion are compared for validation,
+     a warning is reported for duplicated hashes, which come from hash collisions,
+     or k-mers and their reverse complements in files without the canonical flag.
+  4. Output files are saved in -O/--out-dir with the same basenames.
+     The sequence ID is read from the metadata of input files, or the basename
+     of the file without the suffix ".unik".
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		outDir := getFlagNonEmptyString(cmd, "out-dir")
+		force := getFlagBool(cmd, "force")
+		scale := getFlagPositiveInt(cmd, "scale")
+		if scale > 1<<32-1 {
+			checkError(fmt.Errorf("value of -D/--scale should be in range of [1, %d]", 1<<32-1))
+		}
+		scaled := scale > 1
+		maxHash := uint64(float64(^uint64(0)) / float64(scale))
+
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", true)
+		if opt.Verbose {
+			if len(files) == 1 && isStdin(files[0]) {
+				log.Info("no files given, reading from stdin")
+			} else {
+				log.Infof("%d input file(s) given", len(files))
+			}
+		}
+
+		checkFileSuffix(opt, extDataFile, files...)
+
+		makeOutDir(outDir, force)
+
+		var nFiles, nCollisions int
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		tokens := make(chan int, opt.NumCPUs)
+		for _, file := range files {
+			wg.Add(1)
+			tokens <- 1
+			go func(file string) {
+				defer func() {
+					wg.Done()
+					<-tokens
+				}()
+
+				outFile := filepath.Join(outDir, filepath.Base(file))
+				if !strings.HasSuffix(outFile, extDataFile) {
+					outFile += extDataFile
+				}
+				nIn, nOut, nDup := convertUnikFile(file, outFile, opt.CompressionLevel, scaled, scale, maxHash)
+
+				if nDup > 0 {
+					log.Warningf("%s: %d hash collisions of %d k-mers", file, nDup, nIn)
+				}
+				if opt.Verbose {
+					log.Infof("%s: %d k-mers converted, %d hashes saved to: %s", file, nIn, nOut, outFile)
+				}
+
+				mu.Lock()
+				nFiles++
+				nCollisions += nDup
+				mu.Unlock()
+			}(file)
+		}
+		wg.Wait()
+
+		if opt.Verbose {
+			log.Infof("%d files converted, hash collisions: %d", nFiles, nCollisions)
+		}
+	},
+}
+
+// convertUnikFile rehashes plain k-mers of a .unik file with ntHash, and returns
+// the numbers of input k-mers, output hashes and hash collisions.
+func convertUnikFile(file string, outFile string, compressionLevel int,
+	scaled bool, scale int, maxHash uint64) (nIn uint64, nOut uint64, nDup int) {
+
+	infh, r, _, err := inStream(file)
+	checkError(errors.Wrap(err, file))
+	defer r.Close()
+
+	reader, err := unik.NewReader(infh)
+	checkError(errors.Wrap(err, file))
+
+	if reader.IsHashed() {
+		checkError(fmt.Errorf("k-mers are already hashed and can not be rehashed: %s", file))
+	}
+	if reader.IsScaled() {
+		checkError(fmt.Errorf("down-sampled k-mers are not supported: %s", file))
+	}
+
+	k := reader.K
+
+	var meta Meta
+	if len(reader.Description) > 0 && json.Unmarshal(reader.Description, &meta) == nil && meta.SeqID != "" {
+		meta.Ks = []int{k}
+	} else {
+		meta = Meta{SeqID: strings.TrimSuffix(filepath.Base(file), extDataFile), Ks: []int{k}}
+	}
+
+	hashes := make(map[uint64]struct{}, mapInitSize)
+	kmer := make([]byte, k)
+	var code, hash uint64
+	var dup bool
+	for {
+		code, _, err = reader.ReadCodeWithTaxid()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			checkError(errors.Wrap(err, file))
+		}
+		nIn++
+
+		hash, err = ntHashOfKmer(decodeKmer(kmer, code, k))
+		checkError(errors.Wrap(err, file))
+
+		if _, dup = hashes[hash]; dup {
+			nDup++
+			continue
+		}
+		hashes[hash] = struct{}{}
+	}
+
+	if reader.Number > 0 && reader.Number != nIn {
+		checkError(fmt.Errorf("number of k-mers mismatch, %d in header, %d read: %s", reader.Number, nIn, file))
+	}
+
+	codes := make([]uint64, 0, len(hashes))
+	for hash = range hashes {
+		if scaled && hash > maxHash {
+			continue
+		}
+		codes = append(codes, hash)
+	}
+	nOut = uint64(len(codes))
+
+	writeKmers(k, codes, nOut, outFile, strings.HasSuffix(outFile, ".gz"), compressionLevel, scaled, scale, meta)
+
+	return nIn, nOut, nDup
+}
+
+var bit2base = [4]byte{'A', 'C', 'G', 'T'}
+
+// decodeKmer decodes a 2-bit k-mer code into kmer, which should have a length of k.
+func decodeKmer(kmer []byte, code uint64, k int) []byte {
+	for i := k - 1; i >= 0; i-- {
+		kmer[i] = bit2base[code&3]
+		code >>= 2
+	}
+	return kmer
+}
+
+// ntHashOfKmer returns the canonical ntHash value of a k-mer.
+func ntHashOfKmer(kmer []byte) (uint64, error) {
+	s, err := seq.NewSeqWithoutValidation(seq.DNAredundant, kmer)
+	if err != nil {
+		return 0, err
+	}
+	iter, err := sketches.NewHashIterator(s, len(kmer), true, false)
+	if err != nil {
+		return 0, err
+	}
+	hash, _ := iter.NextHash()
+	iter.NextHash() // recycle the iterator
+	return hash, nil
+}
+
+func init() {
+	utilsCmd.AddCommand(convertUnikCmd)
+
+	convertUnikCmd.Flags().StringP("out-dir", "O", "",
+		formatFlagUsage(`Output directory.`))
+
+	convertUnikCmd.Flags().BoolP("force", "", false,
+		formatFlagUsage(`Overwrite existed output directory.`))
+
+	convertUnikCmd.Flags().IntP("scale", "D", 1,
+		formatFlagUsage(`Scale of the FracMinHash (Scaled MinHash) for down-sampling hashes, 1 for keeping all.`))
+
+	convertUnikCmd.SetUsageTemplate(usageTemplate("-O <out dir> [<.unik files> ...]"))
+}
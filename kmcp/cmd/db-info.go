@@ -0,0 +1,208 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/shenwei356/kmcp/kmcp/search"
+	"github.com/spf13/cobra"
+)
+
+var dbInfoCmd = &cobra.Command{
+	Use:   "db-info",
+	Short: "Print information of databases",
+	Long: `Print information of databases
+
+This command reads the database information file (__db.yml) of
+each repetition (R001, R002, ...) of databases, and prints the main
+parameters in a table, one row for a repetition.
+
+Output format:
+    1. db,          Database directory of the repetition
+    2. alias,       Database alias
+    3. k,           K-mer size(s)
+    4. canonical,   Canonical k-mers
+    5. hashed,      K-mers are hashed
+    6. hashes,      Number of hash functions of bloom filters
+    7. fpr,         False positive rate of bloom filters
+    8. blockSize,   Block size (number of name groups in an index file)
+    9. names,       Number of name groups
+   10. files,       Number of index files
+   11. kmers,       Total number of k-mers
+   12. scale,       Scale of FracMinHash, 0 for unscaled k-mers
+   13. minimizerW,  Window size of minimizers, 0 for not used
+   14. syncmerS,    S-mer size of closed syncmers, 0 for not used
+   15. splitSeq,    Reference genomes are split into chunks
+   16. splitSize,   Chunk size, 0 for splitting by the number of chunks
+   17. splitNum,    Number of chunks
+   18. splitOverlap, Overlap between chunks
+   19. alphabet,    Alphabet of k-mers
+   20. version,     Versions of the database and index formats
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		outFile := getFlagString(cmd, "out-file")
+		outJSON := getFlagBool(cmd, "json")
+
+		if len(args) == 0 {
+			checkError(fmt.Errorf("at least one database needed"))
+		}
+
+		infos := make([]search.UnikIndexDBInfo, 0, 8)
+		for _, dbDir := range args {
+			dirs, err := search.DBRepeatDirs(dbDir)
+			checkError(err)
+			for _, dir := range dirs {
+				info, err := search.UnikIndexDBInfoFromFile(filepath.Join(dir, search.DBInfoFile))
+				checkError(err)
+				info.Path = dir
+				infos = append(infos, info)
+			}
+		}
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		if outJSON {
+			summaries := make([]dbInfoSummary, len(infos))
+			for i, info := range infos {
+				summaries[i] = newDBInfoSummary(info)
+			}
+			data, err := json.MarshalIndent(summaries, "", "  ")
+			checkError(err)
+			outfh.Write(data)
+			outfh.WriteByte('\n')
+			return
+		}
+
+		outfh.WriteString("db\talias\tk\tcanonical\thashed\thashes\tfpr\tblockSize\tnames\tfiles\tkmers" +
+			"\tscale\tminimizerW\tsyncmerS\tsplitSeq\tsplitSize\tsplitNum\tsplitOverlap\talphabet\tversion\n")
+		for _, info := range infos {
+			s := newDBInfoSummary(info)
+			outfh.WriteString(fmt.Sprintf("%s\t%s\t%s\t%v\t%v\t%d\t%f\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%v\t%d\t%d\t%d\t%s\t%d/%d\n",
+				s.DB, s.Alias, strings.Join(IntSlice2StringSlice(s.Ks), ","), s.Canonical, s.Hashed,
+				s.NumHashes, s.FPR, s.BlockSize, s.NumNames, s.NumFiles, s.Kmers,
+				s.Scale, s.MinimizerW, s.SyncmerS, s.SplitSeq, s.SplitSize, s.SplitNum, s.SplitOverlap,
+				s.Alphabet, s.Version, s.IndexVersion))
+		}
+	},
+}
+
+// dbInfoSummary is the main information of a database (repetition).
+type dbInfoSummary struct {
+	DB           string `json:"db"`
+	Alias        string `json:"alias"`
+	Version      uint8  `json:"version"`
+	IndexVersion uint8  `json:"indexVersion"`
+
+	Ks        []int   `json:"k"`
+	Canonical bool    `json:"canonical"`
+	Hashed    bool    `json:"hashed"`
+	NumHashes int     `json:"hashes"`
+	FPR       float64 `json:"fpr"`
+	BlockSize int     `json:"blockSize"`
+	NumNames  int     `json:"names"`
+	NumFiles  int     `json:"files"`
+	Kmers     uint64  `json:"kmers"`
+
+	Scale      uint32 `json:"scale"`
+	MinimizerW uint32 `json:"minimizerW"`
+	SyncmerS   uint32 `json:"syncmerS"`
+
+	SplitSeq     bool `json:"splitSeq"`
+	SplitSize    int  `json:"splitSize"`
+	SplitNum     int  `json:"splitNum"`
+	SplitOverlap int  `json:"splitOverlap"`
+
+	Alphabet string `json:"alphabet"`
+
+	RealizedFPR *search.RealizedFPR `json:"realizedFPR,omitempty"`
+}
+
+func newDBInfoSummary(info search.UnikIndexDBInfo) dbInfoSummary {
+	ks := info.Ks
+	if len(ks) == 0 {
+		ks = []int{info.K}
+	}
+	alphabet := info.Alphabet
+	if alphabet == "" {
+		alphabet = search.AlphabetDNA
+	}
+	s := dbInfoSummary{
+		DB:           info.Path,
+		Alias:        info.Alias,
+		Version:      info.Version,
+		IndexVersion: info.IndexVersion,
+
+		Ks:        ks,
+		Canonical: info.Canonical,
+		Hashed:    info.Hashed,
+		NumHashes: info.NumHashes,
+		FPR:       info.FPR,
+		BlockSize: info.BlockSize,
+		NumNames:  info.NumNames,
+		NumFiles:  len(info.Files),
+		Kmers:     info.Kmers,
+
+		SplitSeq:     info.SplitSeq,
+		SplitSize:    info.SplitSize,
+		SplitNum:     info.SplitNum,
+		SplitOverlap: info.SplitOverlap,
+
+		Alphabet: alphabet,
+
+		RealizedFPR: info.RealizedFPR,
+	}
+	if info.Scaled {
+		s.Scale = info.Scale
+	}
+	if info.Minimizer {
+		s.MinimizerW = info.MinimizerW
+	}
+	if info.Syncmer {
+		s.SyncmerS = info.SyncmerS
+	}
+	return s
+}
+
+func init() {
+	RootCmd.AddCommand(dbInfoCmd)
+
+	dbInfoCmd.Flags().StringP("out-file", "o", "-",
+		formatFlagUsage(`Out file, supports and recommends a ".gz" suffix ("-" for stdout).`))
+	dbInfoCmd.Flags().BoolP("json", "", false,
+		formatFlagUsage(`Output in JSON format, for machine consumption.`))
+
+	dbInfoCmd.SetUsageTemplate(usageTemplate("[--json] <kmcp db> [<kmcp db> ...]"))
+}
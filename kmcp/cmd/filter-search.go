@@ -0,0 +1,267 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var filterSearchCmd = &cobra.Command{
+	Use:   "filter",
+	Short: "Filter search results with new thresholds",
+	Long: `Filter search results with new thresholds
+
+This command re-thresholds search results of "kmcp search" without
+re-running the search, for cheaply sweeping thresholds when tuning
+a pipeline. Thresholds should be stricter than those used in searching,
+as filtered matches can not be recovered.
+
+Matches of a query are kept in the same group, and the column "hits"
+is updated with the number of retained matches. Queries with none
+matches passing the thresholds are removed, while rows of unmatched
+queries (-K/--keep-unmatched of "kmcp search") are kept as they are.
+
+The header row and extra columns after "queryIdx" are kept.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		var fhLog *os.File
+		if opt.Log2File {
+			fhLog = addLog(opt.LogFile, opt.Verbose)
+		}
+		timeStart := time.Now()
+		defer func() {
+			if opt.Verbose || opt.Log2File {
+				log.Info()
+				log.Infof("elapsed time: %s", time.Since(timeStart))
+				log.Info()
+			}
+			if opt.Log2File {
+				fhLog.Close()
+			}
+		}()
+
+		outFile := getFlagString(cmd, "out-file")
+		minQcov := getFlagNonNegativeFloat64(cmd, "min-query-cov")
+		minTcov := getFlagNonNegativeFloat64(cmd, "min-target-cov")
+		maxFPR := getFlagPositiveFloat64(cmd, "max-fpr")
+		minKmers := getFlagNonNegativeInt(cmd, "min-kmers")
+		noHeaderRow := getFlagBool(cmd, "no-header-row")
+
+		if minQcov > 1 {
+			checkError(fmt.Errorf("the value of -t/--min-query-cov (%f) should be in range of [0, 1]", minQcov))
+		}
+		if minTcov > 1 {
+			checkError(fmt.Errorf("the value of -T/--min-target-cov (%f) should be in range of [0, 1]", minTcov))
+		}
+
+		// ---------------------------------------------------------------
+		// input files
+
+		if opt.Verbose || opt.Log2File {
+			log.Info("checking input files ...")
+		}
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", true)
+		if opt.Verbose || opt.Log2File {
+			if len(files) == 1 && isStdin(files[0]) {
+				log.Info("  no files given, reading from stdin")
+			} else {
+				log.Infof("  %d input files given", len(files))
+			}
+		}
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(outFile, ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		items := make([]string, searchResultFields+1)
+
+		var nMatches, nKept, nQueries, nQueriesKept uint64
+
+		// matches of the current query
+		group := make([][]string, 0, 8)
+		var query, queryIdx string
+		flush := func() {
+			if len(group) == 0 {
+				return
+			}
+			nQueriesKept++
+			hits := strconv.Itoa(len(group))
+			for _, _items := range group {
+				_items[4] = hits
+				outfh.WriteString(strings.Join(_items, "\t"))
+				outfh.WriteByte('\n')
+			}
+			group = group[:0]
+		}
+
+		var headerWritten bool
+		var line string
+		var m searchRecord
+		var ok bool
+		for _, file := range files {
+			infh, r, _, err := inStream(file)
+			checkError(err)
+
+			for {
+				line, err = infh.ReadString('\n')
+				if line != "" {
+					line = strings.TrimRight(line, "\r\n")
+				}
+				if line == "" {
+					if err != nil {
+						break
+					}
+					continue
+				}
+
+				if line[0] == '#' {
+					if !headerWritten && !noHeaderRow {
+						outfh.WriteString(line)
+						outfh.WriteByte('\n')
+					}
+					headerWritten = true
+					continue
+				}
+
+				items = items[:searchResultFields+1]
+				m = parseSearchRecord(line, &items)
+
+				if m.Query != query || m.QueryIdx != queryIdx {
+					flush()
+					query, queryIdx = m.Query, m.QueryIdx
+					nQueries++
+				}
+
+				if m.Unmatched {
+					nQueriesKept++
+					outfh.WriteString(line)
+					outfh.WriteByte('\n')
+					continue
+				}
+
+				nMatches++
+				ok = m.FPR <= maxFPR && m.QCov >= minQcov && m.TCov >= minTcov && m.MKmers >= minKmers
+				if !ok {
+					continue
+				}
+				nKept++
+				group = append(group, append([]string{}, items...))
+			}
+			flush()
+
+			if err != io.EOF {
+				checkError(err)
+			}
+			r.Close()
+		}
+
+		if opt.Verbose || opt.Log2File {
+			log.Infof("%d of %d matches kept, %d of %d queries kept", nKept, nMatches, nQueriesKept, nQueries)
+		}
+	},
+}
+
+// searchResultFields is the number of basic columns of search results.
+const searchResultFields = 15
+
+// searchRecord is a row of search results with values used for filtering.
+type searchRecord struct {
+	Query     string
+	QueryIdx  string
+	FPR       float64
+	MKmers    int
+	QCov      float64
+	TCov      float64
+	Unmatched bool // a row of an unmatched query
+}
+
+// parseSearchRecord parses a row of search results, like parseMatchResult,
+// but all columns are kept in items, with extra columns after queryIdx in the last one.
+func parseSearchRecord(line string, items *[]string) searchRecord {
+	stringSplitNByByte(line, '\t', searchResultFields+1, items)
+	if len(*items) < searchResultFields {
+		checkError(fmt.Errorf("invalid kmcp search result format: %s", line))
+	}
+
+	m := searchRecord{Query: (*items)[0], QueryIdx: (*items)[14]}
+
+	hits, err := strconv.Atoi((*items)[4])
+	if err != nil {
+		checkError(fmt.Errorf("failed to parse hits: %s", (*items)[4]))
+	}
+	if hits == 0 {
+		m.Unmatched = true
+		return m
+	}
+
+	m.FPR, err = strconv.ParseFloat((*items)[3], 64)
+	if err != nil {
+		checkError(fmt.Errorf("failed to parse FPR: %s", (*items)[3]))
+	}
+	m.MKmers, err = strconv.Atoi((*items)[10])
+	if err != nil {
+		checkError(fmt.Errorf("failed to parse mKmers: %s", (*items)[10]))
+	}
+	m.QCov, err = strconv.ParseFloat((*items)[11], 64)
+	if err != nil {
+		checkError(fmt.Errorf("failed to parse qCov: %s", (*items)[11]))
+	}
+	m.TCov, err = strconv.ParseFloat((*items)[12], 64)
+	if err != nil {
+		checkError(fmt.Errorf("failed to parse tCov: %s", (*items)[12]))
+	}
+	return m
+}
+
+func init() {
+	RootCmd.AddCommand(filterSearchCmd)
+
+	filterSearchCmd.Flags().StringP("out-file", "o", "-",
+		formatFlagUsage(`Out file, supports and recommends a ".gz" suffix ("-" for stdout).`))
+	filterSearchCmd.Flags().Float64P("min-query-cov", "t", 0,
+		formatFlagUsage(`Minimal query coverage, i.e., proportion of matched k-mers and unique k-mers of a query.`))
+	filterSearchCmd.Flags().Float64P("min-target-cov", "T", 0,
+		formatFlagUsage(`Minimal target coverage, i.e., proportion of matched k-mers and unique k-mers of a target.`))
+	filterSearchCmd.Flags().Float64P("max-fpr", "f", 1,
+		formatFlagUsage(`Maximal false positive rate of a query.`))
+	filterSearchCmd.Flags().IntP("min-kmers", "c", 0,
+		formatFlagUsage(`Minimal number of matched k-mers (sketches).`))
+	filterSearchCmd.Flags().BoolP("no-header-row", "H", false,
+		formatFlagUsage(`Do not print header row.`))
+
+	filterSearchCmd.SetUsageTemplate(usageTemplate("[-t <min-query-cov>] [-T <min-target-cov>] [-f <max-fpr>] [-c <min-kmers>] [-o out.tsv.gz] [<search results> ...]"))
+}
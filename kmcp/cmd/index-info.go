@@ -26,7 +26,7 @@ import (
 	"strings"
 
 	"github.com/pkg/errors"
-	"github.com/shenwei356/kmcp/kmcp/cmd/index"
+	"github.com/shenwei356/kmcp/kmcp/index"
 	"github.com/spf13/cobra"
 )
 
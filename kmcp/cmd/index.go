@@ -22,6 +22,7 @@ package cmd
 
 import (
 	"bufio"
+	"compress/flate"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -32,10 +33,12 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
-	"github.com/shenwei356/kmcp/kmcp/cmd/index"
+	"github.com/shenwei356/kmcp/kmcp/index"
+	"github.com/shenwei356/kmcp/kmcp/search"
 	"github.com/shenwei356/unik/v5"
 	"github.com/shenwei356/util/bytesize"
 	"github.com/shenwei356/util/math"
@@ -92,10 +95,15 @@ Performance tips:
   2. #threads files are simultaneously opened, and max number
      of opened files is limited by the flag -F/--max-open-files.
      You may use a small value of -F/--max-open-files for 
-     hard disk drive storages.
+     hard disk drive storages. The value is automatically capped
+     below the limit of open files (ulimit -n).
   3. When the database is used in a new computer with more CPU cores,
      'kmcp search' could automatically scale to utilize as many cores
      as possible.
+  4. Index files are not compressed, because rows of signatures are
+     randomly accessed in searching, via mmap or seeking in the files
+     (--low-mem). Please compress the database directory (e.g., tar and
+     zstd) only for archiving or transferring.
 
 Examples:
   1. For bacteria genomes:
@@ -171,9 +179,29 @@ Examples:
 		}
 
 		force := getFlagBool(cmd, "force")
+		resume := getFlagBool(cmd, "resume")
+		if resume && force {
+			checkError(fmt.Errorf("flag --resume is not compatible with --force"))
+		}
 
 		alias := getFlagString(cmd, "alias")
 
+		saveTaxids := getFlagBool(cmd, "save-taxids")
+
+		minFileKmers := uint64(getFlagNonNegativeInt(cmd, "min-file-kmers"))
+
+		reportCompression := getFlagBool(cmd, "report-compression")
+		reportFPR := getFlagBool(cmd, "report-fpr")
+
+		compressNameMap := getFlagBool(cmd, "compress-name-map")
+		shuffleSeed := getFlagInt64(cmd, "shuffle-seed")
+		fileNameMapping := search.DBNameMappingFile
+		if compressNameMap {
+			fileNameMapping += ".gz"
+		}
+		var compressions []blockCompression
+		var muCompressions sync.Mutex
+
 		// ---------------------------------------------------------------
 		// index flags
 
@@ -190,7 +218,20 @@ Examples:
 		// faster := getFlagBool(cmd, "faster")
 		faster := false
 
+		ignoreMetaMismatch := getFlagBool(cmd, "ignore-meta-mismatch")
+		reportEvery := getFlagNonNegativeInt(cmd, "report-every")
+		skipErrors := getFlagBool(cmd, "skip-errors")
+
+		contaminationReport := getFlagString(cmd, "contamination-report")
+		contaminationMinFrac := getFlagNonNegativeFloat64(cmd, "contamination-min-frac")
+		if contaminationMinFrac > 1 {
+			checkError(fmt.Errorf("the value of --contamination-min-frac (%f) should be in range of [0, 1]", contaminationMinFrac))
+		}
+		contaminationScale := uint64(getFlagPositiveInt(cmd, "contamination-scale"))
+
 		maxOpenFiles := getFlagPositiveInt(cmd, "max-open-files")
+		// index files being written and other files are also opened
+		maxOpenFiles = tuneMaxOpenFiles(maxOpenFiles, 2*opt.NumCPUs+16, cmd.Flags().Changed("max-open-files"))
 		// maxWriteFiles := getFlagPositiveInt(cmd, "max-write-files")
 
 		// block-sizeX-kmers-t
@@ -242,6 +283,20 @@ Examples:
 			checkError(fmt.Errorf("value of flag -8/--block-size8-kmers-t (%d) should be small than -1/--block-size1-kmers-t (%d)", kmerThreshold8, kmerThreshold1))
 		}
 
+		// max-memory
+		var maxMemory uint64
+		maxMemoryStr := getFlagString(cmd, "max-memory")
+		if maxMemoryStr != "" {
+			maxMemoryFloat, err := bytesize.ParseByteSize(maxMemoryStr)
+			if err != nil {
+				checkError(fmt.Errorf("invalid size: %s", maxMemoryStr))
+			}
+			if maxMemoryFloat <= 0 {
+				checkError(fmt.Errorf("value of flag --max-memory should be positive: %s", maxMemoryStr))
+			}
+			maxMemory = uint64(maxMemoryFloat)
+		}
+
 		// ---------------------------------------------------------------
 		// note: 2021-08-12
 		// RAMBO index is not suitable for single machine,
@@ -273,7 +328,11 @@ Examples:
 			}
 		}
 		if !dryRun {
-			makeOutDir(outDir, force)
+			if resume { // keep index files written before
+				checkError(os.MkdirAll(outDir, 0777))
+			} else {
+				makeOutDir(outDir, force)
+			}
 		}
 		if alias == "" {
 			alias = filepath.Base(outDir)
@@ -301,20 +360,36 @@ Examples:
 		var namesMap0 map[string]interface{}
 
 		var reader0 *unik.Reader
+		var nMetaMismatch uint64 // number of files with sketch information different from the first one
+
+		// unreadable or corrupt files, only for --skip-errors
+		skippedFiles := make([]string, 0, 8)
+		var muSkipped sync.Mutex
+		skipFile := func(file string, err error) {
+			log.Warningf("skip file: %s", err)
+			muSkipped.Lock()
+			skippedFiles = append(skippedFiles, file)
+			muSkipped.Unlock()
+		}
 
-		getInfo := func(file string, first bool) UnikFileInfo {
+		getInfo := func(file string, first bool) (UnikFileInfo, error) {
 			infh, r, _, err := inStream(file)
-			checkError(err)
+			if err != nil {
+				return UnikFileInfo{}, errors.Wrap(err, file)
+			}
+			defer r.Close()
 
 			reader, err := unik.NewReader(infh)
-			checkError(errors.Wrap(err, file))
+			if err != nil {
+				return UnikFileInfo{}, errors.Wrap(err, file)
+			}
 
 			var meta Meta
 
 			if len(reader.Description) > 0 {
 				err := json.Unmarshal(reader.Description, &meta)
 				if err != nil {
-					checkError(fmt.Errorf("unsupported metadata: %s", reader.Description))
+					return UnikFileInfo{}, fmt.Errorf("unsupported metadata: %s: %s", reader.Description, file)
 				}
 			}
 
@@ -330,8 +405,9 @@ Examples:
 					checkError(fmt.Errorf(`flag 'hashed' is supposed to be true, are the files created by 'kmcp compute'? %s`, file))
 				}
 
+				// amino acid k-mers are not canonical
 				canonical = reader.IsCanonical()
-				if !canonical {
+				if !canonical && search.IsDNAAlphabet(meta.Alphabet) {
 					checkError(fmt.Errorf(`files with 'canonical' flag needed: %s`, file))
 				}
 				scaled = reader.IsScaled()
@@ -339,18 +415,37 @@ Examples:
 
 				meta0 = meta
 			} else {
-				checkCompatibility(reader0, reader, file, &meta0, &meta)
+				if checkCompatibility(reader0, reader, file, &meta0, &meta, ignoreMetaMismatch) {
+					atomic.AddUint64(&nMetaMismatch, 1)
+				}
 				if scaled && scale != reader.GetScale() {
 					checkError(fmt.Errorf(`scales not consistent, please check with "kmcp utils unik-info": %s`, file))
 				}
 			}
 
 			if reader.Number == 0 {
-				checkError(fmt.Errorf("binary file not sorted or no k-mers number found: %s", file))
+				return UnikFileInfo{}, fmt.Errorf("binary file not sorted or no k-mers number found: %s", file)
 			}
 
-			checkError(r.Close())
-			return UnikFileInfo{Path: file, Name: meta.SeqID, Index: meta.FragIdx, Kmers: reader.Number}
+			// all k-mers are read to detect corrupt data
+			if skipErrors {
+				var nKmers uint64
+				for {
+					_, _, err = reader.ReadCodeWithTaxid()
+					if err != nil {
+						if err == io.EOF {
+							break
+						}
+						return UnikFileInfo{}, errors.Wrap(err, file)
+					}
+					nKmers++
+				}
+				if nKmers != reader.Number {
+					return UnikFileInfo{}, fmt.Errorf("number of k-mers mismatch, %d in header, %d read: %s", reader.Number, nKmers, file)
+				}
+			}
+
+			return UnikFileInfo{Path: file, Name: meta.SeqID, Index: meta.FragIdx, Kmers: reader.Number}, nil
 		}
 
 		fileInfos0 := make([]UnikFileInfo, 0, 1024)
@@ -393,7 +488,14 @@ Examples:
 				}
 
 				// read some basic data
-				getInfo(fileInfos0[0].Path, true)
+				_, err = getInfo(fileInfos0[0].Path, true)
+				checkError(err)
+
+				// files are not rechecked with the cache, so they are conservatively
+				// treated as plain k-mers, which is always correct for searching.
+				if ignoreMetaMismatch {
+					nMetaMismatch = 1
+				}
 
 				InfoCacheOK = true
 			}
@@ -440,13 +542,27 @@ Examples:
 				log.Info("checking .unik files ...")
 			}
 
+			// running totals are logged instead of showing a progress bar with --report-every
+			showBar := (opt.Verbose || opt.Log2File) && reportEvery == 0
+			var nChecked int
+			var sigBits uint64 // bits of signatures of all checked files
+			reportProgress := func(info UnikFileInfo) {
+				nChecked++
+				sigBits += index.CalcSignatureSize(info.Kmers, numHashes, fpr)
+				if nChecked%reportEvery == 0 || nChecked == nfiles {
+					log.Infof("  checked .unik files: %d/%d, k-mers: %d, signature size: %s, estimated final signature size: %s",
+						nChecked, nfiles, n, bytesize.ByteSize(sigBits>>3),
+						bytesize.ByteSize(float64(sigBits>>3)*float64(nfiles)/float64(nChecked)))
+				}
+			}
+
 			var pbs *mpb.Progress
 			var bar *mpb.Bar
 			var chDuration chan time.Duration
 			var doneDuration chan int
 
-			if opt.Verbose || opt.Log2File {
-				pbs = mpb.New(mpb.WithWidth(40), mpb.WithOutput(os.Stderr))
+			if showBar {
+				pbs = mpb.New(mpb.WithWidth(40), mpb.WithOutput(progressBarOutput()))
 				bar = pbs.AddBar(int64(len(files)),
 					mpb.BarStyle("[=>-]<+"),
 					mpb.PrependDecorators(
@@ -472,16 +588,35 @@ Examples:
 				}()
 			}
 
-			// first file
-			file := files[0]
+			// first file, the first readable one with --skip-errors
 			var t time.Time
-			if opt.Verbose || opt.Log2File {
+			if showBar {
 				t = time.Now()
 			}
 
-			info := getInfo(file, true)
+			var info UnikFileInfo
+			var iFirst int
+			for iFirst = 0; iFirst < nfiles; iFirst++ {
+				info, err = getInfo(files[iFirst], true)
+				if err == nil {
+					break
+				}
+				if !skipErrors {
+					checkError(err)
+				}
+				skipFile(files[iFirst], err)
+				if showBar {
+					bar.Increment()
+				}
+			}
+			if iFirst == nfiles {
+				checkError(fmt.Errorf("all %d input files are skipped", nfiles))
+			}
 			n += info.Kmers
-			if opt.Verbose || opt.Log2File {
+			if reportEvery > 0 && (opt.Verbose || opt.Log2File) {
+				reportProgress(info)
+			}
+			if showBar {
 				bar.Increment()
 				bar.DecoratorEwmaUpdate(time.Since(t))
 			}
@@ -503,6 +638,9 @@ Examples:
 				for info := range chInfos {
 					fileInfos0 = append(fileInfos0, info)
 					n += info.Kmers
+					if reportEvery > 0 && (opt.Verbose || opt.Log2File) {
+						reportProgress(info)
+					}
 
 					nameHash = xxh3.HashString(fmt.Sprintf("%s%s%d", info.Name, sepNameIdx, info.Index))
 					if _, ok = namesMap[nameHash]; ok {
@@ -517,7 +655,7 @@ Examples:
 				doneGetInfo <- 1
 			}()
 
-			for _, file := range files[1:] {
+			for _, file := range files[iFirst+1:] {
 				wgGetInfo.Add(1)
 				tokensGetInfo <- 1
 				go func(file string) {
@@ -526,13 +664,21 @@ Examples:
 						<-tokensGetInfo
 					}()
 					var t time.Time
-					if opt.Verbose || opt.Log2File {
+					if showBar {
 						t = time.Now()
 					}
 
-					chInfos <- getInfo(file, false)
+					info, err := getInfo(file, false)
+					if err != nil {
+						if !skipErrors {
+							checkError(err)
+						}
+						skipFile(file, err)
+					} else {
+						chInfos <- info
+					}
 
-					if opt.Verbose || opt.Log2File {
+					if showBar {
 						chDuration <- time.Duration(float64(time.Since(t)) / float64(opt.NumCPUs))
 					}
 				}(file)
@@ -542,7 +688,7 @@ Examples:
 			close(chInfos)
 			<-doneGetInfo
 
-			if opt.Verbose || opt.Log2File {
+			if showBar {
 				close(chDuration)
 				<-doneDuration
 				pbs.Wait()
@@ -551,16 +697,85 @@ Examples:
 			if opt.Verbose || opt.Log2File {
 				log.Infof("  finished checking %d .unik files", nfiles)
 			}
+
+			if len(skippedFiles) > 0 {
+				sortutil.Strings(skippedFiles)
+				log.Warningf("%d unreadable or corrupt files skipped:", len(skippedFiles))
+				for _, file := range skippedFiles {
+					log.Warningf("  %s", file)
+				}
+				if !dryRun {
+					file := filepath.Join(outDir, fileSkippedFiles)
+					outfh, gw, w, err := outStream(file, false, opt.CompressionLevel)
+					checkError(err)
+					for _, f := range skippedFiles {
+						outfh.WriteString(f + "\n")
+					}
+					outfh.Flush()
+					if gw != nil {
+						gw.Close()
+					}
+					w.Close()
+					log.Warningf("list of skipped files saved to: %s", file)
+				}
+			}
 		}
 
 		// ------------------------------------------------------------------------------------
 		// .unik info
 
-		if !hasInfoCache || !InfoCacheOK { // dump to info file
+		// the cache is not written with skipped files, so they could be checked again after being fixed.
+		if (!hasInfoCache || !InfoCacheOK) && len(skippedFiles) == 0 { // dump to info file
 			log.Infof("write unik file info to file: %s", fileInfoCache)
 			dumpUnikFileInfos(fileInfos0, fileInfoCache)
 		}
 
+		// drop files with few k-mers, after dumping file infos, so the cache is reusable for other thresholds.
+		if minFileKmers > 0 {
+			fileInfos1 := make([]UnikFileInfo, 0, len(fileInfos0))
+			namesMap0 = make(map[string]interface{}, len(namesMap0))
+			n = 0
+			for _, info := range fileInfos0 {
+				if info.Kmers < minFileKmers {
+					continue
+				}
+				fileInfos1 = append(fileInfos1, info)
+				n += info.Kmers
+				namesMap0[info.Name] = struct{}{}
+			}
+
+			if opt.Verbose || opt.Log2File {
+				log.Infof("%d of %d files with < %d k-mers dropped", len(fileInfos0)-len(fileInfos1), len(fileInfos0), minFileKmers)
+			}
+			if len(fileInfos1) == 0 {
+				checkError(fmt.Errorf("no files left after dropping files with < %d k-mers (--min-file-kmers)", minFileKmers))
+			}
+
+			fileInfos0 = fileInfos1
+		}
+
+		// ------------------------------------------------------------------------------------
+		// k-mers shared by targets
+
+		if contaminationReport != "" {
+			if opt.Verbose || opt.Log2File {
+				log.Infof("computing k-mers shared by targets with a sampling scale of %d ...", contaminationScale)
+			}
+			pairs := findContamination(*opt, fileInfos0, contaminationScale, contaminationMinFrac)
+			writeContaminationReport(contaminationReport, pairs, opt.CompressionLevel)
+
+			if opt.Verbose || opt.Log2File {
+				var nContaminated int
+				for _, p := range pairs {
+					if p.Type() == "contamination" {
+						nContaminated++
+					}
+				}
+				log.Infof("  %d target pairs sharing >= %.2f%% k-mers (%d possible contamination) saved to: %s",
+					len(pairs), contaminationMinFrac*100, nContaminated, contaminationReport)
+			}
+		}
+
 		// ------------------------------------------------------------------------------------
 		// begin creating index
 		if opt.Verbose || opt.Log2File {
@@ -576,6 +791,9 @@ Examples:
 			if meta0.Syncmer {
 				log.Infof("  closed syncmer size: %d", meta0.SyncmerS)
 			}
+			if !search.IsDNAAlphabet(meta0.Alphabet) {
+				log.Infof("  alphabet: %s", meta0.Alphabet)
+			}
 			if meta0.SplitSeq {
 				log.Infof("  split seqequence size: %d, overlap: %d", meta0.SplitSize, meta0.SplitOverlap)
 			}
@@ -603,7 +821,6 @@ Examples:
 			numBuckets = len(fileInfos0)
 			numRepeats = 1
 		}
-		numBucketsUint64 := uint64(numBuckets)
 
 		var fileSize0 float64
 
@@ -616,35 +833,19 @@ Examples:
 			dirR := fmt.Sprintf("R%03d", rr+1)
 			runtime.GC()
 
-			buckets := make([][]UnikFileInfo, numBuckets)
-			var bIdx int
-			var h1, h2 uint32
-			for jj, info := range fileInfos0 {
-				if singleSet {
-					bIdx = jj
-				} else {
-					h1, h2 = baseHashes(xxh3.HashString(info.Path))
-					bIdx = int(uint64(h1+h2*uint32(rr+seed)) % numBucketsUint64) // add seed
-				}
+			// files are assigned into buckets by hashes of their paths, and groups are sorted by k-mers.
+			fileInfoGroups := groupUnikFiles(fileInfos0, numBuckets, singleSet, rr, seed)
 
-				if buckets[bIdx] == nil {
-					buckets[bIdx] = make([]UnikFileInfo, 0, 8)
-				}
-				buckets[bIdx] = append(buckets[bIdx], info)
-			}
-
-			fileInfoGroups := make([]UnikFileInfoGroup, len(buckets))
-			for bb, infos := range buckets {
-				var totalKmers uint64
-				for _, info := range infos {
-					totalKmers += info.Kmers
+			// sorting clusters groups of similar sizes into the same blocks,
+			// shuffling small groups makes the sizes of blocks more uniform.
+			if shuffleSeed != 0 {
+				nShuffled := shuffleSmallGroups(fileInfoGroups, kmerThresholdX, shuffleSeed)
+				if opt.Verbose || opt.Log2File {
+					log.Infof("  %d of %d file groups with <= %s k-mers shuffled with a seed of %d",
+						nShuffled, len(fileInfoGroups), bytesize.ByteSize(kmerThresholdX), shuffleSeed)
 				}
-				fileInfoGroups[bb] = UnikFileInfoGroup{Infos: infos, Kmers: totalKmers}
 			}
 
-			// sort by group kmer size
-			sorts.Quicksort(UnikFileInfoGroups(fileInfoGroups))
-
 			nFiles := len(fileInfoGroups)
 			var sBlock int
 			if sBlock00 <= 0 { // block size from command line
@@ -678,7 +879,7 @@ Examples:
 			}
 
 			if opt.Verbose {
-				pbs = mpb.New(mpb.WithWidth(40), mpb.WithOutput(os.Stderr))
+				pbs = mpb.New(mpb.WithWidth(40), mpb.WithOutput(progressBarOutput()))
 			}
 
 			// really begin
@@ -727,150 +928,72 @@ Examples:
 			}()
 
 			var fileSize float64
+			blockSizes := make([]float64, 0, nIndexFiles)
 			chFileSize := make(chan float64, nIndexFiles)
 			doneFileSize := make(chan int)
 			go func() {
 				for f := range chFileSize {
 					fileSize += f
+					blockSizes = append(blockSizes, f)
 				}
 				doneFileSize <- 1
 			}()
 
 			var prefix string
 
+			var nResumed uint64 // number of index files reused, only for --resume
+
+			var blockFPRs []float64 // realized false positive rates of blocks, only for --report-fpr
+			var muBlockFPRs sync.Mutex
+
 			var b int
 			var wg0 sync.WaitGroup
 			// maxConc := opt.NumCPUs
 			maxConc := 2
-			if dryRun {
-				maxConc = 1 // just for logging in order
-			} else if (sBlock / 8) < opt.NumCPUs {
+			if (sBlock / 8) < opt.NumCPUs {
 				maxConc = opt.NumCPUs / (sBlock / 8)
 				if maxConc < 2 {
 					maxConc = 2
 				}
 			}
 
-			tokens0 := make(chan int, maxConc)
-			tokensOpenFiles := make(chan int, maxOpenFiles)
-			// tokensWriteFiles := make(chan int, maxWriteFiles)
-
-			sBlock0 := sBlock // save for later use
-
-			batch := make([][]UnikFileInfo, 0, sBlock)
-			var flagX, flag8, flag bool
-			var lastInfos []UnikFileInfo
-			var infoGroup UnikFileInfoGroup
-
-			for i := 0; i <= nFiles; i++ {
-				if i == nFiles { // process lastInfo
-					// add previous file to batch
-					if flag || flag8 || flagX {
-						if lastInfos != nil {
-							batch = append(batch, lastInfos)
-							lastInfos = nil
-						}
-					}
-				} else {
-					infoGroup = fileInfoGroups[i]
-					infos := infoGroup.Infos
-					if infoGroup.Kmers == 0 { // skip empty buckets
-						continue
+			// fit signatures of blocks being built concurrently into the memory budget,
+			// by reducing the concurrency first, and then the block size.
+			if maxMemory > 0 || dryRun {
+				mem := blockMemory(fileInfoGroups, sBlock, blockSizeX, kmerThresholdX, kmerThreshold8, numHashes, fpr)
+				if maxMemory > 0 {
+					for maxConc > 1 && mem*uint64(maxConc) > maxMemory {
+						maxConc--
 					}
-
-					if flag || flag8 || flagX {
-						// add previous file to batch
-						if lastInfos != nil {
-							batch = append(batch, lastInfos)
-							lastInfos = nil
-						}
-
-						if flag { // single
-							lastInfos = infos // leave this file process in the next round
-							// and we have to process files aleady in batch
-						} else if infoGroup.Kmers > kmerThreshold1 { // !flag && (flag8 || flagx) -> flag
-							// meet a very big file the first time
-							flag = true       // mark
-							lastInfos = infos // leave this file process in the next round
-							// and we have to process files aleady in batch
-						} else if skipBlockX {
-							batch = append(batch, infos)
-							if len(batch) < sBlock { // not filled
-								continue
-							}
-						} else {
-							if infoGroup.Kmers > kmerThreshold8 { // !flag && flagx -> flag8
-								if flag8 { // keep the same
-									batch = append(batch, infos)
-									if len(batch) < sBlock { // not filled
-										continue
-									}
-								} else {
-									// meet a big file > kmerThreshold8
-									sBlock = 8
-									flag8 = true // mark
-									lastInfos = infos
-									// and we have to process files aleady in batch
-								}
-							} else { //  flagX
-								batch = append(batch, infos)
-								if len(batch) < sBlock { // not filled
-									continue
-								}
-							}
-						}
-					} else if skipBlockX {
-						if infoGroup.Kmers > kmerThreshold8 {
-							if infoGroup.Kmers > kmerThreshold1 {
-								// meet a very big file the first time
-								flag = true // mark
-							} else {
-								// meet a big file > kmerThresholdX
-								sBlock = blockSizeX
-								flagX = true // mark
-							}
-							lastInfos = infos // leave this file process in the next round
-							// and we have to process files aleady in batch
-						} else {
-							batch = append(batch, infos)
-							if len(batch) < sBlock { // not filled
-								continue
-							}
-						}
-					} else {
-						if infoGroup.Kmers > kmerThresholdX {
-							if infoGroup.Kmers > kmerThreshold1 {
-								// meet a very big file the first time
-								flag = true // mark
-							} else if infoGroup.Kmers > kmerThreshold8 {
-								// meet a big file > kmerThreshold8
-								sBlock = 8
-								flag8 = true // mark
-							} else {
-								// meet a big file > kmerThresholdX
-								sBlock = blockSizeX
-								flagX = true // mark
-							}
-							lastInfos = infos // leave this file process in the next round
-							// and we have to process files aleady in batch
-						} else {
-							batch = append(batch, infos)
-							if len(batch) < sBlock { // not filled
-								continue
-							}
+					for mem > maxMemory && sBlock > 8 {
+						sBlock = (sBlock/2 + 7) / 8 * 8
+						if blockSizeX > sBlock {
+							skipBlockX = true
+							blockSizeX = sBlock
 						}
+						mem = blockMemory(fileInfoGroups, sBlock, blockSizeX, kmerThresholdX, kmerThreshold8, numHashes, fpr)
 					}
-
-				}
-
-				if len(batch) == 0 {
-					if lastInfos == nil {
-						break
-					} else {
-						continue
+					if mem > maxMemory {
+						checkError(fmt.Errorf("value of --max-memory (%s) is too small, at least %s is needed for the biggest block",
+							bytesize.ByteSize(maxMemory), bytesize.ByteSize(mem)))
 					}
 				}
+				if opt.Verbose || opt.Log2File {
+					log.Infof("  block size: %d, concurrency: %d, predicted peak memory of signatures: %s",
+						sBlock, maxConc, bytesize.ByteSize(mem*uint64(maxConc)))
+				}
+			}
+			if dryRun {
+				maxConc = 1 // just for logging in order
+			}
 
+			tokens0 := make(chan int, maxConc)
+			tokensOpenFiles := make(chan int, maxOpenFiles)
+			// tokensWriteFiles := make(chan int, maxWriteFiles)
+
+			batches := blockBatches(fileInfoGroups, sBlock, blockSizeX, skipBlockX,
+				kmerThresholdX, kmerThreshold8, kmerThreshold1)
+			for _, batch := range batches {
 				b++
 
 				if singleRepeat {
@@ -927,8 +1050,12 @@ Examples:
 					namesBlock := make([][]string, 0, nInfoGroups)
 					gsizesBlock := make([][]uint64, 0, nInfoGroups)
 					// kmersBlock := make([][]uint64, 0, nInfoGroups)
-					indicesBlock := make([][]uint32, 0, nInfoGroups)
+					indicesBlock := make([][]uint64, 0, nInfoGroups)
 					sizesBlock := make([]uint64, 0, nInfoGroups)
+					var taxidsBlock [][]uint32
+					if saveTaxids {
+						taxidsBlock = make([][]uint32, 0, nInfoGroups)
+					}
 
 					chBatch8 := make(chan batch8s, nBatchFiles)
 					doneBatch8 := make(chan int)
@@ -945,6 +1072,7 @@ Examples:
 								// kmersBlock = append(kmersBlock, batch2.kmers...)
 								indicesBlock = append(indicesBlock, batch2.indices...)
 								sizesBlock = append(sizesBlock, batch2.sizes...)
+								taxidsBlock = append(taxidsBlock, batch2.taxids...)
 								if opt.Verbose && !dryRun {
 									bar.Increment()
 								}
@@ -959,6 +1087,7 @@ Examples:
 									// kmersBlock = append(kmersBlock, _batch.kmers...)
 									indicesBlock = append(indicesBlock, _batch.indices...)
 									sizesBlock = append(sizesBlock, _batch.sizes...)
+									taxidsBlock = append(taxidsBlock, _batch.taxids...)
 									if (opt.Verbose || opt.Log2File) && !dryRun {
 										bar.Increment()
 									}
@@ -985,6 +1114,7 @@ Examples:
 								// kmersBlock = append(kmersBlock, _batch.kmers...)
 								indicesBlock = append(indicesBlock, _batch.indices...)
 								sizesBlock = append(sizesBlock, _batch.sizes...)
+								taxidsBlock = append(taxidsBlock, _batch.taxids...)
 								if (opt.Verbose || opt.Log2File) && !dryRun {
 									bar.Increment()
 								}
@@ -994,7 +1124,7 @@ Examples:
 						doneBatch8 <- 1
 					}()
 
-					numSigs := CalcSignatureSize(uint64(maxElements), numHashes, fpr)
+					numSigs := index.CalcSignatureSize(uint64(maxElements), numHashes, fpr)
 					if faster {
 						numSigs = roundup64(numSigs)
 					}
@@ -1006,6 +1136,9 @@ Examples:
 						for _, info := range infos {
 							// name + "\n" (1) + indice (4) + size (8)
 							eFileSize += float64(len(info.Name) + 13)
+							if saveTaxids {
+								eFileSize += 4 // taxid (4)
+							}
 						}
 					}
 					eFileSize += float64(numSigs * uint64(nBatchFiles))
@@ -1020,6 +1153,43 @@ Examples:
 						}
 					}
 
+					blockFile := filepath.Join(outDir,
+						dirR,
+						fmt.Sprintf("_block%03d%s", b, extIndex))
+
+					// reuse the index file written before the interruption
+					if resume && !dryRun {
+						size, err := checkBlockFileForResuming(blockFile, batch, k, uint8(numHashes), numSigs)
+						if err == nil {
+							atomic.AddUint64(&nResumed, 1)
+							close(chBatch8)
+							<-doneBatch8
+
+							if reportFPR {
+								fill, err := NewBloomFill(blockFile)
+								checkError(err)
+								muBlockFPRs.Lock()
+								blockFPRs = append(blockFPRs, fill.MaxFPR())
+								muBlockFPRs.Unlock()
+							}
+
+							ch <- filepath.Base(blockFile)
+							chFileSize <- float64(size)
+
+							if opt.Verbose {
+								bar.SetTotal(int64(nBatchFiles), true)
+								chDurationW <- time.Duration(float64(time.Since(startTime)) / float64(maxConc))
+							}
+
+							wg0.Done()
+							<-tokens0
+							return
+						}
+						if !os.IsNotExist(err) {
+							log.Warningf("index file to be rebuilt: %s", err)
+						}
+					}
+
 					// split into batches with 8 files
 					var bb, jj int
 					for ii := 0; ii < nInfoGroups; ii += 8 {
@@ -1046,13 +1216,17 @@ Examples:
 							names := make([][]string, 0, 8)
 							gsizes := make([][]uint64, 0, 8)
 							// kmers := make([][]uint64, 0, 8)
-							indices := make([][]uint32, 0, 8)
+							indices := make([][]uint64, 0, 8)
 							sizes := make([]uint64, 0, 8)
+							var taxids [][]uint32
+							if saveTaxids {
+								taxids = make([][]uint32, 0, 8)
+							}
 							for _, infos := range _batch {
 								_names := make([]string, len(infos))
 								_gsizes := make([]uint64, len(infos))
 								// _kmers := make([]uint64, len(infos))
-								_indices := make([]uint32, len(infos))
+								_indices := make([]uint64, len(infos))
 								var _size uint64
 
 								sorts.Quicksort(UnikFileInfosByName(infos))
@@ -1062,7 +1236,7 @@ Examples:
 									_gsizes[iii] = info.GenomeSize
 									// _kmers[iii] = info.Kmers
 									// _indices[iii] = info.Index
-									_indices[iii] = info.Index + info.Indexes<<16 // add number of indexes
+									_indices[iii] = index.EncodeChunkIdx(info.Index, info.Indexes) // add number of indexes
 									_size += info.Kmers
 								}
 								names = append(names, _names)
@@ -1078,7 +1252,12 @@ Examples:
 
 							// every file in 8 file groups
 							for _k, infos := range _batch {
-								for _, info := range infos {
+								var _taxids []uint32
+								if saveTaxids {
+									_taxids = make([]uint32, len(infos))
+								}
+
+								for iii, info := range infos {
 									tokensOpenFiles <- 1
 
 									var infh *bufio.Reader
@@ -1086,6 +1265,8 @@ Examples:
 									var reader *unik.Reader
 									var err error
 									var code uint64
+									var taxid uint32
+									var voter taxidVoter
 									var loc int
 
 									infh, r, _, err = inStream(info.Path)
@@ -1099,26 +1280,32 @@ Examples:
 										if singleHash {
 											if faster {
 												for {
-													code, _, err = reader.ReadCodeWithTaxid()
+													code, taxid, err = reader.ReadCodeWithTaxid()
 													if err != nil {
 														if err == io.EOF {
 															break
 														}
 														checkError(errors.Wrap(err, info.Path))
 													}
+													if saveTaxids {
+														voter.Add(taxid)
+													}
 
 													// sigs[code%numSigs] |= 1 << (7 - _k)
 													sigs[code&numSigsM1] |= 1 << (7 - _k) // &Xis faster than %X when X is power of 2
 												}
 											} else {
 												for {
-													code, _, err = reader.ReadCodeWithTaxid()
+													code, taxid, err = reader.ReadCodeWithTaxid()
 													if err != nil {
 														if err == io.EOF {
 															break
 														}
 														checkError(errors.Wrap(err, info.Path))
 													}
+													if saveTaxids {
+														voter.Add(taxid)
+													}
 
 													sigs[code%numSigs] |= 1 << (7 - _k)
 													// sigs[code&numSigsM1] |= 1 << (7 - _k) // &Xis faster than %X when X is power of 2
@@ -1127,31 +1314,37 @@ Examples:
 										} else {
 											if faster {
 												for {
-													code, _, err = reader.ReadCodeWithTaxid()
+													code, taxid, err = reader.ReadCodeWithTaxid()
 													if err != nil {
 														if err == io.EOF {
 															break
 														}
 														checkError(errors.Wrap(err, info.Path))
 													}
+													if saveTaxids {
+														voter.Add(taxid)
+													}
 
-													// for _, loc = range hashLocations(code, numHashes, numSigs) {
-													for _, loc = range hashLocationsFaster(code, numHashes, numSigsM1) {
+													// for _, loc = range index.HashLocations(code, numHashes, numSigs) {
+													for _, loc = range index.HashLocationsFaster(code, numHashes, numSigsM1) {
 														sigs[loc] |= 1 << (7 - _k)
 													}
 												}
 											} else {
 												for {
-													code, _, err = reader.ReadCodeWithTaxid()
+													code, taxid, err = reader.ReadCodeWithTaxid()
 													if err != nil {
 														if err == io.EOF {
 															break
 														}
 														checkError(errors.Wrap(err, info.Path))
 													}
+													if saveTaxids {
+														voter.Add(taxid)
+													}
 
-													for _, loc = range hashLocations(code, numHashes, numSigs) {
-														// for _, loc = range hashLocationsFaster(code, numHashes, numSigsM1) {
+													for _, loc = range index.HashLocations(code, numHashes, numSigs) {
+														// for _, loc = range index.HashLocationsFaster(code, numHashes, numSigsM1) {
 														sigs[loc] |= 1 << (7 - _k)
 													}
 												}
@@ -1161,59 +1354,71 @@ Examples:
 										if singleHash {
 											if faster {
 												for {
-													code, _, err = reader.ReadCodeWithTaxid()
+													code, taxid, err = reader.ReadCodeWithTaxid()
 													if err != nil {
 														if err == io.EOF {
 															break
 														}
 														checkError(errors.Wrap(err, info.Path))
 													}
+													if saveTaxids {
+														voter.Add(taxid)
+													}
 
-													// sigs[hash64(code)%numSigs] |= 1 << (7 - _k)
-													sigs[hash64(code)&numSigsM1] |= 1 << (7 - _k) // &Xis faster than %X when X is power of 2
+													// sigs[index.Hash64(code)%numSigs] |= 1 << (7 - _k)
+													sigs[index.Hash64(code)&numSigsM1] |= 1 << (7 - _k) // &Xis faster than %X when X is power of 2
 												}
 											} else {
 												for {
-													code, _, err = reader.ReadCodeWithTaxid()
+													code, taxid, err = reader.ReadCodeWithTaxid()
 													if err != nil {
 														if err == io.EOF {
 															break
 														}
 														checkError(errors.Wrap(err, info.Path))
 													}
+													if saveTaxids {
+														voter.Add(taxid)
+													}
 
-													sigs[hash64(code)%numSigs] |= 1 << (7 - _k)
-													// sigs[hash64(code)&numSigsM1] |= 1 << (7 - _k) // &Xis faster than %X when X is power of 2
+													sigs[index.Hash64(code)%numSigs] |= 1 << (7 - _k)
+													// sigs[index.Hash64(code)&numSigsM1] |= 1 << (7 - _k) // &Xis faster than %X when X is power of 2
 												}
 											}
 										} else {
 											if faster {
 												for {
-													code, _, err = reader.ReadCodeWithTaxid()
+													code, taxid, err = reader.ReadCodeWithTaxid()
 													if err != nil {
 														if err == io.EOF {
 															break
 														}
 														checkError(errors.Wrap(err, info.Path))
 													}
+													if saveTaxids {
+														voter.Add(taxid)
+													}
 
-													// for _, loc = range hashLocations(code, numHashes, numSigs) {
-													for _, loc = range hashLocationsFaster(hash64(code), numHashes, numSigsM1) {
+													// for _, loc = range index.HashLocations(code, numHashes, numSigs) {
+													for _, loc = range index.HashLocationsFaster(index.Hash64(code), numHashes, numSigsM1) {
 														sigs[loc] |= 1 << (7 - _k)
 													}
 												}
 											} else {
 												for {
-													code, _, err = reader.ReadCodeWithTaxid()
+													code, taxid, err = reader.ReadCodeWithTaxid()
 													if err != nil {
 														if err == io.EOF {
 															break
 														}
 														checkError(errors.Wrap(err, info.Path))
 													}
+													if saveTaxids {
+														voter.Add(taxid)
+													}
 
-													for _, loc = range hashLocations(code, numHashes, numSigs) {
-														// for _, loc = range hashLocationsFaster(hash64(code), numHashes, numSigsM1) {
+													for _, loc = range index.HashLocations(code, numHashes, numSigs) {
+														// for _, loc = range index.HashLocationsFaster(index.Hash64(code), numHashes, numSigsM1) {
 														sigs[loc] |= 1 << (7 - _k)
 													}
 												}
@@ -1223,8 +1428,16 @@ Examples:
 
 									r.Close()
 
+									if saveTaxids {
+										_taxids[iii] = voter.Taxid()
+									}
+
 									<-tokensOpenFiles
 								}
+
+								if saveTaxids {
+									taxids = append(taxids, _taxids)
+								}
 							}
 
 							chBatch8 <- batch8s{
@@ -1235,6 +1448,7 @@ Examples:
 								// kmers:   kmers,
 								indices: indices,
 								sizes:   sizes,
+								taxids:  taxids,
 							}
 						}(batch[ii:jj], bb, numSigs, outFile, bb)
 					}
@@ -1243,10 +1457,6 @@ Examples:
 					close(chBatch8)
 					<-doneBatch8
 
-					blockFile := filepath.Join(outDir,
-						dirR,
-						fmt.Sprintf("_block%03d%s", b, extIndex))
-
 					if !dryRun {
 						// save to index file
 
@@ -1258,6 +1468,9 @@ Examples:
 						// writer, err := index.NewWriter(outfh, k, canonical, !faster, uint8(numHashes), numSigs, namesBlock, gsizesBlock, kmersBlock, indicesBlock, sizesBlock)
 						writer, err := index.NewWriter(outfh, k, canonical, !faster, uint8(numHashes), numSigs, namesBlock, gsizesBlock, indicesBlock, sizesBlock)
 						checkError(err)
+						if saveTaxids {
+							checkError(writer.SetTaxids(taxidsBlock))
+						}
 
 						if nBatchFiles == 1 {
 							checkError(writer.WriteBatch(sigsBlock[0], len(sigsBlock[0])))
@@ -1281,6 +1494,26 @@ Examples:
 						// <-tokensWriteFiles
 					}
 
+					if reportCompression && !dryRun {
+						raw, compressed, err := compressedSize(sigsBlock)
+						checkError(err)
+
+						muCompressions.Lock()
+						compressions = append(compressions, blockCompression{
+							File:       filepath.Join(dirR, filepath.Base(blockFile)),
+							Raw:        raw,
+							Compressed: compressed,
+						})
+						muCompressions.Unlock()
+					}
+
+					if reportFPR && !dryRun {
+						_fpr := blockFPR(sigsBlock, numHashes)
+						muBlockFPRs.Lock()
+						blockFPRs = append(blockFPRs, _fpr)
+						muBlockFPRs.Unlock()
+					}
+
 					ch <- filepath.Base(blockFile)
 					chFileSize <- eFileSize
 
@@ -1293,7 +1526,6 @@ Examples:
 					<-tokens0
 				}(batch, b, prefix, bar)
 
-				batch = make([][]UnikFileInfo, 0, sBlock)
 			}
 
 			wg0.Wait()
@@ -1303,6 +1535,16 @@ Examples:
 			<-done
 			<-doneFileSize
 
+			if resume && (opt.Verbose || opt.Log2File) {
+				log.Infof("  %d of %d index files written before were reused", nResumed, b)
+			}
+
+			if opt.Verbose || opt.Log2File {
+				mean, sd, cv := meanAndCV(blockSizes)
+				log.Infof("  sizes of %d index files: mean: %s, standard deviation: %s, coefficient of variation: %.4f",
+					len(blockSizes), bytesize.ByteSize(mean), bytesize.ByteSize(sd), cv)
+			}
+
 			if opt.Verbose && !dryRun {
 				barW.SetTotal(int64(b), true)
 				close(chDurationW)
@@ -1313,37 +1555,67 @@ Examples:
 			totalIndexFiles += len(indexFiles)
 
 			sortutil.Strings(indexFiles)
-			dbInfo := NewUnikIndexDBInfo(indexFiles)
+			dbInfo := search.NewUnikIndexDBInfo(indexFiles)
 			dbInfo.Alias = alias
 			dbInfo.Ks = ks
 			dbInfo.Hashed = hashed
 			dbInfo.Kmers = n
 			dbInfo.FPR = fpr
-			dbInfo.BlockSize = sBlock0
+			dbInfo.BlockSize = sBlock
 			dbInfo.NumNames = len(fileInfoGroups)
 			dbInfo.CompactSize = !faster
 			dbInfo.NumHashes = numHashes
 			dbInfo.Canonical = canonical
 			dbInfo.Scaled = scaled
 			dbInfo.Scale = scale
-			dbInfo.Minimizer = meta0.Minimizer
-			dbInfo.MinimizerW = uint32(meta0.MinimizerW)
-			dbInfo.Syncmer = meta0.Syncmer
-			dbInfo.SyncmerS = uint32(meta0.SyncmerS)
+			if nMetaMismatch > 0 { // search queries with all k-mers, a superset of any sketch
+				dbInfo.MixedSketches = true
+			} else {
+				dbInfo.Minimizer = meta0.Minimizer
+				dbInfo.MinimizerW = uint32(meta0.MinimizerW)
+				dbInfo.Syncmer = meta0.Syncmer
+				dbInfo.SyncmerS = uint32(meta0.SyncmerS)
+			}
 			dbInfo.SplitSeq = meta0.SplitSeq
 			dbInfo.SplitSize = meta0.SplitSize
 			dbInfo.SplitNum = meta0.SplitNum
 			dbInfo.SplitOverlap = meta0.SplitOverlap
+			dbInfo.Taxids = saveTaxids
+			if !search.IsDNAAlphabet(meta0.Alphabet) {
+				dbInfo.Alphabet = meta0.Alphabet
+			}
+			if reportFPR && len(blockFPRs) > 0 {
+				dbInfo.RealizedFPR = search.NewRealizedFPR(blockFPRs)
+				if opt.Verbose || opt.Log2File {
+					log.Infof("  realized false positive rates of %d blocks: min: %f, median: %f, max: %f",
+						len(blockFPRs), dbInfo.RealizedFPR.Min, dbInfo.RealizedFPR.Median, dbInfo.RealizedFPR.Max)
+				}
+				if dbInfo.RealizedFPR.Max > fpr {
+					log.Warningf("  the maximal realized false positive rate (%f) is bigger than -f/--false-positive-rate (%f)",
+						dbInfo.RealizedFPR.Max, fpr)
+				}
+			}
 
 			if !dryRun {
+				dbInfo.Path = filepath.Join(outDir, dirR)
+				if opt.Verbose || opt.Log2File {
+					log.Infof("computing database hash ...")
+				}
+				dbInfo.DBHash, err = dbInfo.ComputeHash()
+				checkError(err)
+				if opt.Verbose || opt.Log2File {
+					log.Infof("database hash: %s", dbInfo.DBHash)
+				}
+
 				var n2 int
-				n2, err = dbInfo.WriteTo(filepath.Join(outDir, dirR, dbInfoFile))
+				n2, err = dbInfo.WriteTo(filepath.Join(outDir, dirR, search.DBInfoFile))
 				checkError(err)
 				fileSize += float64(n2)
 
 				// write name_mapping.tsv
+				file := filepath.Join(outDir, dirR, fileNameMapping)
 				func() {
-					outfh, gw, w, err := outStream(filepath.Join(outDir, dirR, dbNameMappingFile), false, opt.CompressionLevel)
+					outfh, gw, w, err := outStream(file, compressNameMap, opt.CompressionLevel)
 					checkError(err)
 					defer func() {
 						outfh.Flush()
@@ -1356,10 +1628,12 @@ Examples:
 					var line string
 					for name := range namesMap0 {
 						line = fmt.Sprintf("%s\t%s\n", name, name)
-						fileSize += float64(len(line))
 						outfh.WriteString(line)
 					}
 				}()
+				fi, err := os.Stat(file)
+				checkError(err)
+				fileSize += float64(fi.Size())
 			} else { // compute file size of __db.yaml and __name_mapping.tsv
 				// __db.yaml
 				data, err := yaml.Marshal(dbInfo)
@@ -1386,6 +1660,10 @@ Examples:
 			log.Infof("total file size: %s", bytesize.ByteSize(fileSize0))
 			log.Infof("total index files: %d", totalIndexFiles)
 		}
+
+		if reportCompression && !dryRun && (opt.Verbose || opt.Log2File) {
+			reportBlockCompressions(compressions)
+		}
 	},
 }
 
@@ -1411,7 +1689,8 @@ func init() {
 		formatFlagUsage(`Number of hash functions in bloom filters.`))
 
 	indexCmd.Flags().IntP("block-size", "b", 0,
-		formatFlagUsage(`Block size, better be multiple of 64 for large number of input files. (default: min(#.files/#theads, 8))`))
+		formatFlagUsage(`Block size, better be multiple of 64 for large number of input files. (default: min(#.files/#theads, 8)). `+
+			`As the default value depends on -j/--threads, set it to build identical databases with different numbers of threads.`))
 
 	indexCmd.Flags().StringP("block-sizeX-kmers-t", "x", "10M",
 		formatFlagUsage(`If k-mers of single .unik file exceeds this threshold, block size is changed to --block-sizeX. Supported units: K, M, G.`))
@@ -1432,9 +1711,72 @@ func init() {
 	// indexCmd.Flags().IntP("num-buckets", "B", 0, `[RAMBO] number of buckets per repitition, 0 for one set per bucket`)
 	// indexCmd.Flags().IntP("seed", "", 1, `[RAMBO] seed for randomly assigning names to buckets`)
 
+	indexCmd.Flags().IntP("min-file-kmers", "", 0,
+		formatFlagUsage(`Drop input files with fewer k-mers than this value, e.g., nearly empty genome fragments `+
+			`which just bloat the name list. Note that the number of chunks of a reference is not changed.`))
+
+	indexCmd.Flags().BoolP("report-compression", "", false,
+		formatFlagUsage(`Report the compression ratio (compressed/raw size) of signatures of each block in the summary. `+
+			`Index files are not compressed, the ratio is measured with DEFLATE, and blocks compressing poorly `+
+			`have saturated bloom filters, which indicates bad sizing.`))
+
+	indexCmd.Flags().BoolP("report-fpr", "", false,
+		formatFlagUsage(`Report realized false positive rates of blocks, estimated from the fractions of set bits in bloom filters, `+
+			`i.e., fill^hashes of the most saturated bloom filter of each block. The minimum, median and maximum across blocks `+
+			`are logged and saved in the database info file (__db.yml), for judging whether -f/--false-positive-rate is too loose.`))
+
+	indexCmd.Flags().BoolP("skip-errors", "", false,
+		formatFlagUsage(`Skip unreadable or corrupt .unik files with warnings, rather than aborting the build. `+
+			`All k-mers of input files are read in checking to detect corrupt data, which takes extra time. `+
+			`The list of skipped files is saved to `+fileSkippedFiles+` in the output directory, `+
+			`and the .unik file info cache is not written, so the files could be indexed again after being fixed.`))
+
+	indexCmd.Flags().Int64P("shuffle-seed", "", 0,
+		formatFlagUsage(`Randomly shuffle input files with <= -x/--block-sizeX-kmers-t k-mers with this seed before assigning them to blocks, 0 for no shuffling. `+
+			`By default, files are sorted by k-mer size, so files of similar sizes are clustered into the same blocks. `+
+			`Shuffling makes sizes of index files more uniform, at the cost of a bigger database, as the bloom filter size of a block is decided by its biggest file. `+
+			`The variation of index file sizes is reported.`))
+
+	indexCmd.Flags().BoolP("compress-name-map", "", false,
+		formatFlagUsage(`Save the name mapping file in gzip format (__name_mapping.tsv.gz), to reduce the size of databases with millions of targets. `+
+			`It's supported by "kmcp search -D/--default-name-map".`))
+
+	indexCmd.Flags().BoolP("save-taxids", "", false,
+		formatFlagUsage(`Save taxids of targets in index files, which are the most frequent taxids of k-mers in .unik files (the smallest one for ties), `+
+			`so "kmcp search" can output taxids directly with --output-taxid.`))
+
+	indexCmd.Flags().BoolP("resume", "", false,
+		formatFlagUsage(`Resume an interrupted run with the same input and parameters, complete index files in the output directory are reused, while truncated or corrupt ones are rebuilt. `+
+			`The cached .unik file infos (`+fileUnikInfos+`) in -I/--in-dir is used to avoid rechecking input files.`))
 	indexCmd.Flags().BoolP("force", "", false,
 		formatFlagUsage(`Overwrite existed output directory.`))
 
+	indexCmd.Flags().IntP("report-every", "", 0,
+		formatFlagUsage(`Log running totals of k-mers and the estimated final signature size every N checked .unik files, instead of showing a progress bar, `+
+			`so you can abort early if the parameters are clearly wrong. 0 for showing a progress bar.`))
+
+	indexCmd.Flags().BoolP("ignore-meta-mismatch", "", false,
+		formatFlagUsage(`Downgrade inconsistent sketch information (minimizer, syncmer and sequence splitting) of input files to a warning, `+
+			`for combining heterogeneous sketch collections. The k-mer size, canonical flag and scale should still be the same. `+
+			`The heterogeneity is recorded in the database info file (mixed-sketches), and queries are searched with all k-mers.`))
+
+	indexCmd.Flags().StringP("contamination-report", "", "",
+		formatFlagUsage(`Detect potential cross-contamination of references, and save pairs of targets sharing k-mers to this TSV file. `+
+			`K-mers of all input files are sampled with --contamination-scale and counted for co-occurrences in targets, `+
+			`which takes extra time and memory. Pairs sharing a large fraction of both targets are typed as "relatives", `+
+			`others as "contamination".`))
+
+	indexCmd.Flags().Float64P("contamination-min-frac", "", 0.05,
+		formatFlagUsage(`Minimal fraction of sampled k-mers of either target shared by a target pair, for --contamination-report.`))
+
+	indexCmd.Flags().IntP("contamination-scale", "", 1000,
+		formatFlagUsage(`Only 1/scale of k-mers are sampled by hash values to count co-occurrences, for --contamination-report. `+
+			`It is applied on top of the scale of .unik files.`))
+
+	indexCmd.Flags().StringP("max-memory", "", "",
+		formatFlagUsage(`Maximal memory of signatures of blocks being built, supported units: K, M, G. `+
+			`The concurrency and then the block size are reduced to fit the biggest blocks in it. `+
+			`Use it with --dry-run to check the chosen values and the predicted peak memory.`))
 	indexCmd.Flags().IntP("max-open-files", "F", 256,
 		formatFlagUsage(`Maximal number of opened files, please use a small value for hard disk drive storage.`))
 
@@ -1455,13 +1797,46 @@ type batch8s struct {
 	names  [][]string
 	gsizes [][]uint64
 	// kmers   [][]uint64
-	indices [][]uint32
+	indices [][]uint64
 	sizes   []uint64
+	taxids  [][]uint32
+}
+
+// taxidVoter finds the most frequent taxid of k-mers,
+// the smallest one is chosen for ties.
+type taxidVoter struct {
+	counts map[uint32]int
+}
+
+// Add adds a taxid, 0 is ignored.
+func (v *taxidVoter) Add(taxid uint32) {
+	if taxid == 0 {
+		return
+	}
+	if v.counts == nil {
+		v.counts = make(map[uint32]int, 8)
+	}
+	v.counts[taxid]++
+}
+
+// Taxid returns the most frequent taxid, 0 for no taxids.
+func (v *taxidVoter) Taxid() uint32 {
+	var taxid uint32
+	var max int
+	for t, c := range v.counts {
+		if c > max || (c == max && t < taxid) {
+			taxid, max = t, c
+		}
+	}
+	return taxid
 }
 
 var sepNameIdx = "-id"
 
 // compute exact max elements by reading all file. not used.
+// fileSkippedFiles is the list of input files skipped by --skip-errors.
+const fileSkippedFiles = "_skipped_files.txt"
+
 func maxElements(opt Options, tokensOpenFiles chan int, batch [][]UnikFileInfo) (maxElements int64) {
 	var _wg sync.WaitGroup
 	_tokens := make(chan int, opt.NumCPUs)
@@ -1525,3 +1900,87 @@ func maxElements(opt Options, tokensOpenFiles chan int, batch [][]UnikFileInfo)
 
 	return
 }
+
+// blockCompression records the raw and compressed sizes of signatures of an index block.
+type blockCompression struct {
+	File       string
+	Raw        uint64
+	Compressed uint64
+}
+
+// Ratio returns the compression ratio.
+func (c blockCompression) Ratio() float64 {
+	if c.Raw == 0 {
+		return 0
+	}
+	return float64(c.Compressed) / float64(c.Raw)
+}
+
+type countingWriter struct {
+	n uint64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += uint64(len(p))
+	return len(p), nil
+}
+
+// compressedSize returns the raw size of signatures of a block and the size compressed with DEFLATE.
+// Saturated bloom filters are nearly random and compress badly.
+func compressedSize(sigsBlock [][]byte) (uint64, uint64, error) {
+	cw := &countingWriter{}
+	fw, err := flate.NewWriter(cw, flate.BestSpeed)
+	if err != nil {
+		return 0, 0, err
+	}
+	var raw uint64
+	for _, sigs := range sigsBlock {
+		raw += uint64(len(sigs))
+		_, err = fw.Write(sigs)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	err = fw.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+	return raw, cw.n, nil
+}
+
+// blockCompressionOutlierDiff is the minimal difference to the median ratio of a poorly compressing block.
+const blockCompressionOutlierDiff = 0.05
+
+// reportBlockCompressions logs compression ratios of all blocks,
+// and blocks compressing much worse than the others.
+func reportBlockCompressions(compressions []blockCompression) {
+	if len(compressions) == 0 {
+		return
+	}
+	sort.Slice(compressions, func(i, j int) bool { return compressions[i].File < compressions[j].File })
+
+	ratios := make([]float64, len(compressions))
+	for i, c := range compressions {
+		ratios[i] = c.Ratio()
+	}
+	sort.Float64s(ratios)
+	median := ratios[len(ratios)/2]
+
+	log.Info()
+	log.Infof("compression ratios of signatures in blocks (median: %.4f):", median)
+	var nPoor int
+	for _, c := range compressions {
+		if c.Ratio()-median >= blockCompressionOutlierDiff {
+			nPoor++
+			log.Warningf("  %s: raw: %s, compressed: %s, ratio: %.4f, compressing poorly",
+				c.File, bytesize.ByteSize(c.Raw), bytesize.ByteSize(c.Compressed), c.Ratio())
+			continue
+		}
+		log.Infof("  %s: raw: %s, compressed: %s, ratio: %.4f",
+			c.File, bytesize.ByteSize(c.Raw), bytesize.ByteSize(c.Compressed), c.Ratio())
+	}
+	if nPoor > 0 {
+		log.Warningf("%d block(s) compress much worse than the others, their bloom filters may be saturated, "+
+			"please consider adjusting -b/--block-size or the k-mer thresholds of block sizes", nPoor)
+	}
+}
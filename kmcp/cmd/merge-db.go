@@ -0,0 +1,299 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/shenwei356/kmcp/kmcp/search"
+	"github.com/shenwei356/util/cliutil"
+	"github.com/spf13/cobra"
+)
+
+var mergeDBCmd = &cobra.Command{
+	Use:   "merge-db",
+	Short: "Merge multiple databases into one",
+	Long: `Merge multiple databases into one
+
+This command combines databases built independently, e.g., one per
+taxonomic group on different compute nodes, into a single database,
+without re-indexing the k-mer files (.unik). Index files of all input
+databases are copied into the output directory and renamed in order,
+and a new database information file (__db.yml) is written with the
+summed numbers of k-mers and name groups.
+
+Input databases must be compatible, i.e., sharing the same:
+  1. versions of the database and index formats,
+  2. k-mer sizes, hashed and canonical k-mers,
+  3. number of hash functions and false positive rate,
+  4. scaling, minimizer and syncmer information, and k-mer alphabet,
+  5. number of repetitions (subdirectories R001, R002, ...).
+
+Attention:
+  1. Targets existing in multiple databases are not deduplicated,
+     a warning is shown and they are reported more than once in searching.
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		outDir := getFlagString(cmd, "out-dir")
+		if outDir == "" {
+			checkError(fmt.Errorf("flag -O/--out-dir is needed"))
+		}
+		force := getFlagBool(cmd, "force")
+		alias := getFlagString(cmd, "alias")
+		compressNameMap := getFlagBool(cmd, "compress-name-map")
+
+		if len(args) < 2 {
+			checkError(fmt.Errorf("at least two databases needed"))
+		}
+		for _, dbDir := range args {
+			if filepath.Clean(dbDir) == filepath.Clean(outDir) {
+				checkError(fmt.Errorf("-O/--out-dir should not be one of the input databases: %s", dbDir))
+			}
+		}
+
+		if alias == "" {
+			alias = filepath.Base(outDir)
+		}
+
+		// ------------------------------------------------------------------------------------
+		// check databases
+
+		if opt.Verbose {
+			log.Infof("checking %d databases ...", len(args))
+		}
+
+		// repetitions of every database
+		dbDirs := make([][]string, len(args))
+		var numRepeats int
+		for i, dbDir := range args {
+			dirs, err := search.DBRepeatDirs(dbDir)
+			checkError(err)
+
+			if i == 0 {
+				numRepeats = len(dirs)
+			} else if len(dirs) != numRepeats {
+				checkError(fmt.Errorf("numbers of repetitions differ: %d (%s) != %d (%s)",
+					numRepeats, args[0], len(dirs), dbDir))
+			}
+			dbDirs[i] = dirs
+		}
+
+		infos := make([][]search.UnikIndexDBInfo, numRepeats)
+		for r := 0; r < numRepeats; r++ {
+			infos[r] = make([]search.UnikIndexDBInfo, len(args))
+			for i := range args {
+				info, err := search.UnikIndexDBInfoFromFile(filepath.Join(dbDirs[i][r], search.DBInfoFile))
+				checkError(err)
+				checkError(info.Check())
+
+				if i > 0 {
+					if msg := dbIncompatibility(infos[r][0], info); msg != "" {
+						checkError(fmt.Errorf("incompatible databases: %s: %s vs %s", msg, args[0], args[i]))
+					}
+				}
+				infos[r][i] = info
+			}
+		}
+
+		// ------------------------------------------------------------------------------------
+		// merge
+
+		makeOutDir(outDir, force)
+
+		var totalIndexFiles int
+		for r := 0; r < numRepeats; r++ {
+			dirR := fmt.Sprintf("R%03d", r+1)
+			outDirR := filepath.Join(outDir, dirR)
+			checkError(os.MkdirAll(outDirR, 0777))
+
+			if opt.Verbose {
+				if numRepeats > 1 {
+					log.Infof("[Repeat %d/%d] merging index files ...", r+1, numRepeats)
+				} else {
+					log.Infof("merging index files ...")
+				}
+			}
+
+			files := make([]string, 0, 64)
+			var kmers uint64
+			var numNames int
+			var b int
+			for i, info := range infos[r] {
+				for _, file := range info.Files {
+					b++
+					newFile := fmt.Sprintf("_block%03d%s", b, extIndex)
+					checkError(copyFile(filepath.Join(info.Path, file), filepath.Join(outDirR, newFile)))
+					files = append(files, newFile)
+				}
+				kmers += info.Kmers
+				numNames += info.NumNames
+
+				if opt.Verbose {
+					log.Infof("  %d index files copied from %s", len(info.Files), dbDirs[i][r])
+				}
+			}
+			totalIndexFiles += len(files)
+
+			// name mapping
+			var nDup int
+			nameMapping := make(map[string]string, 1024)
+			for _, info := range infos[r] {
+				file, existed, err := search.NameMappingFile(info.Path)
+				checkError(err)
+				if !existed {
+					continue
+				}
+				m, err := cliutil.ReadKVs(file, false)
+				checkError(err)
+				for k, v := range m {
+					if _, ok := nameMapping[k]; ok {
+						nDup++
+						continue
+					}
+					nameMapping[k] = v
+				}
+			}
+			if nDup > 0 {
+				log.Warningf("%d targets exist in more than one database", nDup)
+			}
+
+			dbInfo := infos[r][0]
+			dbInfo.Alias = alias
+			dbInfo.Files = files
+			dbInfo.Kmers = kmers
+			dbInfo.NumNames = numNames
+			dbInfo.KmcpVersion = VERSION
+			dbInfo.MinKmcpVersion = search.UnikIndexDBMinKmcpVersion
+			dbInfo.RealizedFPR = nil
+			dbInfo.Path = outDirR
+
+			if opt.Verbose {
+				log.Infof("computing database hash ...")
+			}
+			var err error
+			dbInfo.DBHash, err = dbInfo.ComputeHash()
+			checkError(err)
+
+			_, err = dbInfo.WriteTo(filepath.Join(outDirR, search.DBInfoFile))
+			checkError(err)
+
+			if len(nameMapping) > 0 {
+				fileNameMapping := search.DBNameMappingFile
+				if compressNameMap {
+					fileNameMapping += ".gz"
+				}
+				names := make([]string, 0, len(nameMapping))
+				for name := range nameMapping {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+
+				outfh, gw, w, err := outStream(filepath.Join(outDirR, fileNameMapping), compressNameMap, opt.CompressionLevel)
+				checkError(err)
+				for _, name := range names {
+					outfh.WriteString(fmt.Sprintf("%s\t%s\n", name, nameMapping[name]))
+				}
+				outfh.Flush()
+				if gw != nil {
+					gw.Close()
+				}
+				w.Close()
+			}
+		}
+
+		if opt.Verbose {
+			log.Infof("%d databases with %d index files merged to %s", len(args), totalIndexFiles, outDir)
+		}
+	},
+}
+
+// dbIncompatibility describes why two databases can not be merged,
+// an empty string is returned for compatible ones.
+func dbIncompatibility(a, b search.UnikIndexDBInfo) string {
+	switch {
+	case a.Version != b.Version || a.IndexVersion != b.IndexVersion:
+		return fmt.Sprintf("database/index format versions: v%d/v%d != v%d/v%d",
+			a.Version, a.IndexVersion, b.Version, b.IndexVersion)
+	case a.ChunkIdxBits != b.ChunkIdxBits:
+		return fmt.Sprintf("chunk-idx-bits: %d != %d", a.ChunkIdxBits, b.ChunkIdxBits)
+	case fmt.Sprintf("%v", a.Ks) != fmt.Sprintf("%v", b.Ks):
+		return fmt.Sprintf("k: %v != %v", a.Ks, b.Ks)
+	case a.Hashed != b.Hashed:
+		return fmt.Sprintf("hashed: %v != %v", a.Hashed, b.Hashed)
+	case a.Canonical != b.Canonical:
+		return fmt.Sprintf("canonical: %v != %v", a.Canonical, b.Canonical)
+	case a.NumHashes != b.NumHashes:
+		return fmt.Sprintf("number of hashes: %d != %d", a.NumHashes, b.NumHashes)
+	case a.FPR != b.FPR:
+		return fmt.Sprintf("fpr: %f != %f", a.FPR, b.FPR)
+	case a.Taxids != b.Taxids:
+		return fmt.Sprintf("taxids saved: %v != %v", a.Taxids, b.Taxids)
+	case a.MixedSketches != b.MixedSketches:
+		return fmt.Sprintf("mixed-sketches: %v != %v", a.MixedSketches, b.MixedSketches)
+	case !a.CompatibleWith(b): // scaling, minimizer, syncmer and alphabet
+		return fmt.Sprintf("sketch information: scale: %d/%d, minimizer-w: %d/%d, syncmer-s: %d/%d, alphabet: %s/%s",
+			a.Scale, b.Scale, a.MinimizerW, b.MinimizerW, a.SyncmerS, b.SyncmerS, a.Alphabet, b.Alphabet)
+	}
+	return ""
+}
+
+// copyFile copies a file to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("fail to open file: %s: %s", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("fail to create file: %s: %s", dst, err)
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return fmt.Errorf("fail to copy file: %s: %s", src, err)
+	}
+	return out.Close()
+}
+
+func init() {
+	RootCmd.AddCommand(mergeDBCmd)
+
+	mergeDBCmd.Flags().StringP("out-dir", "O", "",
+		formatFlagUsage(`Output directory of the merged database.`))
+	mergeDBCmd.Flags().BoolP("force", "", false,
+		formatFlagUsage(`Overwrite existed output directory.`))
+	mergeDBCmd.Flags().StringP("alias", "a", "",
+		formatFlagUsage(`Database alias/name. (default: basename of --out-dir).`))
+	mergeDBCmd.Flags().BoolP("compress-name-map", "", false,
+		formatFlagUsage(`Compress the name mapping file (__name_mapping.tsv) with gzip.`))
+
+	mergeDBCmd.SetUsageTemplate(usageTemplate("-O <out dir> <kmcp db> <kmcp db> [<kmcp db> ...]"))
+}
@@ -42,7 +42,8 @@ var mergeCmd = &cobra.Command{
 	Long: `Merge search results from multiple databases
 
 Input:
-  *. Searching results of the same reads in different databases.
+  *. Searching results of the same reads in different databases,
+     or in different shards of a database ("kmcp search --shards").
   *. The order of multiple input reads files should be the same during searching.
   *. When only one input given, we just copy and write to the input file.
      This is friendly to workflows which assume multiple inputs are given.
@@ -398,13 +399,13 @@ func NewSearchResultParser(file string, poolStrings *sync.Pool, poolMatches *syn
 				continue
 			}
 
-			tmp := make([]string, numFields)
+			tmp := make([]string, numFields+1) // the last one holds optional extra columns, e.g., taxid
 			items := &tmp
 
 			// Strangely, it's much slower (nearly 1/2 speed) in server with Intel CPUs.
 			// items := poolStrings.Get().(*[]string)
 
-			stringSplitNByByte(line, '\t', numFields, items)
+			stringSplitNByByte(line, '\t', numFields+1, items)
 			if len(*items) < numFields {
 				checkError(fmt.Errorf("number of fields (%d) < query index field (%d)", len(*items), numFields))
 			}
@@ -0,0 +1,376 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/bio/seq"
+	"github.com/shenwei356/kmcp/kmcp/index"
+	"github.com/shenwei356/kmcp/kmcp/search"
+	"github.com/shenwei356/util/pathutil"
+	"github.com/spf13/cobra"
+)
+
+var primerSearchCmd = &cobra.Command{
+	Use:   "primer-search",
+	Short: "Check the presence of primer pairs in a database (in-silico PCR)",
+	Long: `Check the presence of primer pairs in a database (in-silico PCR)
+
+This command searches both primers of each primer pair against a database,
+and reports targets containing both of them in the same or nearby chunks,
+for checking the specificity of primers quickly.
+
+Input format (tab-delimited, lines starting with "#" are ignored):
+    1. name,     Name of the primer pair
+    2. forward,  Forward primer (5'-3')
+    3. reverse,  Reverse primer (5'-3')
+
+Attention:
+  1. Degenerate bases (IUPAC codes) are expanded into all possible
+     variants, a primer matches a target if any of its variants does.
+  2. Primers should not be shorter than the k-mer size of the database,
+     and a smaller k-mer size (e.g., 15) is recommended for short primers.
+  3. Positions of k-mers are not stored in the database, the distance between
+     the two primers is measured by chunk indices, where the default
+     maximal distance 1 allows amplicons spanning two adjacent chunks.
+  4. Short primers have few k-mers, so false positive matches are common for
+     databases with a high false positive rate of bloom filters, please check
+     the FPR columns and use -t/--min-query-cov 1.
+
+Output format:
+    1. pair,     Name of the primer pair
+    2. target,   Target name
+    3. fChunk,   Chunk index of the forward primer
+    4. rChunk,   Chunk index of the reverse primer
+    5. chunks,   Number of chunks of the target
+    6. fQCov,    Query coverage of the forward primer
+    7. rQCov,    Query coverage of the reverse primer
+    8. fFPR,     FPR of the match of the forward primer
+    9. rFPR,     FPR of the match of the reverse primer
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+		seq.ValidateSeq = false
+
+		var err error
+
+		dbDir := getFlagString(cmd, "db-dir")
+		if dbDir == "" {
+			checkError(fmt.Errorf("flag -d/--db-dir needed"))
+		}
+		existed, err := pathutil.Exists(filepath.Join(dbDir, search.DBInfoFile))
+		checkError(errors.Wrap(err, dbDir))
+		if !existed {
+			checkError(fmt.Errorf("invalid kmcp database: %s", dbDir))
+		}
+
+		queryCov := getFlagNonNegativeFloat64(cmd, "min-query-cov")
+		if queryCov > 1 {
+			checkError(fmt.Errorf("the value of -t/--min-query-cov (%f) should be in range of [0, 1]", queryCov))
+		}
+		maxVariants := getFlagPositiveInt(cmd, "max-variants")
+		maxChunkDist := getFlagNonNegativeInt(cmd, "max-chunk-distance")
+		loadWholeFile := getFlagBool(cmd, "load-whole-db")
+		outFile := getFlagString(cmd, "out-file")
+
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", true)
+		pairs := make([]primerPair, 0, 8)
+		for _, file := range files {
+			_pairs, err := readPrimerPairs(file)
+			checkError(errors.Wrap(err, file))
+			pairs = append(pairs, _pairs...)
+		}
+		if len(pairs) == 0 {
+			checkError(fmt.Errorf("no primer pairs given"))
+		}
+
+		// ---------------------------------------------------------------
+
+		sg, err := search.Open([]string{dbDir}, search.SearchOptions{
+			LoadWholeFile: loadWholeFile,
+			UseMMap:       true,
+			Threads:       opt.NumCPUs,
+			Verbose:       opt.Verbose || opt.Log2File,
+
+			SortBy:    "qcov",
+			DoNotSort: true,
+
+			MinMatched:  1,
+			MinQueryCov: queryCov,
+			MaxFPR:      1,
+		})
+		checkError(err)
+
+		k := sg.DBs[0].Info.K
+		if !search.IsDNAAlphabet(sg.DBs[0].Info.Alphabet) {
+			checkError(fmt.Errorf("only databases of DNA sequences are supported"))
+		}
+
+		// expand degenerate bases
+		queries := make([]primerQuery, 0, len(pairs)*2)
+		var variants [][]byte
+		for i, pair := range pairs {
+			for j, primer := range []string{pair.Forward, pair.Reverse} {
+				if len(primer) < k {
+					checkError(fmt.Errorf("primer pair %s: primer %s is shorter than the k-mer size (%d)", pair.Name, primer, k))
+				}
+				variants, err = expandDegenerateBases([]byte(primer), maxVariants)
+				checkError(errors.Wrapf(err, "primer pair %s", pair.Name))
+				for _, v := range variants {
+					queries = append(queries, primerQuery{Pair: i, Reverse: j == 1, Seq: v})
+				}
+			}
+		}
+		if opt.Verbose || opt.Log2File {
+			log.Infof("%d primer pairs loaded, %d primer variants to search", len(pairs), len(queries))
+		}
+
+		// best matches of each primer in each target chunk
+		hits := make([]map[string]*primerHits, len(pairs))
+		for i := range hits {
+			hits[i] = make(map[string]*primerHits, 8)
+		}
+
+		done := make(chan int)
+		go func() {
+			var q primerQuery
+			var h *primerHits
+			var ok bool
+			var chunkIdx, chunks uint32
+			var m map[uint32]*search.Match
+			for result := range sg.OutCh {
+				checkError(result.Err)
+				if result.Matches != nil {
+					q = queries[result.QueryIdx]
+					for _, match := range *result.Matches {
+						if h, ok = hits[q.Pair][match.Target[0]]; !ok {
+							h = &primerHits{F: make(map[uint32]*search.Match, 1), R: make(map[uint32]*search.Match, 1)}
+							hits[q.Pair][match.Target[0]] = h
+						}
+						chunkIdx, chunks = index.DecodeChunkIdx(match.TargetIdx[0])
+						h.Chunks = chunks
+						if q.Reverse {
+							m = h.R
+						} else {
+							m = h.F
+						}
+						if _m, ok := m[chunkIdx]; !ok || match.QCov > _m.QCov {
+							m[chunkIdx] = &search.Match{QCov: match.QCov, FPR: match.FPR}
+						}
+					}
+				}
+				search.RecycleQueryResult(result)
+			}
+			done <- 1
+		}()
+
+		var clone *seq.Seq
+		for i, q := range queries {
+			clone = search.NewSeq()
+			clone.Alphabet = seq.DNAredundant
+			clone.Seq = append(clone.Seq[:0], q.Seq...)
+
+			query := search.NewQuery()
+			query.Idx = uint64(i)
+			query.ID = q.Seq
+			query.Seq = clone
+			sg.InCh <- query
+		}
+		sg.Done()
+		<-done
+
+		checkError(sg.Close())
+
+		// ---------------------------------------------------------------
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		outfh.WriteString("#pair\ttarget\tfChunk\trChunk\tchunks\tfQCov\trQCov\tfFPR\trFPR\n")
+
+		var nAmplified int
+		targets := make([]string, 0, 8)
+		for i, pair := range pairs {
+			targets = targets[:0]
+			for target := range hits[i] {
+				targets = append(targets, target)
+			}
+			sort.Strings(targets)
+
+			for _, target := range targets {
+				h := hits[i][target]
+				cf, cr, ok := h.Nearest(maxChunkDist)
+				if !ok {
+					continue
+				}
+				nAmplified++
+				fmt.Fprintf(outfh, "%s\t%s\t%d\t%d\t%d\t%.4f\t%.4f\t%.4e\t%.4e\n",
+					pair.Name, target, cf, cr, h.Chunks,
+					h.F[cf].QCov, h.R[cr].QCov, h.F[cf].FPR, h.R[cr].FPR)
+			}
+		}
+
+		if opt.Verbose || opt.Log2File {
+			log.Infof("%d target-primer pair hits found", nAmplified)
+		}
+	},
+}
+
+// primerPair is a pair of PCR primers.
+type primerPair struct {
+	Name    string
+	Forward string
+	Reverse string
+}
+
+// primerQuery is a variant of a primer with degenerate bases expanded.
+type primerQuery struct {
+	Pair    int // index of the primer pair
+	Reverse bool
+	Seq     []byte
+}
+
+// primerHits records the best matches of the two primers in chunks of a target.
+type primerHits struct {
+	Chunks uint32
+	F      map[uint32]*search.Match
+	R      map[uint32]*search.Match
+}
+
+// Nearest returns the chunk indices of the closest matches of the two primers,
+// false is returned if the distance is bigger than maxDist.
+func (h *primerHits) Nearest(maxDist int) (uint32, uint32, bool) {
+	var cf, cr uint32
+	dist := -1
+	var d int
+	for f := range h.F {
+		for r := range h.R {
+			d = int(f) - int(r)
+			if d < 0 {
+				d = -d
+			}
+			if dist < 0 || d < dist || (d == dist && (f < cf || (f == cf && r < cr))) {
+				dist, cf, cr = d, f, r
+			}
+		}
+	}
+	return cf, cr, dist >= 0 && dist <= maxDist
+}
+
+// readPrimerPairs reads primer pairs from a tab-delimited file.
+func readPrimerPairs(file string) ([]primerPair, error) {
+	fh, r, _, err := inStream(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	pairs := make([]primerPair, 0, 8)
+	scanner := bufio.NewScanner(fh)
+	var line string
+	var items []string
+	for scanner.Scan() {
+		line = strings.TrimRight(scanner.Text(), "\r\n")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		items = strings.Split(line, "\t")
+		if len(items) < 3 {
+			return nil, fmt.Errorf("three columns needed: %s", line)
+		}
+		pairs = append(pairs, primerPair{
+			Name:    items[0],
+			Forward: strings.ToUpper(strings.TrimSpace(items[1])),
+			Reverse: strings.ToUpper(strings.TrimSpace(items[2])),
+		})
+	}
+	return pairs, scanner.Err()
+}
+
+// iupacBases maps IUPAC nucleotide codes to the bases they represent.
+var iupacBases = map[byte][]byte{
+	'A': []byte("A"), 'C': []byte("C"), 'G': []byte("G"), 'T': []byte("T"), 'U': []byte("T"),
+	'R': []byte("AG"), 'Y': []byte("CT"), 'S': []byte("CG"), 'W': []byte("AT"),
+	'K': []byte("GT"), 'M': []byte("AC"), 'B': []byte("CGT"), 'D': []byte("AGT"),
+	'H': []byte("ACT"), 'V': []byte("ACG"), 'N': []byte("ACGT"),
+}
+
+// expandDegenerateBases returns all variants of a sequence with degenerate bases.
+func expandDegenerateBases(s []byte, maxVariants int) ([][]byte, error) {
+	n := 1
+	for _, b := range s {
+		bases, ok := iupacBases[b]
+		if !ok {
+			return nil, fmt.Errorf("invalid base '%c' in primer: %s", b, s)
+		}
+		n *= len(bases)
+		if n > maxVariants {
+			return nil, fmt.Errorf("too many variants (> %d) of primer: %s", maxVariants, s)
+		}
+	}
+
+	variants := make([][]byte, 1, n)
+	variants[0] = make([]byte, 0, len(s))
+	for _, b := range s {
+		bases := iupacBases[b]
+		for i := range variants {
+			for _, base := range bases[1:] {
+				v := make([]byte, len(variants[i]), len(s))
+				copy(v, variants[i])
+				variants = append(variants, append(v, base))
+			}
+			variants[i] = append(variants[i], bases[0])
+		}
+	}
+	return variants, nil
+}
+
+func init() {
+	utilsCmd.AddCommand(primerSearchCmd)
+
+	primerSearchCmd.Flags().StringP("db-dir", "d", "",
+		formatFlagUsage(`Database directory created by "kmcp index".`))
+	primerSearchCmd.Flags().Float64P("min-query-cov", "t", 1,
+		formatFlagUsage(`Minimal query coverage of a primer, i.e., proportion of matched k-mers of the primer.`))
+	primerSearchCmd.Flags().IntP("max-variants", "", 1024,
+		formatFlagUsage(`Maximal number of variants of a primer with degenerate bases.`))
+	primerSearchCmd.Flags().IntP("max-chunk-distance", "", 1,
+		formatFlagUsage(`Maximal distance between chunk indices of the two primers in a target.`))
+	primerSearchCmd.Flags().BoolP("load-whole-db", "w", false,
+		formatFlagUsage(`Load all index files into memory.`))
+	primerSearchCmd.Flags().StringP("out-file", "o", "-",
+		formatFlagUsage(`Out file, supports and recommends a ".gz" suffix ("-" for stdout).`))
+
+	primerSearchCmd.SetUsageTemplate(usageTemplate("-d <kmcp db> [-o <out.tsv>] <primer pair files>"))
+}
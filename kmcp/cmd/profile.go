@@ -37,6 +37,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/shenwei356/bio/taxdump"
 	"github.com/shenwei356/breader"
+	"github.com/shenwei356/kmcp/kmcp/search"
 	"github.com/shenwei356/util/cliutil"
 	"github.com/shenwei356/util/stats"
 	"github.com/spf13/cobra"
@@ -131,7 +132,7 @@ Performance notes:
      ambiguous reads correction which has very little effect on the results.
 
 Profiling output formats:
-  1. KMCP      (-o/--out-prefix)
+  1. KMCP      (-o/--out-prefix, --out-format kmcp)
      Note that: abundances are only computed for target references rather than
      each taxon at all taxonomic ranks, so please output CAMI or MetaPhlAn format.
   2. CAMI      (-M/--metaphlan-report, --metaphlan-report-version,
@@ -142,29 +143,49 @@ Profiling output formats:
        - taxonkit cami-filter: remove taxa of given TaxIds and their
          descendants in CAMI metagenomic profile.
   3. MetaPhlAn (-C/--cami-report, -s/--sample-id)
+     The CAMI format can also be written to -o/--out-prefix with
+     --out-format cami, where percentages of taxa at each rank are
+     normalized to sum up to 100, and taxa at the same rank are in the
+     order of references in the KMCP format.
+  4. Rank      (--rank-report, --rank)
+     Abundances rolled up to a single rank, e.g., species or genus.
+     References without TaxIds or taxa at the rank are reported as
+     "unclassified" (TaxId 0), so percentages sum up to 100.
 
 KMCP format:
-  Tab-delimited format with 16 columns:
+  Tab-delimited format with 18 columns, and chunksEvenness is always
+  the last column, after the optional columns tCov and uchunksFrac:
 
      1. ref,                Identifier of the reference genome
      2. percentage,         Relative abundance of the reference
-     3. score,              The 90th percentile of qCov of uniquely matched reads
-     4. chunksFrac,         Genome chunks fraction
-     5. chunksRelDepth,     Relative depths of reference chunks
-     6. chunksRelDepthStd,  The strandard deviation of chunksRelDepth
-     7. reads,              Total number of matched reads of this reference
-     8. ureads,             Number of uniquely matched reads
-     9. hicureads,          Number of uniquely matched reads with high-confidence
-    10. refsize,            Reference size
-    11. refname,            Reference name, optional via name mapping file
-    12. taxid,              TaxId of the reference
-    13. rank,               Taxonomic rank
-    14. taxname,            Taxonomic name
-    15. taxpath,            Complete lineage
-    16. taxpathsn,          Corresponding TaxIds of taxa in the complete lineage
+     3. coverage,           Average sequencing depth of the reference
+     4. score,              The 90th percentile of qCov of uniquely matched reads
+     5. chunksFrac,         Genome chunks fraction
+     6. chunksRelDepth,     Relative depths of reference chunks
+     7. chunksRelDepthStd,  The strandard deviation of chunksRelDepth
+     8. reads,              Total number of reads assigned to this reference, i.e., the sum
+                            of counts of all chunks, where ambiguous reads are split
+                            among references. It can be used as the absolute read count
+                            by count-based tools, while percentage is the relative one
+     9. ureads,             Number of uniquely matched reads
+    10. hicureads,          Number of uniquely matched reads with high-confidence
+    11. refsize,            Reference size
+    12. refname,            Reference name, optional via name mapping file
+    13. taxid,              TaxId of the reference
+    14. rank,               Taxonomic rank
+    15. taxname,            Taxonomic name
+    16. taxpath,            Complete lineage
+    17. taxpathsn,          Corresponding TaxIds of taxa in the complete lineage
+        tCov,               Fraction of target k-mers in the union of matched k-mers of all reads,
+                            only for search results with --output-kmer-sketch
+        uchunksFrac,        Fraction of chunks with uniquely matched reads,
+                            only for --min-uniq-frags-prop > 0
+    18. chunksEvenness,     Fraction of chunks with relative depths within 2X of the median
 
 Taxonomic binning formats:
   1. CAMI      (-B/--binning-result)
+     The BINID is the reference ID for reads assigned to a single reference,
+     or the LCA TaxId for reads assigned to multiple references.
 
 Examples:
   1. Default mode:
@@ -198,27 +219,7 @@ Examples:
 
 		var err error
 
-		// ---------------- debug ---------
-
 		debugFile := getFlagString(cmd, "debug")
-		// debugFile := ""
-
-		debug := debugFile != ""
-		var outfhD *bufio.Writer
-		var gwD io.WriteCloser
-		var wD *os.File
-		if debug {
-			outfhD, gwD, wD, err = outStream(debugFile, strings.HasSuffix(strings.ToLower(debugFile), ".gz"), opt.CompressionLevel)
-			checkError(err)
-			defer func() {
-				outfhD.Flush()
-				if gwD != nil {
-					gwD.Close()
-				}
-				wD.Close()
-			}()
-		}
-		// ---------------- debug ---------
 
 		// ---------------- preset modes ----------------
 		type profileParams struct {
@@ -333,6 +334,18 @@ Examples:
 		noAmbCorr := getFlagBool(cmd, "no-amb-corr")
 
 		outFile := getFlagString(cmd, "out-prefix")
+		appendOutput := getFlagBool(cmd, "append")
+		outFormat := getFlagString(cmd, "out-format")
+		switch outFormat {
+		case "kmcp", "cami":
+		default:
+			checkError(fmt.Errorf("invalid value of --out-format: %s, available: kmcp, cami", outFormat))
+		}
+		outCAMI := outFormat == "cami"
+		if outCAMI && appendOutput {
+			checkError(fmt.Errorf("flag --append is only supported for --out-format kmcp"))
+		}
+		collisionsFile := getFlagString(cmd, "report-map-collisions")
 
 		maxFPR := getFlagPositiveFloat64(cmd, "max-fpr")
 		minQcov := getFlagNonNegativeFloat64(cmd, "min-query-cov")
@@ -435,6 +448,29 @@ Examples:
 		if maxMismatchErr >= 1 {
 			checkError(fmt.Errorf("the value of -R/--max-mismatch-err (%f) should be in range of (0, 1)", maxMismatchErr))
 		}
+		pairedEnd := getFlagBool(cmd, "paired")
+		maxTargets := getFlagNonNegativeInt(cmd, "max-targets")
+		limitTargets := maxTargets > 0
+		minEvenness := getFlagNonNegativeFloat64(cmd, "min-evenness")
+		if minEvenness > 1 {
+			checkError(fmt.Errorf("the value of --min-evenness (%f) should be in range of [0, 1]", minEvenness))
+		}
+		minTargetCov := getFlagNonNegativeFloat64(cmd, "min-target-cov")
+		if minTargetCov > 1 {
+			checkError(fmt.Errorf("the value of --min-target-cov (%f) should be in range of [0, 1]", minTargetCov))
+		}
+		minGenomeUniq := getFlagNonNegativeFloat64(cmd, "min-genome-uniqueness")
+		if minGenomeUniq > 1 {
+			checkError(fmt.Errorf("the value of --min-genome-uniqueness (%f) should be in range of [0, 1]", minGenomeUniq))
+		}
+
+		minUniqFragsProp := getFlagNonNegativeFloat64(cmd, "min-uniq-frags-prop")
+		if minUniqFragsProp > 1 {
+			checkError(fmt.Errorf("the value of --min-uniq-frags-prop (%f) should be in range of [0, 1]", minUniqFragsProp))
+		}
+
+		minCoverage := getFlagNonNegativeFloat64(cmd, "min-coverage")
+
 		lowAbcPct := getFlagNonNegativeFloat64(cmd, "filter-low-pct")
 		if lowAbcPct >= 100 {
 			checkError(fmt.Errorf("the value of -F/--filter-low-pct (%f) should be in range of [0, 100)", lowAbcPct))
@@ -443,6 +479,29 @@ Examples:
 		}
 		fileterLowAbc := lowAbcPct > 0
 
+		minRelAbund := getFlagNonNegativeFloat64(cmd, "min-rel-abundance")
+		if minRelAbund >= 100 {
+			checkError(fmt.Errorf("the value of --min-rel-abundance (%f) should be in range of [0, 100)", minRelAbund))
+		}
+
+		outputNA := getFlagBool(cmd, "output-na")
+
+		floatPrecision := getFlagInt(cmd, "float-precision")
+		if floatPrecision < -1 {
+			checkError(fmt.Errorf("the value of --float-precision should be >= 0, or -1 for the default precision of each column"))
+		}
+		// prec returns the precision of a float column, p is the default one.
+		prec := func(p int) int {
+			if floatPrecision >= 0 {
+				return floatPrecision
+			}
+			return p
+		}
+
+		useEM := getFlagBool(cmd, "em")
+		emMaxIter := getFlagPositiveInt(cmd, "em-max-iter")
+		emTol := getFlagPositiveFloat64(cmd, "em-tol")
+
 		level := strings.ToLower(getFlagString(cmd, "level"))
 		var levelSpecies bool
 		switch level {
@@ -488,7 +547,22 @@ Examples:
 		}
 
 		chunkSize := getFlagPositiveInt(cmd, "line-chunk-size")
-		if opt.NumCPUs > 4 {
+
+		byFile := getFlagBool(cmd, "by-file")
+		byFileOutDir := getFlagString(cmd, "by-file-out-dir")
+		if byFile && byFileOutDir == "" {
+			checkError(fmt.Errorf("flag --by-file-out-dir is needed when --by-file given"))
+		}
+		if byFile {
+			for _, flag := range []string{"append", "debug", "output-kmers", "save-state", "load-state", "report-map-collisions"} {
+				if cmd.Flags().Lookup(flag).Changed {
+					checkError(fmt.Errorf("flag --%s is not supported with --by-file", flag))
+				}
+			}
+		}
+		byFileThreads := opt.NumCPUs
+
+		if opt.NumCPUs > 4 && !byFile {
 			if opt.Verbose || opt.Log2File {
 				log.Infof("using a lot of threads does not always accelerate processing, 4-threads is fast enough")
 			}
@@ -512,6 +586,9 @@ Examples:
 		if outputCamiReport && !strings.HasSuffix(camiReportFile, ".profile") {
 			camiReportFile = camiReportFile + ".profile"
 		}
+		if outCAMI && (len(taxidMappingFiles) == 0 || taxonomyDataDir == "") {
+			checkError(fmt.Errorf("flag -T/--taxid-map and -X/--taxdump needed for --out-format cami"))
+		}
 
 		metaphlanReportFile := getFlagString(cmd, "metaphlan-report")
 		outputMetaphlanReport := metaphlanReportFile != ""
@@ -519,6 +596,29 @@ Examples:
 			metaphlanReportFile = metaphlanReportFile + ".profile"
 		}
 
+		rankReportFile := getFlagString(cmd, "rank-report")
+		rank := strings.ToLower(getFlagString(cmd, "rank"))
+		if rankReportFile != "" {
+			if !mappingTaxids || taxonomyDataDir == "" {
+				checkError(fmt.Errorf("flag -T/--taxid-map and -X/--taxdump needed when --rank-report given"))
+			}
+			if rank == "" {
+				checkError(fmt.Errorf("the value of --rank should not be empty"))
+			}
+		}
+
+		treeFile := getFlagString(cmd, "tree")
+		treeReportFile := getFlagString(cmd, "tree-report")
+		if (treeFile == "") != (treeReportFile == "") {
+			checkError(fmt.Errorf("flags --tree and --tree-report should be given together"))
+		}
+
+		targetsDiagFile := getFlagString(cmd, "output-kmers")
+
+		stateFile := getFlagString(cmd, "save-state")
+		saveState := stateFile != ""
+		loadStateFiles := getFlagStringSlice(cmd, "load-state")
+
 		metaphlanReportVersion := getFlagString(cmd, "metaphlan-report-version")
 		switch metaphlanReportVersion {
 		case "2", "3":
@@ -557,6 +657,9 @@ Examples:
 			log.Info("checking input files ...")
 		}
 		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", true)
+		if len(loadStateFiles) > 0 && len(files) == 1 && isStdin(files[0]) {
+			files = files[:0] // only merging saved profile states
+		}
 		if opt.Verbose || opt.Log2File {
 			if len(files) == 1 && isStdin(files[0]) {
 				// log.Info("no files given, reading from stdin")
@@ -735,6 +838,21 @@ Examples:
 			log.Infof("  minimal number of uniquely matched reads: %.0f", minUReads)
 			log.Infof("  minimal proportion of matched reference chunks: %f", minFragsProp)
 			log.Infof("  maximal standard deviation of relative depths of all chunks: %f", maxFragsDepthStdev)
+			if minEvenness > 0 {
+				log.Infof("  minimal evenness of relative depths of chunks: %f", minEvenness)
+			}
+			if minTargetCov > 0 {
+				log.Infof("  minimal target coverage of the union of matched k-mers: %f", minTargetCov)
+			}
+			if minGenomeUniq > 0 {
+				log.Infof("  minimal fraction of matched k-mers not shared with other references: %f", minGenomeUniq)
+			}
+			if minUniqFragsProp > 0 {
+				log.Infof("  minimal fraction of chunks with uniquely matched reads: %f", minUniqFragsProp)
+			}
+			if minCoverage > 0 {
+				log.Infof("  minimal estimated coverage (chunks fraction × depth): %f", minCoverage)
+			}
 			log.Info()
 
 			log.Infof("  minimal number of high-confidence uniquely matched reads: %.0f", minHicUreads)
@@ -756,6 +874,9 @@ Examples:
 			if fileterLowAbc {
 				log.Infof("  filter out predictions with the smallest relative abundances summing up %d%%", lowAbcPct)
 			}
+			if minRelAbund > 0 {
+				log.Infof("  filter out predictions with relative abundances < %v%%", minRelAbund)
+			}
 			log.Infof("  default format  : %s", outFile)
 			if outputCamiReport {
 				log.Infof("  CAMI format     : %s", camiReportFile)
@@ -769,6 +890,12 @@ Examples:
 			if outputBinningResult {
 				log.Infof("  Binning result  : %s", binningFile)
 			}
+			if rankReportFile != "" {
+				log.Infof("  abundances at rank %s: %s", rank, rankReportFile)
+			}
+			if treeFile != "" {
+				log.Infof("  Tree abundances : %s", treeReportFile)
+			}
 
 			log.Infof("-------------------- [main parameters] --------------------")
 			log.Info()
@@ -776,398 +903,165 @@ Examples:
 		}
 		// ---------------------------------------------------------------
 
-		numFields := 13
-
-		profile := make(map[uint64]*Target, 128)
-
-		floatOne := float64(1)
-
-		// ---------------------------------------------------------------
-
-		pool := &sync.Pool{New: func() interface{} {
-			tmp := make([]string, numFields)
-			return &tmp
-		}}
-
-		fn := func(line string) (interface{}, bool, error) {
-			if line == "" || line[0] == '#' { // ignoring blank line and comment line
-				return "", false, nil
-			}
-
-			items := pool.Get().(*[]string)
-
-			match, ok := parseMatchResult(line, numFields, items, maxFPR, minQcov)
-			if !ok {
-				pool.Put(items)
-				return nil, false, nil
+		outputs := profileOutputs{
+			profile:    outFile,
+			cami:       camiReportFile,
+			metaphlan:  metaphlanReportFile,
+			binning:    binningFile,
+			rank:       rankReportFile,
+			tree:       treeReportFile,
+			diag:       targetsDiagFile,
+			state:      stateFile,
+			collisions: collisionsFile,
+			debug:      debugFile,
+			sampleID:   sampleID,
+		}
+
+		// profileFiles profiles search results in files and writes the outputs,
+		// it is called once for all input files, or for each file with --by-file.
+		profileFiles := func(files []string, outs profileOutputs, verbose bool) error {
+			var err error
+
+			// ---------------- debug ---------
+
+			debug := outs.debug != ""
+			var outfhD *bufio.Writer
+			var gwD io.WriteCloser
+			var wD *os.File
+			if debug {
+				outfhD, gwD, wD, err = outStream(outs.debug, strings.HasSuffix(strings.ToLower(outs.debug), ".gz"), opt.CompressionLevel)
+				if err != nil {
+					return err
+				}
+				defer func() {
+					outfhD.Flush()
+					if gwD != nil {
+						gwD.Close()
+					}
+					wD.Close()
+				}()
 			}
+			// ---------------- debug ---------
 
-			pool.Put(items)
-			return match, true, nil
-		}
-
-		var nReads float64
-
-		// ---------------------------------------------------------------
-		// stage 1/4
-		if opt.Verbose || opt.Log2File {
-			log.Infof("stage 1/4: counting matches and unique matches for filtering out low-confidence references")
-		}
-		timeStart1 := time.Now()
+			numFields := 14
 
-		for _, file := range files {
-			if opt.Verbose || opt.Log2File {
-				log.Infof("  parsing file: %s", file)
+			// columns of sampled matched k-mers, for search results with --output-kmer-sketch
+			kmerSketchCols := make(map[string]int, len(files))
+			hasSketch := true
+			for _, file := range files {
+				col, err := searchResultColumn(file, "kmerSketch")
+				if err != nil {
+					return err
+				}
+				if col < 0 {
+					hasSketch = false
+					break
+				}
+				kmerSketchCols[file] = col
 			}
 
-			var matches map[uint64]*[]*MatchResult // target -> match result
-			var m *MatchResult
-			var ms *[]*MatchResult
-			var t *Target
-			var ok bool
-			var hTarget, h uint64
-			var prevQuery string
-			var floatMsSize float64
-			var match *MatchResult
-			var first bool
-
-			onlyTopNScore := topNScore > 0
-			var nScore int
-			var pScore float64
-			var processThisMatch bool
-
-			taxids := make([]uint32, 0, 128)
-			var taxid1, taxid2 uint32
-			var theSameSpecies bool
-
-			reader, err := breader.NewBufferedReader(file, opt.NumCPUs, chunkSize, fn)
-			checkError(err)
-			var data interface{}
-
-			matches = make(map[uint64]*[]*MatchResult)
-			pScore = 1024
-			nScore = 0
-			processThisMatch = true
-			for chunk := range reader.Ch {
-				checkError(chunk.Err)
-
-				for _, data = range chunk.Data {
-					match = data.(*MatchResult)
-
-					if prevQuery != match.Query { // new query
-						nReads++
-
-						if len(matches) > 0 { // not the first query
-							if levelSpecies {
-								taxids = taxids[:0]
-								for h, ms = range matches {
-									taxid1, ok = taxidMap[(*ms)[0].Target]
-									if !ok {
-										checkError(fmt.Errorf("unknown taxid for %s, please check taxid mapping file(s)", (*ms)[0].Target))
-									}
-									taxids = append(taxids, taxid1)
-								}
-								// LCA
-								theSameSpecies = false
-								taxid1 = taxids[0]
-								for _, taxid2 = range taxids[1:] {
-									taxid1 = taxdb.LCA(taxid1, taxid2)
-								}
-								if taxdb.AtOrBelowRank(taxid1, "species") {
-									theSameSpecies = true
-								}
-							}
-
-							for h, ms = range matches {
-								floatMsSize = float64(len(*ms))
-								first = true
-								for _, m = range *ms { // multiple matches in different chunks
-									if t, ok = profile[h]; !ok {
-										t0 := Target{
-											Name:         m.Target,
-											GenomeSize:   m.GSize,
-											Match:        make([]float64, m.IdxNum),
-											UniqMatch:    make([]float64, m.IdxNum),
-											UniqMatchHic: make([]float64, m.IdxNum),
-											// QLen:         make([]float64, m.IdxNum),
-											// RelDepth:  make([]float64, m.IdxNum),
-											StatsA: stats.NewQuantiler(),
-										}
-										profile[h] = &t0
-										t = &t0
-									}
-
-									if first { // count once
-										if len(matches) == 1 || theSameSpecies {
-											t.UniqMatch[m.FragIdx]++
-											if m.QCov >= hicUreadsMinQcov {
-												t.UniqMatchHic[m.FragIdx]++
-											}
-										}
-										t.StatsA.Add(m.QCov)
-
-										first = false
-									}
-
-									// t.QLen[m.FragIdx] += float64(m.QLen)
-
-									// for a read matching multiple regions of a reference, distribute count to multiple regions,
-									// the sum is still one.
-									t.Match[m.FragIdx] += floatOne / floatMsSize
-								}
-								poolMatchResults.Put(ms)
-							}
-						}
-
-						matches = make(map[uint64]*[]*MatchResult)
-						pScore = 1024
-						nScore = 0
-						processThisMatch = true
-					} else if keepFullMatch { // not the first match
-						if !processThisMatch {
-							prevQuery = match.Query
-							continue
-						}
-
-						if pScore == 1 && match.QCov < 1 {
-							processThisMatch = false
-
-							prevQuery = match.Query
-							continue
-						}
-					} else if keepMainMatch && pScore <= 1 {
-						if !processThisMatch {
-							prevQuery = match.Query
-							continue
-						}
-
-						if pScore-match.QCov > maxScoreGap {
-							processThisMatch = false
-
-							prevQuery = match.Query
-							continue
-						}
-					}
-
-					if onlyTopNScore {
-						if !processThisMatch {
-							prevQuery = match.Query
-							continue
-						}
-
-						if match.QCov < pScore { // match with a smaller score
-							nScore++
-							if nScore > topNScore {
-								processThisMatch = false
-
-								prevQuery = match.Query
-								continue
-							}
-						}
-					}
-
-					hTarget = wyhash.HashString(match.Target, 1)
-					if ms, ok = matches[hTarget]; !ok {
-						// tmp := []*MatchResult{match}
-						tmp := poolMatchResults.Get().(*[]*MatchResult)
-						*tmp = (*tmp)[:0]
-						*tmp = append(*tmp, match)
-						matches[hTarget] = tmp
-					} else {
-						*ms = append(*ms, match)
-					}
+			// saved profile states to merge
+			states := make([]*ProfileState, 0, len(loadStateFiles))
+			for _, file := range loadStateFiles {
+				state, err := ProfileStateFromFile(file)
+				if err != nil {
+					return errors.Wrap(err, file)
+				}
+				states = append(states, state)
 
-					prevQuery = match.Query
-					pScore = match.QCov
+				if len(files) == 0 {
+					hasSketch = state.HasSketch()
+				} else if !state.HasSketch() {
+					hasSketch = false
 				}
 			}
+			if len(files) == 0 && len(states) == 0 {
+				return fmt.Errorf("no input files given")
+			}
 
-			if len(matches) > 0 {
-				nReads++
-
-				if levelSpecies {
-					taxids = taxids[:0]
-					for h, ms = range matches {
-						taxid1, ok = taxidMap[(*ms)[0].Target]
-						if !ok {
-							checkError(fmt.Errorf("unknown taxid for %s, please check taxid mapping file(s)", (*ms)[0].Target))
-						}
-						taxids = append(taxids, taxid1)
-					}
-
-					theSameSpecies = false
-					taxid1 = taxids[0]
-					for _, taxid2 = range taxids[1:] {
-						taxid1 = taxdb.LCA(taxid1, taxid2)
-					}
-					if taxdb.AtOrBelowRank(taxid1, "species") {
-						theSameSpecies = true
-					}
-				}
+			if !hasSketch && minTargetCov > 0 {
+				return fmt.Errorf("flag --min-target-cov needs search results with sampled matched k-mers (kmcp search --output-kmer-sketch)")
+			}
+			if !hasSketch && minGenomeUniq > 0 {
+				return fmt.Errorf("flag --min-genome-uniqueness needs search results with sampled matched k-mers (kmcp search --output-kmer-sketch)")
+			}
+			sketchCol := -1 // only parsed in stage 3/4
 
-				for h, ms = range matches {
-					floatMsSize = float64(len(*ms))
-					first = true
-					for _, m = range *ms { // multiple matches in different chunks
-						if t, ok = profile[h]; !ok {
-							t0 := Target{
-								Name:         m.Target,
-								GenomeSize:   m.GSize,
-								Match:        make([]float64, m.IdxNum),
-								UniqMatch:    make([]float64, m.IdxNum),
-								UniqMatchHic: make([]float64, m.IdxNum),
-								// QLen:         make([]float64, m.IdxNum),
-								// RelDepth:  make([]float64, m.IdxNum),
-								StatsA: stats.NewQuantiler(),
-							}
-							profile[h] = &t0
-							t = &t0
-						}
+			profile := make(map[uint64]*Target, 128)
 
-						if first { // count once
-							if len(matches) == 1 || theSameSpecies {
-								t.UniqMatch[m.FragIdx]++
-								if m.QCov >= hicUreadsMinQcov {
-									t.UniqMatchHic[m.FragIdx]++
-								}
-							}
-							t.StatsA.Add(m.QCov)
+			floatOne := float64(1)
 
-							first = false
-						}
+			// ---------------------------------------------------------------
 
-						// t.QLen[m.FragIdx] += float64(m.QLen) / floatMsSize
+			pool := &sync.Pool{New: func() interface{} {
+				tmp := make([]string, numFields)
+				return &tmp
+			}}
 
-						// for a read matching multiple regions of a reference, distribute count to multiple regions,
-						// the sum is still one.
-						t.Match[m.FragIdx] += floatOne / floatMsSize
-					}
-					poolMatchResults.Put(ms)
+			fn := func(line string) (interface{}, bool, error) {
+				if line == "" || line[0] == '#' { // ignoring blank line and comment line
+					return "", false, nil
 				}
-			}
-		}
-
-		// --------------------
-		// sum up #1
-
-		if debug {
-			outfhD.WriteString("#------------------ round 1 ------------------\n")
-		}
 
-		if opt.Verbose || opt.Log2File {
-			log.Infof("  number of references in search result: %d", len(profile))
-		}
+				items := pool.Get().(*[]string)
 
-		var c float64
-		var c1 float64
-		var c2 float64
-		var hs []uint64
-		hs = make([]uint64, 0, 10240) // list to delete
-		for h, t := range profile {
-			for _, c1 = range t.UniqMatch {
-				t.SumUniqMatch += c1
-			}
-			if t.SumUniqMatch < 1 { // no enough unique match
-				hs = append(hs, h)
-				if debug {
-					fmt.Fprintf(outfhD, "failed1: %s (%s), 90th percentile: %.2f, %s: %.0f\n",
-						t.Name, taxdb.Name(taxidMap[t.Name]),
-						t.StatsA.Percentile(90),
-						"no enough unique match", t.SumUniqMatch)
+				match, ok, err := parseMatchResult(line, numFields, items, maxFPR, minQcov)
+				if err != nil {
+					pool.Put(items)
+					return nil, false, err
 				}
-				continue
-			}
-
-			for _, c1 = range t.UniqMatchHic {
-				t.SumUniqMatchHic += c1
-			}
-			if t.SumUniqMatchHic < 1 { // no enough high-confidence unique match
-				hs = append(hs, h)
-				if debug {
-					fmt.Fprintf(outfhD, "failed1: %s (%s), 90th percentile: %.2f, %s: %.0f\n",
-						t.Name, taxdb.Name(taxidMap[t.Name]),
-						t.StatsA.Percentile(90),
-						"no enough high-confidence unique match", t.SumUniqMatchHic)
+				if !ok {
+					pool.Put(items)
+					return nil, false, nil
 				}
-				continue
-			}
-
-			// the SumUniqMatchHic may increase later
-
-			// if t.SumUniqMatchHic < t.SumUniqMatch*HicUreadsMinProp {
-			// 	hs = append(hs, h)
-			// 	continue
-			// }
-
-			// ---------------
-
-			for _, c = range t.Match {
-				if c > 0 {
-					t.FragsProp++
+				if sketchCol >= 0 {
+					parseKmerSketch(nthField((*items)[numFields-1], '\t', sketchCol-numFields+1), match)
 				}
-				t.SumMatch += c
-			}
-			t.FragsProp = t.FragsProp / float64(len(t.Match))
-			if t.FragsProp < minFragsProp { // low coverage
-				hs = append(hs, h)
-				if debug {
-					fmt.Fprintf(outfhD, "failed1: %s (%s), 90th percentile: %.2f, %s: %.1f %v\n",
-						t.Name, taxdb.Name(taxidMap[t.Name]),
-						t.StatsA.Percentile(90),
-						"low chunks fraction", t.FragsProp, t.Match)
+				if pairedEnd {
+					match.Query, match.Mate = trimMateSuffix(match.Query)
 				}
-				continue
-			}
-		}
 
-		for _, h := range hs {
-			delete(profile, h)
-		}
-
-		if opt.Verbose || opt.Log2File {
-			log.Infof("  number of estimated references: %d", len(profile))
-			if len(profile) >= 1000 && !noAmbCorr {
-				log.Warningf("  too many candidates detected, the next stage would be very slow")
-				log.Warningf("  the flag --no-amb-corr is recommended to disable ambiguous reads correction which has very little effect on the results")
+				pool.Put(items)
+				return match, true, nil
 			}
-			log.Infof("  elapsed time: %s", time.Since(timeStart1))
-			log.Info()
-		}
 
-		// ---------------------------------------------------------------
-		// stage 2/4, counting ambiguous reads/matches
-		if opt.Verbose || opt.Log2File {
-			log.Infof("stage 2/4: counting ambiguous matches for correcting matches")
-		}
-		timeStart1 = time.Now()
+			var nReads float64
+			var nEvicted int
 
-		// hashA -> hashB -> count
-		ambMatch := make(map[uint64]map[uint64]float64, len(profile))
+			// ---------------------------------------------------------------
+			// stage 1/4
+			if verbose {
+				log.Infof("stage 1/4: counting matches and unique matches for filtering out low-confidence references")
+			}
+			timeStart1 := time.Now()
 
-		if !noAmbCorr {
 			for _, file := range files {
-				if opt.Verbose || opt.Log2File {
+				if verbose {
 					log.Infof("  parsing file: %s", file)
 				}
 
 				var matches map[uint64]*[]*MatchResult // target -> match result
+				var ms *[]*MatchResult
+				var t *Target
 				var ok bool
-				// var ms *[]*MatchResult
-				var hTarget, h, h1, h2 uint64
+				var hTarget, h uint64
 				var prevQuery string
-				hs := make([]uint64, 0, 256)
+				var prevMate uint8
 				var match *MatchResult
-				var amb map[uint64]float64
-				var i, j int
-				var n, np1 int
 
 				onlyTopNScore := topNScore > 0
 				var nScore int
 				var pScore float64
 				var processThisMatch bool
 
+				taxids := make([]uint32, 0, 128)
+				var taxid1, taxid2 uint32
+				var theSameSpecies bool
+
 				reader, err := breader.NewBufferedReader(file, opt.NumCPUs, chunkSize, fn)
-				checkError(err)
+				if err != nil {
+					return err
+				}
 				var data interface{}
 
 				matches = make(map[uint64]*[]*MatchResult)
@@ -1175,38 +1069,59 @@ Examples:
 				nScore = 0
 				processThisMatch = true
 				for chunk := range reader.Ch {
-					checkError(chunk.Err)
+					if chunk.Err != nil {
+						return chunk.Err
+					}
 
 					for _, data = range chunk.Data {
 						match = data.(*MatchResult)
 
-						hTarget = wyhash.HashString(match.Target, 1)
-						if _, ok = profile[hTarget]; !ok { // skip matches of unwanted targets
-							continue
+						if pairedEnd && prevQuery == match.Query && match.Mate != prevMate { // the other mate of a read pair
+							pScore = 1024
+							nScore = 0
+							processThisMatch = true
 						}
+						prevMate = match.Mate
 
 						if prevQuery != match.Query { // new query
-							if len(matches) > 1 { // skip uniq match
-								hs = hs[:0]
-								for h = range matches {
-									hs = append(hs, h)
-								}
+							if pairedEnd {
+								filterDisagreedMates(matches)
+							}
+							nReads++
 
-								sorts.Quicksort(Uint64Slice(hs))
-
-								n = len(hs)
-								np1 = len(hs) - 1
-								for i = 0; i < np1; i++ {
-									for j = i + 1; j < n; j++ {
-										h1, h2 = hs[i], hs[j]
-										if amb, ok = ambMatch[h1]; !ok {
-											tmp := make(map[uint64]float64, 128)
-											tmp[h2]++ // count of cooccurence
-											ambMatch[h1] = tmp
-										} else {
-											amb[h2]++
+							if len(matches) > 0 { // not the first query
+								if levelSpecies {
+									taxids = taxids[:0]
+									for h, ms = range matches {
+										taxid1, ok = taxidMap[(*ms)[0].Target]
+										if !ok {
+											cancelReader(reader)
+											return fmt.Errorf("unknown taxid for %s, please check taxid mapping file(s)", (*ms)[0].Target)
 										}
+										taxids = append(taxids, taxid1)
+									}
+									// LCA
+									theSameSpecies = false
+									taxid1 = taxids[0]
+									for _, taxid2 = range taxids[1:] {
+										taxid1 = taxdb.LCA(taxid1, taxid2)
 									}
+									if taxdb.AtOrBelowRank(taxid1, "species") {
+										theSameSpecies = true
+									}
+								}
+
+								for h, ms = range matches {
+									if t, ok = profile[h]; !ok {
+										t = newTarget((*ms)[0])
+										profile[h] = t
+									}
+									t.CountMatches(*ms, len(matches) == 1 || theSameSpecies, hicUreadsMinQcov)
+									poolMatchResults.Put(ms)
+								}
+
+								if limitTargets && len(profile) > maxTargets {
+									nEvicted += evictLeastAbundantTargets(profile, maxTargets)
 								}
 							}
 
@@ -1214,7 +1129,7 @@ Examples:
 							pScore = 1024
 							nScore = 0
 							processThisMatch = true
-						} else if keepFullMatch {
+						} else if keepFullMatch { // not the first match
 							if !processThisMatch {
 								prevQuery = match.Query
 								continue
@@ -1257,172 +1172,528 @@ Examples:
 							}
 						}
 
-						// just need to collect keys
-						matches[hTarget] = nil
+						hTarget = wyhash.HashString(match.Target, 1)
+						if ms, ok = matches[hTarget]; !ok {
+							// tmp := []*MatchResult{match}
+							tmp := poolMatchResults.Get().(*[]*MatchResult)
+							*tmp = (*tmp)[:0]
+							*tmp = append(*tmp, match)
+							matches[hTarget] = tmp
+						} else {
+							*ms = append(*ms, match)
+						}
 
 						prevQuery = match.Query
 						pScore = match.QCov
 					}
 				}
 
-				if len(matches) > 1 {
-					hs = hs[:0]
-					for h = range matches {
-						hs = append(hs, h)
-					}
-
-					sorts.Quicksort(Uint64Slice(hs))
+				if pairedEnd {
+					filterDisagreedMates(matches)
+				}
+				if len(matches) > 0 {
+					nReads++
 
-					n = len(hs)
-					np1 = len(hs) - 1
-					for i = 0; i < np1; i++ {
-						for j = i + 1; j < n; j++ {
-							h1, h2 = hs[i], hs[j]
-							if amb, ok = ambMatch[h1]; !ok {
-								tmp := make(map[uint64]float64, 128)
-								tmp[h2]++ // count of cooccurence
-								ambMatch[h1] = tmp
-							} else {
-								amb[h2]++
+					if levelSpecies {
+						taxids = taxids[:0]
+						for h, ms = range matches {
+							taxid1, ok = taxidMap[(*ms)[0].Target]
+							if !ok {
+								return fmt.Errorf("unknown taxid for %s, please check taxid mapping file(s)", (*ms)[0].Target)
 							}
+							taxids = append(taxids, taxid1)
+						}
+
+						theSameSpecies = false
+						taxid1 = taxids[0]
+						for _, taxid2 = range taxids[1:] {
+							taxid1 = taxdb.LCA(taxid1, taxid2)
 						}
+						if taxdb.AtOrBelowRank(taxid1, "species") {
+							theSameSpecies = true
+						}
+					}
+
+					for h, ms = range matches {
+						if t, ok = profile[h]; !ok {
+							t = newTarget((*ms)[0])
+							profile[h] = t
+						}
+						t.CountMatches(*ms, len(matches) == 1 || theSameSpecies, hicUreadsMinQcov)
+						poolMatchResults.Put(ms)
+					}
+
+					if limitTargets && len(profile) > maxTargets {
+						nEvicted += evictLeastAbundantTargets(profile, maxTargets)
 					}
 				}
 			}
-		} else if opt.Verbose || opt.Log2File {
-			log.Infof("  skipped by user with the flag --no-amb-corr")
-		}
 
-		if opt.Verbose || opt.Log2File {
-			log.Infof("  elapsed time: %s", time.Since(timeStart1))
-			log.Info()
-		}
+			if nEvicted > 0 {
+				log.Warningf("%d least abundant references were evicted to keep at most %d references in memory (--max-targets), "+
+					"the result might be less accurate", nEvicted, maxTargets)
+			}
 
-		// ---------------------------------------------------------------
-		// stage 3/4
-		if opt.Verbose || opt.Log2File {
-			log.Infof("stage 3/4: recounting matches and unique matches")
-		}
-		timeStart1 = time.Now()
+			// --------------------
+			// sum up #1
 
-		profile2 := make(map[uint64]*Target, len(profile))
+			if debug {
+				outfhD.WriteString("#------------------ round 1 ------------------\n")
+			}
 
-		for _, file := range files {
-			if opt.Verbose || opt.Log2File {
-				log.Infof("  parsing file: %s", file)
+			if verbose {
+				log.Infof("  number of references in search result: %d", len(profile))
 			}
 
-			var matches map[uint64]*[]*MatchResult // target -> match result
-			var m *MatchResult
-			var ms *[]*MatchResult
-			var t *Target
-			var ok bool
-			var hTarget, h, h1, h2 uint64
-			var prevQuery string
-			var floatMsSize float64
-			var uniqMatch bool
-			var first bool
-			hss := make([]uint64, 0, 256) // for sorting hash value of reference
-			hsm := make([]bool, 0, 256)   // marking hash values to delete
-			var n, np1, i, j int
-			var match *MatchResult
-
-			onlyTopNScore := topNScore > 0
-			var nScore int
-			var pScore float64
-			var processThisMatch bool
-
-			taxids := make([]uint32, 0, 128)
-			var taxid1, taxid2 uint32
-			var theSameSpecies bool
-
-			reader, err := breader.NewBufferedReader(file, opt.NumCPUs, chunkSize, fn)
-			checkError(err)
-			var data interface{}
-
-			matches = make(map[uint64]*[]*MatchResult)
-			pScore = 1024
-			nScore = 0
-			processThisMatch = true
-			for chunk := range reader.Ch {
-				checkError(chunk.Err)
-
-				for _, data = range chunk.Data {
-					match = data.(*MatchResult)
-
-					hTarget = wyhash.HashString(match.Target, 1)
-					if _, ok = profile[hTarget]; !ok { // skip matches of unwanted targets
-						continue
+			var c float64
+			var c1 float64
+			var c2 float64
+			var hs []uint64
+			hs = make([]uint64, 0, 10240) // list to delete
+			for h, t := range profile {
+				for _, c1 = range t.UniqMatch {
+					t.SumUniqMatch += c1
+				}
+				if t.SumUniqMatch < 1 { // no enough unique match
+					hs = append(hs, h)
+					if debug {
+						fmt.Fprintf(outfhD, "failed1: %s (%s), 90th percentile: %.2f, %s: %.0f\n",
+							t.Name, taxdb.Name(taxidMap[t.Name]),
+							t.StatsA.Percentile(90),
+							"no enough unique match", t.SumUniqMatch)
+					}
+					continue
+				}
+
+				for _, c1 = range t.UniqMatchHic {
+					t.SumUniqMatchHic += c1
+				}
+				if t.SumUniqMatchHic < 1 { // no enough high-confidence unique match
+					hs = append(hs, h)
+					if debug {
+						fmt.Fprintf(outfhD, "failed1: %s (%s), 90th percentile: %.2f, %s: %.0f\n",
+							t.Name, taxdb.Name(taxidMap[t.Name]),
+							t.StatsA.Percentile(90),
+							"no enough high-confidence unique match", t.SumUniqMatchHic)
+					}
+					continue
+				}
+
+				// the SumUniqMatchHic may increase later
+
+				// if t.SumUniqMatchHic < t.SumUniqMatch*HicUreadsMinProp {
+				// 	hs = append(hs, h)
+				// 	continue
+				// }
+
+				// ---------------
+
+				for _, c = range t.Match {
+					if c > 0 {
+						t.FragsProp++
+					}
+					t.SumMatch += c
+				}
+				t.FragsProp = t.FragsProp / float64(len(t.Match))
+				if t.FragsProp < minFragsProp { // low coverage
+					hs = append(hs, h)
+					if debug {
+						fmt.Fprintf(outfhD, "failed1: %s (%s), 90th percentile: %.2f, %s: %.1f %v\n",
+							t.Name, taxdb.Name(taxidMap[t.Name]),
+							t.StatsA.Percentile(90),
+							"low chunks fraction", t.FragsProp, t.Match)
+					}
+					continue
+				}
+			}
+
+			for _, h := range hs {
+				delete(profile, h)
+			}
+
+			if verbose {
+				log.Infof("  number of estimated references: %d", len(profile))
+				if len(profile) >= 1000 && !noAmbCorr {
+					log.Warningf("  too many candidates detected, the next stage would be very slow")
+					log.Warningf("  the flag --no-amb-corr is recommended to disable ambiguous reads correction which has very little effect on the results")
+				}
+				log.Infof("  elapsed time: %s", time.Since(timeStart1))
+				log.Info()
+			}
+
+			// ---------------------------------------------------------------
+			// stage 2/4, counting ambiguous reads/matches
+			if verbose {
+				log.Infof("stage 2/4: counting ambiguous matches for correcting matches")
+			}
+			timeStart1 = time.Now()
+
+			// hashA -> hashB -> count
+			ambMatch := make(map[uint64]map[uint64]float64, len(profile))
+
+			if !noAmbCorr {
+				for _, file := range files {
+					if verbose {
+						log.Infof("  parsing file: %s", file)
+					}
+
+					var matches map[uint64]*[]*MatchResult // target -> match result
+					var ok bool
+					// var ms *[]*MatchResult
+					var hTarget, h, h1, h2 uint64
+					var prevQuery string
+					var prevMate uint8
+					hs := make([]uint64, 0, 256)
+					var match *MatchResult
+					var amb map[uint64]float64
+					var i, j int
+					var n, np1 int
+
+					onlyTopNScore := topNScore > 0
+					var nScore int
+					var pScore float64
+					var processThisMatch bool
+
+					reader, err := breader.NewBufferedReader(file, opt.NumCPUs, chunkSize, fn)
+					if err != nil {
+						return err
 					}
+					var data interface{}
+
+					matches = make(map[uint64]*[]*MatchResult)
+					pScore = 1024
+					nScore = 0
+					processThisMatch = true
+					for chunk := range reader.Ch {
+						if chunk.Err != nil {
+							return chunk.Err
+						}
+
+						for _, data = range chunk.Data {
+							match = data.(*MatchResult)
+
+							hTarget = wyhash.HashString(match.Target, 1)
+							if _, ok = profile[hTarget]; !ok { // skip matches of unwanted targets
+								continue
+							}
+
+							if pairedEnd && prevQuery == match.Query && match.Mate != prevMate { // the other mate of a read pair
+								pScore = 1024
+								nScore = 0
+								processThisMatch = true
+							}
+							prevMate = match.Mate
+
+							if prevQuery != match.Query { // new query
+								if len(matches) > 1 { // skip uniq match
+									hs = hs[:0]
+									for h = range matches {
+										hs = append(hs, h)
+									}
+
+									sorts.Quicksort(search.Uint64Slice(hs))
+
+									n = len(hs)
+									np1 = len(hs) - 1
+									for i = 0; i < np1; i++ {
+										for j = i + 1; j < n; j++ {
+											h1, h2 = hs[i], hs[j]
+											if amb, ok = ambMatch[h1]; !ok {
+												tmp := make(map[uint64]float64, 128)
+												tmp[h2]++ // count of cooccurence
+												ambMatch[h1] = tmp
+											} else {
+												amb[h2]++
+											}
+										}
+									}
+								}
+
+								matches = make(map[uint64]*[]*MatchResult)
+								pScore = 1024
+								nScore = 0
+								processThisMatch = true
+							} else if keepFullMatch {
+								if !processThisMatch {
+									prevQuery = match.Query
+									continue
+								}
+
+								if pScore == 1 && match.QCov < 1 {
+									processThisMatch = false
+
+									prevQuery = match.Query
+									continue
+								}
+							} else if keepMainMatch && pScore <= 1 {
+								if !processThisMatch {
+									prevQuery = match.Query
+									continue
+								}
 
-					if prevQuery != match.Query {
-						uniqMatch = false
-						if len(matches) > 1 {
-							if !noAmbCorr {
-								hss = hss[:0]
-								hsm = hsm[:0]
-								for h = range matches {
-									hss = append(hss, h)
-									hsm = append(hsm, false)
+								if pScore-match.QCov > maxScoreGap {
+									processThisMatch = false
+
+									prevQuery = match.Query
+									continue
+								}
+							}
+
+							if onlyTopNScore {
+								if !processThisMatch {
+									prevQuery = match.Query
+									continue
 								}
-								sort.Slice(hss, func(i, j int) bool {
-									return (*matches[hss[i]])[0].QCov > (*matches[hss[j]])[0].QCov
-								})
-
-								n = len(hss)
-								np1 = len(hss) - 1
-								for i = 0; i < np1; i++ {
-									if hsm[i] { // deleted
+
+								if match.QCov < pScore { // match with a smaller score
+									nScore++
+									if nScore > topNScore {
+										processThisMatch = false
+
+										prevQuery = match.Query
 										continue
 									}
-									for j = i + 1; j < n; j++ {
-										if hsm[j] { // deleted
+								}
+							}
+
+							// just need to collect keys
+							matches[hTarget] = nil
+
+							prevQuery = match.Query
+							pScore = match.QCov
+						}
+					}
+
+					if len(matches) > 1 {
+						hs = hs[:0]
+						for h = range matches {
+							hs = append(hs, h)
+						}
+
+						sorts.Quicksort(search.Uint64Slice(hs))
+
+						n = len(hs)
+						np1 = len(hs) - 1
+						for i = 0; i < np1; i++ {
+							for j = i + 1; j < n; j++ {
+								h1, h2 = hs[i], hs[j]
+								if amb, ok = ambMatch[h1]; !ok {
+									tmp := make(map[uint64]float64, 128)
+									tmp[h2]++ // count of cooccurence
+									ambMatch[h1] = tmp
+								} else {
+									amb[h2]++
+								}
+							}
+						}
+					}
+				}
+			} else if verbose {
+				log.Infof("  skipped by user with the flag --no-amb-corr")
+			}
+
+			if verbose {
+				log.Infof("  elapsed time: %s", time.Since(timeStart1))
+				log.Info()
+			}
+
+			// ---------------------------------------------------------------
+			// stage 3/4
+			if verbose {
+				log.Infof("stage 3/4: recounting matches and unique matches")
+			}
+			timeStart1 = time.Now()
+
+			profile2 := make(map[uint64]*Target, len(profile))
+
+			for _, file := range files {
+				if hasSketch {
+					sketchCol = kmerSketchCols[file]
+				}
+				if verbose {
+					log.Infof("  parsing file: %s", file)
+				}
+
+				var matches map[uint64]*[]*MatchResult // target -> match result
+				var m *MatchResult
+				var ms *[]*MatchResult
+				var t *Target
+				var ok bool
+				var hTarget, h, h1, h2 uint64
+				var prevQuery string
+				var prevMate uint8
+				var floatMsSize float64
+				var uniqMatch bool
+				var first bool
+				hss := make([]uint64, 0, 256) // for sorting hash value of reference
+				hsm := make([]bool, 0, 256)   // marking hash values to delete
+				var n, np1, i, j int
+				var match *MatchResult
+
+				onlyTopNScore := topNScore > 0
+				var nScore int
+				var pScore float64
+				var processThisMatch bool
+
+				taxids := make([]uint32, 0, 128)
+				var taxid1, taxid2 uint32
+				var theSameSpecies bool
+
+				reader, err := breader.NewBufferedReader(file, opt.NumCPUs, chunkSize, fn)
+				if err != nil {
+					return err
+				}
+				var data interface{}
+
+				matches = make(map[uint64]*[]*MatchResult)
+				pScore = 1024
+				nScore = 0
+				processThisMatch = true
+				for chunk := range reader.Ch {
+					if chunk.Err != nil {
+						return chunk.Err
+					}
+
+					for _, data = range chunk.Data {
+						match = data.(*MatchResult)
+
+						hTarget = wyhash.HashString(match.Target, 1)
+						if _, ok = profile[hTarget]; !ok { // skip matches of unwanted targets
+							continue
+						}
+
+						if pairedEnd && prevQuery == match.Query && match.Mate != prevMate { // the other mate of a read pair
+							pScore = 1024
+							nScore = 0
+							processThisMatch = true
+						}
+						prevMate = match.Mate
+
+						if prevQuery != match.Query {
+							if pairedEnd {
+								filterDisagreedMates(matches)
+							}
+							uniqMatch = false
+							if len(matches) > 1 {
+								if !noAmbCorr {
+									hss = hss[:0]
+									hsm = hsm[:0]
+									for h = range matches {
+										hss = append(hss, h)
+										hsm = append(hsm, false)
+									}
+									sort.Slice(hss, func(i, j int) bool {
+										return (*matches[hss[i]])[0].QCov > (*matches[hss[j]])[0].QCov
+									})
+
+									n = len(hss)
+									np1 = len(hss) - 1
+									for i = 0; i < np1; i++ {
+										if hsm[i] { // deleted
 											continue
 										}
+										for j = i + 1; j < n; j++ {
+											if hsm[j] { // deleted
+												continue
+											}
 
-										h1, h2 = sortTwoUint64s(hss[i], hss[j]) // sort to extract data from ambMatch
-
-										if profile[hss[i]].SumMatch*(1-minDReadsProp) >= ambMatch[h1][h2] &&
-											profile[hss[j]].SumUniqMatch < profile[hss[i]].SumUniqMatch*maxMismatchErr {
-											// remove hss[j]
-											hsm[j] = true
-											// fmt.Println(matches[hss[i]], matches[hss[j]])
-										} else if profile[hss[j]].SumMatch*(1-minDReadsProp) >= ambMatch[h1][h2] &&
-											profile[hss[i]].SumUniqMatch < profile[hss[j]].SumUniqMatch*maxMismatchErr {
-											// remove hss[i]
-											hsm[i] = true
-											// fmt.Println(matches[hss[j]], matches[hss[i]])
+											h1, h2 = sortTwoUint64s(hss[i], hss[j]) // sort to extract data from ambMatch
+
+											if profile[hss[i]].SumMatch*(1-minDReadsProp) >= ambMatch[h1][h2] &&
+												profile[hss[j]].SumUniqMatch < profile[hss[i]].SumUniqMatch*maxMismatchErr {
+												// remove hss[j]
+												hsm[j] = true
+												// fmt.Println(matches[hss[i]], matches[hss[j]])
+											} else if profile[hss[j]].SumMatch*(1-minDReadsProp) >= ambMatch[h1][h2] &&
+												profile[hss[i]].SumUniqMatch < profile[hss[j]].SumUniqMatch*maxMismatchErr {
+												// remove hss[i]
+												hsm[i] = true
+												// fmt.Println(matches[hss[j]], matches[hss[i]])
+											}
 										}
 									}
-								}
-								for i, h = range hss {
-									if hsm[i] {
-										delete(matches, h)
+									for i, h = range hss {
+										if hsm[i] {
+											delete(matches, h)
+										}
 									}
 								}
-							}
 
-							if len(matches) > 1 { // redistribute matches
-								taxids = taxids[:0]
-								if levelSpecies {
-									for h, ms = range matches {
-										taxid1, ok = taxidMap[(*ms)[0].Target]
-										if !ok {
-											checkError(fmt.Errorf("unknown taxid for %s, please check taxid mapping file(s)", (*ms)[0].Target))
+								if len(matches) > 1 { // redistribute matches
+									taxids = taxids[:0]
+									if levelSpecies {
+										for h, ms = range matches {
+											taxid1, ok = taxidMap[(*ms)[0].Target]
+											if !ok {
+												cancelReader(reader)
+												return fmt.Errorf("unknown taxid for %s, please check taxid mapping file(s)", (*ms)[0].Target)
+											}
+											taxids = append(taxids, taxid1)
+										}
+										// LCA
+										theSameSpecies = false
+										taxid1 = taxids[0]
+										for _, taxid2 = range taxids[1:] {
+											taxid1 = taxdb.LCA(taxid1, taxid2)
+										}
+										if taxdb.AtOrBelowRank(taxid1, "species") {
+											theSameSpecies = true
 										}
-										taxids = append(taxids, taxid1)
-									}
-									// LCA
-									theSameSpecies = false
-									taxid1 = taxids[0]
-									for _, taxid2 = range taxids[1:] {
-										taxid1 = taxdb.LCA(taxid1, taxid2)
 									}
-									if taxdb.AtOrBelowRank(taxid1, "species") {
-										theSameSpecies = true
+
+									for h, ms = range matches {
+										floatMsSize = float64(len(*ms))
+										first = true
+										for _, m = range *ms {
+											if t, ok = profile2[h]; !ok {
+												t0 := Target{
+													Name:         m.Target,
+													GenomeSize:   m.GSize,
+													Match:        make([]float64, m.IdxNum),
+													UniqMatch:    make([]float64, m.IdxNum),
+													UniqMatchHic: make([]float64, m.IdxNum),
+													QLen:         make([]float64, m.IdxNum),
+													RelDepth:     make([]float64, m.IdxNum),
+													// Stats:        stats.NewQuantiler(),
+													StatsA: stats.NewQuantiler(),
+												}
+												profile2[h] = &t0
+												t = &t0
+											}
+
+											if first { // count once
+												if levelSpecies && theSameSpecies {
+													t.UniqMatch[m.FragIdx] += floatOne / floatMsSize
+													if m.QCov >= hicUreadsMinQcov {
+														t.UniqMatchHic[m.FragIdx] += floatOne / floatMsSize
+													}
+
+													// t.Stats.Add(m.QCov) // the best match on a subject
+												}
+												t.StatsA.Add(m.QCov)
+
+												first = false
+											}
+
+											t.QLen[m.FragIdx] += float64(m.QLen) / floatMsSize
+
+											// for a read matching multiple regions of a reference, distribute count to multiple regions,
+											// the sum is still one.
+											t.Match[m.FragIdx] += floatOne / floatMsSize
+											if hasSketch {
+												t.AddKmerSketch(m)
+											}
+										}
+										poolMatchResults.Put(ms)
 									}
+								} else { // len(matches) == 1
+									uniqMatch = true
 								}
+							} else if len(matches) == 1 {
+								uniqMatch = true
+							}
 
+							if uniqMatch {
 								for h, ms = range matches {
 									floatMsSize = float64(len(*ms))
 									first = true
@@ -1436,7 +1707,7 @@ Examples:
 												UniqMatchHic: make([]float64, m.IdxNum),
 												QLen:         make([]float64, m.IdxNum),
 												RelDepth:     make([]float64, m.IdxNum),
-												// Stats:        stats.NewQuantiler(),
+												// Stats: stats.NewQuantiler(),
 												StatsA: stats.NewQuantiler(),
 											}
 											profile2[h] = &t0
@@ -1444,15 +1715,15 @@ Examples:
 										}
 
 										if first { // count once
-											if levelSpecies && theSameSpecies {
-												t.UniqMatch[m.FragIdx] += floatOne / floatMsSize
+											if len(matches) == 1 {
+												t.UniqMatch[m.FragIdx]++
 												if m.QCov >= hicUreadsMinQcov {
-													t.UniqMatchHic[m.FragIdx] += floatOne / floatMsSize
+													t.UniqMatchHic[m.FragIdx]++
 												}
 
 												// t.Stats.Add(m.QCov) // the best match on a subject
 											}
-											t.StatsA.Add(m.QCov)
+											t.StatsA.Add(m.QCov) // the best match on a subject
 
 											first = false
 										}
@@ -1462,195 +1733,856 @@ Examples:
 										// for a read matching multiple regions of a reference, distribute count to multiple regions,
 										// the sum is still one.
 										t.Match[m.FragIdx] += floatOne / floatMsSize
+										if hasSketch {
+											t.AddKmerSketch(m)
+										}
 									}
 									poolMatchResults.Put(ms)
 								}
-							} else { // len(matches) == 1
-								uniqMatch = true
 							}
-						} else if len(matches) == 1 {
-							uniqMatch = true
-						}
-
-						if uniqMatch {
-							for h, ms = range matches {
-								floatMsSize = float64(len(*ms))
-								first = true
-								for _, m = range *ms {
-									if t, ok = profile2[h]; !ok {
-										t0 := Target{
-											Name:         m.Target,
-											GenomeSize:   m.GSize,
-											Match:        make([]float64, m.IdxNum),
-											UniqMatch:    make([]float64, m.IdxNum),
-											UniqMatchHic: make([]float64, m.IdxNum),
-											QLen:         make([]float64, m.IdxNum),
-											RelDepth:     make([]float64, m.IdxNum),
-											// Stats: stats.NewQuantiler(),
-											StatsA: stats.NewQuantiler(),
-										}
-										profile2[h] = &t0
-										t = &t0
-									}
 
-									if first { // count once
-										if len(matches) == 1 {
-											t.UniqMatch[m.FragIdx]++
-											if m.QCov >= hicUreadsMinQcov {
-												t.UniqMatchHic[m.FragIdx]++
-											}
+							matches = make(map[uint64]*[]*MatchResult)
+							pScore = 1024
+							nScore = 0
+							processThisMatch = true
+						} else if keepFullMatch {
+							if !processThisMatch {
+								prevQuery = match.Query
+								continue
+							}
 
-											// t.Stats.Add(m.QCov) // the best match on a subject
-										}
-										t.StatsA.Add(m.QCov) // the best match on a subject
+							if pScore == 1 && match.QCov < 1 {
+								processThisMatch = false
 
-										first = false
-									}
+								prevQuery = match.Query
+								continue
+							}
+						} else if keepMainMatch && pScore <= 1 {
+							if !processThisMatch {
+								prevQuery = match.Query
+								continue
+							}
 
-									t.QLen[m.FragIdx] += float64(m.QLen) / floatMsSize
+							if pScore-match.QCov > maxScoreGap {
+								processThisMatch = false
 
-									// for a read matching multiple regions of a reference, distribute count to multiple regions,
-									// the sum is still one.
-									t.Match[m.FragIdx] += floatOne / floatMsSize
-								}
-								poolMatchResults.Put(ms)
+								prevQuery = match.Query
+								continue
 							}
 						}
 
-						matches = make(map[uint64]*[]*MatchResult)
-						pScore = 1024
-						nScore = 0
-						processThisMatch = true
-					} else if keepFullMatch {
-						if !processThisMatch {
-							prevQuery = match.Query
-							continue
-						}
+						if onlyTopNScore {
+							if !processThisMatch {
+								prevQuery = match.Query
+								continue
+							}
 
-						if pScore == 1 && match.QCov < 1 {
-							processThisMatch = false
+							if match.QCov < pScore { // match with a smaller score
+								nScore++
+								if nScore > topNScore {
+									processThisMatch = false
 
-							prevQuery = match.Query
-							continue
-						}
-					} else if keepMainMatch && pScore <= 1 {
-						if !processThisMatch {
-							prevQuery = match.Query
-							continue
+									prevQuery = match.Query
+									continue
+								}
+							}
 						}
 
-						if pScore-match.QCov > maxScoreGap {
-							processThisMatch = false
-
-							prevQuery = match.Query
-							continue
+						if ms, ok = matches[hTarget]; !ok {
+							// tmp := []*MatchResult{match}
+							tmp := poolMatchResults.Get().(*[]*MatchResult)
+							*tmp = (*tmp)[:0]
+							*tmp = append(*tmp, match)
+							matches[hTarget] = tmp
+						} else {
+							*ms = append(*ms, match)
 						}
+
+						prevQuery = match.Query
+						pScore = match.QCov
 					}
+				}
 
-					if onlyTopNScore {
-						if !processThisMatch {
-							prevQuery = match.Query
-							continue
+				if pairedEnd {
+					filterDisagreedMates(matches)
+				}
+				uniqMatch = false
+				if len(matches) > 1 {
+					if !noAmbCorr {
+						hss = hss[:0]
+						hsm = hsm[:0]
+						for h = range matches {
+							hss = append(hss, h)
+							hsm = append(hsm, false)
 						}
+						sort.Slice(hss, func(i, j int) bool {
+							return (*matches[hss[i]])[0].QCov > (*matches[hss[j]])[0].QCov
+						})
+
+						n = len(hss)
+						np1 = len(hss) - 1
+						for i = 0; i < np1; i++ {
+							if hsm[i] { // deleted
+								continue
+							}
+							for j = i + 1; j < n; j++ {
+								if hsm[j] { // deleted
+									continue
+								}
+
+								h1, h2 = sortTwoUint64s(hss[i], hss[j]) // sort to extract data from ambMatch
+
+								if profile[hss[i]].SumMatch*(1-minDReadsProp) >= ambMatch[h1][h2] &&
+									profile[hss[j]].SumUniqMatch < profile[hss[i]].SumUniqMatch*maxMismatchErr {
+									// remove hss[j]
+									hsm[j] = true
+									// fmt.Println(matches[hss[i]], matches[hss[j]])
+								} else if profile[hss[j]].SumMatch*(1-minDReadsProp) >= ambMatch[h1][h2] &&
+									profile[hss[i]].SumUniqMatch < profile[hss[j]].SumUniqMatch*maxMismatchErr {
+									// remove hss[i]
+									hsm[i] = true
+									// fmt.Println(matches[hss[j]], matches[hss[i]])
+								}
+							}
+						}
+						for i, h = range hss {
+							if hsm[i] {
+								delete(matches, h)
+							}
+						}
+					}
+
+					if len(matches) > 1 { // redistribute matches
+						taxids = taxids[:0]
+						if levelSpecies {
+							for h, ms = range matches {
+								taxid1, ok = taxidMap[(*ms)[0].Target]
+								if !ok {
+									return fmt.Errorf("unknown taxid for %s, please check taxid mapping file(s)", (*ms)[0].Target)
+								}
+								taxids = append(taxids, taxid1)
+							}
+							// LCA
+							theSameSpecies = false
+							taxid1 = taxids[0]
+							for _, taxid2 = range taxids[1:] {
+								taxid1 = taxdb.LCA(taxid1, taxid2)
+							}
+							if taxdb.AtOrBelowRank(taxid1, "species") {
+								theSameSpecies = true
+							}
+						}
+
+						for h, ms = range matches {
+							floatMsSize = float64(len(*ms))
+							first = true
+							for _, m = range *ms {
+								if t, ok = profile2[h]; !ok {
+									t0 := Target{
+										Name:         m.Target,
+										GenomeSize:   m.GSize,
+										Match:        make([]float64, m.IdxNum),
+										UniqMatch:    make([]float64, m.IdxNum),
+										UniqMatchHic: make([]float64, m.IdxNum),
+										QLen:         make([]float64, m.IdxNum),
+										RelDepth:     make([]float64, m.IdxNum),
+										// Stats:        stats.NewQuantiler(),
+										StatsA: stats.NewQuantiler(),
+									}
+									profile2[h] = &t0
+									t = &t0
+								}
+
+								if first { // count once
+									if levelSpecies && theSameSpecies {
+										t.UniqMatch[m.FragIdx] += floatOne / floatMsSize
+										if m.QCov >= hicUreadsMinQcov {
+											t.UniqMatchHic[m.FragIdx] += floatOne / floatMsSize
+										}
+
+										// t.Stats.Add(m.QCov) // the best match on a subject
+									}
+									t.StatsA.Add(m.QCov) // the best match on a subject
+
+									first = false
+								}
+
+								t.QLen[m.FragIdx] += float64(m.QLen) / floatMsSize
+
+								// for a read matching multiple regions of a reference, distribute count to multiple regions,
+								// the sum is still one.
+								t.Match[m.FragIdx] += floatOne / floatMsSize
+								if hasSketch {
+									t.AddKmerSketch(m)
+								}
+							}
+							poolMatchResults.Put(ms)
+						}
+					} else { // len(matches) == 1
+						uniqMatch = true
+					}
+				} else if len(matches) == 1 {
+					uniqMatch = true
+				}
+
+				if uniqMatch {
+					for h, ms = range matches {
+						floatMsSize = float64(len(*ms))
+						first = true
+						for _, m = range *ms {
+							if t, ok = profile2[h]; !ok {
+								t0 := Target{
+									Name:         m.Target,
+									GenomeSize:   m.GSize,
+									Match:        make([]float64, m.IdxNum),
+									UniqMatch:    make([]float64, m.IdxNum),
+									UniqMatchHic: make([]float64, m.IdxNum),
+									QLen:         make([]float64, m.IdxNum),
+									RelDepth:     make([]float64, m.IdxNum),
+									// Stats:        stats.NewQuantiler(),
+									StatsA: stats.NewQuantiler(),
+								}
+								profile2[h] = &t0
+								t = &t0
+							}
+
+							if first { // count once
+								if len(matches) == 1 {
+									t.UniqMatch[m.FragIdx]++
+									if m.QCov >= hicUreadsMinQcov {
+										t.UniqMatchHic[m.FragIdx]++
+									}
+
+									// t.Stats.Add(m.QCov) // the best match on a subject
+								}
+								t.StatsA.Add(m.QCov) // the best match on a subject
+
+								first = false
+							}
+
+							t.QLen[m.FragIdx] += float64(m.QLen) / floatMsSize
+
+							// for a read matching multiple regions of a reference, distribute count to multiple regions,
+							// the sum is still one.
+							t.Match[m.FragIdx] += floatOne / floatMsSize
+							if hasSketch {
+								t.AddKmerSketch(m)
+							}
+						}
+						poolMatchResults.Put(ms)
+					}
+				}
+			}
+
+			// --------------------
+			// sum up #3
+
+			if debug {
+				outfhD.WriteString("\n\n")
+				outfhD.WriteString("#------------------ round 2 ------------------\n")
+			}
+
+			hs = make([]uint64, 0, len(profile)) // list to delete
+			for h, t := range profile2 {
+				for _, c1 = range t.UniqMatch {
+					t.SumUniqMatch += c1
+				}
+				if t.SumUniqMatch < minUReads {
+					hs = append(hs, h)
+					if debug {
+						fmt.Fprintf(outfhD, "failed2: %s (%s), 90th percentile: %.2f, %s: %.0f\n",
+							t.Name, taxdb.Name(taxidMap[t.Name]),
+							t.StatsA.Percentile(90),
+							"no enough unique match", t.SumUniqMatch)
+					}
+					continue
+				}
+
+				for _, c1 = range t.UniqMatchHic {
+					t.SumUniqMatchHic += c1
+				}
+				if t.SumUniqMatchHic < minHicUreads {
+					hs = append(hs, h)
+					if debug {
+						fmt.Fprintf(outfhD, "failed2: %s (%s), 90th percentile: %.2f, %s: %.0f\n",
+							t.Name, taxdb.Name(taxidMap[t.Name]),
+							t.StatsA.Percentile(90),
+							"no enough high-confidence unique match", t.SumUniqMatchHic)
+					}
+					continue
+				}
+
+				if t.SumUniqMatchHic < HicUreadsMinProp*t.SumUniqMatch {
+					hs = append(hs, h)
+					if debug {
+						fmt.Fprintf(outfhD, "failed2: %s (%s), 90th percentile: %.2f, %s: %.4f (%.0f/%.0f)\n",
+							t.Name, taxdb.Name(taxidMap[t.Name]),
+							t.StatsA.Percentile(90),
+							"no enough high-confidence unique match proportion", t.SumUniqMatchHic/t.SumUniqMatch, t.SumUniqMatchHic, t.SumUniqMatch)
+					}
+					continue
+				}
+
+				// ----------------------
+
+				for _, c = range t.Match {
+					if c >= minReads {
+						t.FragsProp++
+					}
+					t.SumMatch += c
+				}
+				t.FragsProp = t.FragsProp / float64(len(t.Match))
+				if t.FragsProp < minFragsProp {
+					hs = append(hs, h)
+					if debug {
+						fmt.Fprintf(outfhD, "failed2: %s (%s), 90th percentile: %.2f, %s: %.1f %v\n",
+							t.Name, taxdb.Name(taxidMap[t.Name]),
+							t.StatsA.Percentile(90),
+							"low chunks fraction", t.FragsProp, t.Match)
+					}
+					continue
+				}
+
+				t.Qlens = 0
+				for _, c2 = range t.QLen {
+					t.Qlens += c2
+				}
+				for i, c2 := range t.QLen {
+					t.RelDepth[i] = c2 / t.Qlens * float64(len(t.QLen))
+				}
+
+				_, t.RelDepthStd = MeanStdev(t.RelDepth)
+				if t.RelDepthStd > maxFragsDepthStdev {
+					hs = append(hs, h)
+					if debug {
+						fmt.Fprintf(outfhD, "failed2: %s (%s), 90th percentile: %.2f, %s: %f\n",
+							t.Name, taxdb.Name(taxidMap[t.Name]),
+							t.StatsA.Percentile(90),
+							"high FragsDepthStdev", t.RelDepthStd)
+					}
+					continue
+				}
+
+			}
+
+			for _, h := range hs {
+				delete(profile2, h)
+			}
+
+			if verbose {
+				log.Infof("  number of estimated references: %d", len(profile2))
+				log.Infof("  elapsed time: %s", time.Since(timeStart1))
+				log.Info()
+			}
+
+			// ---------------------------------------------------------------
+			sketchCol = -1
+
+			// stage 4/4
+			if verbose {
+				log.Infof("stage 4/4: computing profile")
+			}
+			timeStart1 = time.Now()
+
+			var outfhB *bufio.Writer
+			var gwB io.WriteCloser
+			var wB *os.File
+			var nB uint64
+			if outputBinningResult {
+				outfhB, gwB, wB, err = outStream(outs.binning, strings.HasSuffix(strings.ToLower(outs.binning), ".gz"), opt.CompressionLevel)
+				if err != nil {
+					return err
+				}
+				defer func() {
+					outfhB.Flush()
+					if gwB != nil {
+						gwB.Close()
+					}
+					wB.Close()
+				}()
+
+				outfhB.WriteString("# This is the bioboxes.org binning output format at\n")
+				outfhB.WriteString("# https://github.com/bioboxes/rfc/tree/master/data-format\n")
+				outfhB.WriteString("@Version:0.10.0\n")
+				outfhB.WriteString(fmt.Sprintf("@SampleID:%s\n", outs.sampleID))
+				outfhB.WriteString("@@SEQUENCEID	TAXID	BINID\n")
+			}
+
+			// with --min-uniq-frags-prop, reads are reassigned among the references
+			// passing the filter in a second pass, where the binning result is written.
+			var secondPass bool
+			var writeBinning bool
+			var nUniqFragsFiltered int
+
+		STAGE4:
+			writeBinning = outputBinningResult && (minUniqFragsProp == 0 || secondPass)
+
+			// abundances estimated with the EM algorithm for redistributing ambiguous reads
+			var emAbund map[uint64]float64
+			if useEM {
+				if verbose {
+					log.Infof("  estimating abundances with the EM algorithm")
+				}
+
+				ecs := newEquivalenceClasses()
+				hs := make([]uint64, 0, 128)
+				for _, file := range files {
+					var match *MatchResult
+					var hTarget uint64
+					var ok bool
+					var prevQuery string
+					var prevMate uint8
+					var nScore int
+					pScore := float64(1024)
+					processThisMatch := true
+					onlyTopNScore := topNScore > 0
+
+					reader, err := breader.NewBufferedReader(file, opt.NumCPUs, chunkSize, fn)
+					if err != nil {
+						return err
+					}
+
+					for chunk := range reader.Ch {
+						if chunk.Err != nil {
+							return chunk.Err
+						}
+
+						for _, data := range chunk.Data {
+							match = data.(*MatchResult)
+
+							hTarget = wyhash.HashString(match.Target, 1)
+							if _, ok = profile2[hTarget]; !ok { // skip matches of unwanted targets
+								continue
+							}
+
+							if pairedEnd && prevQuery == match.Query && match.Mate != prevMate { // the other mate of a read pair
+								pScore = 1024
+								nScore = 0
+								processThisMatch = true
+							}
+							prevMate = match.Mate
+
+							if prevQuery != match.Query {
+								ecs.Add(hs)
+								hs = hs[:0]
+								pScore = 1024
+								nScore = 0
+								processThisMatch = true
+							} else if keepFullMatch {
+								if !processThisMatch || (pScore == 1 && match.QCov < 1) {
+									processThisMatch = false
+									prevQuery = match.Query
+									continue
+								}
+							} else if keepMainMatch && pScore <= 1 {
+								if !processThisMatch || pScore-match.QCov > maxScoreGap {
+									processThisMatch = false
+									prevQuery = match.Query
+									continue
+								}
+							}
+
+							if onlyTopNScore {
+								if !processThisMatch {
+									prevQuery = match.Query
+									continue
+								}
+
+								if match.QCov < pScore { // match with a smaller score
+									nScore++
+									if nScore > topNScore {
+										processThisMatch = false
+										prevQuery = match.Query
+										continue
+									}
+								}
+							}
+
+							hs = append(hs, hTarget)
+							prevQuery = match.Query
+							pScore = match.QCov
+						}
+					}
+					ecs.Add(hs)
+					hs = hs[:0]
+				}
+
+				var iters int
+				var converged bool
+				emAbund, iters, converged = ecs.EM(emMaxIter, emTol)
+				if !converged {
+					log.Warningf("  the EM algorithm did not converge in %d iterations", iters)
+				} else if verbose {
+					log.Infof("  the EM algorithm converged in %d iterations, %d read classes", iters, len(ecs.classes))
+				}
+			}
+
+			profile3 := make(map[uint64]*Target, len(profile2))
+
+			var nAssignedReads float64
+
+			for _, file := range files {
+				if verbose {
+					log.Infof("  parsing file: %s", file)
+				}
+
+				var matches map[uint64]*[]*MatchResult // target -> match result
+				var m *MatchResult
+				var ms *[]*MatchResult
+				var t, t1 *Target
+				var ok bool
+				var hTarget, h uint64
+				var prevQuery string
+				var prevMate uint8
+				var floatMsSize float64
+				var uniqMatch bool
+				var first bool
+				var sumUReads, prop float64
+				var uregionProp float64
+				var match *MatchResult
+
+				onlyTopNScore := topNScore > 0
+				var nScore int
+				var pScore float64
+				var processThisMatch bool
+
+				taxids := make([]uint32, 0, 128)
+				var taxid1, taxid2 uint32
+				var theSameSpecies bool
+
+				reader, err := breader.NewBufferedReader(file, opt.NumCPUs, chunkSize, fn)
+				if err != nil {
+					return err
+				}
+				var data interface{}
+
+				matches = make(map[uint64]*[]*MatchResult)
+				pScore = 1024
+				nScore = 0
+				processThisMatch = true
+				for chunk := range reader.Ch {
+					if chunk.Err != nil {
+						return chunk.Err
+					}
+
+					for _, data = range chunk.Data {
+						match = data.(*MatchResult)
+
+						hTarget = wyhash.HashString(match.Target, 1)
+						if _, ok = profile2[hTarget]; !ok { // skip matches of unwanted targets
+							continue
+						}
+
+						if pairedEnd && prevQuery == match.Query && match.Mate != prevMate { // the other mate of a read pair
+							pScore = 1024
+							nScore = 0
+							processThisMatch = true
+						}
+						prevMate = match.Mate
+
+						if prevQuery != match.Query {
+							if pairedEnd {
+								filterDisagreedMates(matches)
+							}
+							nAssignedReads++
+							uniqMatch = false
+							if len(matches) > 1 { // redistribute matches
+								sumUReads = 0
+
+								taxids = taxids[:0]
+								for h, ms = range matches {
+									// consider unique sequence proportion of references.
+									if emAbund != nil {
+										sumUReads += emAbund[h]
+									} else if considerUregionProp {
+										if uregionProp, ok = uregionPropMap[profile2[h].Name]; ok {
+											sumUReads += profile2[h].SumUniqMatch / uregionProp
+										} else {
+											sumUReads += profile2[h].SumUniqMatch
+										}
+									} else {
+										sumUReads += profile2[h].SumUniqMatch
+									}
+
+									if mappingTaxids {
+										taxid1, ok = taxidMap[(*ms)[0].Target]
+										if !ok {
+											cancelReader(reader)
+											return fmt.Errorf("unknown taxid for %s, please check taxid mapping file(s)", (*ms)[0].Target)
+										}
+										taxids = append(taxids, taxid1)
+									}
+								}
+
+								if mappingTaxids {
+									// LCA
+									theSameSpecies = false
+									taxid1 = taxids[0]
+									for _, taxid2 = range taxids[1:] {
+										taxid1 = taxdb.LCA(taxid1, taxid2)
+									}
+
+									if levelSpecies && taxdb.AtOrBelowRank(taxid1, "species") {
+										theSameSpecies = true
+									}
+
+									if writeBinning {
+										outfhB.WriteString(fmt.Sprintf("%s\t%d\t%d\n", prevQuery, taxid1, taxid1))
+										nB++
+									}
+								}
+
+								for h, ms = range matches {
+									floatMsSize = float64(len(*ms))
+									first = true
+									t1 = profile2[h]
+
+									// consider unique sequence proportion of references.
+									if emAbund != nil {
+										prop = emAbund[h] / sumUReads
+									} else if considerUregionProp {
+										if uregionProp, ok = uregionPropMap[t1.Name]; ok {
+											prop = t1.SumUniqMatch / uregionProp / sumUReads
+										} else {
+											prop = t1.SumUniqMatch / sumUReads
+										}
+									} else {
+										prop = t1.SumUniqMatch / sumUReads
+									}
+
+									for _, m = range *ms {
+										if t, ok = profile3[h]; !ok {
+											t0 := Target{
+												Name:         m.Target,
+												GenomeSize:   m.GSize,
+												Match:        make([]float64, m.IdxNum),
+												UniqMatch:    make([]float64, m.IdxNum),
+												UniqMatchHic: make([]float64, m.IdxNum),
+												QLen:         make([]float64, m.IdxNum),
+												RelDepth:     make([]float64, m.IdxNum),
+												Stats:        stats.NewQuantiler(),
+												StatsA:       stats.NewQuantiler(),
+											}
+											profile3[h] = &t0
+											t = &t0
+										}
+
+										if first { // count once
+											if levelSpecies && theSameSpecies {
+												t.Stats.Add(m.QCov) // the best match on a subject
+												if saveState {
+													t.QCovs = append(t.QCovs, m.QCov)
+												}
+											}
+											first = false
+
+											t.StatsA.Add(m.QCov)
+										}
+
+										t.QLen[m.FragIdx] += float64(m.QLen) * prop / floatMsSize
+										t.Match[m.FragIdx] += prop / floatMsSize
+										t.SumMKmers += float64(m.MKmers) * prop / floatMsSize
+
+										if levelSpecies && theSameSpecies {
+											t.UniqMatch[m.FragIdx] += prop / floatMsSize
+											if m.QCov >= hicUreadsMinQcov {
+												t.UniqMatchHic[m.FragIdx] += prop / floatMsSize
+											}
+										}
+									}
+									poolMatchResults.Put(ms)
+								}
+
+								uniqMatch = false
+							} else if len(matches) == 1 {
+								uniqMatch = true
+							} else {
+								// should not happen here, but it may happen out the main loop
+							}
+
+							if uniqMatch {
+								for h, ms = range matches {
+									floatMsSize = float64(len(*ms))
+									first = true
+									for _, m = range *ms {
+										if t, ok = profile3[h]; !ok {
+											t0 := Target{
+												Name:         m.Target,
+												GenomeSize:   m.GSize,
+												Match:        make([]float64, m.IdxNum),
+												UniqMatch:    make([]float64, m.IdxNum),
+												UniqMatchHic: make([]float64, m.IdxNum),
+												QLen:         make([]float64, m.IdxNum),
+												RelDepth:     make([]float64, m.IdxNum),
+												Stats:        stats.NewQuantiler(),
+												StatsA:       stats.NewQuantiler(),
+											}
+											profile3[h] = &t0
+											t = &t0
+										}
+
+										if first { // count once
+											if len(matches) == 1 {
+												t.UniqMatch[m.FragIdx]++
+												if m.QCov >= hicUreadsMinQcov {
+													t.UniqMatchHic[m.FragIdx]++
+												}
+												t.Stats.Add(m.QCov) // the best match on a subject
+												if saveState {
+													t.QCovs = append(t.QCovs, m.QCov)
+												}
+											}
+
+											t.StatsA.Add(m.QCov)
+											first = false
+
+											if writeBinning {
+												outfhB.WriteString(fmt.Sprintf("%s\t%d\t%s\n", prevQuery, taxidMap[m.Target], m.Target))
+												nB++
+											}
+										}
+
+										t.QLen[m.FragIdx] += float64(m.QLen) / floatMsSize
+
+										t.Match[m.FragIdx] += floatOne / floatMsSize
+										t.SumMKmers += float64(m.MKmers) / floatMsSize
+									}
+									poolMatchResults.Put(ms)
+								}
+							}
+
+							matches = make(map[uint64]*[]*MatchResult)
+							pScore = 1024
+							nScore = 0
+							processThisMatch = true
+						} else if keepFullMatch {
+							if !processThisMatch {
+								prevQuery = match.Query
+								continue
+							}
 
-						if match.QCov < pScore { // match with a smaller score
-							nScore++
-							if nScore > topNScore {
+							if pScore == 1 && match.QCov < 1 {
 								processThisMatch = false
 
 								prevQuery = match.Query
 								continue
 							}
-						}
-					}
-
-					if ms, ok = matches[hTarget]; !ok {
-						// tmp := []*MatchResult{match}
-						tmp := poolMatchResults.Get().(*[]*MatchResult)
-						*tmp = (*tmp)[:0]
-						*tmp = append(*tmp, match)
-						matches[hTarget] = tmp
-					} else {
-						*ms = append(*ms, match)
-					}
-
-					prevQuery = match.Query
-					pScore = match.QCov
-				}
-			}
+						} else if keepMainMatch && pScore <= 1 {
+							if !processThisMatch {
+								prevQuery = match.Query
+								continue
+							}
 
-			uniqMatch = false
-			if len(matches) > 1 {
-				if !noAmbCorr {
-					hss = hss[:0]
-					hsm = hsm[:0]
-					for h = range matches {
-						hss = append(hss, h)
-						hsm = append(hsm, false)
-					}
-					sort.Slice(hss, func(i, j int) bool {
-						return (*matches[hss[i]])[0].QCov > (*matches[hss[j]])[0].QCov
-					})
+							if pScore-match.QCov > maxScoreGap {
+								processThisMatch = false
 
-					n = len(hss)
-					np1 = len(hss) - 1
-					for i = 0; i < np1; i++ {
-						if hsm[i] { // deleted
-							continue
+								prevQuery = match.Query
+								continue
+							}
 						}
-						for j = i + 1; j < n; j++ {
-							if hsm[j] { // deleted
+
+						if onlyTopNScore {
+							if !processThisMatch {
+								prevQuery = match.Query
 								continue
 							}
 
-							h1, h2 = sortTwoUint64s(hss[i], hss[j]) // sort to extract data from ambMatch
-
-							if profile[hss[i]].SumMatch*(1-minDReadsProp) >= ambMatch[h1][h2] &&
-								profile[hss[j]].SumUniqMatch < profile[hss[i]].SumUniqMatch*maxMismatchErr {
-								// remove hss[j]
-								hsm[j] = true
-								// fmt.Println(matches[hss[i]], matches[hss[j]])
-							} else if profile[hss[j]].SumMatch*(1-minDReadsProp) >= ambMatch[h1][h2] &&
-								profile[hss[i]].SumUniqMatch < profile[hss[j]].SumUniqMatch*maxMismatchErr {
-								// remove hss[i]
-								hsm[i] = true
-								// fmt.Println(matches[hss[j]], matches[hss[i]])
+							if match.QCov < pScore { // match with a smaller score
+								nScore++
+								if nScore > topNScore {
+									processThisMatch = false
+
+									prevQuery = match.Query
+									continue
+								}
 							}
 						}
-					}
-					for i, h = range hss {
-						if hsm[i] {
-							delete(matches, h)
+
+						if ms, ok = matches[hTarget]; !ok {
+							// tmp := []*MatchResult{match}
+							tmp := poolMatchResults.Get().(*[]*MatchResult)
+							*tmp = (*tmp)[:0]
+							*tmp = append(*tmp, match)
+							matches[hTarget] = tmp
+						} else {
+							*ms = append(*ms, match)
 						}
+
+						prevQuery = match.Query
+						pScore = match.QCov
 					}
 				}
 
+				if pairedEnd {
+					filterDisagreedMates(matches)
+				}
+				nAssignedReads++
+				uniqMatch = false
 				if len(matches) > 1 { // redistribute matches
+					sumUReads = 0
+
 					taxids = taxids[:0]
-					if levelSpecies {
-						for h, ms = range matches {
+					for h, ms = range matches {
+						// consider unique sequence proportion of references.
+						if emAbund != nil {
+							sumUReads += emAbund[h]
+						} else if considerUregionProp {
+							if uregionProp, ok = uregionPropMap[profile2[h].Name]; ok {
+								sumUReads += profile2[h].SumUniqMatch / uregionProp
+							} else {
+								sumUReads += profile2[h].SumUniqMatch
+							}
+						} else {
+							sumUReads += profile2[h].SumUniqMatch
+						}
+
+						if mappingTaxids {
 							taxid1, ok = taxidMap[(*ms)[0].Target]
 							if !ok {
-								checkError(fmt.Errorf("unknown taxid for %s, please check taxid mapping file(s)", (*ms)[0].Target))
+								return fmt.Errorf("unknown taxid for %s, please check taxid mapping file(s)", (*ms)[0].Target)
 							}
 							taxids = append(taxids, taxid1)
 						}
+					}
+
+					if mappingTaxids {
 						// LCA
 						theSameSpecies = false
 						taxid1 = taxids[0]
 						for _, taxid2 = range taxids[1:] {
 							taxid1 = taxdb.LCA(taxid1, taxid2)
 						}
-						if taxdb.AtOrBelowRank(taxid1, "species") {
+
+						if levelSpecies && taxdb.AtOrBelowRank(taxid1, "species") {
 							theSameSpecies = true
 						}
+
+						if writeBinning {
+							outfhB.WriteString(fmt.Sprintf("%s\t%d\t%d\n", prevQuery, taxid1, taxid1))
+							nB++
+						}
 					}
 
 					for h, ms = range matches {
 						floatMsSize = float64(len(*ms))
 						first = true
+						t1 = profile2[h]
+
+						// consider unique sequence proportion of references.
+						if emAbund != nil {
+							prop = emAbund[h] / sumUReads
+						} else if considerUregionProp {
+							if uregionProp, ok = uregionPropMap[t1.Name]; ok {
+								prop = t1.SumUniqMatch / uregionProp / sumUReads
+							} else {
+								prop = t1.SumUniqMatch / sumUReads
+							}
+						} else {
+							prop = t1.SumUniqMatch / sumUReads
+						}
+
 						for _, m = range *ms {
-							if t, ok = profile2[h]; !ok {
+							if t, ok = profile3[h]; !ok {
 								t0 := Target{
 									Name:         m.Target,
 									GenomeSize:   m.GSize,
@@ -1659,1033 +2591,806 @@ Examples:
 									UniqMatchHic: make([]float64, m.IdxNum),
 									QLen:         make([]float64, m.IdxNum),
 									RelDepth:     make([]float64, m.IdxNum),
-									// Stats:        stats.NewQuantiler(),
-									StatsA: stats.NewQuantiler(),
+									Stats:        stats.NewQuantiler(),
+									StatsA:       stats.NewQuantiler(),
 								}
-								profile2[h] = &t0
+								profile3[h] = &t0
 								t = &t0
 							}
 
 							if first { // count once
 								if levelSpecies && theSameSpecies {
-									t.UniqMatch[m.FragIdx] += floatOne / floatMsSize
-									if m.QCov >= hicUreadsMinQcov {
-										t.UniqMatchHic[m.FragIdx] += floatOne / floatMsSize
+									t.Stats.Add(m.QCov) // the best match on a subject
+									if saveState {
+										t.QCovs = append(t.QCovs, m.QCov)
 									}
-
-									// t.Stats.Add(m.QCov) // the best match on a subject
 								}
-								t.StatsA.Add(m.QCov) // the best match on a subject
-
 								first = false
+								t.StatsA.Add(m.QCov)
 							}
 
-							t.QLen[m.FragIdx] += float64(m.QLen) / floatMsSize
+							t.QLen[m.FragIdx] += float64(m.QLen) * prop / floatMsSize
+							t.Match[m.FragIdx] += prop / floatMsSize
+							t.SumMKmers += float64(m.MKmers) * prop / floatMsSize
 
-							// for a read matching multiple regions of a reference, distribute count to multiple regions,
-							// the sum is still one.
-							t.Match[m.FragIdx] += floatOne / floatMsSize
+							if levelSpecies && theSameSpecies {
+								t.UniqMatch[m.FragIdx] += prop / floatMsSize
+								if m.QCov >= hicUreadsMinQcov {
+									t.UniqMatchHic[m.FragIdx] += prop / floatMsSize
+								}
+							}
 						}
 						poolMatchResults.Put(ms)
 					}
-				} else { // len(matches) == 1
+
+					uniqMatch = false
+				} else if len(matches) == 1 {
 					uniqMatch = true
+				} else {
+					// should not happen here, but it may happen out the main loop
 				}
-			} else if len(matches) == 1 {
-				uniqMatch = true
-			}
-
-			if uniqMatch {
-				for h, ms = range matches {
-					floatMsSize = float64(len(*ms))
-					first = true
-					for _, m = range *ms {
-						if t, ok = profile2[h]; !ok {
-							t0 := Target{
-								Name:         m.Target,
-								GenomeSize:   m.GSize,
-								Match:        make([]float64, m.IdxNum),
-								UniqMatch:    make([]float64, m.IdxNum),
-								UniqMatchHic: make([]float64, m.IdxNum),
-								QLen:         make([]float64, m.IdxNum),
-								RelDepth:     make([]float64, m.IdxNum),
-								// Stats:        stats.NewQuantiler(),
-								StatsA: stats.NewQuantiler(),
+
+				if uniqMatch {
+					for h, ms = range matches {
+						floatMsSize = float64(len(*ms))
+						first = true
+						for _, m = range *ms {
+							if t, ok = profile3[h]; !ok {
+								t0 := Target{
+									Name:         m.Target,
+									GenomeSize:   m.GSize,
+									Match:        make([]float64, m.IdxNum),
+									UniqMatch:    make([]float64, m.IdxNum),
+									UniqMatchHic: make([]float64, m.IdxNum),
+									QLen:         make([]float64, m.IdxNum),
+									RelDepth:     make([]float64, m.IdxNum),
+									Stats:        stats.NewQuantiler(),
+									StatsA:       stats.NewQuantiler(),
+								}
+								profile3[h] = &t0
+								t = &t0
 							}
-							profile2[h] = &t0
-							t = &t0
-						}
 
-						if first { // count once
-							if len(matches) == 1 {
-								t.UniqMatch[m.FragIdx]++
-								if m.QCov >= hicUreadsMinQcov {
-									t.UniqMatchHic[m.FragIdx]++
+							if first { // count once
+								if len(matches) == 1 {
+									t.UniqMatch[m.FragIdx]++
+									if m.QCov >= hicUreadsMinQcov {
+										t.UniqMatchHic[m.FragIdx]++
+									}
+									t.Stats.Add(m.QCov) // the best match on a subject
+									if saveState {
+										t.QCovs = append(t.QCovs, m.QCov)
+									}
 								}
 
-								// t.Stats.Add(m.QCov) // the best match on a subject
-							}
-							t.StatsA.Add(m.QCov) // the best match on a subject
+								t.StatsA.Add(m.QCov)
+								first = false
 
-							first = false
-						}
+								if writeBinning {
+									outfhB.WriteString(fmt.Sprintf("%s\t%d\t%s\n", prevQuery, taxidMap[m.Target], m.Target))
+									nB++
+								}
+							}
 
-						t.QLen[m.FragIdx] += float64(m.QLen) / floatMsSize
+							t.QLen[m.FragIdx] += float64(m.QLen) / floatMsSize
 
-						// for a read matching multiple regions of a reference, distribute count to multiple regions,
-						// the sum is still one.
-						t.Match[m.FragIdx] += floatOne / floatMsSize
+							t.Match[m.FragIdx] += floatOne / floatMsSize
+							t.SumMKmers += float64(m.MKmers) / floatMsSize
+						}
+						poolMatchResults.Put(ms)
 					}
-					poolMatchResults.Put(ms)
 				}
-			}
-		}
 
-		// --------------------
-		// sum up #3
+			}
 
-		if debug {
-			outfhD.WriteString("\n\n")
-			outfhD.WriteString("#------------------ round 2 ------------------\n")
-		}
+			// --------------------
+			// merge and save profile states
 
-		hs = make([]uint64, 0, len(profile)) // list to delete
-		for h, t := range profile2 {
-			for _, c1 = range t.UniqMatch {
-				t.SumUniqMatch += c1
-			}
-			if t.SumUniqMatch < minUReads {
-				hs = append(hs, h)
-				if debug {
-					fmt.Fprintf(outfhD, "failed2: %s (%s), 90th percentile: %.2f, %s: %.0f\n",
-						t.Name, taxdb.Name(taxidMap[t.Name]),
-						t.StatsA.Percentile(90),
-						"no enough unique match", t.SumUniqMatch)
+			for i, state := range states {
+				if err = state.MergeInto(profile3, profile2, saveState); err != nil {
+					return errors.Wrap(err, loadStateFiles[i])
 				}
-				continue
-			}
-
-			for _, c1 = range t.UniqMatchHic {
-				t.SumUniqMatchHic += c1
-			}
-			if t.SumUniqMatchHic < minHicUreads {
-				hs = append(hs, h)
-				if debug {
-					fmt.Fprintf(outfhD, "failed2: %s (%s), 90th percentile: %.2f, %s: %.0f\n",
-						t.Name, taxdb.Name(taxidMap[t.Name]),
-						t.StatsA.Percentile(90),
-						"no enough high-confidence unique match", t.SumUniqMatchHic)
+				if !secondPass {
+					nReads += state.Reads
 				}
-				continue
+				nAssignedReads += state.AssignedReads
 			}
-
-			if t.SumUniqMatchHic < HicUreadsMinProp*t.SumUniqMatch {
-				hs = append(hs, h)
-				if debug {
-					fmt.Fprintf(outfhD, "failed2: %s (%s), 90th percentile: %.2f, %s: %.4f (%.0f/%.0f)\n",
-						t.Name, taxdb.Name(taxidMap[t.Name]),
-						t.StatsA.Percentile(90),
-						"no enough high-confidence unique match proportion", t.SumUniqMatchHic/t.SumUniqMatch, t.SumUniqMatchHic, t.SumUniqMatch)
+			if verbose {
+				if len(states) > 0 {
+					log.Infof("  %d profile state(s) merged, number of references: %d", len(states), len(profile3))
 				}
-				continue
 			}
 
-			// ----------------------
-
-			for _, c = range t.Match {
-				if c >= minReads {
-					t.FragsProp++
+			if saveState {
+				if err = NewProfileState(nReads, nAssignedReads, profile3, profile2).WriteTo(outs.state, opt.CompressionLevel); err != nil {
+					return err
 				}
-				t.SumMatch += c
-			}
-			t.FragsProp = t.FragsProp / float64(len(t.Match))
-			if t.FragsProp < minFragsProp {
-				hs = append(hs, h)
-				if debug {
-					fmt.Fprintf(outfhD, "failed2: %s (%s), 90th percentile: %.2f, %s: %.1f %v\n",
-						t.Name, taxdb.Name(taxidMap[t.Name]),
-						t.StatsA.Percentile(90),
-						"low chunks fraction", t.FragsProp, t.Match)
+				if verbose {
+					log.Infof("  profile state saved to: %s", outs.state)
 				}
-				continue
 			}
 
-			t.Qlens = 0
-			for _, c2 = range t.QLen {
-				t.Qlens += c2
-			}
-			for i, c2 := range t.QLen {
-				t.RelDepth[i] = c2 / t.Qlens * float64(len(t.QLen))
-			}
+			// --------------------
+			// sum up #4
 
-			_, t.RelDepthStd = MeanStdev(t.RelDepth)
-			if t.RelDepthStd > maxFragsDepthStdev {
-				hs = append(hs, h)
-				if debug {
-					fmt.Fprintf(outfhD, "failed2: %s (%s), 90th percentile: %.2f, %s: %f\n",
-						t.Name, taxdb.Name(taxidMap[t.Name]),
-						t.StatsA.Percentile(90),
-						"high FragsDepthStdev", t.RelDepthStd)
-				}
-				continue
+			if debug {
+				outfhD.WriteString("\n\n")
+				outfhD.WriteString("#------------------ round 3 ------------------\n")
 			}
 
-		}
-
-		for _, h := range hs {
-			delete(profile2, h)
-		}
-
-		if opt.Verbose || opt.Log2File {
-			log.Infof("  number of estimated references: %d", len(profile2))
-			log.Infof("  elapsed time: %s", time.Since(timeStart1))
-			log.Info()
-		}
+			targets := make([]*Target, 0, 256)
+			var nNoGSize int // references without genome size, for --min-coverage
 
-		// ---------------------------------------------------------------
-		// stage 4/4
-		if opt.Verbose || opt.Log2File {
-			log.Infof("stage 4/4: computing profile")
-		}
-		timeStart1 = time.Now()
-
-		var outfhB *bufio.Writer
-		var gwB io.WriteCloser
-		var wB *os.File
-		var nB uint64
-		if outputBinningResult {
-			outfhB, gwB, wB, err = outStream(binningFile, strings.HasSuffix(strings.ToLower(binningFile), ".gz"), opt.CompressionLevel)
-			checkError(err)
-			defer func() {
-				outfhB.Flush()
-				if gwB != nil {
-					gwB.Close()
+			for h, t := range profile3 {
+				for _, c1 = range t.UniqMatch {
+					t.SumUniqMatch += c1
 				}
-				wB.Close()
-			}()
-
-			outfhB.WriteString("# This is the bioboxes.org binning output format at\n")
-			outfhB.WriteString("# https://github.com/bioboxes/rfc/tree/master/data-format\n")
-			outfhB.WriteString("@Version:0.10.0\n")
-			outfhB.WriteString(fmt.Sprintf("@SampleID:%s\n", sampleID))
-			outfhB.WriteString("@@SEQUENCEID	TAXID\n")
-		}
-
-		profile3 := make(map[uint64]*Target, len(profile2))
-
-		var nAssignedReads float64
-
-		for _, file := range files {
-			if opt.Verbose || opt.Log2File {
-				log.Infof("  parsing file: %s", file)
-			}
-
-			var matches map[uint64]*[]*MatchResult // target -> match result
-			var m *MatchResult
-			var ms *[]*MatchResult
-			var t, t1 *Target
-			var ok bool
-			var hTarget, h uint64
-			var prevQuery string
-			var floatMsSize float64
-			var uniqMatch bool
-			var first bool
-			var sumUReads, prop float64
-			var uregionProp float64
-			var match *MatchResult
-
-			onlyTopNScore := topNScore > 0
-			var nScore int
-			var pScore float64
-			var processThisMatch bool
-
-			taxids := make([]uint32, 0, 128)
-			var taxid1, taxid2 uint32
-			var theSameSpecies bool
-
-			reader, err := breader.NewBufferedReader(file, opt.NumCPUs, chunkSize, fn)
-			checkError(err)
-			var data interface{}
-
-			matches = make(map[uint64]*[]*MatchResult)
-			pScore = 1024
-			nScore = 0
-			processThisMatch = true
-			for chunk := range reader.Ch {
-				checkError(chunk.Err)
-
-				for _, data = range chunk.Data {
-					match = data.(*MatchResult)
-
-					hTarget = wyhash.HashString(match.Target, 1)
-					if _, ok = profile2[hTarget]; !ok { // skip matches of unwanted targets
-						continue
-					}
-
-					if prevQuery != match.Query {
-						nAssignedReads++
-						uniqMatch = false
-						if len(matches) > 1 { // redistribute matches
-							sumUReads = 0
-
-							taxids = taxids[:0]
-							for h, ms = range matches {
-								// consider unique sequence proportion of references.
-								if considerUregionProp {
-									if uregionProp, ok = uregionPropMap[profile2[h].Name]; ok {
-										sumUReads += profile2[h].SumUniqMatch / uregionProp
-									} else {
-										sumUReads += profile2[h].SumUniqMatch
-									}
-								} else {
-									sumUReads += profile2[h].SumUniqMatch
-								}
-
-								if mappingTaxids {
-									taxid1, ok = taxidMap[(*ms)[0].Target]
-									if !ok {
-										checkError(fmt.Errorf("unknown taxid for %s, please check taxid mapping file(s)", (*ms)[0].Target))
-									}
-									taxids = append(taxids, taxid1)
-								}
-							}
-
-							if mappingTaxids {
-								// LCA
-								theSameSpecies = false
-								taxid1 = taxids[0]
-								for _, taxid2 = range taxids[1:] {
-									taxid1 = taxdb.LCA(taxid1, taxid2)
-								}
-
-								if levelSpecies && taxdb.AtOrBelowRank(taxid1, "species") {
-									theSameSpecies = true
-								}
-
-								if outputBinningResult {
-									outfhB.WriteString(fmt.Sprintf("%s\t%d\n", prevQuery, taxid1))
-									nB++
-								}
-							}
-
-							for h, ms = range matches {
-								floatMsSize = float64(len(*ms))
-								first = true
-								t1 = profile2[h]
-
-								// consider unique sequence proportion of references.
-								if considerUregionProp {
-									if uregionProp, ok = uregionPropMap[t1.Name]; ok {
-										prop = t1.SumUniqMatch / uregionProp / sumUReads
-									} else {
-										prop = t1.SumUniqMatch / sumUReads
-									}
-								} else {
-									prop = t1.SumUniqMatch / sumUReads
-								}
-
-								for _, m = range *ms {
-									if t, ok = profile3[h]; !ok {
-										t0 := Target{
-											Name:         m.Target,
-											GenomeSize:   m.GSize,
-											Match:        make([]float64, m.IdxNum),
-											UniqMatch:    make([]float64, m.IdxNum),
-											UniqMatchHic: make([]float64, m.IdxNum),
-											QLen:         make([]float64, m.IdxNum),
-											RelDepth:     make([]float64, m.IdxNum),
-											Stats:        stats.NewQuantiler(),
-											StatsA:       stats.NewQuantiler(),
-										}
-										profile3[h] = &t0
-										t = &t0
-									}
-
-									if first { // count once
-										if levelSpecies && theSameSpecies {
-											t.Stats.Add(m.QCov) // the best match on a subject
-										}
-										first = false
-
-										t.StatsA.Add(m.QCov)
-									}
-
-									t.QLen[m.FragIdx] += float64(m.QLen) * prop / floatMsSize
-									t.Match[m.FragIdx] += prop / floatMsSize
-
-									if levelSpecies && theSameSpecies {
-										t.UniqMatch[m.FragIdx] += prop / floatMsSize
-										if m.QCov >= hicUreadsMinQcov {
-											t.UniqMatchHic[m.FragIdx] += prop / floatMsSize
-										}
-									}
-								}
-								poolMatchResults.Put(ms)
-							}
-
-							uniqMatch = false
-						} else if len(matches) == 1 {
-							uniqMatch = true
-						} else {
-							// should not happen here, but it may happen out the main loop
-						}
-
-						if uniqMatch {
-							for h, ms = range matches {
-								floatMsSize = float64(len(*ms))
-								first = true
-								for _, m = range *ms {
-									if t, ok = profile3[h]; !ok {
-										t0 := Target{
-											Name:         m.Target,
-											GenomeSize:   m.GSize,
-											Match:        make([]float64, m.IdxNum),
-											UniqMatch:    make([]float64, m.IdxNum),
-											UniqMatchHic: make([]float64, m.IdxNum),
-											QLen:         make([]float64, m.IdxNum),
-											RelDepth:     make([]float64, m.IdxNum),
-											Stats:        stats.NewQuantiler(),
-											StatsA:       stats.NewQuantiler(),
-										}
-										profile3[h] = &t0
-										t = &t0
-									}
-
-									if first { // count once
-										if len(matches) == 1 {
-											t.UniqMatch[m.FragIdx]++
-											if m.QCov >= hicUreadsMinQcov {
-												t.UniqMatchHic[m.FragIdx]++
-											}
-											t.Stats.Add(m.QCov) // the best match on a subject
-										}
-
-										t.StatsA.Add(m.QCov)
-										first = false
-
-										if outputBinningResult {
-											outfhB.WriteString(fmt.Sprintf("%s\t%d\n", prevQuery, taxidMap[m.Target]))
-											nB++
-										}
-									}
-
-									t.QLen[m.FragIdx] += float64(m.QLen) / floatMsSize
-
-									t.Match[m.FragIdx] += floatOne / floatMsSize
-								}
-								poolMatchResults.Put(ms)
-							}
-						}
-
-						matches = make(map[uint64]*[]*MatchResult)
-						pScore = 1024
-						nScore = 0
-						processThisMatch = true
-					} else if keepFullMatch {
-						if !processThisMatch {
-							prevQuery = match.Query
-							continue
-						}
-
-						if pScore == 1 && match.QCov < 1 {
-							processThisMatch = false
-
-							prevQuery = match.Query
-							continue
-						}
-					} else if keepMainMatch && pScore <= 1 {
-						if !processThisMatch {
-							prevQuery = match.Query
-							continue
-						}
-
-						if pScore-match.QCov > maxScoreGap {
-							processThisMatch = false
-
-							prevQuery = match.Query
-							continue
-						}
+				if t.SumUniqMatch < minUReads {
+					if debug {
+						fmt.Fprintf(outfhD, "failed3: %s (%s), 90th percentile: %.2f, %s: %.0f\n",
+							t.Name, taxdb.Name(taxidMap[t.Name]),
+							t.StatsA.Percentile(90),
+							"no enough unique match", t.SumUniqMatch)
 					}
+					continue
+				}
 
-					if onlyTopNScore {
-						if !processThisMatch {
-							prevQuery = match.Query
-							continue
-						}
-
-						if match.QCov < pScore { // match with a smaller score
-							nScore++
-							if nScore > topNScore {
-								processThisMatch = false
-
-								prevQuery = match.Query
-								continue
-							}
-						}
+				for _, c1 = range t.UniqMatchHic {
+					t.SumUniqMatchHic += c1
+				}
+				if t.SumUniqMatchHic < minHicUreads {
+					if debug {
+						fmt.Fprintf(outfhD, "failed3: %s (%s), 90th percentile: %.2f, %s: %.0f\n",
+							t.Name, taxdb.Name(taxidMap[t.Name]),
+							t.StatsA.Percentile(90),
+							"no enough high-confidence unique match", t.SumUniqMatchHic)
 					}
+					continue
+				}
 
-					if ms, ok = matches[hTarget]; !ok {
-						// tmp := []*MatchResult{match}
-						tmp := poolMatchResults.Get().(*[]*MatchResult)
-						*tmp = (*tmp)[:0]
-						*tmp = append(*tmp, match)
-						matches[hTarget] = tmp
-					} else {
-						*ms = append(*ms, match)
+				if t.SumUniqMatchHic < HicUreadsMinProp*t.SumUniqMatch {
+					if debug {
+						fmt.Fprintf(outfhD, "failed3: %s (%s), 90th percentile: %.2f, %s: %.4f (%.0f/%.0f)\n",
+							t.Name, taxdb.Name(taxidMap[t.Name]),
+							t.StatsA.Percentile(90),
+							"no enough high-confidence unique match proportion", t.SumUniqMatchHic/t.SumUniqMatch, t.SumUniqMatchHic, t.SumUniqMatch)
 					}
-
-					prevQuery = match.Query
-					pScore = match.QCov
+					continue
 				}
-			}
 
-			nAssignedReads++
-			uniqMatch = false
-			if len(matches) > 1 { // redistribute matches
-				sumUReads = 0
+				// ----------------------
 
-				taxids = taxids[:0]
-				for h, ms = range matches {
-					// consider unique sequence proportion of references.
-					if considerUregionProp {
-						if uregionProp, ok = uregionPropMap[profile2[h].Name]; ok {
-							sumUReads += profile2[h].SumUniqMatch / uregionProp
-						} else {
-							sumUReads += profile2[h].SumUniqMatch
-						}
-					} else {
-						sumUReads += profile2[h].SumUniqMatch
+				for _, c = range t.Match {
+					if c >= minReads {
+						t.FragsProp++
 					}
-
-					if mappingTaxids {
-						taxid1, ok = taxidMap[(*ms)[0].Target]
-						if !ok {
-							checkError(fmt.Errorf("unknown taxid for %s, please check taxid mapping file(s)", (*ms)[0].Target))
-						}
-						taxids = append(taxids, taxid1)
+					t.SumMatch += c
+				}
+				t.FragsProp = t.FragsProp / float64(len(t.Match))
+				if t.FragsProp < minFragsProp {
+					if debug {
+						fmt.Fprintf(outfhD, "failed3: %s (%s), 90th percentile: %.2f, %s: %.1f %v\n",
+							t.Name, taxdb.Name(taxidMap[t.Name]),
+							t.StatsA.Percentile(90),
+							"low chunks fraction", t.FragsProp, t.Match)
 					}
+					continue
 				}
 
-				if mappingTaxids {
-					// LCA
-					theSameSpecies = false
-					taxid1 = taxids[0]
-					for _, taxid2 = range taxids[1:] {
-						taxid1 = taxdb.LCA(taxid1, taxid2)
+				t.Qlens = 0
+				for _, c2 = range t.QLen {
+					t.Qlens += c2
+				}
+				for i, c2 := range t.QLen {
+					t.RelDepth[i] = c2 / t.Qlens * float64(len(t.QLen))
+				}
+
+				_, t.RelDepthStd = MeanStdev(t.RelDepth)
+				if t.RelDepthStd > maxFragsDepthStdev {
+					if debug {
+						fmt.Fprintf(outfhD, "failed3: %s (%s), 90th percentile: %.2f, %s: %f\n",
+							t.Name, taxdb.Name(taxidMap[t.Name]),
+							t.StatsA.Percentile(90),
+							"high FragsDepthStdev", t.RelDepthStd)
 					}
+					continue
+				}
 
-					if levelSpecies && taxdb.AtOrBelowRank(taxid1, "species") {
-						theSameSpecies = true
+				t.Evenness = Evenness(t.RelDepth)
+				if t.Evenness < minEvenness {
+					if debug {
+						fmt.Fprintf(outfhD, "failed3: %s (%s), 90th percentile: %.2f, %s: %f %v\n",
+							t.Name, taxdb.Name(taxidMap[t.Name]),
+							t.StatsA.Percentile(90),
+							"low chunks evenness", t.Evenness, t.RelDepth)
 					}
+					continue
+				}
 
-					if outputBinningResult {
-						outfhB.WriteString(fmt.Sprintf("%s\t%d\n", prevQuery, taxid1))
-						nB++
+				if hasSketch { // sampled matched k-mers are collected in stage 3/4
+					if t2, ok := profile2[h]; ok {
+						t.UnionTCov = t2.UnionTargetCov()
+						t.Sketch = t2.Sketch
+					}
+					if t.UnionTCov < minTargetCov {
+						if debug {
+							fmt.Fprintf(outfhD, "failed3: %s (%s), 90th percentile: %.2f, %s: %f\n",
+								t.Name, taxdb.Name(taxidMap[t.Name]),
+								t.StatsA.Percentile(90),
+								"low target coverage of the union of matched k-mers", t.UnionTCov)
+						}
+						continue
 					}
 				}
 
-				for h, ms = range matches {
-					floatMsSize = float64(len(*ms))
-					first = true
-					t1 = profile2[h]
+				// ----------------------
 
-					// consider unique sequence proportion of references.
-					if considerUregionProp {
-						if uregionProp, ok = uregionPropMap[t1.Name]; ok {
-							prop = t1.SumUniqMatch / uregionProp / sumUReads
-						} else {
-							prop = t1.SumUniqMatch / sumUReads
+				switch normAbund {
+				case "mean":
+					t.Coverage = t.Qlens / float64(t.GenomeSize)
+				case "min":
+					tmp := math.MaxFloat64
+					for _, c2 = range t.QLen {
+						if c2 == 0 {
+							continue
 						}
-					} else {
-						prop = t1.SumUniqMatch / sumUReads
-					}
-
-					for _, m = range *ms {
-						if t, ok = profile3[h]; !ok {
-							t0 := Target{
-								Name:         m.Target,
-								GenomeSize:   m.GSize,
-								Match:        make([]float64, m.IdxNum),
-								UniqMatch:    make([]float64, m.IdxNum),
-								UniqMatchHic: make([]float64, m.IdxNum),
-								QLen:         make([]float64, m.IdxNum),
-								RelDepth:     make([]float64, m.IdxNum),
-								Stats:        stats.NewQuantiler(),
-								StatsA:       stats.NewQuantiler(),
-							}
-							profile3[h] = &t0
-							t = &t0
+						if c2 < tmp {
+							tmp = c2
 						}
-
-						if first { // count once
-							if levelSpecies && theSameSpecies {
-								t.Stats.Add(m.QCov) // the best match on a subject
-							}
-							first = false
-							t.StatsA.Add(m.QCov)
+					}
+					t.Coverage = tmp * float64(len(t.QLen)) / float64(t.GenomeSize)
+				case "max":
+					var tmp float64
+					for _, c2 = range t.QLen {
+						if c2 == 0 {
+							continue
 						}
-
-						t.QLen[m.FragIdx] += float64(m.QLen) * prop / floatMsSize
-						t.Match[m.FragIdx] += prop / floatMsSize
-
-						if levelSpecies && theSameSpecies {
-							t.UniqMatch[m.FragIdx] += prop / floatMsSize
-							if m.QCov >= hicUreadsMinQcov {
-								t.UniqMatchHic[m.FragIdx] += prop / floatMsSize
-							}
+						if c2 > tmp {
+							tmp = c2
 						}
 					}
-					poolMatchResults.Put(ms)
+					t.Coverage = tmp * float64(len(t.QLen)) / float64(t.GenomeSize)
 				}
 
-				uniqMatch = false
-			} else if len(matches) == 1 {
-				uniqMatch = true
-			} else {
-				// should not happen here, but it may happen out the main loop
-			}
-
-			if uniqMatch {
-				for h, ms = range matches {
-					floatMsSize = float64(len(*ms))
-					first = true
-					for _, m = range *ms {
-						if t, ok = profile3[h]; !ok {
-							t0 := Target{
-								Name:         m.Target,
-								GenomeSize:   m.GSize,
-								Match:        make([]float64, m.IdxNum),
-								UniqMatch:    make([]float64, m.IdxNum),
-								UniqMatchHic: make([]float64, m.IdxNum),
-								QLen:         make([]float64, m.IdxNum),
-								RelDepth:     make([]float64, m.IdxNum),
-								Stats:        stats.NewQuantiler(),
-								StatsA:       stats.NewQuantiler(),
-							}
-							profile3[h] = &t0
-							t = &t0
+				if minCoverage > 0 {
+					cov, ok := t.BreadthDepth()
+					if !ok {
+						nNoGSize++
+					}
+					if cov < minCoverage {
+						if debug {
+							fmt.Fprintf(outfhD, "failed3: %s (%s), 90th percentile: %.2f, %s: %f\n",
+								t.Name, taxdb.Name(taxidMap[t.Name]),
+								t.StatsA.Percentile(90),
+								"low estimated coverage (chunks fraction × depth)", cov)
 						}
+						continue
+					}
+				}
 
-						if first { // count once
-							if len(matches) == 1 {
-								t.UniqMatch[m.FragIdx]++
-								if m.QCov >= hicUreadsMinQcov {
-									t.UniqMatchHic[m.FragIdx]++
-								}
-								t.Stats.Add(m.QCov) // the best match on a subject
-							}
+				// t.Score = similarity(t.Stats.Percentile(90))
+				t.Score = t.Stats.Percentile(90) * 100
 
-							t.StatsA.Add(m.QCov)
-							first = false
+				targets = append(targets, t)
+			}
+			if nNoGSize > 0 {
+				log.Warningf("%d references without genome size are filtered by --min-coverage with the chunks fraction only", nNoGSize)
+			}
 
-							if outputBinningResult {
-								outfhB.WriteString(fmt.Sprintf("%s\t%d\n", prevQuery, taxidMap[m.Target]))
-								nB++
-							}
+			// genome-level uniqueness among references passing all the filters above,
+			// k-mers shared by close relatives are not counted.
+			if minGenomeUniq > 0 && len(targets) > 0 {
+				ComputeGenomeUniqueness(targets)
+				targets2 := make([]*Target, 0, len(targets))
+				for _, t := range targets {
+					if t.GenomeUniq < minGenomeUniq {
+						if debug {
+							fmt.Fprintf(outfhD, "failed3: %s (%s), 90th percentile: %.2f, %s: %f\n",
+								t.Name, taxdb.Name(taxidMap[t.Name]),
+								t.StatsA.Percentile(90),
+								"low fraction of matched k-mers not shared with other references", t.GenomeUniq)
 						}
-
-						t.QLen[m.FragIdx] += float64(m.QLen) / floatMsSize
-
-						t.Match[m.FragIdx] += floatOne / floatMsSize
+						continue
 					}
-					poolMatchResults.Put(ms)
+					targets2 = append(targets2, t)
 				}
+				if verbose {
+					log.Infof("  %d references filtered out by --min-genome-uniqueness", len(targets)-len(targets2))
+				}
+				targets = targets2
 			}
 
-		}
-
-		// --------------------
-		// sum up #4
-
-		if debug {
-			outfhD.WriteString("\n\n")
-			outfhD.WriteString("#------------------ round 3 ------------------\n")
-		}
-
-		targets := make([]*Target, 0, 256)
-
-		for _, t := range profile3 {
-			for _, c1 = range t.UniqMatch {
-				t.SumUniqMatch += c1
-			}
-			if t.SumUniqMatch < minUReads {
-				if debug {
-					fmt.Fprintf(outfhD, "failed3: %s (%s), 90th percentile: %.2f, %s: %.0f\n",
-						t.Name, taxdb.Name(taxidMap[t.Name]),
-						t.StatsA.Percentile(90),
-						"no enough unique match", t.SumUniqMatch)
+			// closely related strains share most k-mers,
+			// a true one should have uniquely matched reads spreading over its chunks.
+			if minUniqFragsProp > 0 && len(targets) > 0 {
+				targets2 := make([]*Target, 0, len(targets))
+				for _, t := range targets {
+					t.ComputeUniqFragsProp()
+					if t.UniqFragsProp < minUniqFragsProp {
+						if debug {
+							fmt.Fprintf(outfhD, "failed3: %s (%s), 90th percentile: %.2f, %s: %f %v\n",
+								t.Name, taxdb.Name(taxidMap[t.Name]),
+								t.StatsA.Percentile(90),
+								"low fraction of chunks with uniquely matched reads", t.UniqFragsProp, t.UniqMatch)
+						}
+						if !secondPass {
+							delete(profile2, wyhash.HashString(t.Name, 1))
+						}
+						continue
+					}
+					targets2 = append(targets2, t)
+				}
+				nUniqFragsFiltered = len(targets) - len(targets2)
+				if verbose {
+					log.Infof("  %d references filtered out by --min-uniq-frags-prop", nUniqFragsFiltered)
 				}
-				continue
+				targets = targets2
 			}
 
-			for _, c1 = range t.UniqMatchHic {
-				t.SumUniqMatchHic += c1
-			}
-			if t.SumUniqMatchHic < minHicUreads {
-				if debug {
-					fmt.Fprintf(outfhD, "failed3: %s (%s), 90th percentile: %.2f, %s: %.0f\n",
-						t.Name, taxdb.Name(taxidMap[t.Name]),
-						t.StatsA.Percentile(90),
-						"no enough high-confidence unique match", t.SumUniqMatchHic)
+			// reads of the filtered references are reassigned among the remaining ones,
+			// the second pass is also needed for writing the binning result.
+			if minUniqFragsProp > 0 && !secondPass && (nUniqFragsFiltered > 0 || outputBinningResult) {
+				secondPass = true
+				if verbose {
+					log.Infof("  elapsed time: %s", time.Since(timeStart1))
+					log.Info()
+					log.Infof("stage 4/4 (second pass): computing profile with %d references passing --min-uniq-frags-prop", len(profile2))
 				}
-				continue
+				timeStart1 = time.Now()
+				goto STAGE4
 			}
 
-			if t.SumUniqMatchHic < HicUreadsMinProp*t.SumUniqMatch {
-				if debug {
-					fmt.Fprintf(outfhD, "failed3: %s (%s), 90th percentile: %.2f, %s: %.4f (%.0f/%.0f)\n",
-						t.Name, taxdb.Name(taxidMap[t.Name]),
-						t.StatsA.Percentile(90),
-						"no enough high-confidence unique match proportion", t.SumUniqMatchHic/t.SumUniqMatch, t.SumUniqMatchHic, t.SumUniqMatch)
+			if verbose {
+				log.Infof("  number of estimated references: %d", len(targets))
+				log.Infof("  elapsed time: %s", time.Since(timeStart1))
+				log.Info()
+				if outputBinningResult {
+					log.Infof("%d binning results are save to %s", nB, outs.binning)
 				}
-				continue
+				log.Info()
+				logInfoFields(logFields{"reads": nReads, "assignedReads": nAssignedReads},
+					"#input matched reads: %.0f, #reads belonging to references in profile: %0.f, proportion: %.6f%%",
+					nReads, nAssignedReads, nAssignedReads/nReads*100)
 			}
 
-			// ----------------------
+			// ---------------------------------------------------------------
+			// output
+
+			format := &kmcpProfileFormat{
+				tCov:          hasSketch,
+				uniqFragsProp: minUniqFragsProp > 0,
+				precision:     floatPrecision,
+				na:            outputNA,
+				separator:     separator,
+			}
+			header := format.header()
+			needHeader := true
 
-			for _, c = range t.Match {
-				if c >= minReads {
-					t.FragsProp++
+			var outfh *bufio.Writer
+			var gw io.WriteCloser
+			var w *os.File
+			if appendOutput {
+				needHeader, err = checkHeaderForAppending(outs.profile, header)
+				if err != nil {
+					return err
 				}
-				t.SumMatch += c
+				outfh, gw, w, err = outStreamAppend(outs.profile, strings.HasSuffix(strings.ToLower(outs.profile), ".gz"), opt.CompressionLevel)
+			} else {
+				outfh, gw, w, err = outStream(outs.profile, strings.HasSuffix(strings.ToLower(outs.profile), ".gz"), opt.CompressionLevel)
+			}
+			if err != nil {
+				return err
 			}
-			t.FragsProp = t.FragsProp / float64(len(t.Match))
-			if t.FragsProp < minFragsProp {
-				if debug {
-					fmt.Fprintf(outfhD, "failed3: %s (%s), 90th percentile: %.2f, %s: %.1f %v\n",
-						t.Name, taxdb.Name(taxidMap[t.Name]),
-						t.StatsA.Percentile(90),
-						"low chunks fraction", t.FragsProp, t.Match)
+			defer func() {
+				outfh.Flush()
+				if gw != nil {
+					gw.Close()
 				}
-				continue
+				w.Close()
+			}()
+
+			if mode0 {
+				sort.Slice(targets, func(i, j int) bool {
+					d := targets[i].Score*targets[i].FragsProp - targets[j].Score*targets[j].FragsProp
+					if d < 0 {
+						return false
+					} else if d > 0 {
+						return true
+					}
+
+					d = targets[i].Score - targets[j].Score
+					if d < 0 {
+						return false
+					} else if d > 0 {
+						return true
+					}
+
+					d = targets[i].FragsProp - targets[j].FragsProp
+					if d < 0 {
+						return false
+					} else if d > 0 {
+						return true
+					}
+					return targets[i].SumMatch > targets[j].SumMatch
+				})
+			} else {
+				sorts.Quicksort(Targets(targets))
 			}
 
-			t.Qlens = 0
-			for _, c2 = range t.QLen {
-				t.Qlens += c2
+			var totalCoverage float64
+			for _, t := range targets {
+				totalCoverage += t.Coverage
 			}
-			for i, c2 := range t.QLen {
-				t.RelDepth[i] = c2 / t.Qlens * float64(len(t.QLen))
+
+			for _, t := range targets {
+				t.Percentage = t.Coverage / totalCoverage * 100
 			}
 
-			_, t.RelDepthStd = MeanStdev(t.RelDepth)
-			if t.RelDepthStd > maxFragsDepthStdev {
-				if debug {
-					fmt.Fprintf(outfhD, "failed3: %s (%s), 90th percentile: %.2f, %s: %f\n",
-						t.Name, taxdb.Name(taxidMap[t.Name]),
-						t.StatsA.Percentile(90),
-						"high FragsDepthStdev", t.RelDepthStd)
+			if fileterLowAbc && len(targets) > 1 {
+				if verbose {
+					log.Infof("filtering out predictions with the smallest relative abundances summing up %v%%", lowAbcPct)
 				}
-				continue
-			}
+				var accPct float64
+				var t *Target
+				var i, n int
 
-			// ----------------------
+				for i = len(targets) - 1; i >= 0; i-- { // reverse order
+					t = targets[i]
+					accPct += t.Percentage
 
-			switch normAbund {
-			case "mean":
-				t.Coverage = t.Qlens / float64(t.GenomeSize)
-			case "min":
-				tmp := math.MaxFloat64
-				for _, c2 = range t.QLen {
-					if c2 == 0 {
-						continue
-					}
-					if c2 < tmp {
-						tmp = c2
+					if accPct > lowAbcPct {
+						break
 					}
+					n++
 				}
-				t.Coverage = tmp * float64(len(t.QLen)) / float64(t.GenomeSize)
-			case "max":
-				var tmp float64
-				for _, c2 = range t.QLen {
-					if c2 == 0 {
-						continue
+
+				if n > 0 {
+					if verbose {
+						log.Infof("  %d targets being filtered out", n)
 					}
-					if c2 > tmp {
-						tmp = c2
+					targets = targets[:len(targets)-n]
+
+					totalCoverage = 0
+					for _, t := range targets {
+						totalCoverage += t.Coverage
+					}
+
+					for _, t := range targets {
+						t.Percentage = t.Coverage / totalCoverage * 100
 					}
+				} else if verbose {
+					log.Infof("no targets being filtered out", n)
 				}
-				t.Coverage = tmp * float64(len(t.QLen)) / float64(t.GenomeSize)
+
 			}
 
-			// t.Score = similarity(t.Stats.Percentile(90))
-			t.Score = t.Stats.Percentile(90) * 100
+			if minRelAbund > 0 && len(targets) > 0 {
+				if verbose {
+					log.Infof("filtering out predictions with relative abundances < %v%%", minRelAbund)
+				}
+				targets2 := make([]*Target, 0, len(targets))
+				for _, t := range targets {
+					if t.Percentage >= minRelAbund {
+						targets2 = append(targets2, t)
+					}
+				}
+
+				if n := len(targets) - len(targets2); n > 0 {
+					if verbose {
+						log.Infof("  %d targets being filtered out", n)
+					}
+					targets = targets2
 
-			targets = append(targets, t)
-		}
+					totalCoverage = 0
+					for _, t := range targets {
+						totalCoverage += t.Coverage
+					}
 
-		if opt.Verbose || opt.Log2File {
-			log.Infof("  number of estimated references: %d", len(targets))
-			log.Infof("  elapsed time: %s", time.Since(timeStart1))
-			log.Info()
-			if outputBinningResult {
-				log.Infof("%d binning results are save to %s", nB, binningFile)
+					for _, t := range targets {
+						t.Percentage = t.Coverage / totalCoverage * 100
+					}
+				} else if verbose {
+					log.Infof("  no targets being filtered out")
+				}
 			}
-			log.Info()
-			log.Infof("#input matched reads: %.0f, #reads belonging to references in profile: %0.f, proportion: %.6f%%",
-				nReads, nAssignedReads, nAssignedReads/nReads*100)
-		}
 
-		// ---------------------------------------------------------------
-		// output
+			var taxid uint32
+			var ok bool
 
-		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
-		checkError(err)
-		defer func() {
-			outfh.Flush()
-			if gw != nil {
-				gw.Close()
+			// for limit ranks to show
+			showRanksMap := make(map[string]interface{}, 128)
+			for _, _rank := range showRanks {
+				showRanksMap[_rank] = struct{}{}
 			}
-			w.Close()
-		}()
 
-		if mode0 {
-			sort.Slice(targets, func(i, j int) bool {
-				d := targets[i].Score*targets[i].FragsProp - targets[j].Score*targets[j].FragsProp
-				if d < 0 {
-					return false
-				} else if d > 0 {
-					return true
+			rankPrefixesMap := make(map[string]string, len(rankPrefixes))
+			for _i, _r := range showRanks {
+				rankPrefixesMap[_r] = rankPrefixes[_i]
+			}
+
+			if needHeader && !outCAMI {
+				outfh.WriteString(header)
+			}
+
+			for _, t := range targets {
+				if mappingNames {
+					t.RefName = namesMap[t.Name]
 				}
 
-				d = targets[i].Score - targets[j].Score
-				if d < 0 {
-					return false
-				} else if d > 0 {
-					return true
+				if mappingTaxids {
+					if taxid, ok = taxidMap[t.Name]; !ok {
+						log.Warningf("%s is not mapped to any TaxId", t.Name)
+					} else {
+						t.AddTaxonomy(taxdb, showRanksMap, taxid)
+					}
 				}
 
-				d = targets[i].FragsProp - targets[j].FragsProp
-				if d < 0 {
-					return false
-				} else if d > 0 {
-					return true
+				if outCAMI { // only taxonomy information is needed
+					continue
 				}
-				return targets[i].SumMatch > targets[j].SumMatch
-			})
-		} else {
-			sorts.Quicksort(Targets(targets))
-		}
 
-		var totalCoverage float64
-		for _, t := range targets {
-			totalCoverage += t.Coverage
-		}
+				format.write(outfh, t)
+			}
 
-		for _, t := range targets {
-			t.Percentage = t.Coverage / totalCoverage * 100
-		}
+			// diagnostic information of retained targets
 
-		if fileterLowAbc && len(targets) > 1 {
-			if opt.Verbose || opt.Log2File {
-				log.Infof("filtering out predictions with the smallest relative abundances summing up %v%%", lowAbcPct)
-			}
-			var accPct float64
-			var t *Target
-			var i, n int
+			if outs.diag != "" {
+				outfh5, gw5, w5, err := outStream(outs.diag, strings.HasSuffix(strings.ToLower(outs.diag), ".gz"), opt.CompressionLevel)
+				if err != nil {
+					return err
+				}
 
-			for i = len(targets) - 1; i >= 0; i-- { // reverse order
-				t = targets[i]
-				accPct += t.Percentage
+				outfh5.WriteString("ref\tpercentage\tmKmers\treads\tureads\thicureads\tchunksFrac\tchunksEvenness\tpassed\n")
+				reasons := make([]string, 0, 10)
+				for _, t := range targets {
+					reasons = reasons[:0]
+					reasons = append(reasons,
+						fmt.Sprintf("ureads=%.0f>=%.0f", t.SumUniqMatch, minUReads),
+						fmt.Sprintf("hicureads=%.0f>=%.0f", t.SumUniqMatchHic, minHicUreads),
+						fmt.Sprintf("hicureadsProp=%.4f>=%v", t.SumUniqMatchHic/t.SumUniqMatch, HicUreadsMinProp),
+						fmt.Sprintf("chunksFrac=%.4f>=%v", t.FragsProp, minFragsProp),
+						fmt.Sprintf("chunksRelDepthStd=%.4f<=%v", t.RelDepthStd, maxFragsDepthStdev))
+					if minEvenness > 0 {
+						reasons = append(reasons, fmt.Sprintf("chunksEvenness=%.4f>=%v", t.Evenness, minEvenness))
+					}
+					if hasSketch {
+						reasons = append(reasons, fmt.Sprintf("tCov=%.4f>=%v", t.UnionTCov, minTargetCov))
+					}
+					if minGenomeUniq > 0 {
+						reasons = append(reasons, fmt.Sprintf("genomeUniqueness=%.4f>=%v", t.GenomeUniq, minGenomeUniq))
+					}
+					if minUniqFragsProp > 0 {
+						reasons = append(reasons, fmt.Sprintf("uchunksFrac=%.4f>=%v", t.UniqFragsProp, minUniqFragsProp))
+					}
+					if minCoverage > 0 {
+						cov, _ := t.BreadthDepth()
+						reasons = append(reasons, fmt.Sprintf("breadthDepth=%.4f>=%v", cov, minCoverage))
+					}
+					if minRelAbund > 0 {
+						reasons = append(reasons, fmt.Sprintf("percentage=%.6f>=%v", t.Percentage, minRelAbund))
+					}
 
-				if accPct > lowAbcPct {
-					break
+					fmt.Fprintf(outfh5, "%s\t%.6f\t%.0f\t%.0f\t%.0f\t%.0f\t%.4f\t%.4f\t%s\n",
+						t.Name, t.Percentage, t.SumMKmers, t.SumMatch, t.SumUniqMatch, t.SumUniqMatchHic,
+						t.FragsProp, t.Evenness, strings.Join(reasons, ";"))
 				}
-				n++
-			}
 
-			if n > 0 {
-				if opt.Verbose || opt.Log2File {
-					log.Infof("  %d targets being filtered out", n)
+				outfh5.Flush()
+				if gw5 != nil {
+					gw5.Close()
 				}
-				targets = targets[:len(targets)-n]
+				w5.Close()
 
-				totalCoverage = 0
-				for _, t := range targets {
-					totalCoverage += t.Coverage
+				if verbose {
+					log.Infof("diagnostic information of %d references saved to: %s", len(targets), outs.diag)
 				}
+			}
 
-				for _, t := range targets {
-					t.Percentage = t.Coverage / totalCoverage * 100
+			if outs.collisions != "" {
+				if !mappingNames {
+					log.Warningf("flag --report-map-collisions ignored when no name mapping files given (-N/--name-map)")
+				} else {
+					collisions := search.NewNameMappingCollisions(namesMap)
+					for _, t := range targets {
+						collisions.AddN(t.Name, uint64(math.Round(t.SumMatch)))
+					}
+					if err = writeNameMappingCollisions(collisions, outs.collisions, opt.CompressionLevel); err != nil {
+						return err
+					}
+					if verbose {
+						log.Infof("%d mapped names shared by multiple references, saved to: %s", len(collisions.Groups), outs.collisions)
+					}
 				}
-			} else if opt.Verbose || opt.Log2File {
-				log.Infof("no targets being filtered out", n)
 			}
 
-		}
+			// ---------------------------------------------------------------
+			// more output
 
-		var taxid uint32
-		var ok bool
+			// abundances rolled up to a rank
 
-		// for limit ranks to show
-		showRanksMap := make(map[string]interface{}, 128)
-		for _, _rank := range showRanks {
-			showRanksMap[_rank] = struct{}{}
-		}
+			if outs.rank != "" {
+				rankNodes := rollupProfile(taxdb, targets, rank)
 
-		rankPrefixesMap := make(map[string]string, len(rankPrefixes))
-		for _i, _r := range showRanks {
-			rankPrefixesMap[_r] = rankPrefixes[_i]
-		}
+				outfh6, gw6, w6, err := outStream(outs.rank, strings.HasSuffix(strings.ToLower(outs.rank), ".gz"), opt.CompressionLevel)
+				if err != nil {
+					return err
+				}
 
-		outfh.WriteString("ref\tpercentage\tcoverage\tscore\tchunksFrac\tchunksRelDepth\tchunksRelDepthStd\treads\tureads\thicureads\trefsize\trefname\ttaxid\trank\ttaxname\ttaxpath\ttaxpathsn\n")
+				outfh6.WriteString("taxid\trank\ttaxname\tpercentage\treads\ttaxpath\ttaxpathsn\n")
+				names := make([]string, 0, 8)
+				taxids := make([]string, 0, 8)
+				for _, node := range rankNodes {
+					names = names[:0]
+					taxids = taxids[:0]
+					for i, taxid := range node.LineageTaxids {
+						if _, ok = showRanksMap[taxdb.Rank(taxid)]; ok || len(showRanksMap) == 0 {
+							taxids = append(taxids, strconv.Itoa(int(taxid)))
+							names = append(names, node.LineageNames[i])
+						}
+					}
+					outfh6.WriteString(fmt.Sprintf("%d\t%s\t%s\t%.*f\t%.0f\t%s\t%s\n",
+						node.Taxid, node.Rank, node.TaxonName, prec(6), node.Percentage, node.Reads,
+						strings.Join(names, separator), strings.Join(taxids, separator)))
+				}
 
-		for _, t := range targets {
-			if mappingNames {
-				t.RefName = namesMap[t.Name]
-			}
+				outfh6.Flush()
+				if gw6 != nil {
+					gw6.Close()
+				}
+				w6.Close()
 
-			if mappingTaxids {
-				if taxid, ok = taxidMap[t.Name]; !ok {
-					log.Warningf("%s is not mapped to any TaxId", t.Name)
-				} else {
-					t.AddTaxonomy(taxdb, showRanksMap, taxid)
+				if verbose {
+					log.Infof("abundances of %d taxa at rank %s saved to: %s", len(rankNodes), rank, outs.rank)
 				}
 			}
-			covs := make([]string, len(t.QLen))
-			for i, v := range t.RelDepth {
-				covs[i] = fmt.Sprintf("%.2f", v)
-			}
 
-			outfh.WriteString(fmt.Sprintf("%s\t%.6f\t%.2f\t%.2f\t%.2f\t%s\t%.2f\t%.0f\t%.0f\t%.0f\t%d\t%s\t%d\t%s\t%s\t%s\t%s\n",
-				t.Name, t.Percentage, t.Coverage, t.Score,
-				t.FragsProp, strings.Join(covs, ";"), t.RelDepthStd,
-				t.SumMatch, t.SumUniqMatch, t.SumUniqMatchHic, t.GenomeSize,
-				t.RefName,
-				t.Taxid, t.Rank, t.TaxonName,
-				strings.Join(t.LineageNames, separator),
-				strings.Join(t.LineageTaxids, separator)))
-		}
+			// abundances of nodes of a custom tree
 
-		// ---------------------------------------------------------------
-		// more output
+			if treeFile != "" {
+				tree, err := NewickFromFile(treeFile)
+				if err != nil {
+					return errors.Wrap(err, treeFile)
+				}
 
-		var profile4 map[uint32]*ProfileNode
-		var nodes []*ProfileNode
+				abundances := make(map[string]float64, len(targets))
+				for _, t := range targets {
+					abundances[t.Name] += t.Percentage
+				}
+				treeNodes, missing, err := TreeRollup(tree, abundances)
+				if err != nil {
+					return errors.Wrap(err, treeFile)
+				}
+				if len(missing) > 0 {
+					log.Warningf("%d references not found in leaves of the tree: %s", len(missing), treeFile)
+				}
 
-		if outputCamiReport || outputMetaphlanReport {
-			profile4 = generateProfile(taxdb, targets)
+				outfh4, gw4, w4, err := outStream(outs.tree, strings.HasSuffix(strings.ToLower(outs.tree), ".gz"), opt.CompressionLevel)
+				if err != nil {
+					return err
+				}
 
-			nodes = make([]*ProfileNode, 0, len(profile4))
-			for _, node := range profile4 {
-				nodes = append(nodes, node)
-			}
+				outfh4.WriteString("node\tdepth\tleaves\tpercentage\n")
+				for _, node := range treeNodes {
+					outfh4.WriteString(fmt.Sprintf("%s\t%d\t%d\t%.6f\n", node.Name, node.Depth, node.Leaves, node.Percentage))
+				}
 
-			sort.Slice(nodes, func(i, j int) bool {
-				if rankOrder[nodes[i].Rank] < rankOrder[nodes[j].Rank] {
-					return true
+				outfh4.Flush()
+				if gw4 != nil {
+					gw4.Close()
 				}
+				w4.Close()
 
-				if rankOrder[nodes[i].Rank] == rankOrder[nodes[j].Rank] {
-					return nodes[i].Percentage > nodes[j].Percentage
+				if verbose {
+					log.Infof("abundances of %d tree nodes saved to: %s", len(treeNodes), outs.tree)
 				}
+			}
 
-				return false
-			})
-		}
+			var profile4 map[uint32]*ProfileNode
+			var nodes []*ProfileNode
 
-		// metaphlan format
+			if outputCamiReport || outputMetaphlanReport || outCAMI {
+				profile4 = generateProfile(taxdb, targets)
 
-		if outputMetaphlanReport {
-			outfh2, gw2, w2, err := outStream(metaphlanReportFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
-			checkError(err)
-			defer func() {
-				outfh2.Flush()
-				if gw2 != nil {
-					gw2.Close()
+				nodes = make([]*ProfileNode, 0, len(profile4))
+				for _, node := range profile4 {
+					nodes = append(nodes, node)
 				}
-				w2.Close()
-			}()
 
-			outfh2.WriteString(fmt.Sprintf("#SampleID\t%s\n", sampleID))
+				sort.Slice(nodes, func(i, j int) bool {
+					if rankOrder[nodes[i].Rank] < rankOrder[nodes[j].Rank] {
+						return true
+					}
+
+					if rankOrder[nodes[i].Rank] == rankOrder[nodes[j].Rank] {
+						return nodes[i].Percentage > nodes[j].Percentage
+					}
 
-			if metaphlanReportVersion == "2" {
-			} else if metaphlanReportVersion == "3" {
-				outfh2.WriteString("#clade_name\tNCBI_tax_id\trelative_abundance\tadditional_species\n")
+					return false
+				})
 			}
 
-			var lineageNames string
-			filterByRank := len(showRanksMap) > 0
-			names := make([]string, 0, 8)
-			for _, node := range nodes {
-				if filterByRank {
-					if _, ok = showRanksMap[taxdb.Rank(node.Taxid)]; !ok {
-						continue
-					}
+			// metaphlan format
 
-					names = names[:0]
-					for i, taxid := range node.LineageTaxids {
-						if _, ok = showRanksMap[taxdb.Rank(taxid)]; ok {
-							names = append(names, rankPrefixesMap[taxdb.Rank(taxid)]+node.LineageNames[i])
-						}
-					}
-					lineageNames = strings.Join(names, "|")
-				} else {
-					lineageNames = strings.Join(node.LineageNames, "|")
+			if outputMetaphlanReport {
+				outfh2, gw2, w2, err := outStream(outs.metaphlan, strings.HasSuffix(strings.ToLower(outs.profile), ".gz"), opt.CompressionLevel)
+				if err != nil {
+					return err
 				}
+				defer func() {
+					outfh2.Flush()
+					if gw2 != nil {
+						gw2.Close()
+					}
+					w2.Close()
+				}()
+
+				outfh2.WriteString(fmt.Sprintf("#SampleID\t%s\n", outs.sampleID))
 
 				if metaphlanReportVersion == "2" {
-					outfh2.WriteString(fmt.Sprintf("%s\t%.6f\n", lineageNames, node.Percentage))
 				} else if metaphlanReportVersion == "3" {
-					outfh2.WriteString(fmt.Sprintf("%s\t%d\t%.6f\t%s\n", lineageNames, node.Taxid, node.Percentage, ""))
-				}
-			}
-		}
-
-		// cami format
-		// https://github.com/bioboxes/rfc/blob/master/data-format/profiling.mkd
-
-		if outputCamiReport {
-			outfh3, gw3, w3, err := outStream(camiReportFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
-			checkError(err)
-			defer func() {
-				outfh3.Flush()
-				if gw3 != nil {
-					gw3.Close()
+					outfh2.WriteString("#clade_name\tNCBI_tax_id\trelative_abundance\tadditional_species\n")
 				}
-				w3.Close()
-			}()
 
-			outfh3.WriteString(fmt.Sprintf("@SampleID:%s\n", sampleID))
-			outfh3.WriteString("@Version:0.10.0\n")
-			outfh3.WriteString("@Ranks:superkingdom|phylum|class|order|family|genus|species|strain\n")
-			outfh3.WriteString(fmt.Sprintf("@TaxonomyID:%s\n", taxonomyID))
-			outfh3.WriteString("@@TAXID\tRANK\tTAXPATH\tTAXPATHSN\tPERCENTAGE\n")
-
-			var lineageTaxids, lineageNames string
-			filterByRank := len(showRanksMap) > 0
-			names := make([]string, 0, 8)
-			taxids := make([]string, 0, 8)
-			for _, node := range nodes {
-				if filterByRank {
-					if _, ok = showRanksMap[taxdb.Rank(node.Taxid)]; !ok {
-						continue
-					}
+				var lineageNames string
+				filterByRank := len(showRanksMap) > 0
+				names := make([]string, 0, 8)
+				for _, node := range nodes {
+					if filterByRank {
+						if _, ok = showRanksMap[taxdb.Rank(node.Taxid)]; !ok {
+							continue
+						}
 
-					names = names[:0]
-					taxids = taxids[:0]
-					for i, taxid := range node.LineageTaxids {
-						if _, ok = showRanksMap[taxdb.Rank(taxid)]; ok {
-							taxids = append(taxids, strconv.Itoa(int(taxid)))
-							names = append(names, node.LineageNames[i])
+						names = names[:0]
+						for i, taxid := range node.LineageTaxids {
+							if _, ok = showRanksMap[taxdb.Rank(taxid)]; ok {
+								names = append(names, rankPrefixesMap[taxdb.Rank(taxid)]+node.LineageNames[i])
+							}
 						}
+						lineageNames = strings.Join(names, "|")
+					} else {
+						lineageNames = strings.Join(node.LineageNames, "|")
 					}
-					lineageTaxids = strings.Join(taxids, "|")
-					lineageNames = strings.Join(names, "|")
-				} else {
-					taxids = taxids[:0]
-					for _, taxid := range node.LineageTaxids {
-						taxids = append(taxids, strconv.Itoa(int(taxid)))
+
+					if metaphlanReportVersion == "2" {
+						outfh2.WriteString(fmt.Sprintf("%s\t%.*f\n", lineageNames, prec(6), node.Percentage))
+					} else if metaphlanReportVersion == "3" {
+						outfh2.WriteString(fmt.Sprintf("%s\t%d\t%.*f\t%s\n", lineageNames, node.Taxid, prec(6), node.Percentage, ""))
 					}
-					lineageTaxids = strings.Join(taxids, "|")
-					lineageNames = strings.Join(node.LineageNames, "|")
 				}
+			}
+
+			// cami format
+			// https://github.com/bioboxes/rfc/blob/master/data-format/profiling.mkd
+
+			if outCAMI {
+				writeCAMIProfile(outfh, taxdb, normalizeProfileByRank(nodes, rankOrder), showRanksMap, outs.sampleID, taxonomyID, prec(6))
+			}
+
+			if outputCamiReport {
+				outfh3, gw3, w3, err := outStream(outs.cami, strings.HasSuffix(strings.ToLower(outs.profile), ".gz"), opt.CompressionLevel)
+				if err != nil {
+					return err
+				}
+				defer func() {
+					outfh3.Flush()
+					if gw3 != nil {
+						gw3.Close()
+					}
+					w3.Close()
+				}()
 
-				outfh3.WriteString(fmt.Sprintf("%d\t%s\t%s\t%s\t%.6f\n",
-					node.Taxid, node.Rank, lineageTaxids, lineageNames, node.Percentage))
+				writeCAMIProfile(outfh3, taxdb, nodes, showRanksMap, outs.sampleID, taxonomyID, prec(6))
 			}
+
+			return nil
+		}
+
+		if byFile {
+			profileByFile(opt, files, byFileOutDir, byFileThreads, outputs, profileFiles)
+			return
 		}
 
+		checkError(profileFiles(files, outputs, opt.Verbose || opt.Log2File))
 	},
 }
 
@@ -2698,6 +3403,18 @@ func init() {
 	profileCmd.Flags().StringP("out-prefix", "o", "-",
 		formatFlagUsage(`Out file prefix ("-" for stdout).`))
 
+	profileCmd.Flags().StringP("out-format", "", "kmcp",
+		formatFlagUsage(`Format of -o/--out-prefix, "kmcp" or "cami". "cami" outputs the CAMI profiling format with percentages normalized to 100 at each rank, -T/--taxid-map and -X/--taxdump are needed.`))
+
+	profileCmd.Flags().BoolP("append", "", false,
+		formatFlagUsage(`Append the profile in KMCP format to the output file rather than overwrite it, the header row is only written for a new or empty file. The header row of an existing file is checked before appending.`))
+
+	profileCmd.Flags().BoolP("by-file", "", false,
+		formatFlagUsage(`Profile each input file independently and in parallel, the number of files processed at the same time is set by -j/--threads. Profiles of each file are saved in --by-file-out-dir, named with the basename of the input file and suffixes of ".k.profile", ".c.profile" (-C/--cami-report), ".m.profile" (-M/--metaphlan-report), ".binning.gz" (-B/--binning-result), ".rank.profile" (--rank-report), and ".tree.profile" (--tree-report). Values of these output flags are ignored, and -s/--sample-id defaults to the basename. Flags --append, --output-kmers, --save-state, --load-state and --report-map-collisions are not supported.`))
+
+	profileCmd.Flags().StringP("by-file-out-dir", "", "",
+		formatFlagUsage(`Output directory for --by-file.`))
+
 	// for single read
 	profileCmd.Flags().Float64P("max-fpr", "f", 0.05,
 		formatFlagUsage(`Maximal false positive rate of a read in search result.`))
@@ -2730,6 +3447,38 @@ func init() {
 	profileCmd.Flags().Float64P("max-chunks-depth-stdev", "d", maxFragsDepthStdev0,
 		formatFlagUsage(`Maximal standard deviation of relative depths of all chunks.`))
 
+	profileCmd.Flags().IntP("max-targets", "", 0,
+		formatFlagUsage(`Maximal number of references kept in memory when counting matches, 0 for no limit. `+
+			`When exceeded, the least abundant references are evicted with a warning, which keeps profiling usable on noisy search results with millions of spurious references.`))
+
+	profileCmd.Flags().Float64P("min-genome-uniqueness", "", 0,
+		formatFlagUsage(`Minimal fraction of matched k-mers of a reference not shared with other references passing all other filters, `+
+			`the strongest specificity filter for distinguishing co-occurring close relatives. 0 for no filtering. `+
+			`It needs search results with sampled matched k-mers (kmcp search --output-kmer-sketch).`))
+
+	profileCmd.Flags().Float64P("min-uniq-frags-prop", "", 0,
+		formatFlagUsage(`Minimal fraction of chunks of a reference with uniquely matched reads, for disambiguating closely related strains sharing most k-mers. `+
+			`It is computed after the profile is assembled, then reads are reassigned among the references passing it by rerunning the stage 4/4. `+
+			`The value is also outputted in an extra column "uchunksFrac". 0 for no filtering.`))
+
+	profileCmd.Flags().Float64P("min-coverage", "", 0,
+		formatFlagUsage(`Minimal estimated coverage of a reference combining breadth and depth, i.e., chunksFrac × coverage (sequencing depth), `+
+			`computed after ambiguous reads are corrected. 0 for no filtering. `+
+			`For references without genome size, the depth is skipped and only the chunks fraction is compared, with a warning.`))
+
+	profileCmd.Flags().BoolP("paired", "", false,
+		formatFlagUsage(`Search results of paired-end reads searched as single-end reads, where query IDs of mates end with "/1" and "/2" and mates are adjacent, e.g., searching interleaved reads. `+
+			`A read pair is counted once, and when both mates match some references, references matched by only one mate are discarded.`))
+
+	profileCmd.Flags().Float64P("min-target-cov", "", 0,
+		formatFlagUsage(`Minimal genome-level target coverage, i.e., the fraction of target k-mers in the union of matched k-mers of all reads `+
+			`assigned to the reference, 0 for no filtering. It needs search results with sampled matched k-mers (kmcp search --output-kmer-sketch), `+
+			`with which the value is also outputted in an extra column "tCov".`))
+
+	profileCmd.Flags().Float64P("min-evenness", "", 0,
+		formatFlagUsage(`Minimal evenness of a reference, i.e., the fraction of chunks with relative depths within 2X of the median. `+
+			`Real genomes get fairly even coverage while false hits sharing conserved regions with true ones are spiky. 0 for no filtering.`))
+
 	profileCmd.Flags().IntP("min-hic-ureads", "U", minHicUreads0,
 		formatFlagUsage(`Minimal number of high-confidence uniquely matched reads for a reference.`))
 
@@ -2751,6 +3500,9 @@ func init() {
 		formatFlagUsage(`Tabular two-column file(s) mapping reference IDs to reference names.`))
 
 	// taxonomy
+	profileCmd.Flags().StringP("report-map-collisions", "", "",
+		formatFlagUsage(`Save reference IDs mapped to the same name (-N/--name-map) and numbers of reads of them in profile to a file, for surfacing unintended merges.`))
+
 	profileCmd.Flags().StringSliceP("taxid-map", "T", []string{},
 		formatFlagUsage(`Tabular two-column file(s) mapping reference IDs to TaxIds.`))
 
@@ -2778,9 +3530,45 @@ func init() {
 
 	profileCmd.Flags().StringP("binning-result", "B", "", formatFlagUsage(`Save extra binning result in CAMI report.`))
 
+	profileCmd.Flags().StringP("save-state", "", "",
+		formatFlagUsage(`Save the intermediate profile state, i.e., counts of references before filtering, to a (gzipped) JSON file, which can be merged with --load-state. It's for profiling shards of search results on different nodes. Profiling parameters should be the same for all shards.`))
+
+	profileCmd.Flags().StringSliceP("load-state", "", []string{},
+		formatFlagUsage(`Profile state file(s) saved by --save-state, to merge with the input files into the final profile. Input files are optional when this flag is given.`))
+
+	profileCmd.Flags().StringP("rank-report", "", "",
+		formatFlagUsage(`Save abundances rolled up to the rank of --rank to this file, references without TaxIds or taxa at the rank are reported as "unclassified" (TaxId 0). -T/--taxid-map and -X/--taxdump are needed.`))
+
+	profileCmd.Flags().StringP("rank", "", "species",
+		formatFlagUsage(`Rank to roll up abundances to for --rank-report, e.g., species, genus, family.`))
+
+	profileCmd.Flags().StringP("tree", "", "",
+		formatFlagUsage(`A custom reference tree in Newick format (e.g., GTDB), with reference IDs as leaf names. Abundances of references are summed up along the tree and saved to --tree-report.`))
+
+	profileCmd.Flags().StringP("tree-report", "", "",
+		formatFlagUsage(`Output file of cumulative abundances of tree nodes (--tree), with columns of node name, depth, number of leaves with abundance, and percentage. Unnamed nodes are named with "node_" and the pre-order index.`))
+
 	profileCmd.Flags().Float64P("filter-low-pct", "F", 0,
 		formatFlagUsage(`Filter out predictions with the smallest relative abundances summing up X%. Range: [0,100).`))
 
+	profileCmd.Flags().Float64P("min-rel-abundance", "", 0,
+		formatFlagUsage(`Minimal relative abundance (percentage) of a prediction, abundances of the remaining ones are renormalized. Range: [0,100).`))
+
+	profileCmd.Flags().BoolP("em", "", false,
+		formatFlagUsage(`Redistribute ambiguous reads by abundances estimated with the expectation-maximization (EM) algorithm, rather than by the numbers of unique reads, which is more accurate for closely related references.`))
+
+	profileCmd.Flags().IntP("em-max-iter", "", 1000,
+		formatFlagUsage(`Maximal number of iterations of the EM algorithm.`))
+
+	profileCmd.Flags().Float64P("em-tol", "", 1e-7,
+		formatFlagUsage(`Convergence threshold of the EM algorithm, i.e., the maximal change of relative abundances between two iterations.`))
+
+	profileCmd.Flags().BoolP("output-na", "", false,
+		formatFlagUsage(`Output "NA" for undefined values in the default format, rather than 0 or empty strings, e.g., coverage and reference size for references without genome size, standard deviation of chunk depths for a single chunk, and taxonomy information for unmapped references.`))
+
+	profileCmd.Flags().IntP("float-precision", "", -1,
+		formatFlagUsage(`Number of digits after the decimal point of float columns in all output formats, e.g., percentage, coverage and score. -1 for the default precision of each column.`))
+
 	// abundance
 	profileCmd.Flags().StringP("norm-abund", "", "mean",
 		formatFlagUsage(`Method for normalize abundance of a reference by the mean/min/max abundance in all chunks, available values: mean, min, max.`))
@@ -2794,6 +3582,10 @@ func init() {
 	// debug
 	profileCmd.Flags().StringP("debug", "", "", formatFlagUsage(`Debug output file.`))
 
+	profileCmd.Flags().StringP("output-kmers", "", "",
+		formatFlagUsage(`Save diagnostic information of references in the profile, including matched k-mers, reads, unique reads, chunks fraction, `+
+			`and values of all filters they passed, for explaining borderline calls and tuning -r/--min-chunks-reads, -u/--min-uniq-reads and -p/--min-chunks-fraction.`))
+
 	profileCmd.Flags().BoolP("no-amb-corr", "", false, formatFlagUsage(`Do not correct ambiguous reads. Use this flag to reduce analysis time if the stage 1/4 produces thousands of candidates.`))
 
 	// modes
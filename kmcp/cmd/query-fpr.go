@@ -22,9 +22,15 @@ package cmd
 
 import (
 	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
 	"strconv"
 	"strings"
 
+	"github.com/shenwei356/kmcp/kmcp/index"
+	"github.com/shenwei356/kmcp/kmcp/search"
+	"github.com/shenwei356/util/pathutil"
 	"github.com/spf13/cobra"
 )
 
@@ -48,6 +54,27 @@ Reference:
   1. SBT: https://doi.org/10.1038/nbt.3442
   2. COBS: https://arxiv.org/abs/1905.09624v2
 
+Bloom filter fill report:
+  With -d/--db-dir and --bloom-fill-report, bit-fill fractions of bloom
+  filters of all index files are computed from the block signatures, to
+  pinpoint saturated blocks driving false positives. The false positive
+  rate of a bloom filter is estimated as fill^(number of hashes).
+  For blocks with filters exceeding the false positive rate of the database,
+  a smaller -x/--block-sizeX-kmers-t for "kmcp index" is recommended,
+  which puts big targets in smaller blocks.
+
+  Output format:
+    1. db,         Database directory
+    2. file,       Index file
+    3. names,      Number of name groups (bloom filters)
+    4. sigs,       Size of bloom filters
+    5. hashes,     Number of hash functions
+    6. maxKmers,   Maximal number of k-mers of all name groups
+    7. minFill,    Minimal bit-fill fraction
+    8. meanFill,   Mean bit-fill fraction
+    9. maxFill,    Maximal bit-fill fraction
+   10. maxFPR,     False positive rate of the most saturated bloom filter
+
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		opt := getOptions(cmd)
@@ -89,7 +116,90 @@ Reference:
 			fpr(0.3, 0.8, 60)
 		*/
 
-		fmt.Fprintf(outfh, "%s\n", strconv.FormatFloat(maxFPR(fpr, queryCov, nKmers), 'e', 4, 64))
+		fmt.Fprintf(outfh, "%s\n", strconv.FormatFloat(index.MaxFPR(fpr, queryCov, nKmers), 'e', 4, 64))
+
+		// ---------------------------------------------------------------
+		// bloom filter fill report
+
+		fillReportFile := getFlagString(cmd, "bloom-fill-report")
+		if fillReportFile == "" {
+			return
+		}
+		dbDir := getFlagString(cmd, "db-dir")
+		if dbDir == "" {
+			checkError(fmt.Errorf("flag -d/--db-dir needed when --bloom-fill-report given"))
+		}
+
+		subFiles, err := ioutil.ReadDir(dbDir)
+		if err != nil {
+			checkError(fmt.Errorf("read database error: %s", err))
+		}
+		dbDirs := make([]string, 0, 8)
+		for _, file := range subFiles {
+			if !file.IsDir() {
+				continue
+			}
+			path := filepath.Join(dbDir, file.Name())
+			existed, err := pathutil.Exists(filepath.Join(path, search.DBInfoFile))
+			if err != nil {
+				checkError(fmt.Errorf("read database error: %s", err))
+			}
+			if existed {
+				dbDirs = append(dbDirs, path)
+			}
+		}
+		if len(dbDirs) == 0 {
+			checkError(fmt.Errorf("invalid kmcp database: %s", dbDir))
+		}
+
+		outfh2, gw2, w2, err := outStream(fillReportFile, strings.HasSuffix(strings.ToLower(fillReportFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh2.Flush()
+			if gw2 != nil {
+				gw2.Close()
+			}
+			w2.Close()
+		}()
+
+		outfh2.WriteString("db\tfile\tnames\tsigs\thashes\tmaxKmers\tminFill\tmeanFill\tmaxFill\tmaxFPR\n")
+
+		var nBlocks, nSaturated, nSaturatedNames int
+		var minSaturatedKmers uint64 = math.MaxUint64
+		for _, path := range dbDirs {
+			if opt.Verbose {
+				log.Infof("computing bit-fill fractions of bloom filters in database: %s", path)
+			}
+			fills, dbFPR, err := BloomFillsOfDB(path)
+			checkError(err)
+
+			for _, f := range fills {
+				nBlocks++
+				outfh2.WriteString(fmt.Sprintf("%s\t%s\t%d\t%d\t%d\t%d\t%.4f\t%.4f\t%.4f\t%.4f\n",
+					path, f.File, f.NumNames, f.NumSigs, f.NumHashes, f.MaxKmers,
+					f.MinFill, f.MeanFill, f.MaxFill, f.MaxFPR()))
+
+				kmers, n := f.SaturatedKmers(dbFPR)
+				if n == 0 {
+					continue
+				}
+				nSaturated++
+				nSaturatedNames += n
+				if kmers < minSaturatedKmers {
+					minSaturatedKmers = kmers
+				}
+			}
+			outfh2.Flush()
+		}
+
+		if nSaturated == 0 {
+			if opt.Verbose {
+				log.Infof("no saturated bloom filters found in %d blocks", nBlocks)
+			}
+		} else {
+			log.Warningf("%d bloom filters in %d of %d blocks exceed the false positive rate of the database", nSaturatedNames, nSaturated, nBlocks)
+			log.Warningf("the minimal number of k-mers of these targets is %d, please rebuild the database with -x/--block-sizeX-kmers-t < %d", minSaturatedKmers, minSaturatedKmers)
+		}
 
 	},
 }
@@ -104,4 +214,9 @@ func init() {
 	queryFPRCmd.Flags().Float64P("min-query-cov", "t", 0.55,
 		formatFlagUsage(`Minimal query coverage, i.e., proportion of matched k-mers and unique k-mers of a query. range: [0, 1]`))
 	queryFPRCmd.Flags().IntP("num-kmers", "n", 80, formatFlagUsage("Number of unique k-mers of the query."))
+
+	queryFPRCmd.Flags().StringP("db-dir", "d", "",
+		formatFlagUsage(`Database directory created by "kmcp index", for --bloom-fill-report.`))
+	queryFPRCmd.Flags().StringP("bloom-fill-report", "", "",
+		formatFlagUsage(`Save bit-fill fractions of bloom filters of each index file in the database (-d/--db-dir) to this file, to pinpoint saturated blocks.`))
 }
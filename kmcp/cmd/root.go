@@ -23,7 +23,6 @@ package cmd
 import (
 	"fmt"
 	"os"
-	"runtime"
 
 	"github.com/spf13/cobra"
 )
@@ -52,6 +51,8 @@ KMCP can also be used for:
 // Execute adds all child commands to the root command sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
+	shareFlagsWithBuild()
+
 	if err := RootCmd.Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(-1)
@@ -60,10 +61,10 @@ func Execute() {
 
 func init() {
 
-	defaultThreads := runtime.NumCPU()
+	defaultThreads := availableCPUs()
 
 	RootCmd.PersistentFlags().IntP("threads", "j", defaultThreads,
-		formatFlagUsage("Number of CPUs cores to use."))
+		formatFlagUsage("Number of CPUs cores to use. The default value is the number of available CPUs, limited by the CPU quota of cgroup if there is."))
 
 	// RootCmd.PersistentFlags().BoolP("verbose", "", false, "print verbose information (recommended)")
 
@@ -75,6 +76,11 @@ func init() {
 
 	RootCmd.PersistentFlags().StringP("log", "", "", formatFlagUsage("Log file."))
 
+	RootCmd.PersistentFlags().StringP("log-format", "", "text",
+		formatFlagUsage(`Log format: "text" or "json" (one JSON object per line, for log ingestion). `+
+			`In JSON format, counts and speeds are also outputted as separate keys, progress bars are disabled, `+
+			`and other messages to stderr are logged line by line.`))
+
 	RootCmd.CompletionOptions.DisableDefaultCmd = true
 
 	RootCmd.SetHelpCommand(&cobra.Command{Hidden: true})
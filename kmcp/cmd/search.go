@@ -21,22 +21,26 @@
 package cmd
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
 	"github.com/shenwei356/bio/seq"
 	"github.com/shenwei356/bio/seqio/fastx"
+	"github.com/shenwei356/kmcp/kmcp/index"
+	"github.com/shenwei356/kmcp/kmcp/search"
+	"github.com/shenwei356/util/bytesize"
 	"github.com/shenwei356/util/cliutil"
-	"github.com/shenwei356/util/pathutil"
 	"github.com/spf13/cobra"
 	"github.com/twotwotwo/sorts/sortutil"
 )
@@ -50,6 +54,8 @@ Attentions:
   1. Input format should be (gzipped) FASTA or FASTQ from files or stdin.
      - Paired-end files should be given via -1/--read1 and -2/--read2.
         kmcp search -d db -1 read_1.fq.gz -2 read_2.fq.gz -o read.tsv.gz
+       Mates are searched as a single query with k-mers of both reads,
+       and the two files should have the same number of records.
      - Single-end can be given as positional arguments or -1/-2.
         kmcp search -d db file1.fq.gz file2.fq.gz -o result.tsv.gz
     **Single-end mode is recommended for paired-end reads, for higher sensitivity**.
@@ -59,6 +65,8 @@ Attentions:
   3. For long reads or contigs, you should split them into short reads
      using "seqkit sliding", e.g.,
          seqkit sliding -s 100 -W 300
+     and matches could be mapped back to the original sequences
+     in BED format with --out-bed.
 
 Shared flags between "search" and "profile":
   1. -t/--min-query-cov.
@@ -86,7 +94,8 @@ Output format:
 
      1. query,    Identifier of the query sequence
      2. qLen,     Query length
-     3. qKmers,   K-mer number of the query sequence
+     3. qKmers,   K-mer number of the query sequence, or the number of
+                 sampled k-mers with --read-scale
      4. FPR,      False positive rate of the match
      5. hits,     Number of matches
      6. target,   Identifier of the target sequence
@@ -96,9 +105,36 @@ Output format:
     10. kSize,    K-mer size
     11. mKmers,   Number of matched k-mers
     12. qCov,     Query coverage,  equals to: mKmers / qKmers
-    13. tCov,     Target coverage, equals to: mKmers / K-mer number of reference chunk
+    13. tCov,     Target coverage, equals to: mKmers / K-mer number of reference chunk,
+                 or that of the whole reference genome with --tcov-denom genome
     14. jacc,     Jaccard index
     15. queryIdx, Index of query sequence, only for merging
+    16. taxid,    Taxid of target, only with --output-taxid
+    17. chunksKmers, Matched k-mers of all matched chunks of the target,
+                 "chunkIdx:mKmers" pairs, only with --output-chunks-kmers
+    18. lineage,  Lineage of target, only with --output-lineage
+    19. kmerSketch, Sampled matched k-mers, only with --output-kmer-sketch, in the
+                 format of "<k-mers of the target chunk>:<scale>:<k-mers>",
+                 for estimating genome-level target coverage in "kmcp profile"
+    20. maxCont,  Containment relative to the smaller k-mer set, i.e.,
+                 mKmers / min(qKmers, k-mers of reference chunk),
+                 only with --output-containment
+    21. qCovSE,   Standard error of qCov, only with --output-containment
+    22. expQCov,  Expected qCov of a query from the reference genome with the
+                 sequencing error rate, i.e., (1-e)^k, only with --error-rate
+    23. normQCov, Normalized qCov, i.e., qCov / expQCov, only with --error-rate
+    24. margin,   Gap between qCov of the best and the second-best targets
+                 of the query, only with --output-margin
+    25. nDBs,     Number of databases the query is searched against,
+                 only with --output-db-hits for multiple databases
+    26. nDBsHit,  Number of databases with any matches of the query,
+                 only with --output-db-hits for multiple databases
+    27. ani,      Average nucleotide identity estimated from qCov, i.e.,
+                 1 + ln(qCov) / k, only with --estimate-ani for databases
+                 of scaled sketches (NA for others)
+    28. positions, 0-based positions of matched k-mers in the query,
+                 separated by commas, only with --report-positions.
+                 Positions in read2 of paired-end reads follow read1
  
   The values of tCov and jacc in results only apply to databases built
   with a single size of k-mer.
@@ -157,24 +193,294 @@ Examples:
 		queryCov := getFlagFloat64(cmd, "min-query-cov")
 		targetCov := getFlagFloat64(cmd, "min-target-cov")
 		minCount := getFlagPositiveInt(cmd, "min-kmers")
+		minRun := getFlagNonNegativeInt(cmd, "min-run")
+		useIDF := getFlagBool(cmd, "idf")
+		skipMasked := getFlagBool(cmd, "skip-masked")
+		tcovDenom := getFlagString(cmd, "tcov-denom")
+		switch tcovDenom {
+		case "fragment", "genome":
+		default:
+			checkError(fmt.Errorf("invalid value of --tcov-denom: %s, available: fragment, genome", tcovDenom))
+		}
 		maxFPR := getFlagPositiveFloat64(cmd, "max-fpr")
 		useMmap := !getFlagBool(cmd, "low-mem")
 		loadWholeFile := getFlagBool(cmd, "load-whole-db")
 		nameMappingFiles := getFlagStringSlice(cmd, "name-map")
 		loadDefaultNameMap := getFlagBool(cmd, "default-name-map")
 		keepUnmatched := getFlagBool(cmd, "keep-unmatched")
+		calibrateTruth := getFlagString(cmd, "calibrate-truth")
+		calibrateStep := getFlagPositiveFloat64(cmd, "calibrate-step")
+		var qcovHist *QcovHistogram
+		if outputLog {
+			qcovHist = NewQcovHistogram(qcovHistogramBinWidth)
+		}
+		var calibration *QcovCalibration
+		if calibrateTruth != "" {
+			if calibrateStep >= 1 {
+				checkError(fmt.Errorf("the value of --calibrate-step (%f) should be in range of (0, 1)", calibrateStep))
+			}
+			calibration = NewQcovCalibration(calibrateTruth, queryCov, calibrateStep)
+		}
+		sqliteFile := getFlagString(cmd, "sqlite")
+		sqliteTable := getFlagString(cmd, "sqlite-table")
+		if sqliteFile != "" && sqliteTable == "" {
+			checkError(fmt.Errorf("the value of --sqlite-table should not be empty"))
+		}
+		outBEDFile := getFlagString(cmd, "out-bed")
+		profileFile := getFlagString(cmd, "profile-out")
+		outMatchedFile := getFlagString(cmd, "out-matched")
+		outUnmatchedFile := getFlagString(cmd, "out-unmatched")
+		if outUnmatchedFile != "" {
+			keepUnmatched = true
+		}
+		if (outMatchedFile != "" && (outMatchedFile == outFile || outMatchedFile == outUnmatchedFile)) ||
+			(outUnmatchedFile != "" && outUnmatchedFile == outFile) {
+			checkError(fmt.Errorf("the values of -o/--out-file, --out-matched and --out-unmatched should be different"))
+		}
+		skipExisting := getFlagBool(cmd, "skip-existing")
+		if skipExisting {
+			if getFlagBool(cmd, "append") {
+				checkError(fmt.Errorf("flag --skip-existing is not compatible with --append"))
+			}
+			if outFile == "-" {
+				checkError(fmt.Errorf("flag --skip-existing needs an output file (-o/--out-file) rather than stdout"))
+			}
+
+			skip := true
+			for _, file := range []string{outFile, outMatchedFile, outUnmatchedFile} {
+				if file == "" {
+					continue
+				}
+				nonEmpty, err := nonEmptyOutput(file)
+				checkError(err)
+				if !nonEmpty {
+					skip = false
+					break
+				}
+			}
+			if skip {
+				if outputLog {
+					log.Infof("skipped as the output file already exists and is not empty: %s", outFile)
+				}
+				return
+			}
+		}
 		// topN := getFlagNonNegativeInt(cmd, "keep-top")
 		topN := 0
 		topNScore := getFlagNonNegativeInt(cmd, "keep-top-scores")
+		maxTargets := getFlagNonNegativeInt(cmd, "max-target-seqs")
 		noHeaderRow := getFlagBool(cmd, "no-header-row")
+		outFormat := getFlagString(cmd, "out-format")
+		switch outFormat {
+		case "tsv", "jsonl":
+		default:
+			checkError(fmt.Errorf("invalid value of --out-format: %s, available: tsv, jsonl", outFormat))
+		}
+		outJSONL := outFormat == "jsonl"
+		if outJSONL {
+			if sqliteFile != "" {
+				checkError(fmt.Errorf("flag --sqlite is not compatible with --out-format jsonl"))
+			}
+			noHeaderRow = true
+		}
+		outputTaxid := getFlagBool(cmd, "output-taxid")
+		outputChunksKmers := getFlagBool(cmd, "output-chunks-kmers")
+		outputLineage := getFlagBool(cmd, "output-lineage")
+		outputKmerSketch := getFlagBool(cmd, "output-kmer-sketch")
+		kmerSketchScale := getFlagPositiveInt(cmd, "kmer-sketch-scale")
+		if !outputKmerSketch {
+			kmerSketchScale = 0
+		}
+		outputContainment := getFlagBool(cmd, "output-containment")
+		errorRate := getFlagNonNegativeFloat64(cmd, "error-rate")
+		outputMargin := getFlagBool(cmd, "output-margin")
+		floatPrecision := getFlagNonNegativeInt(cmd, "float-precision")
+		emitBlock := getFlagBool(cmd, "emit-block")
+		outputDBHits := getFlagBool(cmd, "output-db-hits")
+		estimateANI := getFlagBool(cmd, "estimate-ani")
+		reportPositions := getFlagBool(cmd, "report-positions")
+		if errorRate >= 1 {
+			checkError(fmt.Errorf("the value of --error-rate (%f) should be in range of [0, 1)", errorRate))
+		}
+		appendOutput := getFlagBool(cmd, "append")
+		writeBufferSizeStr := getFlagString(cmd, "write-buffer-size")
+		writeBufferSizeFloat, err := bytesize.ParseByteSize(writeBufferSizeStr)
+		if err != nil {
+			checkError(fmt.Errorf("invalid size: %s", writeBufferSizeStr))
+		}
+		if writeBufferSizeFloat <= 0 {
+			checkError(fmt.Errorf("the value of --write-buffer-size should be positive: %s", writeBufferSizeStr))
+		}
+		writeBufferSize := int(writeBufferSizeFloat)
+		flushInterval := getFlagNonNegativeDuration(cmd, "flush-interval")
+		progressFile := getFlagString(cmd, "progress-json")
+		progressInterval := getFlagNonNegativeDuration(cmd, "progress-interval")
+		if progressFile != "" && progressInterval == 0 {
+			checkError(fmt.Errorf("the value of --progress-interval should be positive"))
+		}
 		sortBy := getFlagString(cmd, "sort-by")
 		doNotSort := getFlagBool(cmd, "do-not-sort")
 		// keepOrder := getFlagBool(cmd, "keep-order")
 		keepOrder := true
 		wholeFile := getFlagBool(cmd, "query-whole-file")
 		useFileName := getFlagBool(cmd, "use-filename")
+		maxWholeFileRecords := getFlagNonNegativeInt(cmd, "max-whole-file-records")
+		maxWholeFileBases := getFlagNonNegativeInt(cmd, "max-whole-file-bases")
 		queryID := getFlagString(cmd, "query-id")
+		collisionsFile := getFlagString(cmd, "report-map-collisions")
+		fileAsQuery := getFlagBool(cmd, "file-as-query")
+		if fileAsQuery {
+			if queryID != "" {
+				log.Warningf("flag --query-id ignored when --file-as-query given")
+				queryID = ""
+			}
+			wholeFile = true
+			useFileName = true
+		}
 		deduplicateThreshold := getFlagPositiveInt(cmd, "kmer-dedup-threshold")
+		noDedup := getFlagBool(cmd, "no-dedup")
+		maxKmersPerQuery := getFlagNonNegativeInt(cmd, "max-kmers-per-query")
+		readScale := getFlagPositiveInt(cmd, "read-scale")
+		seed := getFlagInt64(cmd, "seed")
+		var cappedQueries uint64
+
+		adapterFile := getFlagString(cmd, "adapters")
+		adapterK := getFlagPositiveInt(cmd, "adapter-kmer-size")
+		adapterMinProp := getFlagPositiveFloat64(cmd, "adapter-min-prop")
+		if adapterMinProp > 1 {
+			checkError(fmt.Errorf("the value of --adapter-min-prop (%f) should be in range of (0, 1]", adapterMinProp))
+		}
+		if adapterK > 32 {
+			checkError(fmt.Errorf("the value of --adapter-kmer-size (%d) should be in range of [1, 32]", adapterK))
+		}
+		var adapters *search.AdapterScreener
+		if adapterFile != "" {
+			adapters, err = search.NewAdapterScreener(adapterFile, adapterK, adapterMinProp)
+			checkError(err)
+			if outputLog {
+				log.Infof("%d adapter k-mers loaded from: %s", adapters.NumKmers(), adapterFile)
+			}
+		}
+
+		dedupAcrossQueries := getFlagBool(cmd, "dedup-across-queries")
+		cacheSize := getFlagNonNegativeInt(cmd, "cache-size")
+		var dedupStats *search.KmerDedupStats
+		if outputLog && !noDedup {
+			dedupStats = &search.KmerDedupStats{}
+		}
+
+		var cacheStats *search.KmerCacheStats
+		if dedupAcrossQueries {
+			if cacheSize == 0 {
+				checkError(fmt.Errorf("the value of --cache-size should be positive when --dedup-across-queries given"))
+			}
+			cacheStats = &search.KmerCacheStats{}
+		} else {
+			cacheSize = 0
+		}
+
+		gzipBlocks := getFlagNonNegativeInt(cmd, "gzip-blocks")
+
+		if !wholeFile && (maxWholeFileRecords > 0 || maxWholeFileBases > 0) {
+			log.Warningf("flags --max-whole-file-records and --max-whole-file-bases ignored when -g/--query-whole-file is not given")
+		}
+
+		interleaveInputs := getFlagBool(cmd, "interleave-inputs")
+		readerThreads := getFlagPositiveInt(cmd, "reader-threads")
+		if interleaveInputs && readerThreads > 1 {
+			log.Warningf("flag --reader-threads ignored when --interleave-inputs given")
+			readerThreads = 1
+		}
+		if interleaveInputs && wholeFile {
+			checkError(fmt.Errorf("flag --interleave-inputs is not compatible with -g/--query-whole-file or --file-as-query"))
+		}
+
+		whitelistFile := getFlagString(cmd, "target-whitelist")
+		var whitelist map[string]struct{}
+		if whitelistFile != "" {
+			whitelist, err = readNameList(whitelistFile)
+			checkError(err)
+			if len(whitelist) == 0 {
+				checkError(fmt.Errorf("no target names in file: %s", whitelistFile))
+			}
+			if outputLog {
+				log.Infof("%d target names loaded from whitelist file: %s", len(whitelist), whitelistFile)
+			}
+		}
+
+		var shards, shard int
+		if shardStr := getFlagString(cmd, "shards"); shardStr != "" {
+			shards, shard, err = search.ParseShard(shardStr)
+			checkError(err)
+		}
+
+		collapseRank := getFlagString(cmd, "collapse-to-rank")
+		taxidMappingFiles := getFlagStringSlice(cmd, "taxid-map")
+		taxonomyDataDir := getFlagString(cmd, "taxdump")
+		var collapser *search.TaxonCollapser
+		var lineages map[string]string
+		if collapseRank != "" || outputLineage {
+			if len(taxidMappingFiles) == 0 || taxonomyDataDir == "" {
+				checkError(fmt.Errorf("flags --taxid-map and --taxdump are needed when --collapse-to-rank or --output-lineage given"))
+			}
+
+			taxidMap := make(map[string]uint32, 1024)
+			var taxid uint64
+			for _, taxidMappingFile := range taxidMappingFiles {
+				taxidMapStr, err := cliutil.ReadKVs(taxidMappingFile, false)
+				if err != nil {
+					checkError(errors.Wrap(err, taxidMappingFile))
+				}
+				for k, v := range taxidMapStr {
+					taxid, err = strconv.ParseUint(v, 10, 32)
+					if err != nil {
+						checkError(fmt.Errorf("invalid TaxId: %s", v))
+					}
+					taxidMap[k] = uint32(taxid)
+				}
+			}
+			if len(taxidMap) == 0 {
+				checkError(fmt.Errorf("no valid TaxIds found in TaxId mapping file: %s", strings.Join(taxidMappingFiles, ", ")))
+			}
+
+			taxdb := loadTaxonomy(opt, taxonomyDataDir)
+
+			if collapseRank != "" {
+				if _, ok := taxdb.Ranks[collapseRank]; !ok {
+					checkError(fmt.Errorf("rank %s not found in taxonomy data: %s", collapseRank, taxonomyDataDir))
+				}
+
+				collapser = search.NewTaxonCollapser(taxdb, taxidMap, collapseRank)
+				if outputLog {
+					log.Infof("%d targets belonging to %d taxa at rank %s will be collapsed", collapser.NumTargets(), collapser.NumTaxa(), collapseRank)
+				}
+			}
+
+			if outputLineage {
+				showRanks := getFlagStringSlice(cmd, "show-rank")
+				rankPrefixes := getFlagStringSlice(cmd, "rank-prefix")
+				if len(showRanks) != len(rankPrefixes) {
+					checkError(fmt.Errorf("number of ranks to show and their prefixes should match"))
+				}
+
+				lineages = targetLineages(taxdb, taxidMap, showRanks, rankPrefixes, collapser)
+				if outputLog {
+					log.Infof("lineages of %d targets formatted", len(taxidMap))
+				}
+			}
+		} else if len(taxidMappingFiles) > 0 || taxonomyDataDir != "" {
+			log.Warningf("flags --taxid-map and --taxdump are only used with --collapse-to-rank or --output-lineage")
+		}
+
+		explainQueryID := getFlagString(cmd, "explain-query")
+		// explainQuery returns a QueryExplanation for the query to explain.
+		explainQuery := func(id []byte) *search.QueryExplanation {
+			if explainQueryID == "" || string(id) != explainQueryID {
+				return nil
+			}
+			return search.NewQueryExplanation()
+		}
+
 		// immediateOutput := getFlagBool(cmd, "immediate-output")
 
 		// make it default
@@ -242,12 +548,41 @@ Examples:
 			}
 		}
 
+		if interleaveInputs && pairedEnd {
+			log.Warningf("flag --interleave-inputs ignored for paired-end input")
+			interleaveInputs = false
+		}
+
 		if trySE && !pairedEnd {
 			log.Warningf("flag --try-se ignored for single-end input(s)")
 			trySE = false
 		}
 
-		if !pairedEnd {
+		queryUnikFiles := getFlagStringSlice(cmd, "query-unik")
+		if reportPositions {
+			if len(queryUnikFiles) > 0 {
+				checkError(fmt.Errorf("flag --report-positions is not compatible with --query-unik"))
+			}
+			if readScale > 1 {
+				checkError(fmt.Errorf("flag --report-positions is not compatible with --read-scale"))
+			}
+			if maxKmersPerQuery > 0 {
+				checkError(fmt.Errorf("flag --report-positions is not compatible with --max-kmers-per-query"))
+			}
+		}
+		if len(queryUnikFiles) > 0 {
+			if pairedEnd {
+				checkError(fmt.Errorf("flag --query-unik is not compatible with paired-end input"))
+			}
+			for _, file := range queryUnikFiles {
+				if isStdin(file) {
+					checkError(fmt.Errorf("stdin not supported for --query-unik"))
+				}
+			}
+			if outputLog {
+				log.Infof("  %d .unik file(s) given as queries, other input files are ignored", len(queryUnikFiles))
+			}
+		} else if !pairedEnd {
 			files1 := getFileListFromArgsAndFile(cmd, args, true, "infile-list", true)
 
 			if read1 != "" || read2 != "" {
@@ -280,31 +615,33 @@ Examples:
 		// ---------------------------------------------------------------
 		// check Database
 
-		subFiles, err := ioutil.ReadDir(dbDir)
-		if err != nil {
-			checkError(fmt.Errorf("read database error: %s", err))
+		dbDirs, err := search.DBRepeatDirs(dbDir)
+		checkError(err)
+		if outputDBHits && len(dbDirs) == 1 {
+			log.Warningf("flag --output-db-hits ignored for a single database")
+			outputDBHits = false
 		}
 
-		dbDirs := make([]string, 0, 8)
-		for _, file := range subFiles {
-			if file.Name() == "." || file.Name() == ".." {
-				continue
-			}
-			path := filepath.Join(dbDir, file.Name())
-
-			if !file.IsDir() {
-				continue
-			}
-			existed, err := pathutil.Exists(filepath.Join(path, dbInfoFile))
-			if err != nil {
-				checkError(fmt.Errorf("read database error: %s", err))
-			}
-			if existed {
-				dbDirs = append(dbDirs, path)
+		// check system limits to avoid running out of memory or file descriptors
+		var nIndexFiles int
+		var dbSize int64
+		for _, path := range dbDirs {
+			n, size, err := indexFilesSize(path)
+			checkError(err)
+			nIndexFiles += n
+			dbSize += size
+		}
+		if loadWholeFile {
+			if mem, ok := availableMemory(); ok && uint64(dbSize) > mem {
+				log.Warningf("the database (%s) is larger than the available memory (%s), mmap is used instead of -w/--load-whole-db",
+					bytesize.ByteSize(dbSize), bytesize.ByteSize(mem))
+				loadWholeFile = false
+				useMmap = true
 			}
 		}
-		if len(dbDirs) == 0 {
-			checkError(fmt.Errorf("invalid kmcp database: %s", dbDir))
+		if limit, ok := openFilesLimit(); ok && uint64(nIndexFiles+64) > limit {
+			log.Warningf("the number of index files (%d) is close to or exceeds the limit of open files (ulimit -n: %d), "+
+				"please increase it with 'ulimit -n'", nIndexFiles, limit)
 		}
 
 		// ---------------------------------------------------------------
@@ -341,6 +678,31 @@ Examples:
 			// mappingNames = len(namesMap) > 0
 		}
 
+		var collisions *search.NameMappingCollisions
+		if collisionsFile != "" {
+			if !mappingNames {
+				log.Warningf("flag --report-map-collisions ignored when no name mapping files given (-N/--name-map)")
+			} else {
+				maps := []map[string]string{namesMap}
+				if loadDefaultNameMap {
+					for _, path := range dbDirs {
+						fileNameMapping, existed, err := search.NameMappingFile(path)
+						checkError(errors.Wrap(err, fileNameMapping))
+						if !existed {
+							continue
+						}
+						_namesMap, err := cliutil.ReadKVs(fileNameMapping, false)
+						checkError(errors.Wrap(err, fileNameMapping))
+						maps = append(maps, _namesMap)
+					}
+				}
+				collisions = search.NewNameMappingCollisions(maps...)
+				if outputLog {
+					log.Infof("  %d mapped names shared by multiple source names", len(collisions.Groups))
+				}
+			}
+		}
+
 		// ---------------------------------------------------------------
 		// load db
 
@@ -353,7 +715,7 @@ Examples:
 				log.Info("loading database ...")
 			}
 		}
-		searchOpt := SearchOptions{
+		searchOpt := search.SearchOptions{
 			LoadWholeFile: loadWholeFile,
 
 			UseMMap: useMmap,
@@ -361,6 +723,12 @@ Examples:
 			Verbose: opt.Verbose || opt.Log2File,
 
 			DeduplicateThreshold: deduplicateThreshold,
+			NoDeduplicate:        noDedup,
+			DedupStats:           dedupStats,
+
+			MaxKmersPerQuery: maxKmersPerQuery,
+			Seed:             uint64(seed),
+			CappedQueries:    &cappedQueries,
 
 			TopN:       topN,
 			TopNScores: topNScore,
@@ -373,24 +741,71 @@ Examples:
 			MinTargetCov: targetCov,
 			MaxFPR:       maxFPR,
 
+			MinRun: minRun,
+
+			KmerSketchScale: kmerSketchScale,
+			ReadScale:       readScale,
+
+			IDF: useIDF,
+
+			SkipMasked: skipMasked,
+
+			TCovOfGenome: tcovDenom == "genome",
+
+			EmitBlock: emitBlock,
+
+			ReportPositions: reportPositions,
+
 			LoadDefaultNameMap: loadDefaultNameMap,
 			NameMap:            namesMap,
 
 			TrySingleEnd: trySE,
+
+			Adapters: adapters,
+
+			TargetWhitelist: whitelist,
+
+			Shards: shards,
+			Shard:  shard,
+
+			MaxTargets: maxTargets,
+
+			Collapser: collapser,
+
+			KmerCacheSize:  cacheSize,
+			KmerCacheStats: cacheStats,
+
+			NameMapCollisions: collisions,
 		}
-		sg, err := NewUnikIndexDBSearchEngine(searchOpt, dbDirs...)
-		if err != nil {
-			checkError(err)
-		}
+		sg, err := search.Open(dbDirs, searchOpt)
+		checkError(err)
 
 		for _, db := range sg.DBs {
 			if queryCov <= db.Info.FPR {
 				checkError(fmt.Errorf("query coverage threshold (%f) should not be smaller than FPR of single bloom filter of index database (%f)", queryCov, db.Info.FPR))
 			}
+			if db.Info.MixedSketches && outputLog {
+				log.Warningf("the database was created from files of different sketch information (mixed-sketches), "+
+					"queries are searched with all k-mers, and query coverages of sketched references are underestimated: %s", db.Path)
+			}
+		}
+		dbAlphabet := sg.DBs[0].Info.Alphabet
+
+		if outputTaxid {
+			for _, db := range sg.DBs {
+				if !db.Info.Taxids {
+					checkError(fmt.Errorf("flag --output-taxid needs databases created by 'kmcp index --save-taxids': %s", db.Path))
+				}
+			}
 		}
 
 		if outputLog {
 			log.Infof("database loaded: %s", dbDir)
+			for _, db := range sg.DBs {
+				if db.Info.DBHash != "" {
+					log.Infof("  database hash of %s: %s", filepath.Base(db.Path), db.Info.DBHash)
+				}
+			}
 			log.Info()
 			log.Infof("-------------------- [main parameters] --------------------")
 			log.Infof("  minimum    query length: %d", minLen)
@@ -404,18 +819,140 @@ Examples:
 
 		timeStart1 := time.Now()
 
-		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(outFile, ".gz"), opt.CompressionLevel)
-		checkError(err)
+		// the header row is generated from the same columns of data rows
+		rw0 := searchRowWriter{OutputTaxid: outputTaxid, OutputChunksKmers: outputChunksKmers, Lineages: lineages,
+			KmerSketchScale: kmerSketchScale, OutputContainment: outputContainment, ErrorRate: errorRate, OutputMargin: outputMargin,
+			Precision: floatPrecision, OutputDBHits: outputDBHits, EmitBlock: emitBlock, JSONL: outJSONL,
+			EstimateANI: estimateANI, ReportPositions: reportPositions}
+		if estimateANI && !sg.DBs[0].Info.Scaled {
+			log.Warningf("ANI is only estimated for databases built with scaled sketches (compute -D/--scale), NA is outputted")
+			rw0.NoScaledSketch = true
+		}
+		if outJSONL && len(rw0.activeColumns()) > 0 {
+			checkError(fmt.Errorf("optional columns (e.g., --output-taxid) are only supported with --out-format tsv"))
+		}
+		header := rw0.Header()
+
+		var outfh *bufio.Writer
+		var gw io.WriteCloser
+		var w *os.File
+		noHeaderRow0 := noHeaderRow
+		var extraOutputClosers []func()
+		var outputFlushers []func() // for --flush-interval
 		defer func() {
-			outfh.Flush()
-			if gw != nil {
-				gw.Close()
+			for _, closeOutput := range extraOutputClosers {
+				closeOutput()
 			}
-			w.Close()
 		}()
+		if sqliteFile != "" { // results are written into an SQLite database instead of -o/--out-file
+			var sqliteOut *sqliteSink
+			sqliteOut, err = newSQLiteSink(sqliteFile, sqliteTable,
+				strings.Split(strings.TrimSuffix(header[1:], "\n"), "\t"), appendOutput, sqliteBatchSize)
+			checkError(err)
+			outfh = bufio.NewWriterSize(sqliteOut, writeBufferSize)
+			defer func() {
+				checkError(outfh.Flush())
+				checkError(sqliteOut.Close())
+			}()
+		} else {
+			if appendOutput {
+				if !outJSONL {
+					var needHeader bool
+					needHeader, err = checkHeaderForAppending(outFile, header)
+					checkError(err)
+					if !needHeader {
+						noHeaderRow = true
+					}
+				}
+				outfh, gw, w, err = outStreamWithBufferSize(outFile, strings.HasSuffix(outFile, ".gz"), opt.CompressionLevel, true, writeBufferSize)
+			} else {
+				outfh, gw, w, err = outStreamWithBufferSize(outFile, strings.HasSuffix(outFile, ".gz"), opt.CompressionLevel, false, writeBufferSize)
+			}
+			checkError(err)
+			defer func() {
+				outfh.Flush()
+				if gw != nil {
+					gw.Close()
+				}
+				w.Close()
+			}()
 
-		if !noHeaderRow {
-			outfh.WriteString("#query\tqLen\tqKmers\tFPR\thits\ttarget\tchunkIdx\tchunks\ttLen\tkSize\tmKmers\tqCov\ttCov\tjacc\tqueryIdx\n")
+			if !noHeaderRow {
+				outfh.WriteString(header)
+			}
+		}
+		outputFlushers = append(outputFlushers, func() {
+			outfh.Flush()
+			if f, ok := gw.(interface{ Flush() error }); ok {
+				f.Flush()
+			}
+		})
+
+		// matched and unmatched results could be written to separate files.
+		outfhM, outfhU := outfh, outfh
+		openExtraOutput := func(file string) *bufio.Writer {
+			var fh *bufio.Writer
+			var gw io.WriteCloser
+			var w *os.File
+			var err error
+			if appendOutput {
+				needHeader := !outJSONL
+				if needHeader {
+					needHeader, err = checkHeaderForAppending(file, header)
+					checkError(err)
+				}
+				fh, gw, w, err = outStreamWithBufferSize(file, strings.HasSuffix(file, ".gz"), opt.CompressionLevel, true, writeBufferSize)
+				checkError(err)
+				if needHeader && !noHeaderRow0 {
+					fh.WriteString(header)
+				}
+			} else {
+				fh, gw, w, err = outStreamWithBufferSize(file, strings.HasSuffix(file, ".gz"), opt.CompressionLevel, false, writeBufferSize)
+				checkError(err)
+				if !noHeaderRow0 {
+					fh.WriteString(header)
+				}
+			}
+			extraOutputClosers = append(extraOutputClosers, func() {
+				fh.Flush()
+				if gw != nil {
+					gw.Close()
+				}
+				w.Close()
+			})
+			outputFlushers = append(outputFlushers, func() {
+				fh.Flush()
+				if f, ok := gw.(interface{ Flush() error }); ok {
+					f.Flush()
+				}
+			})
+			return fh
+		}
+		if outMatchedFile != "" {
+			outfhM = openExtraOutput(outMatchedFile)
+		}
+		if outUnmatchedFile != "" {
+			outfhU = openExtraOutput(outUnmatchedFile)
+		}
+		var outfhBED *bufio.Writer
+		if outBEDFile != "" {
+			var gwBED io.WriteCloser
+			var wBED *os.File
+			outfhBED, gwBED, wBED, err = outStreamWithBufferSize(outBEDFile, strings.HasSuffix(outBEDFile, ".gz"), opt.CompressionLevel, appendOutput, writeBufferSize)
+			checkError(err)
+			extraOutputClosers = append(extraOutputClosers, func() {
+				outfhBED.Flush()
+				if gwBED != nil {
+					gwBED.Close()
+				}
+				wBED.Close()
+			})
+			outputFlushers = append(outputFlushers, func() {
+				outfhBED.Flush()
+				if f, ok := gwBED.(interface{ Flush() error }); ok {
+					f.Flush()
+				}
+			})
 		}
 
 		// ---------------------------------------------------------------
@@ -424,144 +961,87 @@ Examples:
 		var total, matched uint64
 		var speed float64 // k reads/second
 
+		// profiling while searching
+		var profiler *StreamProfiler
+		if profileFile != "" {
+			profiler = NewStreamProfiler(
+				getFlagNonNegativeFloat64(cmd, "profile-min-query-cov"),
+				getFlagPositiveFloat64(cmd, "profile-max-fpr"),
+				float64(getFlagPositiveInt(cmd, "profile-min-chunks-reads")),
+				float64(getFlagPositiveInt(cmd, "profile-min-uniq-reads")),
+				getFlagNonNegativeFloat64(cmd, "profile-min-chunks-fraction"))
+		}
+
+		// with --flush-interval, outputs are flushed periodically,
+		// and writing and flushing are serialized with a lock.
+		flushPeriodically := flushInterval > 0
+		var outputLock sync.Mutex
+		var stopFlushing chan int
+		if flushPeriodically {
+			stopFlushing = make(chan int)
+			go func() {
+				ticker := time.NewTicker(flushInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+						outputLock.Lock()
+						for _, flush := range outputFlushers {
+							flush()
+						}
+						outputLock.Unlock()
+					case <-stopFlushing:
+						return
+					}
+				}
+			}()
+		}
+
 		donePrint := make(chan int)
-		ch := make(chan *QueryResult, 1024)
+		ch := make(chan *search.QueryResult, 1024)
 		go func() {
-			var query []byte
-			var qLen, qKmers, FPR, hits string
-			var target, chunkIdx, chunks, tLen, kSize, mKmers, qCov, tCov, jacc, queryIdx string
+			rw := rw0
+			rw.BED = outfhBED
 
 			for result := range ch {
+				if fileAsQuery && outputLog {
+					log.Infof("  query %s: %d k-mers", result.QueryID, result.NumKmers)
+				}
+
 				if result.Matches == nil {
-					if !keepUnmatched {
-						poolQueryResult.Put(result)
-						continue
+					if keepUnmatched {
+						if flushPeriodically {
+							outputLock.Lock()
+						}
+						rw.WriteUnmatched(outfhU, result, false)
+						if flushPeriodically {
+							outputLock.Unlock()
+						}
 					}
 
-					query = result.QueryID
-					qLen = strconv.Itoa(result.QueryLen)
-					qKmers = strconv.Itoa(result.NumKmers)
-					// FPR = strconv.FormatFloat(result.FPR, 'e', 4, 64)
-					FPR = "0"
-					hits = "0"
-
-					kSize = strconv.Itoa(result.K)
-					queryIdx = strconv.Itoa(int(result.QueryIdx))
-
-					target = ""
-					chunkIdx = "-1"
-					chunks = "0"
-					tLen = "0"
-					mKmers = "0"
-					qCov = "0"
-					tCov = "0"
-					jacc = "0"
-
-					outfh.Write(query)
-					outfh.WriteByte('\t')
-					outfh.WriteString(qLen)
-					outfh.WriteByte('\t')
-					outfh.WriteString(qKmers)
-					outfh.WriteByte('\t')
-					outfh.WriteString(FPR)
-					outfh.WriteByte('\t')
-					outfh.WriteString(hits)
-					outfh.WriteByte('\t')
-
-					outfh.WriteString(target)
-					outfh.WriteByte('\t')
-					outfh.WriteString(chunkIdx)
-					outfh.WriteByte('\t')
-					outfh.WriteString(chunks)
-					outfh.WriteByte('\t')
-					outfh.WriteString(tLen)
-					outfh.WriteByte('\t')
-					outfh.WriteString(kSize)
-					outfh.WriteByte('\t')
-
-					outfh.WriteString(mKmers)
-					outfh.WriteByte('\t')
-					outfh.WriteString(qCov)
-					outfh.WriteByte('\t')
-					outfh.WriteString(tCov)
-					outfh.WriteByte('\t')
-					outfh.WriteString(jacc)
-					outfh.WriteByte('\t')
-					outfh.WriteString(queryIdx)
-
-					outfh.WriteByte('\n')
-
-					poolQueryResult.Put(result)
+					search.RecycleQueryResult(result)
 					continue
 				}
 
 				// found
-				matched++
-
-				query = result.QueryID
-				qLen = strconv.Itoa(result.QueryLen)
-				qKmers = strconv.Itoa(result.NumKmers)
-				// FPR = strconv.FormatFloat(result.FPR, 'e', 4, 64)
-				hits = strconv.Itoa(len(*result.Matches))
-
-				kSize = strconv.Itoa(result.K)
-				queryIdx = strconv.Itoa(int(result.QueryIdx))
-
-				for _, match := range *result.Matches {
-
-					target = match.Target[0]
-					chunkIdx = strconv.Itoa(int(uint16(match.TargetIdx[0])))
-					chunks = strconv.Itoa(int(match.TargetIdx[0] >> 16))
-					tLen = strconv.Itoa(int(match.GenomeSize[0]))
-					mKmers = strconv.Itoa(match.NumKmers)
-					qCov = strconv.FormatFloat(match.QCov, 'f', 4, 64)
-					tCov = strconv.FormatFloat(match.TCov, 'f', 4, 64)
-					jacc = strconv.FormatFloat(match.JaccardIndex, 'f', 4, 64)
-					FPR = strconv.FormatFloat(match.FPR, 'e', 4, 64)
-
-					outfh.Write(query)
-					outfh.WriteByte('\t')
-					outfh.WriteString(qLen)
-					outfh.WriteByte('\t')
-					outfh.WriteString(qKmers)
-					outfh.WriteByte('\t')
-					outfh.WriteString(FPR)
-					outfh.WriteByte('\t')
-					outfh.WriteString(hits)
-					outfh.WriteByte('\t')
-
-					outfh.WriteString(target)
-					outfh.WriteByte('\t')
-					outfh.WriteString(chunkIdx)
-					outfh.WriteByte('\t')
-					outfh.WriteString(chunks)
-					outfh.WriteByte('\t')
-					outfh.WriteString(tLen)
-					outfh.WriteByte('\t')
-					outfh.WriteString(kSize)
-					outfh.WriteByte('\t')
-
-					outfh.WriteString(mKmers)
-					outfh.WriteByte('\t')
-					outfh.WriteString(qCov)
-					outfh.WriteByte('\t')
-					outfh.WriteString(tCov)
-					outfh.WriteByte('\t')
-					outfh.WriteString(jacc)
-					outfh.WriteByte('\t')
-					outfh.WriteString(queryIdx)
-
-					outfh.WriteByte('\n')
+				atomic.AddUint64(&matched, 1)
+				if profiler != nil {
+					profiler.Add(result)
+				}
+
+				if flushPeriodically {
+					outputLock.Lock()
+				}
+				rw.WriteMatches(outfhM, result)
+				if flushPeriodically {
+					outputLock.Unlock()
 				}
 
 				//if immediateOutput {
-				// outfh.Flush()
+				// outfhM.Flush()
 				//}
 
-				(*result.Matches) = (*(result.Matches))[:0]
-				poolMatches.Put(result.Matches)
-
-				poolQueryResult.Put(result)
+				search.RecycleQueryResult(result)
 			}
 			donePrint <- 1
 		}()
@@ -569,154 +1049,83 @@ Examples:
 		done := make(chan int)
 		go func() {
 			if !keepOrder {
-				var query []byte
-				var qLen, qKmers, FPR, hits string
-				var target, chunkIdx, chunks, tLen, kSize, mKmers, qCov, tCov, jacc, queryIdx string
+				rw := rw0
+				rw.BED = outfhBED
 				for result := range sg.OutCh {
-					total++
+					checkError(errors.Wrap(result.Err, string(result.QueryID)))
+					atomic.AddUint64(&total, 1)
+					if result.Explain != nil {
+						checkError(result.Explain.Write(stderrWriter(), result))
+					}
+					if calibration != nil {
+						calibration.Add(result)
+					}
+					if qcovHist != nil {
+						qcovHist.Add(result)
+					}
 
 					// output(result)
 					if result.Matches == nil {
-						if !keepUnmatched {
-							poolQueryResult.Put(result)
-							continue
+						if keepUnmatched {
+							if flushPeriodically {
+								outputLock.Lock()
+							}
+							rw.WriteUnmatched(outfhU, result, true)
+							if flushPeriodically {
+								outputLock.Unlock()
+							}
 						}
 
-						query = result.QueryID
-						qLen = strconv.Itoa(result.QueryLen)
-						qKmers = strconv.Itoa(result.NumKmers)
-						FPR = strconv.FormatFloat(result.FPR, 'e', 4, 64)
-						hits = "0"
-
-						kSize = strconv.Itoa(result.K)
-						queryIdx = strconv.Itoa(int(result.QueryIdx))
-
-						target = ""
-						chunkIdx = "-1"
-						chunks = "0"
-						tLen = "0"
-						mKmers = "0"
-						qCov = "0"
-						tCov = "0"
-						jacc = "0"
-
-						outfh.Write(query)
-						outfh.WriteByte('\t')
-						outfh.WriteString(qLen)
-						outfh.WriteByte('\t')
-						outfh.WriteString(qKmers)
-						outfh.WriteByte('\t')
-						outfh.WriteString(FPR)
-						outfh.WriteByte('\t')
-						outfh.WriteString(hits)
-						outfh.WriteByte('\t')
-
-						outfh.WriteString(target)
-						outfh.WriteByte('\t')
-						outfh.WriteString(chunkIdx)
-						outfh.WriteByte('\t')
-						outfh.WriteString(chunks)
-						outfh.WriteByte('\t')
-						outfh.WriteString(tLen)
-						outfh.WriteByte('\t')
-						outfh.WriteString(kSize)
-						outfh.WriteByte('\t')
-
-						outfh.WriteString(mKmers)
-						outfh.WriteByte('\t')
-						outfh.WriteString(qCov)
-						outfh.WriteByte('\t')
-						outfh.WriteString(tCov)
-						outfh.WriteByte('\t')
-						outfh.WriteString(jacc)
-						outfh.WriteByte('\t')
-						outfh.WriteString(queryIdx)
-
-						outfh.WriteByte('\n')
-
-						poolQueryResult.Put(result)
+						search.RecycleQueryResult(result)
 						continue
 					}
 
 					// found
-					matched++
-
-					query = result.QueryID
-					qLen = strconv.Itoa(result.QueryLen)
-					qKmers = strconv.Itoa(result.NumKmers)
-					// FPR = strconv.FormatFloat(result.FPR, 'e', 4, 64)
-					hits = strconv.Itoa(len(*result.Matches))
-
-					kSize = strconv.Itoa(result.K)
-					queryIdx = strconv.Itoa(int(result.QueryIdx))
-
-					for _, match := range *result.Matches {
-
-						target = match.Target[0]
-						chunkIdx = strconv.Itoa(int(uint16(match.TargetIdx[0])))
-						chunks = strconv.Itoa(int(match.TargetIdx[0] >> 16))
-						tLen = strconv.Itoa(int(match.GenomeSize[0]))
-						mKmers = strconv.Itoa(match.NumKmers)
-						qCov = strconv.FormatFloat(match.QCov, 'f', 4, 64)
-						tCov = strconv.FormatFloat(match.TCov, 'f', 4, 64)
-						jacc = strconv.FormatFloat(match.JaccardIndex, 'f', 4, 64)
-						FPR = strconv.FormatFloat(match.FPR, 'e', 4, 64)
-
-						outfh.Write(query)
-						outfh.WriteByte('\t')
-						outfh.WriteString(qLen)
-						outfh.WriteByte('\t')
-						outfh.WriteString(qKmers)
-						outfh.WriteByte('\t')
-						outfh.WriteString(FPR)
-						outfh.WriteByte('\t')
-						outfh.WriteString(hits)
-						outfh.WriteByte('\t')
-
-						outfh.WriteString(target)
-						outfh.WriteByte('\t')
-						outfh.WriteString(chunkIdx)
-						outfh.WriteByte('\t')
-						outfh.WriteString(chunks)
-						outfh.WriteByte('\t')
-						outfh.WriteString(tLen)
-						outfh.WriteByte('\t')
-						outfh.WriteString(kSize)
-						outfh.WriteByte('\t')
-
-						outfh.WriteString(mKmers)
-						outfh.WriteByte('\t')
-						outfh.WriteString(qCov)
-						outfh.WriteByte('\t')
-						outfh.WriteString(tCov)
-						outfh.WriteByte('\t')
-						outfh.WriteString(jacc)
-						outfh.WriteByte('\t')
-						outfh.WriteString(queryIdx)
-
-						outfh.WriteByte('\n')
+					atomic.AddUint64(&matched, 1)
+					if profiler != nil {
+						profiler.Add(result)
+					}
+
+					if flushPeriodically {
+						outputLock.Lock()
+					}
+					rw.WriteMatches(outfhM, result)
+					if flushPeriodically {
+						outputLock.Unlock()
 					}
 
 					//if immediateOutput {
-					// outfh.Flush()
+					// outfhM.Flush()
 					//}
 
-					(*result.Matches) = (*(result.Matches))[:0]
-					poolMatches.Put(result.Matches)
-
-					poolQueryResult.Put(result)
+					search.RecycleQueryResult(result)
 				}
 			} else {
-				m := make(map[uint64]*QueryResult, opt.NumCPUs)
+				m := make(map[uint64]*search.QueryResult, opt.NumCPUs)
 				var id, _id uint64
 				var ok bool
 
 				for result := range sg.OutCh {
-					total++
+					checkError(errors.Wrap(result.Err, string(result.QueryID)))
+					atomic.AddUint64(&total, 1)
+					if result.Explain != nil {
+						checkError(result.Explain.Write(stderrWriter(), result))
+					}
+					if calibration != nil {
+						calibration.Add(result)
+					}
+					if qcovHist != nil {
+						qcovHist.Add(result)
+					}
 					if verbose {
 						if (total < 8192 && total&63 == 0) || total&8191 == 0 {
 							speed = float64(total) / 1000000 / time.Since(timeStart1).Minutes()
-							fmt.Fprintf(os.Stderr, "processed queries: %d, speed: %.3f million queries per minute\r", total, speed)
+							if logJSON {
+								logInfoFields(logFields{"queries": total, "speed": speed},
+									"processed queries: %d, speed: %.3f million queries per minute", total, speed)
+							} else {
+								fmt.Fprintf(os.Stderr, "processed queries: %d, speed: %.3f million queries per minute\r", total, speed)
+							}
 						}
 					}
 
@@ -764,50 +1173,134 @@ Examples:
 		// send query
 
 		ks := sg.DBs[0].Info.Ks
-		nnn := bytes.Repeat([]byte{'N'}, ks[len(ks)-1]-1) // overlap of k-1 bp
+		gap := byte('N')
+		if !search.IsDNAAlphabet(dbAlphabet) {
+			gap = 'X'
+		}
+		nnn := bytes.Repeat([]byte{gap}, ks[len(ks)-1]-1) // overlap of k-1 bp
 
-		if pairedEnd {
+		// queries shorter than the smallest k produce no k-mers, it's common
+		// when searching short reads against a database with a big k.
+		kMin := ks[0]
+		for _, db := range sg.DBs {
+			for _, k := range db.Info.Ks {
+				if k < kMin {
+					kMin = k
+				}
+			}
+		}
+		var nShortQueries, nQueries uint64
+
+		// warn about contradictory thresholds with the first queries
+		thresholdChecker := NewThresholdChecker(1000, kMin, sg.DBs[0].Info, minLen, minCount, queryCov)
+		thresholdChecker.SetReadScale(readScale)
+
+		var progress *ProgressReporter
+		if progressFile != "" {
+			fh, err := openProgressOutput(progressFile)
+			checkError(errors.Wrap(err, progressFile))
+			progress = NewProgressReporter(fh, progressInterval, timeStart1, func() SearchProgress {
+				return SearchProgress{
+					Processed: atomic.LoadUint64(&total),
+					Total:     atomic.LoadUint64(&nQueries),
+					Matched:   atomic.LoadUint64(&matched),
+				}
+			})
+		}
+
+		if len(queryUnikFiles) > 0 {
+			var codes []uint64
+			var meta Meta
+			var sequence *seq.Seq
+			for id, file := range queryUnikFiles {
+				if outputLog {
+					log.Infof("reading k-mers from .unik file: %s", file)
+				}
+				codes, meta, err = readUnikQuery(file, sg.DBs[0].Info)
+				checkError(errors.Wrap(err, file))
+
+				recordID := []byte(meta.SeqID)
+				if len(recordID) == 0 {
+					recordID = []byte(filepath.Base(file))
+				}
+
+				sequence = search.NewSeq()
+				sequence.Seq = sequence.Seq[:0]
+
+				query := search.NewQuery()
+				query.Idx = uint64(id)
+				query.ID = recordID
+				query.Explain = explainQuery(recordID)
+				query.Seq = sequence
+				query.Seq2 = nil
+				query.Kmers = codes
+				query.KmersLen = int(meta.GenomeSize)
+
+				atomic.AddUint64(&nQueries, 1)
+
+				sg.InCh <- query
+			}
+		} else if pairedEnd {
 			var id uint64
 
 			if outputLog {
 				log.Infof("reading from paired-end files: %s, %s", read1, read2)
 			}
-			fastxReader1, err := fastx.NewDefaultReader(read1)
+			fastxReader1, closer1, err := newFastxReader(read1, gzipBlocks)
 			checkError(errors.Wrap(err, read1))
+			if closer1 != nil {
+				defer closer1.Close()
+			}
 
-			fastxReader2, err := fastx.NewDefaultReader(read2)
+			fastxReader2, closer2, err := newFastxReader(read2, gzipBlocks)
 			checkError(errors.Wrap(err, read2))
+			if closer2 != nil {
+				defer closer2.Close()
+			}
 
 			var record1, record2 *fastx.Record
 			var n, ns, nt int
+			first := true
 
 			for {
 				record1, err = fastxReader1.Read()
 				if err != nil {
 					if err == io.EOF {
+						// read2 should be finished too
+						_, err = fastxReader2.Read()
+						if err == nil {
+							checkError(fmt.Errorf("unpaired reads: %s has more records than %s (%d)", read2, read1, id))
+						} else if err != io.EOF {
+							checkError(errors.Wrap(err, read2))
+						}
 						break
 					}
-					errors.Wrap(err, read1)
+					checkError(errors.Wrap(err, read1))
 					break
 				}
+				if first {
+					checkError(search.CheckQueryAlphabet(dbAlphabet, record1.Seq.Alphabet, read1))
+					first = false
+				}
 
 				record2, err = fastxReader2.Read()
 				if err != nil {
 					if err == io.EOF {
-						break
+						checkError(fmt.Errorf("unpaired reads: %s has more records than %s (%d)", read1, read2, id))
 					}
-					errors.Wrap(err, read2)
+					checkError(errors.Wrap(err, read2))
 					break
 				}
 
 				recordID := make([]byte, len(record1.ID))
 				copy(recordID, record1.ID)
 
-				query := poolQuery.Get().(*Query)
+				query := search.NewQuery()
 				query.Idx = id
 				query.ID = recordID
+				query.Explain = explainQuery(recordID)
 
-				clone := poolSeq.Get().(*seq.Seq)
+				clone := search.NewSeq()
 				clone.Alphabet = record1.Seq.Alphabet
 				ns = len(record1.Seq.Seq)
 				nt = len(clone.Seq)
@@ -823,7 +1316,7 @@ Examples:
 				}
 				query.Seq = clone
 
-				clone2 := poolSeq.Get().(*seq.Seq)
+				clone2 := search.NewSeq()
 				clone2.Alphabet = record2.Seq.Alphabet
 				ns = len(record2.Seq.Seq)
 				nt = len(clone2.Seq)
@@ -839,6 +1332,12 @@ Examples:
 				}
 				query.Seq2 = clone2
 
+				atomic.AddUint64(&nQueries, 1)
+				thresholdChecker.Add(len(record1.Seq.Seq), len(record2.Seq.Seq))
+				if len(record1.Seq.Seq) < kMin && len(record2.Seq.Seq) < kMin {
+					nShortQueries++
+				}
+
 				sg.InCh <- query
 
 				id++
@@ -846,21 +1345,100 @@ Examples:
 			if id == 0 {
 				log.Warningf("no valid sequences in files: %s, %s", read1, read2)
 			}
-		} else {
-			var fastxReader *fastx.Reader
-			var record *fastx.Record
-
-			var id0, id uint64
+		} else if interleaveInputs {
+			// reading all input files (e.g., named pipes) simultaneously,
+			// and sending reads from whichever has data ready.
+			type readRecord struct {
+				id  []byte
+				seq *seq.Seq
+			}
+			chRecords := make(chan readRecord, 1024)
+			var wgReaders sync.WaitGroup
 			for _, file := range files {
+				wgReaders.Add(1)
+				go func(file string) {
+					defer wgReaders.Done()
+
+					if outputLog {
+						log.Infof("reading sequence file: %s", file)
+					}
+					fastxReader, closer, err := newFastxReader(file, gzipBlocks)
+					checkError(errors.Wrap(err, file))
+					if closer != nil {
+						defer closer.Close()
+					}
+
+					var record *fastx.Record
+					var n int
+					first := true
+					for {
+						record, err = fastxReader.Read()
+						if err != nil {
+							if err == io.EOF {
+								break
+							}
+							checkError(errors.Wrap(err, file))
+							break
+						}
+						if first {
+							checkError(search.CheckQueryAlphabet(dbAlphabet, record.Seq.Alphabet, file))
+							first = false
+						}
+
+						recordID := make([]byte, len(record.ID))
+						copy(recordID, record.ID)
+						chRecords <- readRecord{id: recordID, seq: record.Seq.Clone2()}
+						n++
+					}
+
+					if n == 0 {
+						log.Warningf("no valid sequences in file: %s", file)
+					} else if outputLog {
+						log.Infof("finished reading sequence file: %s", file)
+					}
+				}(file)
+			}
+			go func() {
+				wgReaders.Wait()
+				close(chRecords)
+			}()
+
+			var id uint64 // unique across all input files
+			for record := range chRecords {
+				query := search.NewQuery()
+				query.Idx = id
+				query.ID = record.id
+				query.Explain = explainQuery(record.id)
+				query.Seq = record.seq
+
+				atomic.AddUint64(&nQueries, 1)
+				thresholdChecker.Add(len(record.seq.Seq))
+				if len(record.seq.Seq) < kMin {
+					nShortQueries++
+				}
+
+				sg.InCh <- query
+
+				id++
+			}
+		} else {
+			// readQueryFile reads queries from a file, it's safe for concurrent use.
+			readQueryFile := func(file string, send func(query *search.Query)) {
 				if outputLog {
 					log.Infof("reading sequence file: %s", file)
 				}
-				fastxReader, err = fastx.NewDefaultReader(file)
+				fastxReader, closer, err := newFastxReader(file, gzipBlocks)
 				checkError(errors.Wrap(err, file))
+				if closer != nil {
+					defer closer.Close()
+				}
+
+				var record *fastx.Record
 
 				if wholeFile {
 					var recordID []byte
 					var sequence *seq.Seq
+					var nRecords int
 					first := true
 					for {
 						record, err = fastxReader.Read()
@@ -868,11 +1446,22 @@ Examples:
 							if err == io.EOF {
 								break
 							}
-							errors.Wrap(err, file)
+							checkError(errors.Wrap(err, file))
+							break
+						}
+
+						if maxWholeFileRecords > 0 && nRecords == maxWholeFileRecords {
+							log.Warningf("only the first %d records are used for the query of file: %s", nRecords, file)
 							break
 						}
+						if maxWholeFileBases > 0 && !first && len(sequence.Seq)+len(record.Seq.Seq) > maxWholeFileBases {
+							log.Warningf("only the first %d records (%d bases) are used for the query of file: %s", nRecords, len(sequence.Seq), file)
+							break
+						}
+						nRecords++
 
 						if first {
+							checkError(search.CheckQueryAlphabet(dbAlphabet, record.Seq.Alphabet, file))
 							if useFileName {
 								filename, _ := filepathTrimExtension(file)
 								recordID = []byte(filename)
@@ -883,6 +1472,12 @@ Examples:
 								copy(recordID, record.ID)
 							}
 							sequence = record.Seq.Clone2()
+							if maxWholeFileBases > 0 && len(sequence.Seq) > maxWholeFileBases {
+								log.Warningf("only the first %d bases of the first record are used for the query of file: %s", maxWholeFileBases, file)
+								sequence.Seq = sequence.Seq[:maxWholeFileBases]
+								first = false
+								break
+							}
 							first = false
 						} else {
 							sequence.Seq = append(sequence.Seq, record.Seq.Seq...)
@@ -892,48 +1487,45 @@ Examples:
 
 					if sequence == nil { // invalid input
 						log.Warningf("no valid sequences in file: %s", file)
-						continue
+						return
 					}
 
-					query := poolQuery.Get().(*Query)
-					query.Idx = id
+					query := search.NewQuery()
 					query.ID = recordID
+					query.Explain = explainQuery(recordID)
 					query.Seq = sequence
-					sg.InCh <- query
-
-					// sg.InCh <- &Query{
-					// 	Idx: id,
-					// 	ID:  recordID,
-					// 	Seq: sequence,
-					// }
 
-					id++
+					send(query)
 
-					continue
+					return
 				}
 
-				id0 = id
-				var n, ns, nt int
+				var n, ns, nt, nRecords int
+				first := true
 				for {
 					record, err = fastxReader.Read()
 					if err != nil {
 						if err == io.EOF {
 							break
 						}
-						errors.Wrap(err, file)
+						checkError(errors.Wrap(err, file))
 						break
 					}
+					if first {
+						checkError(search.CheckQueryAlphabet(dbAlphabet, record.Seq.Alphabet, file))
+						first = false
+					}
 
 					recordID := make([]byte, len(record.ID))
 					copy(recordID, record.ID)
 
-					query := poolQuery.Get().(*Query)
-					query.Idx = id
+					query := search.NewQuery()
 					query.ID = recordID
+					query.Explain = explainQuery(recordID)
 
 					// query.Seq = record.Seq.Clone2()
 					// query.Seq = cloneFastx(record.Seq)
-					clone := poolSeq.Get().(*seq.Seq)
+					clone := search.NewSeq()
 					clone.Alphabet = record.Seq.Alphabet
 
 					// slower
@@ -958,43 +1550,190 @@ Examples:
 					}
 					query.Seq = clone
 
-					sg.InCh <- query
+					send(query)
 
-					// sg.InCh <- &Query{
-					// 	Idx: id,
-					// 	ID:  recordID,
-					// 	Seq: record.Seq.Clone2(),
-					// }
-
-					id++
+					nRecords++
 				}
 
-				if id0 == id {
+				if nRecords == 0 {
 					log.Warningf("no valid sequences in file: %s", file)
 				}
 			}
+
+			// query indexes are assigned in the only sending goroutine,
+			// so they are consecutive for keeping the output order.
+			var id uint64
+			send := func(query *search.Query) {
+				query.Idx = id
+
+				atomic.AddUint64(&nQueries, 1)
+				if !wholeFile {
+					ns := len(query.Seq.Seq)
+					thresholdChecker.Add(ns)
+					if ns < kMin {
+						nShortQueries++
+					}
+				}
+
+				sg.InCh <- query
+
+				id++
+			}
+
+			if readerThreads > 1 && len(files) > 1 {
+				// reading multiple files concurrently,
+				// queries from different files are interleaved.
+				chQueries := make(chan *search.Query, readerThreads)
+				go func() {
+					tokens := make(chan int, readerThreads)
+					var wgReaders sync.WaitGroup
+					for _, file := range files {
+						tokens <- 1
+						wgReaders.Add(1)
+						go func(file string) {
+							defer func() {
+								wgReaders.Done()
+								<-tokens
+							}()
+							readQueryFile(file, func(query *search.Query) {
+								chQueries <- query
+							})
+						}(file)
+					}
+					wgReaders.Wait()
+					close(chQueries)
+				}()
+
+				for query := range chQueries {
+					send(query)
+				}
+			} else {
+				for _, file := range files {
+					readQueryFile(file, send)
+				}
+			}
 		}
 
-		close(sg.InCh) // close Inch
+		thresholdChecker.Check() // for a few queries
 
-		sg.Wait() // wait all searching finished
+		sg.Done() // wait all searching finished
 		<-done    // all result returned and outputed
 		<-donePrint
+		if flushPeriodically {
+			stopFlushing <- 1 // received only between flushes
+		}
+		if progress != nil {
+			checkError(progress.Close())
+		}
+		if profiler != nil {
+			nRefs, err := profiler.WriteTo(profileFile, opt.CompressionLevel)
+			checkError(err)
+			if outputLog {
+				log.Infof("quick profile of %d references from %.0f reads saved to: %s", nRefs, profiler.NumReads, profileFile)
+			}
+		}
 
 		if outputLog {
-			fmt.Fprintf(os.Stderr, "\n")
+			if !logJSON {
+				fmt.Fprintf(os.Stderr, "\n")
+			}
 
 			speed = float64(total) / 1000000 / time.Since(timeStart1).Minutes()
 			log.Infof("")
-			log.Infof("processed queries: %d, speed: %.3f million queries per minute\n", total, speed)
-			log.Infof("%.4f%% (%d/%d) queries matched", float64(matched)/float64(total)*100, matched, total)
+			logInfoFields(logFields{"queries": total, "speed": speed},
+				"processed queries: %d, speed: %.3f million queries per minute\n", total, speed)
+			logInfoFields(logFields{"queries": total, "matched": matched},
+				"%.4f%% (%d/%d) queries matched", float64(matched)/float64(total)*100, matched, total)
+			if adapters != nil {
+				logInfoFields(logFields{"queries": total, "adapterQueries": adapters.NumFlagged()},
+					"%.4f%% (%d/%d) queries dominated by adapter k-mers and skipped",
+					float64(adapters.NumFlagged())/float64(total)*100, adapters.NumFlagged(), total)
+			}
+			if maxKmersPerQuery > 0 {
+				logInfoFields(logFields{"cappedQueries": atomic.LoadUint64(&cappedQueries)},
+					"%d queries with > %d k-mers (--max-kmers-per-query) sampled", atomic.LoadUint64(&cappedQueries), maxKmersPerQuery)
+			}
+			if dedupStats != nil {
+				logInfoFields(logFields{"dedupQueries": dedupStats.Queries(), "dedupKmers": dedupStats.Kmers(), "dedupUniqKmers": dedupStats.Uniq()},
+					"k-mer deduplication: %d queries with > %d k-mers (-u/--kmer-dedup-threshold), %d k-mers, %d distinct, %.4f%% duplicates removed",
+					dedupStats.Queries(), deduplicateThreshold, dedupStats.Kmers(), dedupStats.Uniq(), dedupStats.DupRate()*100)
+			}
+			if cacheStats != nil {
+				logInfoFields(logFields{"cacheHits": cacheStats.Hits(), "cacheLookups": cacheStats.Lookups()},
+					"k-mer cache hit rate: %.4f%% (%d/%d)",
+					cacheStats.HitRate()*100, cacheStats.Hits(), cacheStats.Lookups())
+			}
 			log.Infof("done searching")
 		}
 
+		if nShortQueries > 0 && float64(nShortQueries) >= float64(nQueries)*shortQueriesWarningProp {
+			log.Warningf("%.4f%% (%d/%d) queries are shorter than the k-mer size of the database (k=%d), they produce no k-mers and can't be matched. Please use a database built with a smaller k",
+				float64(nShortQueries)/float64(nQueries)*100, nShortQueries, nQueries, kMin)
+		}
+
+		if qcovHist != nil {
+			if lines := qcovHist.Lines(50); len(lines) > 0 {
+				log.Info()
+				log.Infof("histogram of query coverages of the best matches:")
+				for _, line := range lines {
+					log.Infof("  %s", line)
+				}
+			}
+		}
+
+		if calibration != nil {
+			log.Info()
+			log.Infof("calibration of -t/--min-query-cov with reads of %s:", calibrateTruth)
+			log.Infof("  %9s  %14s  %11s  %9s  %6s", "threshold", "matchedQueries", "sensitivity", "precision", "F1")
+			for _, r := range calibration.Records() {
+				log.Infof("  %9.4f  %14d  %11.4f  %9.4f  %6.4f", r.Threshold, r.MatchedQueries, r.Sensitivity, r.Precision, r.F1)
+			}
+			best, err := calibration.Suggest()
+			if err != nil {
+				log.Warningf("no threshold suggested: %s", err)
+			} else {
+				log.Infof("suggested -t/--min-query-cov: %.4f (sensitivity: %.4f, precision: %.4f)",
+					best.Threshold, best.Sensitivity, best.Precision)
+			}
+		}
+
+		if collisions != nil {
+			checkError(writeNameMappingCollisions(collisions, collisionsFile, opt.CompressionLevel))
+			if outputLog {
+				log.Infof("name mapping collisions saved to: %s", collisionsFile)
+			}
+		}
+
 		checkError(sg.Close()) // cleanup
 	},
 }
 
+// writeNameMappingCollisions writes name mapping collisions to a file.
+func writeNameMappingCollisions(collisions *search.NameMappingCollisions, file string, level int) error {
+	outfh, gw, w, err := outStream(file, strings.HasSuffix(strings.ToLower(file), ".gz"), level)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		outfh.Flush()
+		if gw != nil {
+			gw.Close()
+		}
+		w.Close()
+	}()
+
+	return collisions.Write(outfh)
+}
+
+// shortQueriesWarningProp is the minimal proportion of queries shorter than k to emit a warning.
+const shortQueriesWarningProp = 0.1
+
+// qcovHistogramBinWidth is the bin width of the histogram of query coverages of the best matches.
+const qcovHistogramBinWidth = 0.05
+
+// sqliteBatchSize is the number of rows inserted in a transaction for --sqlite.
+const sqliteBatchSize = 10000
+
 func init() {
 	RootCmd.AddCommand(searchCmd)
 
@@ -1002,9 +1741,53 @@ func init() {
 
 	searchCmd.Flags().StringP("read2", "2", "", formatFlagUsage("(Gzipped) read2 file."))
 
+	searchCmd.Flags().StringSliceP("query-unik", "", []string{},
+		formatFlagUsage(`.unik file(s) created by "kmcp compute" as queries, each file is searched as a query with its k-mers, `+
+			`other input files are ignored. K-mer parameters should be the same as those of the database, which needs a single k-mer size.`))
+
 	searchCmd.Flags().BoolP("try-se", "", false,
 		formatFlagUsage(`If paired-end reads have no hits, re-search with read1, if still fails, try read2.`))
 
+	searchCmd.Flags().StringP("adapters", "", "",
+		formatFlagUsage(`Skip queries dominated by adapter k-mers, e.g., adapter dimers. Value: a (gzipped) FASTA/Q file of adapter sequences, or "builtin" for common Illumina adapters.`))
+
+	searchCmd.Flags().IntP("adapter-kmer-size", "", 15,
+		formatFlagUsage(`K-mer size for detecting adapters.`))
+
+	searchCmd.Flags().Float64P("adapter-min-prop", "", 0.5,
+		formatFlagUsage(`Minimal proportion of adapter k-mers in a query to skip it.`))
+
+	searchCmd.Flags().StringP("target-whitelist", "", "",
+		formatFlagUsage(`A file of target names (the first column, names in the database rather than mapped ones). Only index files containing these targets are loaded, and only matches of them are outputted.`))
+
+	searchCmd.Flags().StringP("shards", "", "",
+		formatFlagUsage(`Only load and search the Mth of N shards of index files, in the format of "N/M", for distributing a search of a huge database `+
+			`across memory-constrained nodes. Results of all shards should be merged with "kmcp merge". `+
+			`Please note that --keep-top-scores and --max-target-seqs apply to every shard.`))
+
+	searchCmd.Flags().IntP("gzip-blocks", "", 8,
+		formatFlagUsage(`Number of 1-MiB blocks of gzipped input files to decompress ahead in a background goroutine, which keeps searching threads fed. 0 for decompressing in the reading goroutine.`))
+
+	searchCmd.Flags().BoolP("interleave-inputs", "", false,
+		formatFlagUsage(`Read all single-end input files simultaneously and search reads from whichever has data ready, `+
+			`e.g., named pipes fed by a live basecaller for real-time classification. Reads from different files are interleaved, `+
+			`and the queryIdx is unique across files.`))
+
+	searchCmd.Flags().IntP("reader-threads", "", 1,
+		formatFlagUsage(`Number of input files to read concurrently, e.g., for thousands of small genome files `+
+			`with -g/--query-whole-file, where opening and parsing files one by one keeps searching threads idle. `+
+			`Queries from different files are interleaved when > 1, and the queryIdx is unique across files. `+
+			`Stdin is always read by a single reader.`))
+
+	searchCmd.Flags().StringP("explain-query", "", "",
+		formatFlagUsage(`Print diagnostic information of the query with this ID to stderr, including the number of k-mers, matched k-mers of top targets, thresholds passed or failed, and the final result.`))
+
+	searchCmd.Flags().BoolP("dedup-across-queries", "", false,
+		formatFlagUsage(`Cache matched targets of recently searched k-mers to skip repeated lookups in index files, which speeds up searching reads sharing lots of k-mers, e.g., deep amplicon data. Please check the hit rate in the log. Not used for a single hash function with mmap.`))
+
+	searchCmd.Flags().IntP("cache-size", "", 65536,
+		formatFlagUsage(`Maximal number of k-mers in the cache of each index file (and each extra searching thread of it) for --dedup-across-queries. Memory: cache-size * (#targets / 8) bytes for each cache.`))
+
 	// database option
 	searchCmd.Flags().StringP("db-dir", "d", "",
 		formatFlagUsage(`Database directory created by "kmcp index". Please add -w/--load-whole-db for databases on network-attached storages (NAS), e.g., a computer cluster environment.`))
@@ -1016,6 +1799,21 @@ func init() {
 		formatFlagUsage(`Do not load all index files into memory nor use mmap, the searching would be very very slow for a large number of queries. Please read "Index files loading modes" in "kmcp search -h".`))
 
 	// query option
+	searchCmd.Flags().BoolP("no-dedup", "", false,
+		formatFlagUsage(`Do not deduplicate k-mers of queries, which is pure overhead for clean short reads. Duplicated k-mers would be counted multiple times in query coverages of long queries.`))
+
+	searchCmd.Flags().IntP("read-scale", "", 1,
+		formatFlagUsage(`Only search 1/S of k-mers of each query, sampled by hash values (FracMinHash), for ultra-fast screening of high-coverage data, `+
+			`e.g., checking presence of an organism across many samples. It's independent of the scale of the database. `+
+			`The number of sampled k-mers is reported in the column qKmers, and -c/--min-kmers applies to sampled k-mers.`))
+
+	searchCmd.Flags().IntP("max-kmers-per-query", "", 0,
+		formatFlagUsage(`Maximal number of (distinct) k-mers of a query. K-mers of queries with more k-mers are deterministically sampled (--seed), `+
+			`which bounds the worst-case time and memory of pathological queries, e.g., in a public-facing service. 0 for no limit.`))
+
+	searchCmd.Flags().Int64P("seed", "", 1,
+		formatFlagUsage(`Seed for sampling k-mers with --max-kmers-per-query.`))
+
 	searchCmd.Flags().IntP("kmer-dedup-threshold", "u", 256,
 		formatFlagUsage(`Remove duplicated kmers for a query with >= X k-mers.`))
 
@@ -1025,13 +1823,39 @@ func init() {
 	searchCmd.Flags().BoolP("use-filename", "G", false,
 		formatFlagUsage(`Use file name as query ID when using the whole file as a query.`))
 
+	searchCmd.Flags().IntP("max-whole-file-records", "", 0,
+		formatFlagUsage(`Maximal number of records to concatenate when using the whole file as a query, the remaining ones are ignored with a warning. 0 for no limit. A bounded sample is sufficient for sketch databases.`))
+
+	searchCmd.Flags().IntP("max-whole-file-bases", "", 0,
+		formatFlagUsage(`Maximal number of bases to concatenate when using the whole file as a query, which prevents running out of memory for huge files. 0 for no limit.`))
+
 	searchCmd.Flags().StringP("query-id", "", "",
 		formatFlagUsage(`Custom query Id when using the whole file as a query.`))
 
+	searchCmd.Flags().BoolP("file-as-query", "", false,
+		formatFlagUsage(`Treat each input file as a query with k-mers of all its reads pooled, and use the file name as query ID, e.g., for per-sample fingerprinting. It's the same as "-g -G", and --query-id is ignored. Numbers of k-mers of all files are reported in the log.`))
+
 	searchCmd.Flags().IntP("min-kmers", "c", 10, formatFlagUsage(`Minimal number of matched k-mers (sketches).`))
 
+	searchCmd.Flags().IntP("min-run", "", 0,
+		formatFlagUsage(`Minimal number of consecutive query k-mers (sketches) matching a target, which removes matches from scattered hits of conserved motifs. K-mers of a query are not deduplicated when this is on. 0 or 1 for no limit.`))
+
 	searchCmd.Flags().IntP("min-query-len", "m", 30, formatFlagUsage(`Minimal query length.`))
 
+	searchCmd.Flags().BoolP("skip-masked", "", false,
+		formatFlagUsage(`Skip k-mers overlapping lowercase (soft-masked) bases of queries, e.g., repeats masked by RepeatMasker, which reduces repeat-driven false hits. Bases are case-insensitive by default.`))
+
+	searchCmd.Flags().StringP("tcov-denom", "", "fragment",
+		formatFlagUsage(`Denominator of target coverage (tCov), also used for -T/--min-target-cov and jacc. Available values: `+
+			`fragment (k-mers of the reference chunk), genome (k-mers of the whole reference genome, estimated as those of the chunk times the number of chunks). `+
+			`Note that "kmcp profile" needs the default value.`))
+
+	searchCmd.Flags().BoolP("idf", "", false,
+		formatFlagUsage(`Weight matched k-mers by their inverse document frequency (IDF) when computing query coverages, `+
+			`so discriminative k-mers shared by few targets count more than ubiquitous ones, which sharpens classification among related genomes. `+
+			`The document frequency of a k-mer is estimated from the bloom filters of all targets, it's about 2X slower. `+
+			`Matches are prefiltered with unweighted query coverages, and --max-target-seqs applies after the reweighting.`))
+
 	searchCmd.Flags().Float64P("min-query-cov", "t", 0.55,
 		formatFlagUsage(`Minimal query coverage, i.e., proportion of matched k-mers and unique k-mers of a query.`))
 
@@ -1044,24 +1868,172 @@ func init() {
 	// output
 	searchCmd.Flags().StringP("out-file", "o", "-", formatFlagUsage(`Out file, supports and recommends a ".gz" suffix ("-" for stdout).`))
 
+	searchCmd.Flags().StringP("out-format", "", "tsv",
+		formatFlagUsage(`Output format, "tsv" or "jsonl". "jsonl" outputs one JSON object per query with an array of matches, `+
+			`without the header row and optional columns. Unmatched queries kept by -K/--keep-unmatched have an empty array.`))
+
+	searchCmd.Flags().StringP("out-bed", "", "",
+		formatFlagUsage(`Also write matches in BED format against query coordinates, for visualizing where references match long queries in genome browsers. `+
+			`Windows of long queries created by "seqkit sliding" (IDs like "contig_sliding:101-400") are mapped back to the original queries. `+
+			`Columns: query, start, end, target, qCov*1000, strand (".").`))
+
+	searchCmd.Flags().StringP("profile-out", "", "",
+		formatFlagUsage(`Also compute a quick profile from the search results on the fly and save it to this file, `+
+			`which avoids writing and re-parsing huge search results (use "-o /dev/null" to discard them). `+
+			`Matches are counted like the stage 1/4 of "kmcp profile", but ambiguous reads are counted for all matched references `+
+			`rather than reassigned, so please use "kmcp profile" for accurate profiles. `+
+			`The profile is in KMCP format, with empty columns of taxonomy information.`))
+
+	searchCmd.Flags().Float64P("profile-min-query-cov", "", 0.55,
+		formatFlagUsage(`Minimal query coverage of a match for --profile-out.`))
+
+	searchCmd.Flags().Float64P("profile-max-fpr", "", 0.05,
+		formatFlagUsage(`Maximal false positive rate of a match for --profile-out.`))
+
+	searchCmd.Flags().IntP("profile-min-chunks-reads", "", minReads0,
+		formatFlagUsage(`Minimal number of reads for a reference chunk for --profile-out.`))
+
+	searchCmd.Flags().IntP("profile-min-uniq-reads", "", minUReads0,
+		formatFlagUsage(`Minimal number of uniquely matched reads for a reference for --profile-out.`))
+
+	searchCmd.Flags().Float64P("profile-min-chunks-fraction", "", minFragsProp0,
+		formatFlagUsage(`Minimal fraction of matched reference chunks with reads >= --profile-min-chunks-reads for --profile-out.`))
+
+	searchCmd.Flags().StringP("sqlite", "", "",
+		formatFlagUsage(`Write results into a table of an SQLite database file instead of -o/--out-file, with indexes on columns query, target and qCov, for ad-hoc SQL queries. The table is replaced unless --append is given. `+
+			`Attention: the external command-line program "sqlite3" (https://sqlite.org/cli.html) is needed in the PATH at runtime.`))
+
+	searchCmd.Flags().StringP("sqlite-table", "", "matches",
+		formatFlagUsage(`Table name for --sqlite.`))
+
 	searchCmd.Flags().StringSliceP("name-map", "N", []string{},
 		formatFlagUsage(`Tabular two-column file(s) mapping reference IDs to user-defined values. Don't use this if you will use the result for metagenomic profiling which needs the original reference IDs.`))
 
-	searchCmd.Flags().BoolP("default-name-map", "D", false, formatFlagUsage(`Load ${db}/__name_mapping.tsv for mapping name first.`))
+	searchCmd.Flags().BoolP("default-name-map", "D", false, formatFlagUsage(`Load ${db}/__name_mapping.tsv (or the gzipped one) for mapping name first.`))
+
+	searchCmd.Flags().StringP("report-map-collisions", "", "",
+		formatFlagUsage(`Save target names mapped to the same value (-N/--name-map, -D/--default-name-map) and numbers of matches of them to a file, for surfacing unintended merges.`))
 
 	searchCmd.Flags().BoolP("keep-unmatched", "K", false, formatFlagUsage(`Keep unmatched query sequence information.`))
 
+	searchCmd.Flags().StringP("calibrate-truth", "", "",
+		formatFlagUsage(`Calibrate -t/--min-query-cov with reads from a known genome in the database, the value is the target name. `+
+			`Sensitivity and precision of thresholds from -t/--min-query-cov (better be small, e.g., 0.3) to 1 are reported, and the one with the highest F1 score is suggested.`))
+
+	searchCmd.Flags().Float64P("calibrate-step", "", 0.05,
+		formatFlagUsage(`Step of query coverage thresholds for --calibrate-truth.`))
+
+	searchCmd.Flags().StringP("out-matched", "", "",
+		formatFlagUsage(`Write results of matched queries to this file rather than -o/--out-file.`))
+
+	searchCmd.Flags().StringP("out-unmatched", "", "",
+		formatFlagUsage(`Write unmatched queries to this file rather than -o/--out-file, -K/--keep-unmatched is implied.`))
+
 	// making it default
 	// searchCmd.Flags().BoolP("keep-order", "k", false, `keep results in order of input sequences`)
 	// do not use
 	// searchCmd.Flags().IntP("keep-top", "n", 0, `keep top N hits, 0 for all`)
 
 	searchCmd.Flags().IntP("keep-top-scores", "n", 0,
-		formatFlagUsage(`Keep matches with the top N scores for a query, 0 for all.`))
+		formatFlagUsage(`Keep matches with the top N distinct scores (the metric of -s/--sort-by) for a query, 0 for all.`))
+
+	searchCmd.Flags().IntP("max-target-seqs", "", 0,
+		formatFlagUsage(`Keep at most N best matches (ranked by the score of -s/--sort-by) of a query, 0 for all. `+
+			`Unlike -n/--keep-top-scores which sorts all matches first, it caps matches with a bounded heap while collecting them, `+
+			`which bounds memory and output for queries hitting thousands of targets. `+
+			`For multiple databases, matches are capped once after merging results of all databases.`))
+
+	searchCmd.Flags().StringP("collapse-to-rank", "", "",
+		formatFlagUsage(`Merge matches of targets sharing the same taxon at this rank, e.g., strains of a species, before sorting. `+
+			`The best match of a taxon is kept and its target name is replaced with the TaxId. `+
+			`Matched k-mers are not summed as strains share most k-mers. It needs --taxid-map and --taxdump.`))
+
+	searchCmd.Flags().StringSliceP("taxid-map", "", []string{},
+		formatFlagUsage(`Tabular two-column file(s) mapping reference IDs to TaxIds, for --collapse-to-rank and --output-lineage.`))
+
+	searchCmd.Flags().StringP("taxdump", "", "",
+		formatFlagUsage(`Directory of NCBI taxonomy dump files: names.dmp, nodes.dmp, optional with merged.dmp and delnodes.dmp, for --collapse-to-rank and --output-lineage.`))
 
 	searchCmd.Flags().BoolP("no-header-row", "H", false,
 		formatFlagUsage(`Do not print header row.`))
 
+	searchCmd.Flags().BoolP("output-taxid", "", false,
+		formatFlagUsage(`Append a column of taxids of targets, which needs databases created by "kmcp index --save-taxids".`))
+
+	searchCmd.Flags().DurationP("flush-interval", "", 0,
+		formatFlagUsage(`Flush outputs periodically with this interval, e.g., 5s, for live monitoring of long streaming searches. `+
+			`It's much faster than flushing after every query. 0 for flushing only when the buffer is full.`))
+
+	searchCmd.Flags().StringP("progress-json", "", "",
+		formatFlagUsage(`Write progress records in JSON Lines format to a file descriptor (e.g., 3) or a file, independent of the log. `+
+			`Fields: processed (queries searched), total (queries read so far), matched, speed (million queries per minute), elapsed (seconds), and done (true for the last record).`))
+
+	searchCmd.Flags().DurationP("progress-interval", "", time.Second,
+		formatFlagUsage(`Interval of writing progress records for --progress-json.`))
+
+	searchCmd.Flags().StringP("write-buffer-size", "", "64K",
+		formatFlagUsage(`Size of the write buffer of output files, a bigger value reduces write calls for outputs with lots of matches. Supported units: K, M, G.`))
+
+	searchCmd.Flags().BoolP("skip-existing", "", false,
+		formatFlagUsage(`Skip searching if the output file (and files of --out-matched and --out-unmatched) already exists and is not empty, for resuming interrupted batch jobs, e.g., a loop of samples. Note that an output file of an interrupted job might be incomplete.`))
+
+	searchCmd.Flags().BoolP("output-chunks-kmers", "", false,
+		formatFlagUsage(`Append a column of matched k-mers of all matched chunks of the target, in the format of "chunkIdx:mKmers" pairs separated by commas, for fine-grained coverage analysis.`))
+
+	searchCmd.Flags().BoolP("output-lineage", "", false,
+		formatFlagUsage(`Append a column of lineages of targets, e.g., "k__Bacteria;p__Firmicutes;...;s__Bacillus subtilis", for quick inspection. It needs --taxid-map and --taxdump.`))
+
+	searchCmd.Flags().BoolP("output-kmer-sketch", "", false,
+		formatFlagUsage(`Append a column of sampled matched k-mers of each match, with which "kmcp profile" estimates the target coverage `+
+			`as the union of matched k-mers of all reads (--min-target-cov). Only k-mers with hash values in the smallest 1/scale of all values are sampled.`))
+
+	searchCmd.Flags().BoolP("output-containment", "", false,
+		formatFlagUsage(`Append two columns for genome similarity estimation with -g/--query-whole-file or --file-as-query: `+
+			`the containment relative to the smaller k-mer set of the query and the target, and the standard error of qCov, `+
+			`which equals to that of bootstrapping query k-mers.`))
+
+	searchCmd.Flags().BoolP("estimate-ani", "", false,
+		formatFlagUsage(`Append a column of average nucleotide identity estimated from the containment (qCov) with the formula of Mash, `+
+			`i.e., 1 + ln(qCov) / k, for -g/--query-whole-file or --file-as-query. It assumes k-mers are sampled as scaled sketches (compute -D/--scale), `+
+			`so NA is outputted for other databases.`))
+
+	searchCmd.Flags().BoolP("report-positions", "", false,
+		formatFlagUsage(`Append a column of 0-based positions of matched k-mers in the query, separated by commas, for visualization. `+
+			`K-mers of queries are not deduplicated, and the column could be huge for long queries, e.g., with -g/--query-whole-file. `+
+			`Not compatible with --read-scale, --max-kmers-per-query and --query-unik.`))
+
+	searchCmd.Flags().IntP("float-precision", "", 4,
+		formatFlagUsage(`Number of digits after the decimal point of float columns, e.g., qCov, tCov and jacc. FPR is in scientific notation with the same precision.`))
+
+	searchCmd.Flags().BoolP("output-db-hits", "", false,
+		formatFlagUsage(`Append two columns of the numbers of databases a query is searched against and databases with any matches, only for multiple databases. `+
+			`A query hit in most databases is likely from a conserved region, while one hit in few databases is specific.`))
+
+	searchCmd.Flags().BoolP("emit-block", "", false,
+		formatFlagUsage(`[Debug] Append a column of the index file producing each match, e.g., R001/_block001.kmcp, for diagnosing the block assignment of targets.`))
+	searchCmd.Flags().MarkHidden("emit-block")
+
+	searchCmd.Flags().BoolP("output-margin", "", false,
+		formatFlagUsage(`Append a column of the gap between qCov of the best and the second-best targets of a query. `+
+			`A small margin flags ambiguous queries shared by close relatives, while a large one indicates a confident unique assignment.`))
+
+	searchCmd.Flags().Float64P("error-rate", "", 0,
+		formatFlagUsage(`Sequencing error rate of queries. If given, two columns are appended: the expected qCov of a query `+
+			`from the reference genome, i.e., (1-e)^k, as only k-mers free of sequencing errors could be matched, and the normalized qCov `+
+			`(qCov / expected qCov), for comparing queries of different qualities fairly.`))
+
+	searchCmd.Flags().IntP("kmer-sketch-scale", "", 64,
+		formatFlagUsage(`Scale of sampling matched k-mers for --output-kmer-sketch, a smaller value gives more accurate estimation with a bigger output.`))
+
+	searchCmd.Flags().StringSliceP("show-rank", "", []string{"superkingdom", "phylum", "class", "order", "family", "genus", "species", "strain"},
+		formatFlagUsage("Only show names of these ranks in lineages, for --output-lineage."))
+
+	searchCmd.Flags().StringSliceP("rank-prefix", "", []string{"k__", "p__", "c__", "o__", "f__", "g__", "s__", "t__"},
+		formatFlagUsage("Prefixes of taxon names in these ranks, for --output-lineage."))
+
+	searchCmd.Flags().BoolP("append", "", false,
+		formatFlagUsage(`Append to the output file rather than overwrite it, the header row is only written for a new or empty file. The header row of an existing file is checked before appending.`))
+
 	searchCmd.Flags().StringP("sort-by", "s", "qcov",
 		formatFlagUsage(`Sort hits by "qcov", "tcov" or "jacc" (Jaccard Index).`))
 
@@ -1073,6 +2045,34 @@ func init() {
 
 }
 
+// matchedKmersOfChunks returns matched k-mers of all matched chunks of each target of a query,
+// formatted as "chunkIdx:mKmers" pairs separated by commas, in ascending order of chunk index.
+func matchedKmersOfChunks(matches []*search.Match) map[string]string {
+	chunks := make(map[string][][2]int, len(matches))
+	var idx uint32
+	for _, m := range matches {
+		idx, _ = index.DecodeChunkIdx(m.TargetIdx[0])
+		chunks[m.Target[0]] = append(chunks[m.Target[0]], [2]int{int(idx), m.NumKmers})
+	}
+
+	fields := make(map[string]string, len(chunks))
+	var buf strings.Builder
+	for target, cs := range chunks {
+		sort.Slice(cs, func(i, j int) bool { return cs[i][0] < cs[j][0] })
+		buf.Reset()
+		for i, c := range cs {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(strconv.Itoa(c[0]))
+			buf.WriteByte(':')
+			buf.WriteString(strconv.Itoa(c[1]))
+		}
+		fields[target] = buf.String()
+	}
+	return fields
+}
+
 func cloneFastx(sequence *seq.Seq) *seq.Seq {
 	// s := make([]byte, len(sequence.Seq))
 	// copy(s, sequence.Seq)
@@ -1090,7 +2090,7 @@ func cloneFastx(sequence *seq.Seq) *seq.Seq {
 	// 	QualValue: qv,
 	// }
 
-	clone := poolSeq.Get().(*seq.Seq)
+	clone := search.NewSeq()
 	clone.Alphabet = sequence.Alphabet
 	clone.Seq = clone.Seq[:0]
 	clone.Seq = append(clone.Seq, sequence.Seq...)
@@ -1098,7 +2098,3 @@ func cloneFastx(sequence *seq.Seq) *seq.Seq {
 	// clone.QualValue = qv
 	return clone
 }
-
-var poolSeq = &sync.Pool{New: func() interface{} {
-	return &seq.Seq{}
-}}
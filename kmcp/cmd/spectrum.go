@@ -0,0 +1,163 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/bio/seq"
+	"github.com/shenwei356/bio/seqio/fastx"
+	"github.com/shenwei356/bio/sketches"
+	"github.com/spf13/cobra"
+)
+
+var spectrumCmd = &cobra.Command{
+	Use:   "spectrum",
+	Short: "Compute the k-mer spectrum of sequences",
+	Long: `Compute the k-mer spectrum of sequences
+
+This command reports the k-mer multiplicity histogram, i.e., how many
+distinct k-mers are seen once, twice, ..., which helps to assess
+sequencing depth and error rates before searching. No database is needed.
+
+K-mers are computed in the same way as queries in "kmcp search",
+i.e., hash values of canonical k-mers.
+
+Attention:
+  1. All distinct k-mers are stored in main memory.
+
+Output format:
+    1. multiplicity, Number of occurrences of a k-mer
+    2. count,        Number of distinct k-mers with this multiplicity
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+		seq.ValidateSeq = false
+
+		var err error
+
+		k := getFlagPositiveInt(cmd, "kmer")
+		outFile := getFlagString(cmd, "out-file")
+
+		files := getFileListFromArgsAndFile(cmd, args, true, "infile-list", true)
+		if opt.Verbose {
+			if len(files) == 1 && isStdin(files[0]) {
+				log.Info("no files given, reading from stdin")
+			} else {
+				log.Infof("%d input file(s) given", len(files))
+			}
+		}
+
+		counts := make(map[uint64]uint32, 1<<20)
+
+		var fastxReader *fastx.Reader
+		var record *fastx.Record
+		var iter *sketches.Iterator
+		var code uint64
+		var ok bool
+		var nSeqs, nKmers uint64
+		for _, file := range files {
+			if opt.Verbose {
+				log.Infof("reading sequence file: %s", file)
+			}
+			fastxReader, err = fastx.NewDefaultReader(file)
+			checkError(errors.Wrap(err, file))
+
+			for {
+				record, err = fastxReader.Read()
+				if err != nil {
+					if err == io.EOF {
+						break
+					}
+					checkError(errors.Wrap(err, file))
+					break
+				}
+				nSeqs++
+
+				iter, err = sketches.NewHashIterator(record.Seq, k, true, false)
+				if err != nil {
+					if err == sketches.ErrShortSeq {
+						continue
+					}
+					checkError(errors.Wrap(err, file))
+				}
+
+				for {
+					code, ok = iter.NextHash()
+					if !ok {
+						break
+					}
+					if code > 0 {
+						counts[code]++
+						nKmers++
+					}
+				}
+			}
+		}
+
+		hist := make(map[uint32]uint64, 1024)
+		for _, n := range counts {
+			hist[n]++
+		}
+		multiplicities := make([]int, 0, len(hist))
+		for n := range hist {
+			multiplicities = append(multiplicities, int(n))
+		}
+		sort.Ints(multiplicities)
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		outfh.WriteString("multiplicity\tcount\n")
+		for _, n := range multiplicities {
+			outfh.WriteString(strconv.Itoa(n))
+			outfh.WriteByte('\t')
+			outfh.WriteString(strconv.FormatUint(hist[uint32(n)], 10))
+			outfh.WriteByte('\n')
+		}
+
+		if opt.Verbose {
+			log.Infof("%d sequences, %d k-mers, %d distinct k-mers", nSeqs, nKmers, len(counts))
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(spectrumCmd)
+
+	spectrumCmd.Flags().IntP("kmer", "k", 21, formatFlagUsage(`K-mer size.`))
+	spectrumCmd.Flags().StringP("out-file", "o", "-",
+		formatFlagUsage(`Out file, supports and recommends a ".gz" suffix ("-" for stdout).`))
+
+	spectrumCmd.SetUsageTemplate(usageTemplate("[-k <k>] [-o <out.tsv>] <seq files>"))
+}
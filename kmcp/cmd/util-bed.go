@@ -0,0 +1,76 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/shenwei356/kmcp/kmcp/search"
+)
+
+// slidingIDMark is the mark in IDs of subsequences created by "seqkit sliding",
+// e.g., "contig1_sliding:101-400", where coordinates are 1-based and closed.
+var slidingIDMark = []byte("_sliding:")
+
+// parseSlidingWindowID parses the ID of a subsequence created by "seqkit sliding",
+// and returns the ID of the original sequence and the 0-based half-open interval.
+func parseSlidingWindowID(id []byte) (chrom []byte, start int, end int, ok bool) {
+	i := bytes.LastIndex(id, slidingIDMark)
+	if i < 0 {
+		return id, 0, 0, false
+	}
+	loc := id[i+len(slidingIDMark):]
+	j := bytes.IndexByte(loc, '-')
+	if j < 0 {
+		return id, 0, 0, false
+	}
+	var err error
+	if start, err = strconv.Atoi(string(loc[:j])); err != nil || start < 1 {
+		return id, 0, 0, false
+	}
+	if end, err = strconv.Atoi(string(loc[j+1:])); err != nil || end < 1 {
+		return id, 0, 0, false
+	}
+	return id[:i], start - 1, end, true
+}
+
+// appendBED appends a BED6 record of a match, with the query as the chromosome,
+// the matched window as the interval, the target as the name, and qCov*1000 as the score.
+// Queries not created by "seqkit sliding" are treated as a whole.
+// The strand is not available.
+func appendBED(buf []byte, result *search.QueryResult, match *search.Match) []byte {
+	chrom, start, end, ok := parseSlidingWindowID(result.QueryID)
+	if !ok {
+		start, end = 0, result.QueryLen
+	}
+	buf = append(buf, chrom...)
+	buf = append(buf, '\t')
+	buf = strconv.AppendInt(buf, int64(start), 10)
+	buf = append(buf, '\t')
+	buf = strconv.AppendInt(buf, int64(end), 10)
+	buf = append(buf, '\t')
+	buf = append(buf, match.Target[0]...)
+	buf = append(buf, '\t')
+	buf = strconv.AppendInt(buf, int64(match.QCov*1000+0.5), 10)
+	buf = append(buf, "\t.\n"...)
+	return buf
+}
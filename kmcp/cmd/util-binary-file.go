@@ -25,12 +25,16 @@ import (
 	"io"
 
 	"github.com/pkg/errors"
+	"github.com/shenwei356/kmcp/kmcp/search"
 	"github.com/shenwei356/unik/v5"
 )
 
 const extDataFile = ".unik"
 
-func checkCompatibility(reader0 *unik.Reader, reader *unik.Reader, file string, meta0 *Meta, meta *Meta) {
+// checkCompatibility checks if a .unik file is compatible with the first one.
+// If ignoreMetaMismatch is true, inconsistent sketch information (minimizer, syncmer
+// and sequence splitting) is downgraded to a warning, and true is returned.
+func checkCompatibility(reader0 *unik.Reader, reader *unik.Reader, file string, meta0 *Meta, meta *Meta, ignoreMetaMismatch bool) bool {
 	if reader0.K != reader.K {
 		checkError(fmt.Errorf(`k-mer length not consistent (%d != %d), please check with "kmcp utils unik-info": %s`, reader0.K, reader.K, file))
 	}
@@ -44,15 +48,26 @@ func checkCompatibility(reader0 *unik.Reader, reader *unik.Reader, file string,
 		checkError(fmt.Errorf(`'scaled' flags not consistent, please check with "kmcp utils unik-info": %s`, file))
 	}
 
+	if !search.SameAlphabet(meta0.Alphabet, meta.Alphabet) {
+		checkError(fmt.Errorf(`alphabets not consistent (%s != %s), please check with "kmcp utils unik-info -a": %s`,
+			meta0.Alphabet, meta.Alphabet, file))
+	}
+
 	if meta0.MinimizerW == meta.MinimizerW &&
 		meta0.SyncmerS == meta.SyncmerS &&
 		meta0.SplitSize == meta.SplitSize &&
 		meta0.SplitOverlap == meta.SplitOverlap {
-		return
+		return false
 	}
-	checkError(fmt.Errorf(`sketch information (description) not consistent, please check with "kmcp utils unik-info -a ": %s. file1: %s, file: %s`,
+	if ignoreMetaMismatch {
+		log.Warningf(`sketch information (description) not consistent, treated as plain k-mers: %s. file1: %s, file: %s`,
+			file, meta0, meta)
+		return true
+	}
+	checkError(fmt.Errorf(`sketch information (description) not consistent, please check with "kmcp utils unik-info -a ": %s. file1: %s, file: %s. `+
+		`You may use --ignore-meta-mismatch to proceed`,
 		file, meta0, meta))
-
+	return false
 }
 
 // not used
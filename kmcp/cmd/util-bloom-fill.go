@@ -0,0 +1,204 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/kmcp/kmcp/index"
+	"github.com/shenwei356/kmcp/kmcp/search"
+)
+
+// BloomFill is the statistics of bit-fill fractions of bloom filters in an index file.
+type BloomFill struct {
+	File      string
+	NumNames  int
+	NumSigs   uint64
+	NumHashes int
+
+	MaxKmers uint64 // maximal number of k-mers of all name groups
+
+	MinFill  float64
+	MeanFill float64
+	MaxFill  float64
+
+	fills []float64
+	kmers []uint64
+}
+
+// MaxFPR returns the false positive rate of the most saturated bloom filter.
+func (f BloomFill) MaxFPR() float64 {
+	return math.Pow(f.MaxFill, float64(f.NumHashes))
+}
+
+// SaturatedKmers returns the minimal number of k-mers of name groups with
+// false positive rates bigger than fpr, and the number of these name groups.
+func (f BloomFill) SaturatedKmers(fpr float64) (uint64, int) {
+	var kmers uint64 = math.MaxUint64
+	var n int
+	for i, fill := range f.fills {
+		if math.Pow(fill, float64(f.NumHashes)) <= fpr {
+			continue
+		}
+		n++
+		if f.kmers[i] < kmers {
+			kmers = f.kmers[i]
+		}
+	}
+	return kmers, n
+}
+
+// NewBloomFill computes bit-fill fractions of all bloom filters (one for each name group) in an index file.
+func NewBloomFill(file string) (BloomFill, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return BloomFill{}, errors.Wrap(err, file)
+	}
+	defer fh.Close()
+
+	reader, err := index.NewReader(fh)
+	if err != nil {
+		return BloomFill{}, errors.Wrap(err, file)
+	}
+
+	n := len(reader.Names)
+	counts := make([]uint64, reader.NumRowBytes<<3)
+	var row []byte
+	var b byte
+	var i, j int
+	for {
+		row, err = reader.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return BloomFill{}, errors.Wrap(err, file)
+		}
+		for i, b = range row {
+			if b == 0 {
+				continue
+			}
+			for j = 0; j < 8; j++ {
+				if b&(1<<(7-j)) > 0 {
+					counts[i<<3+j]++
+				}
+			}
+		}
+	}
+
+	f := BloomFill{
+		File:      file,
+		NumNames:  n,
+		NumSigs:   reader.NumSigs,
+		NumHashes: int(reader.NumHashes),
+		MinFill:   1,
+		fills:     make([]float64, n),
+		kmers:     make([]uint64, n),
+	}
+	if n == 0 || reader.NumSigs == 0 {
+		f.MinFill = 0
+		return f, nil
+	}
+
+	var fill float64
+	for i = 0; i < n; i++ {
+		fill = float64(counts[i]) / float64(reader.NumSigs)
+		f.fills[i] = fill
+		if i < len(reader.Sizes) {
+			f.kmers[i] = reader.Sizes[i]
+			if reader.Sizes[i] > f.MaxKmers {
+				f.MaxKmers = reader.Sizes[i]
+			}
+		}
+
+		f.MeanFill += fill
+		if fill < f.MinFill {
+			f.MinFill = fill
+		}
+		if fill > f.MaxFill {
+			f.MaxFill = fill
+		}
+	}
+	f.MeanFill /= float64(n)
+
+	return f, nil
+}
+
+// BloomFillsOfDB computes bit-fill fractions of bloom filters of all index files in a database directory.
+func BloomFillsOfDB(dbDir string) ([]BloomFill, float64, error) {
+	info, err := search.UnikIndexDBInfoFromFile(filepath.Join(dbDir, search.DBInfoFile))
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = info.Check(); err != nil {
+		return nil, 0, err
+	}
+
+	fills := make([]BloomFill, 0, len(info.Files))
+	for _, file := range info.Files {
+		f, err := NewBloomFill(filepath.Join(dbDir, file))
+		if err != nil {
+			return nil, 0, err
+		}
+		f.File = file
+		fills = append(fills, f)
+	}
+	if len(fills) == 0 {
+		return nil, 0, fmt.Errorf("no index files found in database: %s", dbDir)
+	}
+	return fills, info.FPR, nil
+}
+
+// blockFPR returns the realized false positive rate of a block being built, i.e., that of
+// the most saturated bloom filter, estimated from the fraction of set bits.
+// The bloom filter of the jth name of the ith batch is the (7-j)th bit of sigsBlock[i].
+func blockFPR(sigsBlock [][]byte, numHashes int) float64 {
+	var maxFill float64
+	var counts [8]uint64
+	var j int
+	for _, sigs := range sigsBlock {
+		if len(sigs) == 0 {
+			continue
+		}
+		counts = [8]uint64{}
+		for _, b := range sigs {
+			if b == 0 {
+				continue
+			}
+			for j = 0; j < 8; j++ {
+				if b&(1<<(7-j)) > 0 {
+					counts[j]++
+				}
+			}
+		}
+		for j = 0; j < 8; j++ {
+			if fill := float64(counts[j]) / float64(len(sigs)); fill > maxFill {
+				maxFill = fill
+			}
+		}
+	}
+	return math.Pow(maxFill, float64(numHashes))
+}
@@ -0,0 +1,220 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/shenwei356/kmcp/kmcp/search"
+)
+
+// QcovCalibration sweeps query coverage thresholds with reads from a known genome
+// in the database (the truth target), and reports sensitivity and precision of each threshold.
+type QcovCalibration struct {
+	Truth      string
+	Thresholds []float64
+
+	nQueries     uint64
+	truthQueries []uint64 // queries matching the truth target at a threshold
+	matchedQuery []uint64 // queries with any match at a threshold
+	tpMatches    []uint64 // matches of the truth target at a threshold
+	allMatches   []uint64 // all matches at a threshold
+}
+
+// NewQcovCalibration creates a QcovCalibration with thresholds
+// from minQcov to 1 in steps of step.
+func NewQcovCalibration(truth string, minQcov float64, step float64) *QcovCalibration {
+	thresholds := []float64{minQcov}
+	t := math.Floor(minQcov/step)*step + step
+	for t <= 1+1e-9 {
+		if t-minQcov > 1e-9 {
+			thresholds = append(thresholds, math.Min(t, 1))
+		}
+		t += step
+	}
+
+	n := len(thresholds)
+	return &QcovCalibration{
+		Truth:      truth,
+		Thresholds: thresholds,
+
+		truthQueries: make([]uint64, n),
+		matchedQuery: make([]uint64, n),
+		tpMatches:    make([]uint64, n),
+		allMatches:   make([]uint64, n),
+	}
+}
+
+// Add adds a search result. It must be called in a single goroutine.
+func (c *QcovCalibration) Add(result *search.QueryResult) {
+	c.nQueries++
+	if result.Matches == nil {
+		return
+	}
+
+	var qcovTruth, qcovMax float64
+	var i int
+	var t float64
+	for _, m := range *result.Matches {
+		if m.QCov > qcovMax {
+			qcovMax = m.QCov
+		}
+		isTruth := m.Target[0] == c.Truth
+		if isTruth && m.QCov > qcovTruth {
+			qcovTruth = m.QCov
+		}
+		for i, t = range c.Thresholds {
+			if m.QCov < t {
+				break
+			}
+			c.allMatches[i]++
+			if isTruth {
+				c.tpMatches[i]++
+			}
+		}
+	}
+
+	for i, t = range c.Thresholds {
+		if qcovMax < t {
+			break
+		}
+		c.matchedQuery[i]++
+		if qcovTruth >= t {
+			c.truthQueries[i]++
+		}
+	}
+}
+
+// QcovCalibrationRecord is the result of a threshold.
+type QcovCalibrationRecord struct {
+	Threshold      float64
+	MatchedQueries uint64
+	Sensitivity    float64 // queries matching the truth target / all queries
+	Precision      float64 // matches of the truth target / all matches
+	F1             float64
+}
+
+// Records returns the results of all thresholds.
+func (c *QcovCalibration) Records() []QcovCalibrationRecord {
+	records := make([]QcovCalibrationRecord, len(c.Thresholds))
+	var r *QcovCalibrationRecord
+	for i, t := range c.Thresholds {
+		r = &records[i]
+		r.Threshold = t
+		r.MatchedQueries = c.matchedQuery[i]
+		if c.nQueries > 0 {
+			r.Sensitivity = float64(c.truthQueries[i]) / float64(c.nQueries)
+		}
+		if c.allMatches[i] > 0 {
+			r.Precision = float64(c.tpMatches[i]) / float64(c.allMatches[i])
+		}
+		if r.Sensitivity+r.Precision > 0 {
+			r.F1 = 2 * r.Sensitivity * r.Precision / (r.Sensitivity + r.Precision)
+		}
+	}
+	return records
+}
+
+// Suggest returns the threshold with the highest F1 score, the bigger one is preferred for ties.
+func (c *QcovCalibration) Suggest() (QcovCalibrationRecord, error) {
+	records := c.Records()
+	if c.nQueries == 0 {
+		return QcovCalibrationRecord{}, fmt.Errorf("no queries for calibration")
+	}
+	best := -1
+	for i, r := range records {
+		if r.F1 > 0 && (best < 0 || r.F1 >= records[best].F1) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return QcovCalibrationRecord{}, fmt.Errorf("the truth target (%s) is not matched by any query", c.Truth)
+	}
+	return records[best], nil
+}
+
+// QcovHistogram is a histogram of query coverages of the best matches of queries,
+// which shows whether real and spurious hits are well separated.
+type QcovHistogram struct {
+	Width  float64
+	Counts []uint64 // the last bin is for qcov == 1
+}
+
+// NewQcovHistogram creates a QcovHistogram with bins of the given width.
+func NewQcovHistogram(width float64) *QcovHistogram {
+	n := int(math.Ceil(1/width-1e-9)) + 1
+	return &QcovHistogram{Width: width, Counts: make([]uint64, n)}
+}
+
+// Add adds a search result, unmatched queries are ignored.
+// It must be called in a single goroutine.
+func (h *QcovHistogram) Add(result *search.QueryResult) {
+	if result.Matches == nil || len(*result.Matches) == 0 {
+		return
+	}
+	var qcovMax float64
+	for _, m := range *result.Matches {
+		if m.QCov > qcovMax {
+			qcovMax = m.QCov
+		}
+	}
+	i := len(h.Counts) - 1
+	if qcovMax < 1 {
+		i = int(qcovMax / h.Width)
+		if i > len(h.Counts)-2 {
+			i = len(h.Counts) - 2
+		}
+	}
+	h.Counts[i]++
+}
+
+// Lines returns the text of the histogram, starting from the first non-empty bin.
+func (h *QcovHistogram) Lines(barWidth int) []string {
+	var max uint64
+	first := -1
+	for i, c := range h.Counts {
+		if c > max {
+			max = c
+		}
+		if c > 0 && first < 0 {
+			first = i
+		}
+	}
+	if first < 0 {
+		return nil
+	}
+
+	lines := make([]string, 0, len(h.Counts)-first)
+	last := len(h.Counts) - 1
+	var label string
+	for i := first; i <= last; i++ {
+		if i == last {
+			label = fmt.Sprintf("%13s", "1")
+		} else {
+			label = fmt.Sprintf("[%.2f, %.2f)", float64(i)*h.Width, math.Min(float64(i+1)*h.Width, 1))
+		}
+		lines = append(lines, fmt.Sprintf("%s %10d %s", label, h.Counts[i],
+			strings.Repeat("*", int(math.Ceil(float64(h.Counts[i])/float64(max)*float64(barWidth))))))
+	}
+	return lines
+}
@@ -26,6 +26,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/shenwei356/util/stringutil"
@@ -185,6 +186,21 @@ func getFlagInt64(cmd *cobra.Command, flag string) int64 {
 	return value
 }
 
+func getFlagFloat64Slice(cmd *cobra.Command, flag string) []float64 {
+	value, err := cmd.Flags().GetFloat64Slice(flag)
+	checkError(err)
+	return value
+}
+
+func getFlagNonNegativeDuration(cmd *cobra.Command, flag string) time.Duration {
+	value, err := cmd.Flags().GetDuration(flag)
+	checkError(err)
+	if value < 0 {
+		checkError(fmt.Errorf("value of flag --%s should be greater than or equal to 0", flag))
+	}
+	return value
+}
+
 func getFlagStringSlice(cmd *cobra.Command, flag string) []string {
 	value, err := cmd.Flags().GetStringSlice(flag)
 	checkError(err)
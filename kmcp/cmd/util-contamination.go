@@ -0,0 +1,197 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/unik/v5"
+)
+
+// contaminationRelatedFrac is the minimal shared fraction of both targets of a pair
+// to regard them as close relatives rather than contamination.
+const contaminationRelatedFrac = 0.5
+
+// ContaminationPair records k-mers shared by two targets.
+type ContaminationPair struct {
+	Target1, Target2 string
+	Kmers1, Kmers2   int // numbers of sampled k-mers
+	Shared           int // number of sampled k-mers shared by the two targets
+}
+
+// Frac1 returns the fraction of k-mers of target 1 shared with target 2.
+func (p ContaminationPair) Frac1() float64 { return float64(p.Shared) / float64(p.Kmers1) }
+
+// Frac2 returns the fraction of k-mers of target 2 shared with target 1.
+func (p ContaminationPair) Frac2() float64 { return float64(p.Shared) / float64(p.Kmers2) }
+
+// Type tells whether the two targets are likely close relatives or one contaminated by the other.
+// Relatives share a large part of both genomes, while contaminated sequences
+// only take a small part of the target containing them.
+func (p ContaminationPair) Type() string {
+	if p.Frac1() >= contaminationRelatedFrac && p.Frac2() >= contaminationRelatedFrac {
+		return "relatives"
+	}
+	return "contamination"
+}
+
+// findContamination samples k-mers of all .unik files with a FracMinHash scale,
+// counts co-occurrences of sampled k-mers in targets (chunks of a target are merged),
+// and returns pairs of targets with the shared fraction of either target >= minFrac.
+func findContamination(opt Options, infos []UnikFileInfo, scale uint64, minFrac float64) []ContaminationPair {
+	// targets
+	names := make([]string, 0, 1024)
+	name2idx := make(map[string]int, 1024)
+	var ok bool
+	for _, info := range infos {
+		if _, ok = name2idx[info.Name]; !ok {
+			name2idx[info.Name] = len(names)
+			names = append(names, info.Name)
+		}
+	}
+
+	maxHash := uint64(math.MaxUint64)
+	if scale > 1 {
+		maxHash = uint64(float64(math.MaxUint64) / float64(scale))
+	}
+
+	// sampled k-mers of each target
+	sketches := make([]map[uint64]struct{}, len(names))
+	for i := range sketches {
+		sketches[i] = make(map[uint64]struct{}, 1024)
+	}
+	locks := make([]sync.Mutex, len(names))
+
+	var wg sync.WaitGroup
+	tokens := make(chan int, opt.NumCPUs)
+	for _, info := range infos {
+		wg.Add(1)
+		tokens <- 1
+		go func(info UnikFileInfo) {
+			defer func() {
+				wg.Done()
+				<-tokens
+			}()
+
+			infh, r, _, err := inStream(info.Path)
+			checkError(err)
+			defer r.Close()
+
+			reader, err := unik.NewReader(infh)
+			checkError(errors.Wrap(err, info.Path))
+
+			codes := make([]uint64, 0, 1024)
+			var code uint64
+			for {
+				code, _, err = reader.ReadCodeWithTaxid()
+				if err != nil {
+					if err == io.EOF {
+						break
+					}
+					checkError(errors.Wrap(err, info.Path))
+				}
+				if code <= maxHash {
+					codes = append(codes, code)
+				}
+			}
+
+			idx := name2idx[info.Name]
+			locks[idx].Lock()
+			for _, code = range codes {
+				sketches[idx][code] = struct{}{}
+			}
+			locks[idx].Unlock()
+		}(info)
+	}
+	wg.Wait()
+
+	// targets of each k-mer, in the order of targets
+	kmer2targets := make(map[uint64][]uint32, 1<<16)
+	for i, sketch := range sketches {
+		for code := range sketch {
+			kmer2targets[code] = append(kmer2targets[code], uint32(i))
+		}
+	}
+
+	// co-occurrences
+	counts := make(map[uint64]int, 1024)
+	var i, j int
+	for _, targets := range kmer2targets {
+		if len(targets) < 2 {
+			continue
+		}
+		for i = 0; i < len(targets)-1; i++ {
+			for j = i + 1; j < len(targets); j++ {
+				counts[uint64(targets[i])<<32|uint64(targets[j])]++
+			}
+		}
+	}
+
+	pairs := make([]ContaminationPair, 0, 128)
+	var p ContaminationPair
+	for key, shared := range counts {
+		i, j = int(key>>32), int(key&math.MaxUint32)
+		p = ContaminationPair{
+			Target1: names[i], Target2: names[j],
+			Kmers1: len(sketches[i]), Kmers2: len(sketches[j]),
+			Shared: shared,
+		}
+		if p.Frac1() >= minFrac || p.Frac2() >= minFrac {
+			pairs = append(pairs, p)
+		}
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Shared != pairs[j].Shared {
+			return pairs[i].Shared > pairs[j].Shared
+		}
+		if pairs[i].Target1 != pairs[j].Target1 {
+			return pairs[i].Target1 < pairs[j].Target1
+		}
+		return pairs[i].Target2 < pairs[j].Target2
+	})
+
+	return pairs
+}
+
+// writeContaminationReport writes target pairs sharing k-mers to a TSV file.
+func writeContaminationReport(file string, pairs []ContaminationPair, compressionLevel int) {
+	outfh, gw, w, err := outStream(file, strings.HasSuffix(strings.ToLower(file), ".gz"), compressionLevel)
+	checkError(err)
+	defer func() {
+		outfh.Flush()
+		if gw != nil {
+			gw.Close()
+		}
+		w.Close()
+	}()
+
+	fmt.Fprintf(outfh, "target1\ttarget2\tkmers1\tkmers2\tshared\tfrac1\tfrac2\ttype\n")
+	for _, p := range pairs {
+		fmt.Fprintf(outfh, "%s\t%s\t%d\t%d\t%d\t%.4f\t%.4f\t%s\n",
+			p.Target1, p.Target2, p.Kmers1, p.Kmers2, p.Shared, p.Frac1(), p.Frac2(), p.Type())
+	}
+}
@@ -21,11 +21,21 @@
 package cmd
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/shenwei356/breader"
+	"github.com/shenwei356/kmcp/kmcp/index"
+	"github.com/twotwotwo/sorts"
+	"github.com/zeebo/xxh3"
 )
 
 const extIndex = ".uniki"
@@ -63,7 +73,10 @@ func (l UnikFileInfosByName) Less(i int, j int) bool {
 	case v > 0:
 		return false
 	}
-	return l[i].Index < l[j].Index
+	if l[i].Index != l[j].Index {
+		return l[i].Index < l[j].Index
+	}
+	return l[i].Path < l[j].Path // for duplicated names
 }
 func (l UnikFileInfosByName) Swap(i int, j int) { l[i], l[j] = l[j], l[i] }
 
@@ -80,9 +93,314 @@ func (i UnikFileInfoGroup) String() string {
 // UnikFileInfoGroups is just a slice of UnikFileInfoGroup
 type UnikFileInfoGroups []UnikFileInfoGroup
 
-func (l UnikFileInfoGroups) Len() int               { return len(l) }
-func (l UnikFileInfoGroups) Less(i int, j int) bool { return l[i].Kmers < l[j].Kmers }
-func (l UnikFileInfoGroups) Swap(i int, j int)      { l[i], l[j] = l[j], l[i] }
+func (l UnikFileInfoGroups) Len() int { return len(l) }
+func (l UnikFileInfoGroups) Less(i int, j int) bool {
+	if l[i].Kmers != l[j].Kmers {
+		return l[i].Kmers < l[j].Kmers
+	}
+
+	// groups with the same number of k-mers are ordered by their first files,
+	// as the sorting is not stable.
+	if len(l[i].Infos) == 0 || len(l[j].Infos) == 0 {
+		return len(l[i].Infos) < len(l[j].Infos)
+	}
+	return UnikFileInfosByName{l[i].Infos[0], l[j].Infos[0]}.Less(0, 1)
+}
+func (l UnikFileInfoGroups) Swap(i int, j int) { l[i], l[j] = l[j], l[i] }
+
+// shuffleSmallGroups randomly shuffles the leading groups with no more than maxKmers k-mers
+// of groups sorted by k-mer size, and returns the number of shuffled groups.
+// Bigger groups are kept in order, as they are assigned to smaller blocks by their sizes.
+func shuffleSmallGroups(groups []UnikFileInfoGroup, maxKmers uint64, seed int64) int {
+	var n int
+	for n < len(groups) && groups[n].Kmers <= maxKmers {
+		n++
+	}
+	r := rand.New(rand.NewSource(seed))
+	r.Shuffle(n, func(i, j int) { groups[i], groups[j] = groups[j], groups[i] })
+	return n
+}
+
+// meanAndCV returns the mean, standard deviation and coefficient of variation of values.
+func meanAndCV(values []float64) (mean float64, sd float64, cv float64) {
+	if len(values) == 0 {
+		return 0, 0, 0
+	}
+	for _, v := range values {
+		mean += v
+	}
+	mean /= float64(len(values))
+	for _, v := range values {
+		sd += (v - mean) * (v - mean)
+	}
+	sd = math.Sqrt(sd / float64(len(values)))
+	if mean > 0 {
+		cv = sd / mean
+	}
+	return mean, sd, cv
+}
+
+// groupUnikFiles assigns files into numBuckets groups by hashes of their paths,
+// with different hash values in different repetitions (rr),
+// and every file is a group for singleSet. Groups are sorted by the number of k-mers.
+//
+// File infos are collected in the completion order of concurrent checking,
+// they are sorted by name in place first, so the assignment of files to groups,
+// and then blocks (blockBatches), is deterministic regardless of -j/--threads.
+func groupUnikFiles(fileInfos []UnikFileInfo, numBuckets int, singleSet bool, rr int, seed int) []UnikFileInfoGroup {
+	sorts.Quicksort(UnikFileInfosByName(fileInfos))
+
+	numBucketsUint64 := uint64(numBuckets)
+	buckets := make([][]UnikFileInfo, numBuckets)
+	var bIdx int
+	var h1, h2 uint32
+	for jj, info := range fileInfos {
+		if singleSet {
+			bIdx = jj
+		} else {
+			h1, h2 = index.BaseHashes(xxh3.HashString(info.Path))
+			bIdx = int(uint64(h1+h2*uint32(rr+seed)) % numBucketsUint64) // add seed
+		}
+
+		if buckets[bIdx] == nil {
+			buckets[bIdx] = make([]UnikFileInfo, 0, 8)
+		}
+		buckets[bIdx] = append(buckets[bIdx], info)
+	}
+
+	groups := make([]UnikFileInfoGroup, len(buckets))
+	for bb, infos := range buckets {
+		var totalKmers uint64
+		for _, info := range infos {
+			totalKmers += info.Kmers
+		}
+		groups[bb] = UnikFileInfoGroup{Infos: infos, Kmers: totalKmers}
+	}
+
+	// sort by group kmer size
+	sorts.Quicksort(UnikFileInfoGroups(groups))
+	return groups
+}
+
+// blockBatches assigns sorted file groups into blocks, i.e., batches of groups saved in index files.
+// A block has sBlock groups, and the block size is changed to blockSizeX, 8 and 1 for groups
+// with more than kmerThresholdX, kmerThreshold8 and kmerThreshold1 k-mers, respectively.
+// Empty groups are skipped.
+func blockBatches(groups []UnikFileInfoGroup, sBlock int, blockSizeX int, skipBlockX bool,
+	kmerThresholdX uint64, kmerThreshold8 uint64, kmerThreshold1 uint64) [][][]UnikFileInfo {
+	batches := make([][][]UnikFileInfo, 0, 8)
+
+	batch := make([][]UnikFileInfo, 0, sBlock)
+	var flagX, flag8, flag bool
+	var lastInfos []UnikFileInfo
+	var infoGroup UnikFileInfoGroup
+
+	nFiles := len(groups)
+	for i := 0; i <= nFiles; i++ {
+		if i == nFiles { // process lastInfo
+			// add previous file to batch
+			if flag || flag8 || flagX {
+				if lastInfos != nil {
+					batch = append(batch, lastInfos)
+					lastInfos = nil
+				}
+			}
+		} else {
+			infoGroup = groups[i]
+			infos := infoGroup.Infos
+			if infoGroup.Kmers == 0 { // skip empty buckets
+				continue
+			}
+
+			if flag || flag8 || flagX {
+				// add previous file to batch
+				if lastInfos != nil {
+					batch = append(batch, lastInfos)
+					lastInfos = nil
+				}
+
+				if flag { // single
+					lastInfos = infos // leave this file process in the next round
+					// and we have to process files aleady in batch
+				} else if infoGroup.Kmers > kmerThreshold1 { // !flag && (flag8 || flagx) -> flag
+					// meet a very big file the first time
+					flag = true       // mark
+					lastInfos = infos // leave this file process in the next round
+					// and we have to process files aleady in batch
+				} else if skipBlockX {
+					batch = append(batch, infos)
+					if len(batch) < sBlock { // not filled
+						continue
+					}
+				} else {
+					if infoGroup.Kmers > kmerThreshold8 { // !flag && flagx -> flag8
+						if flag8 { // keep the same
+							batch = append(batch, infos)
+							if len(batch) < sBlock { // not filled
+								continue
+							}
+						} else {
+							// meet a big file > kmerThreshold8
+							sBlock = 8
+							flag8 = true // mark
+							lastInfos = infos
+							// and we have to process files aleady in batch
+						}
+					} else { //  flagX
+						batch = append(batch, infos)
+						if len(batch) < sBlock { // not filled
+							continue
+						}
+					}
+				}
+			} else if skipBlockX {
+				if infoGroup.Kmers > kmerThreshold8 {
+					if infoGroup.Kmers > kmerThreshold1 {
+						// meet a very big file the first time
+						flag = true // mark
+					} else {
+						// meet a big file > kmerThresholdX
+						sBlock = blockSizeX
+						flagX = true // mark
+					}
+					lastInfos = infos // leave this file process in the next round
+					// and we have to process files aleady in batch
+				} else {
+					batch = append(batch, infos)
+					if len(batch) < sBlock { // not filled
+						continue
+					}
+				}
+			} else {
+				if infoGroup.Kmers > kmerThresholdX {
+					if infoGroup.Kmers > kmerThreshold1 {
+						// meet a very big file the first time
+						flag = true // mark
+					} else if infoGroup.Kmers > kmerThreshold8 {
+						// meet a big file > kmerThreshold8
+						sBlock = 8
+						flag8 = true // mark
+					} else {
+						// meet a big file > kmerThresholdX
+						sBlock = blockSizeX
+						flagX = true // mark
+					}
+					lastInfos = infos // leave this file process in the next round
+					// and we have to process files aleady in batch
+				} else {
+					batch = append(batch, infos)
+					if len(batch) < sBlock { // not filled
+						continue
+					}
+				}
+			}
+
+		}
+
+		if len(batch) == 0 {
+			if lastInfos == nil {
+				break
+			} else {
+				continue
+			}
+		}
+
+		batches = append(batches, batch)
+		batch = make([][]UnikFileInfo, 0, sBlock)
+	}
+	return batches
+}
+
+// blockMemory estimates the maximal memory of signatures of a block, i.e., numSigs * nBatchFiles,
+// from the biggest file groups assigned to blocks of sBlock, blockSizeX, and 8 or 1 groups.
+// In-flight signatures of every 8 groups (batch8s) are parts of the block, so they are not counted twice.
+func blockMemory(groups []UnikFileInfoGroup, sBlock int, blockSizeX int,
+	kmerThresholdX uint64, kmerThreshold8 uint64, numHashes int, fpr float64) uint64 {
+	var m, mX, m8 uint64
+	for _, g := range groups {
+		switch {
+		case g.Kmers > kmerThreshold8:
+			if g.Kmers > m8 {
+				m8 = g.Kmers
+			}
+		case g.Kmers > kmerThresholdX:
+			if g.Kmers > mX {
+				mX = g.Kmers
+			}
+		default:
+			if g.Kmers > m {
+				m = g.Kmers
+			}
+		}
+	}
+
+	mem := index.CalcSignatureSize(m, numHashes, fpr) * uint64((sBlock+7)/8)
+	if v := index.CalcSignatureSize(mX, numHashes, fpr) * uint64((blockSizeX+7)/8); v > mem {
+		mem = v
+	}
+	if v := index.CalcSignatureSize(m8, numHashes, fpr); v > mem { // at most 8 groups, a single batch
+		mem = v
+	}
+	return mem
+}
+
+// checkBlockFileForResuming checks if an index file written before an interruption
+// is complete and built from the same batch of files and parameters, so it can be reused
+// by "index --resume". The file size is returned.
+func checkBlockFileForResuming(file string, batch [][]UnikFileInfo, k int, numHashes uint8, numSigs uint64) (int64, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+
+	br := bufio.NewReader(fh)
+	reader, err := index.NewReader(br)
+	if err != nil {
+		return 0, fmt.Errorf("corrupt index file: %s: %s", file, err)
+	}
+
+	if reader.K != k || reader.NumHashes != numHashes || reader.NumSigs != numSigs {
+		return 0, fmt.Errorf("index file built with different parameters: %s", file)
+	}
+
+	if len(reader.Names) != len(batch) {
+		return 0, fmt.Errorf("index file built with different files: %s", file)
+	}
+	names := make([]string, 0, 8)
+	for i, infos := range batch {
+		if len(reader.Names[i]) != len(infos) {
+			return 0, fmt.Errorf("index file built with different files: %s", file)
+		}
+		names = names[:0]
+		for _, info := range infos {
+			names = append(names, info.Name)
+		}
+		sort.Strings(names)
+		_names := append([]string{}, reader.Names[i]...)
+		sort.Strings(_names)
+		for j, name := range names {
+			if _names[j] != name {
+				return 0, fmt.Errorf("index file built with different files: %s", file)
+			}
+		}
+	}
+
+	// truncated files
+	n, err := io.Copy(ioutil.Discard, br)
+	if err != nil {
+		return 0, fmt.Errorf("corrupt index file: %s: %s", file, err)
+	}
+	if uint64(n) != reader.NumSigs*uint64(reader.NumRowBytes) {
+		return 0, fmt.Errorf("truncated index file: %s", file)
+	}
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
 
 var fnParseUnikInfoFile = func(line string) (interface{}, bool, error) {
 	if len(line) > 0 && line[len(line)-1] == '\n' {
@@ -179,6 +497,8 @@ type Meta struct {
 	SplitSize    int  `json:"sp-s"`
 	SplitNum     int  `json:"sp-n"`
 	SplitOverlap int  `json:"sp-o"`
+
+	Alphabet string `json:"ab,omitempty"` // alphabet, empty for dna
 }
 
 func (m Meta) String() string {
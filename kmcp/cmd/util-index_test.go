@@ -0,0 +1,154 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/twotwotwo/sorts"
+)
+
+// testUnikFileInfos returns n files with duplicated names and k-mer numbers,
+// and some big files for changing block sizes.
+func testUnikFileInfos(n int) []UnikFileInfo {
+	infos := make([]UnikFileInfo, n)
+	var name string
+	var kmers uint64
+	for i := 0; i < n; i++ {
+		// every 10th file shares the name and number of k-mers with the previous one
+		if i%10 != 9 {
+			name = fmt.Sprintf("g%05d", i)
+
+			switch {
+			case i%1000 == 0:
+				kmers = 2000000
+			case i%500 == 0:
+				kmers = 500000
+			case i%100 == 0:
+				kmers = 50000
+			default:
+				kmers = uint64(i%7+1) * 1000
+			}
+		}
+		infos[i] = UnikFileInfo{
+			Path:  fmt.Sprintf("dir%d/%s.unik", i%3, name),
+			Name:  name,
+			Kmers: kmers,
+		}
+	}
+	return infos
+}
+
+func TestBlockBatchesDeterministic(t *testing.T) {
+	files := testUnikFileInfos(12000) // more than the minimal size of parallel sorting
+
+	tests := []struct {
+		name       string
+		numBuckets int
+		singleSet  bool
+		sBlock     int
+		blockSizeX int
+		skipBlockX bool
+	}{
+		{"buckets", 2000, false, 64, 16, false},
+		{"single set", len(files), true, 256, 32, false},
+		{"skip block size X", 2000, false, 64, 64, true},
+		{"small blocks", 2000, false, 8, 8, false},
+	}
+
+	defer func(old int) { sorts.MaxProcs = old }(sorts.MaxProcs)
+
+	assign := func(infos []UnikFileInfo, numBuckets int, singleSet bool, sBlock, blockSizeX int, skipBlockX bool) []string {
+		groups := groupUnikFiles(infos, numBuckets, singleSet, 0, 1)
+		batches := blockBatches(groups, sBlock, blockSizeX, skipBlockX, 20000, 100000, 1000000)
+
+		blocks := make([]string, len(batches))
+		paths := make([]string, 0, 256)
+		for b, batch := range batches {
+			paths = paths[:0]
+			for _, infos := range batch {
+				for _, info := range infos {
+					paths = append(paths, info.Path)
+				}
+				paths = append(paths, "|")
+			}
+			blocks[b] = strings.Join(paths, ",")
+		}
+		return blocks
+	}
+
+	shuffled := func(seed int64) []UnikFileInfo {
+		infos := append([]UnikFileInfo{}, files...)
+		r := rand.New(rand.NewSource(seed))
+		r.Shuffle(len(infos), func(i, j int) { infos[i], infos[j] = infos[j], infos[i] })
+		return infos
+	}
+
+	for _, test := range tests {
+		sorts.MaxProcs = 1
+		want := assign(shuffled(1), test.numBuckets, test.singleSet, test.sBlock, test.blockSizeX, test.skipBlockX)
+		if len(want) < 2 {
+			t.Fatalf("%s: too few blocks: %d", test.name, len(want))
+		}
+
+		for _, threads := range []int{1, 2, 4, 8} {
+			sorts.MaxProcs = threads
+			for seed := int64(2); seed < 5; seed++ {
+				got := assign(shuffled(seed), test.numBuckets, test.singleSet, test.sBlock, test.blockSizeX, test.skipBlockX)
+				if len(got) != len(want) {
+					t.Errorf("%s: threads: %d, seed: %d: %d blocks, want %d", test.name, threads, seed, len(got), len(want))
+					continue
+				}
+				for b := range want {
+					if got[b] != want[b] {
+						t.Errorf("%s: threads: %d, seed: %d: different files in block #%d", test.name, threads, seed, b+1)
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestTaxidVoter(t *testing.T) {
+	tests := []struct {
+		taxids []uint32
+		want   uint32
+	}{
+		{nil, 0},
+		{[]uint32{0, 0}, 0},
+		{[]uint32{3, 3, 1, 2}, 3},    // plurality without a majority
+		{[]uint32{1, 2, 3, 1, 2}, 1}, // ties of 1 and 2, the smallest one
+		{[]uint32{5, 0, 0, 0}, 5},    // 0 is ignored
+	}
+	for _, test := range tests {
+		var voter taxidVoter
+		for _, taxid := range test.taxids {
+			voter.Add(taxid)
+		}
+		if got := voter.Taxid(); got != test.want {
+			t.Errorf("taxidVoter of %v: %d, want %d", test.taxids, got, test.want)
+		}
+	}
+}
@@ -27,14 +27,31 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	gzip "github.com/klauspost/pgzip"
+	"github.com/shenwei356/bio/seqio/fastx"
 )
 
 // BufferSize is size of buffer
 var BufferSize = 65536 // os.Getpagesize()
 
 func outStream(file string, gzipped bool, level int) (*bufio.Writer, io.WriteCloser, *os.File, error) {
+	return _outStream(file, gzipped, level, false, BufferSize)
+}
+
+// outStreamAppend is similar to outStream, but the file is opened in append mode.
+// For gzipped file, a new gzip member is appended, which is supported by most tools.
+func outStreamAppend(file string, gzipped bool, level int) (*bufio.Writer, io.WriteCloser, *os.File, error) {
+	return _outStream(file, gzipped, level, true, BufferSize)
+}
+
+// outStreamWithBufferSize is similar to outStream and outStreamAppend, with a custom size of the write buffer.
+func outStreamWithBufferSize(file string, gzipped bool, level int, appending bool, bufferSize int) (*bufio.Writer, io.WriteCloser, *os.File, error) {
+	return _outStream(file, gzipped, level, appending, bufferSize)
+}
+
+func _outStream(file string, gzipped bool, level int, appending bool, bufferSize int) (*bufio.Writer, io.WriteCloser, *os.File, error) {
 	var w *os.File
 	if file == "-" {
 		w = os.Stdout
@@ -48,7 +65,11 @@ func outStream(file string, gzipped bool, level int) (*bufio.Writer, io.WriteClo
 			os.MkdirAll(dir, 0755)
 		}
 
-		w, err = os.Create(file)
+		if appending {
+			w, err = os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		} else {
+			w, err = os.Create(file)
+		}
 		if err != nil {
 			return nil, nil, nil, fmt.Errorf("fail to write %s: %s", file, err)
 		}
@@ -60,9 +81,90 @@ func outStream(file string, gzipped bool, level int) (*bufio.Writer, io.WriteClo
 		if err != nil {
 			return nil, nil, nil, fmt.Errorf("fail to write %s: %s", file, err)
 		}
-		return bufio.NewWriterSize(gw, BufferSize), gw, w, nil
+		return bufio.NewWriterSize(gw, bufferSize), gw, w, nil
+	}
+	return bufio.NewWriterSize(w, bufferSize), nil, w, nil
+}
+
+// checkHeaderForAppending checks the header row of an existing file
+// before appending data to it, to avoid mixing outputs of different formats.
+// It returns true if a header row is needed, i.e., the file does not exist or is empty.
+// For a file without a header row, the numbers of columns are compared.
+func checkHeaderForAppending(file string, header string) (bool, error) {
+	if file == "-" {
+		return true, nil
+	}
+	fi, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("fail to check %s: %s", file, err)
+	}
+	if fi.Size() == 0 {
+		return true, nil
+	}
+
+	br, r, _, err := inStream(file)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	line, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("fail to read %s: %s", file, err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" { // empty gzip file
+		return true, nil
+	}
+	header = strings.TrimRight(header, "\r\n")
+
+	if header[0] == '#' && line[0] != '#' { // no header row in the existing file
+		if strings.Count(line, "\t") != strings.Count(header, "\t") {
+			return false, fmt.Errorf("the number of columns in %s is different from the current output, refuse to append", file)
+		}
+		return false, nil
+	}
+
+	if line != header {
+		return false, fmt.Errorf("the header row of %s is different from the current output, refuse to append: %s", file, line)
 	}
-	return bufio.NewWriterSize(w, BufferSize), nil, w, nil
+	return false, nil
+}
+
+// nonEmptyOutput checks if an output file exists and has some content,
+// a gzipped file with nothing compressed is treated as empty.
+func nonEmptyOutput(file string) (bool, error) {
+	if file == "-" {
+		return false, nil
+	}
+	fi, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("fail to check %s: %s", file, err)
+	}
+	if fi.Size() == 0 {
+		return false, nil
+	}
+
+	br, r, _, err := inStream(file)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	_, err = br.ReadByte()
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("fail to read %s: %s", file, err)
+	}
+	return true, nil
 }
 
 func inStream(file string) (*bufio.Reader, *os.File, bool, error) {
@@ -96,6 +198,96 @@ func inStream(file string) (*bufio.Reader, *os.File, bool, error) {
 	return br, r, gzipped, nil
 }
 
+// readNameList reads names from the first column of a (gzipped) file,
+// empty lines and lines starting with "#" are ignored.
+func readNameList(file string) (map[string]struct{}, error) {
+	br, r, _, err := inStream(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	names := make(map[string]struct{}, 1024)
+	var line string
+	for {
+		line, err = br.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" && line[0] != '#' {
+			if i := strings.IndexByte(line, '\t'); i >= 0 {
+				line = line[:i]
+			}
+			names[line] = struct{}{}
+		}
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("fail to read %s: %s", file, err)
+		}
+	}
+	return names, nil
+}
+
+// gzipBlockSize is the block size for decompressing gzipped input in background.
+const gzipBlockSize = 1 << 20
+
+// newFastxReader creates a FASTA/Q reader. For gzipped files and blocks > 0,
+// the data is decompressed in a background goroutine with up to the given
+// number of blocks read ahead, so the parser does not wait for decompression.
+// The returned io.Closer should be called after reading, it may be nil.
+func newFastxReader(file string, blocks int) (*fastx.Reader, io.Closer, error) {
+	if blocks <= 0 || file == "-" {
+		r, err := fastx.NewDefaultReader(file)
+		return r, nil, err
+	}
+
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to read %s: %s", file, err)
+	}
+	br := bufio.NewReaderSize(fh, BufferSize)
+	gzipped, err := isGzip(br)
+	if err != nil || !gzipped { // empty or plain text file, use the default reader
+		fh.Close()
+		r, err := fastx.NewDefaultReader(file)
+		return r, nil, err
+	}
+
+	gr, err := gzip.NewReaderN(br, gzipBlockSize, blocks)
+	if err != nil {
+		fh.Close()
+		return nil, nil, fmt.Errorf("fail to create gzip reader for %s: %s", file, err)
+	}
+	bgr := bufio.NewReaderSize(gr, BufferSize)
+	if _, err = bgr.Peek(1); err != nil { // no content after decompression
+		gr.Close()
+		fh.Close()
+		r, err := fastx.NewDefaultReader(file)
+		return r, nil, err
+	}
+
+	r, err := fastx.NewReaderFromIO(nil, bgr, "")
+	if err != nil {
+		gr.Close()
+		fh.Close()
+		return nil, nil, err
+	}
+	return r, &gzipFileCloser{gr: gr, fh: fh}, nil
+}
+
+type gzipFileCloser struct {
+	gr *gzip.Reader
+	fh *os.File
+}
+
+func (c *gzipFileCloser) Close() error {
+	err := c.gr.Close()
+	if err2 := c.fh.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
 func isGzip(b *bufio.Reader) (bool, error) {
 	return checkBytes(b, []byte{0x1f, 0x8b})
 }
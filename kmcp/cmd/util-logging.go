@@ -21,10 +21,14 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"runtime"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/mattn/go-colorable"
 	"github.com/shenwei356/go-logging"
@@ -38,12 +42,133 @@ var logFormat = logging.MustStringFormatter(
 
 var backendFormatter logging.Backend
 
-func init() {
+// logJSON means outputting log in JSON format, one object per line.
+var logJSON bool
+
+var logTimeStart = time.Now()
+
+// logFields are key-value pairs of a log record, e.g., counts and speeds,
+// which are outputted as separate keys of the JSON object in JSON format.
+type logFields map[string]interface{}
+
+// logMessage is a log message with structured fields.
+type logMessage struct {
+	message string
+	fields  logFields
+}
+
+func (m *logMessage) String() string { return m.message }
+
+// logInfoFields logs a message at the INFO level with structured fields,
+// the fields are only outputted in JSON format.
+func logInfoFields(fields logFields, format string, args ...interface{}) {
+	log.Info(&logMessage{message: fmt.Sprintf(format, args...), fields: fields})
+}
+
+// jsonFormatter formats a log record to a JSON object.
+type jsonFormatter struct{}
+
+func (f jsonFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	data, err := json.Marshal(struct {
+		Time    string  `json:"time"`
+		Level   string  `json:"level"`
+		Message string  `json:"message"`
+		Elapsed float64 `json:"elapsed"` // seconds since start
+	}{
+		Time:    r.Time.Format(time.RFC3339Nano),
+		Level:   strings.ToLower(r.Level.String()),
+		Message: strings.TrimSpace(r.Message()),
+		Elapsed: time.Since(logTimeStart).Seconds(),
+	})
+	if err != nil {
+		return err
+	}
+
+	// structured fields are appended after the common keys
+	if len(r.Args) == 1 {
+		if m, ok := r.Args[0].(*logMessage); ok && len(m.fields) > 0 {
+			keys := make([]string, 0, len(m.fields))
+			for key := range m.fields {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			data = data[:len(data)-1] // "}"
+			var k, v []byte
+			for _, key := range keys {
+				if k, err = json.Marshal(key); err != nil {
+					return err
+				}
+				if v, err = json.Marshal(m.fields[key]); err != nil {
+					return err
+				}
+				data = append(data, ',')
+				data = append(data, k...)
+				data = append(data, ':')
+				data = append(data, v...)
+			}
+			data = append(data, '}')
+		}
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// logLineWriter logs every line written to it at the INFO level.
+type logLineWriter struct{}
+
+func (w logLineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		log.Info(line)
+	}
+	return len(p), nil
+}
+
+// stderrWriter returns a writer for messages to stderr. In JSON format,
+// messages are logged line by line, so stderr only contains JSON objects.
+func stderrWriter() io.Writer {
+	if logJSON {
+		return logLineWriter{}
+	}
+	return os.Stderr
+}
+
+// progressBarOutput returns the output of progress bars,
+// which are discarded in JSON format.
+func progressBarOutput() io.Writer {
+	if logJSON {
+		return io.Discard
+	}
+	return os.Stderr
+}
+
+func stderrLogBackend() logging.Backend {
 	var stderr io.Writer = os.Stderr
 	if runtime.GOOS == "windows" {
 		stderr = colorable.NewColorableStderr()
 	}
-	backend := logging.NewLogBackend(stderr, "", 0)
+	return logging.NewLogBackend(stderr, "", 0)
+}
+
+// setLogFormat sets the format of log: text or json.
+func setLogFormat(format string) {
+	switch format {
+	case "text":
+		return
+	case "json":
+		logJSON = true
+		backendFormatter = logging.NewBackendFormatter(stderrLogBackend(), jsonFormatter{})
+		logging.SetBackend(backendFormatter)
+
+		log = logging.MustGetLogger("kmcp")
+	default:
+		checkError(fmt.Errorf("invalid value of flag --log-format: %s. Available: text/json", format))
+	}
+}
+
+func init() {
+	backend := stderrLogBackend()
 	backendFormatter = logging.NewBackendFormatter(backend, logFormat)
 
 	logging.SetBackend(backendFormatter)
@@ -61,7 +186,12 @@ func addLog(file string, verbose bool) *os.File {
 		`%{time:15:04:05.000} [%{level:.4s}] %{message}`,
 	)
 	backend := logging.NewLogBackend(w, "", 0)
-	backendFormatter2 := logging.NewBackendFormatter(backend, logFormat2)
+	var backendFormatter2 logging.Backend
+	if logJSON {
+		backendFormatter2 = logging.NewBackendFormatter(backend, jsonFormatter{})
+	} else {
+		backendFormatter2 = logging.NewBackendFormatter(backend, logFormat2)
+	}
 
 	if !verbose {
 		logging.SetBackend(backendFormatter2)
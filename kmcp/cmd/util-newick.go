@@ -0,0 +1,260 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+)
+
+// NewickNode is a node of a tree in Newick format.
+type NewickNode struct {
+	Name     string
+	Length   float64 // branch length, 0 for not given
+	Children []*NewickNode
+}
+
+// NewickFromFile reads a tree in Newick format from a (gzipped) file.
+func NewickFromFile(file string) (*NewickNode, error) {
+	infh, r, _, err := inStream(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(infh)
+	if err != nil {
+		return nil, err
+	}
+	return ParseNewick(data)
+}
+
+// ParseNewick parses a tree in Newick format.
+// Quoted labels and comments in square brackets are supported.
+func ParseNewick(data []byte) (*NewickNode, error) {
+	p := &newickParser{s: data}
+	p.skip()
+	root, err := p.subtree()
+	if err != nil {
+		return nil, err
+	}
+	p.skip()
+	if p.i < len(p.s) && p.s[p.i] == ';' {
+		p.i++
+		p.skip()
+	}
+	if p.i < len(p.s) {
+		return nil, p.errorf("unexpected data after the tree")
+	}
+	return root, nil
+}
+
+type newickParser struct {
+	s []byte
+	i int
+}
+
+func (p *newickParser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("invalid Newick format at position %d: %s", p.i+1, fmt.Sprintf(format, a...))
+}
+
+// skip skips white spaces and comments.
+func (p *newickParser) skip() {
+	for p.i < len(p.s) {
+		switch p.s[p.i] {
+		case ' ', '\t', '\r', '\n':
+			p.i++
+		case '[':
+			j := bytes.IndexByte(p.s[p.i:], ']')
+			if j < 0 {
+				p.i = len(p.s)
+				return
+			}
+			p.i += j + 1
+		default:
+			return
+		}
+	}
+}
+
+func (p *newickParser) subtree() (*NewickNode, error) {
+	node := &NewickNode{}
+	if p.i < len(p.s) && p.s[p.i] == '(' {
+		p.i++
+		for {
+			p.skip()
+			child, err := p.subtree()
+			if err != nil {
+				return nil, err
+			}
+			node.Children = append(node.Children, child)
+
+			p.skip()
+			if p.i >= len(p.s) {
+				return nil, p.errorf("unclosed parenthesis")
+			}
+			if p.s[p.i] == ',' {
+				p.i++
+				continue
+			}
+			if p.s[p.i] == ')' {
+				p.i++
+				break
+			}
+			return nil, p.errorf("unexpected character: %c", p.s[p.i])
+		}
+	}
+
+	p.skip()
+	name, err := p.label()
+	if err != nil {
+		return nil, err
+	}
+	node.Name = name
+
+	p.skip()
+	if p.i < len(p.s) && p.s[p.i] == ':' {
+		p.i++
+		p.skip()
+		j := p.i
+		for p.i < len(p.s) && bytes.IndexByte([]byte("(),:;[ \t\r\n"), p.s[p.i]) < 0 {
+			p.i++
+		}
+		node.Length, err = strconv.ParseFloat(string(p.s[j:p.i]), 64)
+		if err != nil {
+			return nil, p.errorf("invalid branch length: %s", p.s[j:p.i])
+		}
+	}
+	return node, nil
+}
+
+func (p *newickParser) label() (string, error) {
+	if p.i >= len(p.s) {
+		return "", nil
+	}
+	if p.s[p.i] == '\'' { // quoted label, where '' is a single quote
+		var buf bytes.Buffer
+		p.i++
+		for {
+			if p.i >= len(p.s) {
+				return "", p.errorf("unclosed quote")
+			}
+			if p.s[p.i] == '\'' {
+				if p.i+1 < len(p.s) && p.s[p.i+1] == '\'' {
+					buf.WriteByte('\'')
+					p.i += 2
+					continue
+				}
+				p.i++
+				break
+			}
+			buf.WriteByte(p.s[p.i])
+			p.i++
+		}
+		return buf.String(), nil
+	}
+
+	j := p.i
+	for p.i < len(p.s) && bytes.IndexByte([]byte("(),:;[\t\r\n"), p.s[p.i]) < 0 {
+		p.i++
+	}
+	return string(bytes.TrimRight(p.s[j:p.i], " ")), nil
+}
+
+// TreeNodeAbundance is the cumulative abundance of a node of a tree.
+type TreeNodeAbundance struct {
+	Name       string
+	Depth      int
+	Leaves     int // number of leaves with abundance
+	Percentage float64
+}
+
+// TreeRollup sums up abundances of leaves along the tree,
+// and returns nodes with abundance in pre-order. Unnamed nodes are named
+// with "node_" and their pre-order index. Leaf names absent in abundances are ignored,
+// and names in abundances absent in the tree are returned.
+func TreeRollup(root *NewickNode, abundances map[string]float64) ([]TreeNodeAbundance, []string, error) {
+	seen := make(map[string]struct{}, len(abundances))
+	nodes := make([]TreeNodeAbundance, 0, 1024)
+
+	var idx int
+	var walk func(node *NewickNode, depth int) (float64, int, error)
+	walk = func(node *NewickNode, depth int) (float64, int, error) {
+		name := node.Name
+		if name == "" {
+			name = fmt.Sprintf("node_%d", idx)
+		}
+		idx++
+
+		// placeholder for pre-order output
+		i := len(nodes)
+		nodes = append(nodes, TreeNodeAbundance{Name: name, Depth: depth})
+
+		var sum float64
+		var leaves int
+		if len(node.Children) == 0 {
+			if v, ok := abundances[node.Name]; ok {
+				if _, ok = seen[node.Name]; ok {
+					return 0, 0, fmt.Errorf("duplicated leaf name in the tree: %s", node.Name)
+				}
+				seen[node.Name] = struct{}{}
+				sum, leaves = v, 1
+			}
+		} else {
+			for _, child := range node.Children {
+				v, n, err := walk(child, depth+1)
+				if err != nil {
+					return 0, 0, err
+				}
+				sum += v
+				leaves += n
+			}
+		}
+
+		nodes[i].Percentage = sum
+		nodes[i].Leaves = leaves
+		return sum, leaves, nil
+	}
+
+	if _, _, err := walk(root, 0); err != nil {
+		return nil, nil, err
+	}
+
+	// only keep nodes with abundance
+	j := 0
+	for _, node := range nodes {
+		if node.Leaves > 0 {
+			nodes[j] = node
+			j++
+		}
+	}
+	nodes = nodes[:j]
+
+	missing := make([]string, 0, 8)
+	for name := range abundances {
+		if _, ok := seen[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	return nodes, missing, nil
+}
@@ -0,0 +1,143 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// profileOutputs are output files of profiling, empty ones are not written.
+type profileOutputs struct {
+	profile    string // -o/--out-prefix
+	cami       string // -C/--cami-report
+	metaphlan  string // -M/--metaphlan-report
+	binning    string // -B/--binning-result
+	rank       string // --rank-report
+	tree       string // --tree-report
+	diag       string // --output-kmers
+	state      string // --save-state
+	collisions string // --report-map-collisions
+	debug      string // --debug
+
+	sampleID string
+}
+
+// profileFilePrefix returns the output prefix for a search result file,
+// with the directory and the file extensions removed.
+func profileFilePrefix(outDir string, file string) string {
+	base := filepath.Base(file)
+	if strings.HasSuffix(strings.ToLower(base), ".gz") {
+		base = base[:len(base)-3]
+	}
+	if ext := filepath.Ext(base); ext != "" && ext != base {
+		base = base[:len(base)-len(ext)]
+	}
+	return filepath.Join(outDir, base)
+}
+
+// profileFileOutputs returns outputs of a search result file for --by-file,
+// only the outputs enabled in outs are set.
+func profileFileOutputs(outs profileOutputs, prefix string) profileOutputs {
+	outs2 := profileOutputs{profile: prefix + ".k.profile", sampleID: outs.sampleID}
+	if outs.cami != "" {
+		outs2.cami = prefix + ".c.profile"
+	}
+	if outs.metaphlan != "" {
+		outs2.metaphlan = prefix + ".m.profile"
+	}
+	if outs.binning != "" {
+		outs2.binning = prefix + ".binning.gz"
+	}
+	if outs.rank != "" {
+		outs2.rank = prefix + ".rank.profile"
+	}
+	if outs.tree != "" {
+		outs2.tree = prefix + ".tree.profile"
+	}
+	if outs2.sampleID == "" {
+		outs2.sampleID = filepath.Base(prefix)
+	}
+	return outs2
+}
+
+// profileByFile profiles each search result file independently with profileFiles,
+// so that each of them has its own profile.
+// The number of files processed at the same time is limited by threads.
+func profileByFile(opt *Options, files []string, outDir string, threads int,
+	outs profileOutputs, profileFiles func(files []string, outs profileOutputs, verbose bool) error) {
+
+	// the same output file for different input files
+	prefixes := make(map[string]string, len(files))
+	for _, file := range files {
+		prefix := profileFilePrefix(outDir, file)
+		if _file, ok := prefixes[prefix]; ok {
+			checkError(fmt.Errorf("input files with the same basename are not allowed with --by-file: %s, %s", _file, file))
+		}
+		prefixes[prefix] = file
+	}
+
+	checkError(os.MkdirAll(outDir, 0777))
+
+	if opt.Verbose || opt.Log2File {
+		log.Infof("profiling %d file(s) independently with %d worker(s) in parallel ...", len(files), threads)
+		log.Infof("  output directory: %s", outDir)
+	}
+
+	var wg sync.WaitGroup
+	tokens := make(chan int, threads)
+	var mu sync.Mutex
+	var nDone int
+	var failed []string
+	for _, file := range files {
+		wg.Add(1)
+		tokens <- 1
+		go func(file string) {
+			defer func() {
+				wg.Done()
+				<-tokens
+			}()
+
+			outs2 := profileFileOutputs(outs, profileFilePrefix(outDir, file))
+			err := profileFiles([]string{file}, outs2, false)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Errorf("failed to profile %s: %s", file, err)
+				failed = append(failed, file)
+				return
+			}
+			nDone++
+			if opt.Verbose || opt.Log2File {
+				log.Infof("  [%d/%d] %s -> %s", nDone, len(files), file, outs2.profile)
+			}
+		}(file)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		checkError(fmt.Errorf("failed to profile %d of %d file(s)", len(failed), len(files)))
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/shenwei356/util/stats"
+	"github.com/zeebo/wyhash"
+)
+
+// profileStateVersion is the version of the format of profile state files.
+const profileStateVersion = 1
+
+// ProfileState is the intermediate state of profiling, i.e., counts of
+// references after assigning reads in stage 4/4, before filtering and
+// computing abundances. States of different shards of search results
+// can be merged into a final profile.
+type ProfileState struct {
+	Version       int            `json:"version"`
+	Reads         float64        `json:"reads"`          // number of matched reads
+	AssignedReads float64        `json:"assigned-reads"` // number of reads belonging to references
+	Targets       []*TargetState `json:"targets"`
+}
+
+// TargetState is the state of a reference.
+type TargetState struct {
+	Name         string    `json:"name"`
+	GenomeSize   uint64    `json:"gsize"`
+	Match        []float64 `json:"match"`
+	UniqMatch    []float64 `json:"umatch"`
+	UniqMatchHic []float64 `json:"hicumatch"`
+	QLen         []float64 `json:"qlen"`
+	QCovs        []float64 `json:"qcovs"` // query coverages of unique matches, for computing the score
+
+	// sampled matched k-mers, only for search results with --output-kmer-sketch
+	Sketch       []uint64 `json:"sketch,omitempty"`
+	SketchTKmers []uint64 `json:"sketch-tkmers,omitempty"`
+	SketchScale  int      `json:"sketch-scale,omitempty"`
+}
+
+// HasSketch tells if the state contains sampled matched k-mers.
+func (s *ProfileState) HasSketch() bool {
+	for _, t := range s.Targets {
+		if t.SketchScale > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// NewProfileState creates a state from targets of stage 4/4 (profile3),
+// and sampled matched k-mers of stage 3/4 (profile2).
+func NewProfileState(reads, assignedReads float64, profile3 map[uint64]*Target, profile2 map[uint64]*Target) *ProfileState {
+	s := &ProfileState{
+		Version:       profileStateVersion,
+		Reads:         reads,
+		AssignedReads: assignedReads,
+		Targets:       make([]*TargetState, 0, len(profile3)),
+	}
+	for h, t := range profile3 {
+		ts := &TargetState{
+			Name:         t.Name,
+			GenomeSize:   t.GenomeSize,
+			Match:        t.Match,
+			UniqMatch:    t.UniqMatch,
+			UniqMatchHic: t.UniqMatchHic,
+			QLen:         t.QLen,
+			QCovs:        t.QCovs,
+		}
+		if t2, ok := profile2[h]; ok && t2.Sketch != nil {
+			ts.Sketch = make([]uint64, 0, len(t2.Sketch))
+			for kmer := range t2.Sketch {
+				ts.Sketch = append(ts.Sketch, kmer)
+			}
+			sort.Slice(ts.Sketch, func(i, j int) bool { return ts.Sketch[i] < ts.Sketch[j] })
+			ts.SketchTKmers = t2.SketchTKmers
+			ts.SketchScale = t2.SketchScale
+		}
+		s.Targets = append(s.Targets, ts)
+	}
+	sort.Slice(s.Targets, func(i, j int) bool { return s.Targets[i].Name < s.Targets[j].Name })
+	return s
+}
+
+// WriteTo writes the state to a (gzipped) file in JSON format.
+func (s *ProfileState) WriteTo(file string, compressionLevel int) error {
+	outfh, gw, w, err := outStream(file, strings.HasSuffix(strings.ToLower(file), ".gz"), compressionLevel)
+	if err != nil {
+		return err
+	}
+	if err = json.NewEncoder(outfh).Encode(s); err != nil {
+		return err
+	}
+	if err = outfh.Flush(); err != nil {
+		return err
+	}
+	if gw != nil {
+		if err = gw.Close(); err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
+
+// ProfileStateFromFile reads a state from a (gzipped) file.
+func ProfileStateFromFile(file string) (*ProfileState, error) {
+	infh, r, _, err := inStream(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var s ProfileState
+	if err = json.NewDecoder(infh).Decode(&s); err != nil {
+		return nil, fmt.Errorf("invalid profile state file: %s", err)
+	}
+	if s.Version != profileStateVersion {
+		return nil, fmt.Errorf("unsupported version of profile state file: %d", s.Version)
+	}
+	return &s, nil
+}
+
+// MergeInto adds counts of references into profile3, and sampled matched k-mers into profile2.
+// Query coverages are kept in targets when keepQCovs is true, for saving the merged state.
+func (s *ProfileState) MergeInto(profile3 map[uint64]*Target, profile2 map[uint64]*Target, keepQCovs bool) error {
+	var h uint64
+	var t, t2 *Target
+	var ok bool
+	for _, ts := range s.Targets {
+		h = wyhash.HashString(ts.Name, 1)
+
+		n := len(ts.Match)
+		if len(ts.UniqMatch) != n || len(ts.UniqMatchHic) != n || len(ts.QLen) != n {
+			return fmt.Errorf("inconsistent numbers of chunks of reference: %s", ts.Name)
+		}
+
+		if t, ok = profile3[h]; !ok {
+			t = &Target{
+				Name:         ts.Name,
+				GenomeSize:   ts.GenomeSize,
+				Match:        make([]float64, n),
+				UniqMatch:    make([]float64, n),
+				UniqMatchHic: make([]float64, n),
+				QLen:         make([]float64, n),
+				RelDepth:     make([]float64, n),
+				Stats:        stats.NewQuantiler(),
+				StatsA:       stats.NewQuantiler(),
+			}
+			profile3[h] = t
+		} else if len(t.Match) != n {
+			return fmt.Errorf("numbers of chunks of reference %s are different: %d != %d", ts.Name, len(t.Match), n)
+		}
+
+		for i := 0; i < n; i++ {
+			t.Match[i] += ts.Match[i]
+			t.UniqMatch[i] += ts.UniqMatch[i]
+			t.UniqMatchHic[i] += ts.UniqMatchHic[i]
+			t.QLen[i] += ts.QLen[i]
+		}
+		for _, v := range ts.QCovs {
+			t.Stats.Add(v)
+		}
+		if keepQCovs {
+			t.QCovs = append(t.QCovs, ts.QCovs...)
+		}
+
+		if ts.SketchScale == 0 {
+			continue
+		}
+		if t2, ok = profile2[h]; !ok {
+			t2 = &Target{Name: ts.Name, GenomeSize: ts.GenomeSize}
+			profile2[h] = t2
+		}
+		if t2.Sketch == nil {
+			t2.Sketch = make(map[uint64]struct{}, len(ts.Sketch))
+			t2.SketchTKmers = make([]uint64, len(ts.SketchTKmers))
+		}
+		if ts.SketchScale > t2.SketchScale {
+			t2.SketchScale = ts.SketchScale
+		}
+		for i, v := range ts.SketchTKmers {
+			if i < len(t2.SketchTKmers) && v > 0 {
+				t2.SketchTKmers[i] = v
+			}
+		}
+		for _, kmer := range ts.Sketch {
+			t2.Sketch[kmer] = struct{}{}
+		}
+	}
+	return nil
+}
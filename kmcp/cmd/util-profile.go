@@ -21,12 +21,17 @@
 package cmd
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"math"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/shenwei356/bio/taxdump"
+	"github.com/shenwei356/breader"
 	"github.com/shenwei356/util/stats"
 )
 
@@ -43,6 +48,189 @@ type MatchResult struct {
 	K       int
 	MKmers  int
 	QCov    float64
+	TCov    float64
+
+	Mate uint8 // 1 or 2 for mates of paired-end reads (--paired), 0 for others
+
+	// sampled matched k-mers, only for search results with --output-kmer-sketch
+	TKmers      uint64 // k-mers of the target chunk
+	SketchScale int
+	Sketch      []uint64
+}
+
+// searchResultColumn returns the 0-based index of a column in the header row
+// of a search result file, -1 is returned if the column or the header row is absent.
+func searchResultColumn(file string, column string) (int, error) {
+	br, r, _, err := inStream(file)
+	if err != nil {
+		return -1, err
+	}
+	defer r.Close()
+
+	line, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return -1, fmt.Errorf("fail to read %s: %s", file, err)
+	}
+	if !strings.HasPrefix(line, "#") {
+		return -1, nil
+	}
+	for i, c := range strings.Split(strings.TrimRight(line, "\r\n"), "\t") {
+		if c == column {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// nthField returns the nth (0-based) field of s separated by sep.
+func nthField(s string, sep byte, n int) string {
+	var i int
+	for ; n > 0; n-- {
+		i = strings.IndexByte(s, sep)
+		if i < 0 {
+			return ""
+		}
+		s = s[i+1:]
+	}
+	if i = strings.IndexByte(s, sep); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+// parseKmerSketch parses sampled matched k-mers outputted by "kmcp search --output-kmer-sketch",
+// in the format of "<k-mers of the target chunk>:<scale>:<k-mer>,<k-mer>,...".
+func parseKmerSketch(value string, m *MatchResult) {
+	items := strings.SplitN(value, ":", 3)
+	if len(items) != 3 {
+		checkError(fmt.Errorf("failed to parse kmerSketch: %s", value))
+	}
+
+	var err error
+	m.TKmers, err = strconv.ParseUint(items[0], 10, 64)
+	if err != nil {
+		checkError(fmt.Errorf("failed to parse kmerSketch: %s", value))
+	}
+	m.SketchScale, err = strconv.Atoi(items[1])
+	if err != nil || m.SketchScale <= 0 {
+		checkError(fmt.Errorf("failed to parse kmerSketch: %s", value))
+	}
+
+	m.Sketch = m.Sketch[:0]
+	if items[2] == "" {
+		return
+	}
+	var kmer uint64
+	for _, v := range strings.Split(items[2], ",") {
+		kmer, err = strconv.ParseUint(v, 16, 64)
+		if err != nil {
+			checkError(fmt.Errorf("failed to parse kmerSketch: %s", value))
+		}
+		m.Sketch = append(m.Sketch, kmer)
+	}
+}
+
+// evictLeastAbundantTargets removes the references with the fewest matches,
+// leaving 90% (at least one) of maxTargets references to avoid evicting too frequently.
+// References with the same number of matches are evicted in order of their names.
+// It returns the number of evicted references.
+func evictLeastAbundantTargets(profile map[uint64]*Target, maxTargets int) int {
+	keep := maxTargets * 9 / 10
+	if keep < 1 {
+		keep = 1
+	}
+	n := len(profile) - keep
+	if n <= 0 {
+		return 0
+	}
+
+	type hashCount struct {
+		h     uint64
+		name  string
+		count float64
+	}
+	counts := make([]hashCount, 0, len(profile))
+	var sum float64
+	for h, t := range profile {
+		sum = 0
+		for _, c := range t.Match {
+			sum += c
+		}
+		counts = append(counts, hashCount{h, t.Name, sum})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].count == counts[j].count {
+			return counts[i].name < counts[j].name
+		}
+		return counts[i].count < counts[j].count
+	})
+
+	for _, c := range counts[:n] {
+		delete(profile, c.h)
+	}
+	return n
+}
+
+// cancelReader stops reading a file and drains the remaining chunks,
+// for returning early when an error occurs.
+func cancelReader(reader *breader.BufferedReader) {
+	reader.Cancel()
+	for range reader.Ch {
+	}
+}
+
+// trimMateSuffix removes the mate suffix ("/1" or "/2") of a query ID,
+// and returns the ID of the read pair and the mate number (0 for no suffix).
+func trimMateSuffix(query string) (string, uint8) {
+	n := len(query)
+	if n < 3 || query[n-2] != '/' {
+		return query, 0
+	}
+	switch query[n-1] {
+	case '1':
+		return query[:n-2], 1
+	case '2':
+		return query[:n-2], 2
+	}
+	return query, 0
+}
+
+// filterDisagreedMates removes targets matched by only one mate of a read pair,
+// when some targets are matched by both mates, i.e., both mates agree on them.
+func filterDisagreedMates(matches map[uint64]*[]*MatchResult) {
+	if len(matches) < 2 {
+		return
+	}
+
+	var agreed bool
+	var mates uint8
+	for _, ms := range matches {
+		if ms == nil {
+			return
+		}
+		mates = 0
+		for _, m := range *ms {
+			mates |= m.Mate
+		}
+		if mates == 3 {
+			agreed = true
+			break
+		}
+	}
+	if !agreed {
+		return
+	}
+
+	for h, ms := range matches {
+		mates = 0
+		for _, m := range *ms {
+			mates |= m.Mate
+		}
+		if mates != 3 {
+			poolMatchResults.Put(ms)
+			delete(matches, h)
+		}
+	}
 }
 
 var float64powm10 = []float64{
@@ -91,10 +279,10 @@ func parseFPR(value string) float64 {
 	return v * math.Pow10(-int(e))
 }
 
-func parseMatchResult(line string, numFields int, items *[]string, maxPFR float64, minQcov float64) (*MatchResult, bool) {
+func parseMatchResult(line string, numFields int, items *[]string, maxPFR float64, minQcov float64) (*MatchResult, bool, error) {
 	stringSplitNByByte(line, '\t', numFields, items)
 	if len(*items) < numFields {
-		checkError(fmt.Errorf("invalid kmcp search result format"))
+		return nil, false, fmt.Errorf("invalid kmcp search result format")
 	}
 
 	m := &MatchResult{} // do not use sync.Pool, which is slower for this case
@@ -104,7 +292,7 @@ func parseMatchResult(line string, numFields int, items *[]string, maxPFR float6
 	// slow
 	m.FPR, err = strconv.ParseFloat((*items)[3], 64)
 	if err != nil {
-		checkError(fmt.Errorf("failed to parse FPR: %s", (*items)[3]))
+		return nil, false, fmt.Errorf("failed to parse FPR: %s", (*items)[3])
 	}
 	// did not bring final speedup
 	// if len((*items)[3]) < 2 {
@@ -113,13 +301,13 @@ func parseMatchResult(line string, numFields int, items *[]string, maxPFR float6
 	// m.FPR = parseFPR((*items)[3])
 
 	if m.FPR > maxPFR {
-		return m, false
+		return m, false, nil
 	}
 
 	// slow
 	m.QCov, err = strconv.ParseFloat((*items)[11], 64)
 	if err != nil {
-		checkError(fmt.Errorf("failed to parse qCov: %s", (*items)[11]))
+		return nil, false, fmt.Errorf("failed to parse qCov: %s", (*items)[11])
 	}
 
 	// did not bring final speedup
@@ -129,7 +317,7 @@ func parseMatchResult(line string, numFields int, items *[]string, maxPFR float6
 	// m.QCov = parseQcov((*items)[11])
 
 	if m.QCov < minQcov {
-		return m, false
+		return m, false, nil
 	}
 
 	// -----------
@@ -138,47 +326,52 @@ func parseMatchResult(line string, numFields int, items *[]string, maxPFR float6
 
 	m.QLen, err = strconv.Atoi((*items)[1])
 	if err != nil {
-		checkError(fmt.Errorf("failed to parse qLen: %s", (*items)[1]))
+		return nil, false, fmt.Errorf("failed to parse qLen: %s", (*items)[1])
 	}
 
 	m.QKmers, err = strconv.Atoi((*items)[2])
 	if err != nil {
-		checkError(fmt.Errorf("failed to parse qKmers: %s", (*items)[2]))
+		return nil, false, fmt.Errorf("failed to parse qKmers: %s", (*items)[2])
 	}
 
 	m.Hits, err = strconv.Atoi((*items)[4])
 	if err != nil {
-		checkError(fmt.Errorf("failed to parse hits: %s", (*items)[4]))
+		return nil, false, fmt.Errorf("failed to parse hits: %s", (*items)[4])
 	}
 
 	m.Target = (*items)[5]
 
 	m.FragIdx, err = strconv.Atoi((*items)[6])
 	if err != nil {
-		checkError(fmt.Errorf("failed to parse chunkIdx: %s", (*items)[6]))
+		return nil, false, fmt.Errorf("failed to parse chunkIdx: %s", (*items)[6])
 	}
 
 	m.IdxNum, err = strconv.Atoi((*items)[7])
 	if err != nil {
-		checkError(fmt.Errorf("failed to parse IdxNum: %s", (*items)[7]))
+		return nil, false, fmt.Errorf("failed to parse IdxNum: %s", (*items)[7])
 	}
 
 	m.GSize, err = strconv.ParseUint((*items)[8], 10, 64)
 	if err != nil {
-		checkError(fmt.Errorf("failed to parse genomeSize: %s", (*items)[8]))
+		return nil, false, fmt.Errorf("failed to parse genomeSize: %s", (*items)[8])
 	}
 
 	m.K, err = strconv.Atoi((*items)[9])
 	if err != nil {
-		checkError(fmt.Errorf("failed to parse K: %s", (*items)[9]))
+		return nil, false, fmt.Errorf("failed to parse K: %s", (*items)[9])
 	}
 
 	m.MKmers, err = strconv.Atoi((*items)[10])
 	if err != nil {
-		checkError(fmt.Errorf("failed to parse mKmers: %s", (*items)[10]))
+		return nil, false, fmt.Errorf("failed to parse mKmers: %s", (*items)[10])
+	}
+
+	m.TCov, err = strconv.ParseFloat((*items)[12], 64)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to parse tCov: %s", (*items)[12])
 	}
 
-	return m, true
+	return m, true, nil
 }
 
 type Target struct {
@@ -203,12 +396,24 @@ type Target struct {
 	SumMatch        float64 // depth
 	SumUniqMatch    float64
 	SumUniqMatchHic float64
+	SumMKmers       float64 // matched k-mers, weighted in the same way as Match
 
 	FragsProp   float64 // coverage
 	Coverage    float64
 	Qlens       float64
 	RelDepth    []float64
 	RelDepthStd float64
+	Evenness    float64 // fraction of chunks with relative depths within 2X of the median
+
+	// union of sampled matched k-mers of all reads, and k-mers of chunks,
+	// for computing the genome-level target coverage.
+	Sketch       map[uint64]struct{}
+	SketchTKmers []uint64
+	SketchScale  int
+	UnionTCov    float64
+	GenomeUniq   float64 // fraction of sampled matched k-mers not shared with other references
+
+	UniqFragsProp float64 // fraction of chunks with uniquely matched reads
 
 	//
 	RefName string
@@ -226,11 +431,60 @@ type Target struct {
 	Percentage float64 // relative abundance
 
 	Stats  *stats.Quantiler // for computing percentil of qcov of unique matches
+	QCovs  []float64        // values added to Stats, only for saving profile states
 	StatsA *stats.Quantiler // for computing percentil of qcov of all matches
 
 	Score float64
 }
 
+// newTarget creates a Target for a reference with m.IdxNum chunks,
+// for counting matches as the stage 1/4 of "kmcp profile".
+func newTarget(m *MatchResult) *Target {
+	return &Target{
+		Name:         m.Target,
+		GenomeSize:   m.GSize,
+		Match:        make([]float64, m.IdxNum),
+		UniqMatch:    make([]float64, m.IdxNum),
+		UniqMatchHic: make([]float64, m.IdxNum),
+		StatsA:       stats.NewQuantiler(),
+	}
+}
+
+// CountMatches counts matches of a read on the reference as the stage 1/4 of "kmcp profile",
+// the read could match multiple chunks.
+// uniq means the read is uniquely matched to the reference (or references of the same species).
+// Query lengths are counted when QLen is allocated.
+func (t *Target) CountMatches(ms []*MatchResult, uniq bool, hicUreadsMinQcov float64) {
+	m := ms[0]
+	if uniq { // count once
+		t.UniqMatch[m.FragIdx]++
+		if m.QCov >= hicUreadsMinQcov {
+			t.UniqMatchHic[m.FragIdx]++
+		}
+	}
+	t.StatsA.Add(m.QCov)
+
+	floatMsSize := float64(len(ms))
+	for _, m = range ms {
+		// for a read matching multiple regions of a reference, distribute count to multiple regions,
+		// the sum is still one.
+		t.Match[m.FragIdx] += 1 / floatMsSize
+
+		if t.QLen != nil {
+			t.QLen[m.FragIdx] += float64(m.QLen) / floatMsSize
+		}
+	}
+}
+
+// BreadthDepth returns the estimated coverage combining breadth and depth, i.e., chunksFrac × coverage.
+// Only the breadth is returned for a reference without genome size, and false is returned.
+func (t *Target) BreadthDepth() (float64, bool) {
+	if t.GenomeSize == 0 {
+		return t.FragsProp, false
+	}
+	return t.FragsProp * t.Coverage, true
+}
+
 func (t *Target) AddTaxonomy(taxdb *taxdump.Taxonomy, showRanksMap map[string]interface{}, taxid uint32) {
 	t.Taxid, _ = taxdb.TaxId(taxid)
 	t.Rank = taxdb.Rank(taxid)
@@ -299,13 +553,16 @@ type ProfileNode struct {
 	LineageNames  []string // complete lineage
 	LineageTaxids []uint32
 	Percentage    float64
+	Reads         float64 // only computed by rollupProfile
+
+	firstTarget int // index of the first target belonging to the node
 }
 
 func generateProfile(taxdb *taxdump.Taxonomy, targets []*Target) map[uint32]*ProfileNode {
 
 	profile := make(map[uint32]*ProfileNode, len(targets))
 
-	for _, target := range targets {
+	for i, target := range targets {
 		for _, taxid := range target.CompleteLineageTaxids {
 			if node, ok := profile[taxid]; !ok {
 				profile[taxid] = &ProfileNode{
@@ -316,6 +573,8 @@ func generateProfile(taxdb *taxdump.Taxonomy, targets []*Target) map[uint32]*Pro
 					LineageTaxids: taxdb.LineageTaxIds(taxid),
 
 					Percentage: target.Percentage,
+
+					firstTarget: i,
 				}
 			} else {
 				node.Percentage += target.Percentage
@@ -325,3 +584,456 @@ func generateProfile(taxdb *taxdump.Taxonomy, targets []*Target) map[uint32]*Pro
 
 	return profile
 }
+
+// normalizeProfileByRank returns copies of nodes with percentages normalized to sum up to 100 at each rank,
+// as some targets have no taxa at certain ranks. Nodes are sorted by ranks in rankOrder,
+// and nodes at the same rank are in the order of their first targets.
+func normalizeProfileByRank(nodes []*ProfileNode, rankOrder map[string]int) []*ProfileNode {
+	sums := make(map[string]float64, 8)
+	for _, node := range nodes {
+		sums[node.Rank] += node.Percentage
+	}
+
+	nodes2 := make([]*ProfileNode, len(nodes))
+	for i, node := range nodes {
+		_node := *node
+		if sum := sums[node.Rank]; sum > 0 {
+			_node.Percentage = node.Percentage / sum * 100
+		}
+		nodes2[i] = &_node
+	}
+
+	sort.Slice(nodes2, func(i, j int) bool {
+		if rankOrder[nodes2[i].Rank] != rankOrder[nodes2[j].Rank] {
+			return rankOrder[nodes2[i].Rank] < rankOrder[nodes2[j].Rank]
+		}
+		return nodes2[i].firstTarget < nodes2[j].firstTarget
+	})
+	return nodes2
+}
+
+// writeCAMIProfile writes nodes in the CAMI profiling format.
+// Only taxa at ranks in showRanksMap are written, if it's not empty.
+// https://github.com/bioboxes/rfc/blob/master/data-format/profiling.mkd
+func writeCAMIProfile(outfh *bufio.Writer, taxdb *taxdump.Taxonomy, nodes []*ProfileNode,
+	showRanksMap map[string]interface{}, sampleID string, taxonomyID string, precision int) {
+	outfh.WriteString(fmt.Sprintf("@SampleID:%s\n", sampleID))
+	outfh.WriteString("@Version:0.10.0\n")
+	outfh.WriteString("@Ranks:superkingdom|phylum|class|order|family|genus|species|strain\n")
+	outfh.WriteString(fmt.Sprintf("@TaxonomyID:%s\n", taxonomyID))
+	outfh.WriteString("@@TAXID\tRANK\tTAXPATH\tTAXPATHSN\tPERCENTAGE\n")
+
+	var ok bool
+	var lineageTaxids, lineageNames string
+	filterByRank := len(showRanksMap) > 0
+	names := make([]string, 0, 8)
+	taxids := make([]string, 0, 8)
+	for _, node := range nodes {
+		if filterByRank {
+			if _, ok = showRanksMap[taxdb.Rank(node.Taxid)]; !ok {
+				continue
+			}
+
+			names = names[:0]
+			taxids = taxids[:0]
+			for i, taxid := range node.LineageTaxids {
+				if _, ok = showRanksMap[taxdb.Rank(taxid)]; ok {
+					taxids = append(taxids, strconv.Itoa(int(taxid)))
+					names = append(names, node.LineageNames[i])
+				}
+			}
+			lineageTaxids = strings.Join(taxids, "|")
+			lineageNames = strings.Join(names, "|")
+		} else {
+			taxids = taxids[:0]
+			for _, taxid := range node.LineageTaxids {
+				taxids = append(taxids, strconv.Itoa(int(taxid)))
+			}
+			lineageTaxids = strings.Join(taxids, "|")
+			lineageNames = strings.Join(node.LineageNames, "|")
+		}
+
+		outfh.WriteString(fmt.Sprintf("%d\t%s\t%s\t%s\t%.*f\n",
+			node.Taxid, node.Rank, lineageTaxids, lineageNames, precision, node.Percentage))
+	}
+}
+
+// rollupProfile sums up percentages and reads of targets to their ancestors at the given rank,
+// nodes are sorted by percentage in descending order.
+// Targets without TaxIds or without ancestors at the rank are put into an "unclassified"
+// node with a TaxId of 0 at the end, rather than being dropped, so percentages sum up to 100.
+func rollupProfile(taxdb *taxdump.Taxonomy, targets []*Target, rank string) []*ProfileNode {
+	profile := make(map[uint32]*ProfileNode, len(targets))
+
+	var unclassified *ProfileNode
+	var found bool
+	for _, target := range targets {
+		found = false
+		for _, taxid := range target.CompleteLineageTaxids {
+			if taxdb.Rank(taxid) != rank {
+				continue
+			}
+			found = true
+
+			if node, ok := profile[taxid]; !ok {
+				profile[taxid] = &ProfileNode{
+					Taxid:         taxid,
+					Rank:          rank,
+					TaxonName:     taxdb.Names[taxid],
+					LineageNames:  taxdb.LineageNames(taxid),
+					LineageTaxids: taxdb.LineageTaxIds(taxid),
+
+					Percentage: target.Percentage,
+					Reads:      target.SumMatch,
+				}
+			} else {
+				node.Percentage += target.Percentage
+				node.Reads += target.SumMatch
+			}
+			break
+		}
+
+		if !found {
+			if unclassified == nil {
+				unclassified = &ProfileNode{Taxid: 0, Rank: rank, TaxonName: "unclassified"}
+			}
+			unclassified.Percentage += target.Percentage
+			unclassified.Reads += target.SumMatch
+		}
+	}
+
+	nodes := make([]*ProfileNode, 0, len(profile)+1)
+	for _, node := range profile {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Percentage == nodes[j].Percentage {
+			return nodes[i].Taxid < nodes[j].Taxid
+		}
+		return nodes[i].Percentage > nodes[j].Percentage
+	})
+	if unclassified != nil {
+		nodes = append(nodes, unclassified)
+	}
+
+	return nodes
+}
+
+// AddKmerSketch adds sampled matched k-mers of a match to the union.
+func (t *Target) AddKmerSketch(m *MatchResult) {
+	if t.Sketch == nil {
+		t.Sketch = make(map[uint64]struct{}, 1024)
+		t.SketchTKmers = make([]uint64, m.IdxNum)
+	}
+	if m.SketchScale > t.SketchScale {
+		t.SketchScale = m.SketchScale
+	}
+	t.SketchTKmers[m.FragIdx] = m.TKmers
+	for _, kmer := range m.Sketch {
+		t.Sketch[kmer] = struct{}{}
+	}
+}
+
+// ComputeGenomeUniqueness computes the fraction of sampled matched k-mers of each target
+// that are not shared with any other target in the list.
+func ComputeGenomeUniqueness(targets []*Target) {
+	counts := make(map[uint64]uint32, 1<<16)
+	for _, t := range targets {
+		for kmer := range t.Sketch {
+			counts[kmer]++
+		}
+	}
+	var n int
+	for _, t := range targets {
+		if len(t.Sketch) == 0 {
+			t.GenomeUniq = 0
+			continue
+		}
+		n = 0
+		for kmer := range t.Sketch {
+			if counts[kmer] == 1 {
+				n++
+			}
+		}
+		t.GenomeUniq = float64(n) / float64(len(t.Sketch))
+	}
+}
+
+// ComputeUniqFragsProp computes the fraction of chunks with uniquely matched reads.
+func (t *Target) ComputeUniqFragsProp() {
+	if len(t.UniqMatch) == 0 {
+		t.UniqFragsProp = 0
+		return
+	}
+	var n int
+	for _, c := range t.UniqMatch {
+		if c > 0 {
+			n++
+		}
+	}
+	t.UniqFragsProp = float64(n) / float64(len(t.UniqMatch))
+}
+
+// UnionTargetCov returns the genome-level target coverage, i.e., the fraction of
+// target k-mers in the union of matched k-mers of all reads, estimated from
+// the sampled k-mers. For chunks without any matches, the mean number
+// of k-mers of other chunks is used.
+func (t *Target) UnionTargetCov() float64 {
+	var sumN float64
+	var nChunks int
+	for _, n := range t.SketchTKmers {
+		if n == 0 {
+			continue
+		}
+		nChunks++
+		sumN += float64(n)
+	}
+	if nChunks == 0 {
+		return 0
+	}
+	sumN += sumN / float64(nChunks) * float64(len(t.SketchTKmers)-nChunks)
+
+	cov := float64(len(t.Sketch)*t.SketchScale) / sumN
+	if cov > 1 {
+		return 1
+	}
+	return cov
+}
+
+// naValue is outputted for undefined values when --output-na is given.
+const naValue = "NA"
+
+// formatFloatNA formats a float value with the given precision.
+// When na is true, "NA" is returned for undefined values, i.e.,
+// NaN, Inf, or values flagged as undefined by the caller.
+func formatFloatNA(v float64, prec int, undefined bool, na bool) string {
+	if na && (undefined || math.IsNaN(v) || math.IsInf(v, 0)) {
+		return naValue
+	}
+	return strconv.FormatFloat(v, 'f', prec, 64)
+}
+
+// stringNA returns "NA" for empty strings when na is true.
+func stringNA(s string, na bool) string {
+	if na && s == "" {
+		return naValue
+	}
+	return s
+}
+
+// kmcpProfileFormat defines the columns and values of profiles in KMCP format,
+// it's shared by "kmcp profile" and "kmcp search --profile-out".
+type kmcpProfileFormat struct {
+	tCov          bool   // the column tCov of genome-level target coverages
+	uniqFragsProp bool   // the column uchunksFrac
+	precision     int    // precision of float values, -1 for the default precision of each column
+	na            bool   // output "NA" for undefined values
+	separator     string // separator of lineages
+}
+
+// prec returns the precision of a float column, p is the default one.
+func (f *kmcpProfileFormat) prec(p int) int {
+	if f.precision >= 0 {
+		return f.precision
+	}
+	return p
+}
+
+// header returns the header row.
+func (f *kmcpProfileFormat) header() string {
+	header := "ref\tpercentage\tcoverage\tscore\tchunksFrac\tchunksRelDepth\tchunksRelDepthStd\treads\tureads\thicureads\trefsize\trefname\ttaxid\trank\ttaxname\ttaxpath\ttaxpathsn"
+	if f.tCov {
+		header += "\ttCov"
+	}
+	if f.uniqFragsProp {
+		header += "\tuchunksFrac"
+	}
+	// appended after all other columns to keep their positions
+	return header + "\tchunksEvenness\n"
+}
+
+// write writes a reference as a row.
+func (f *kmcpProfileFormat) write(outfh *bufio.Writer, t *Target) {
+	covs := make([]string, len(t.RelDepth))
+	for i, v := range t.RelDepth {
+		covs[i] = formatFloatNA(v, f.prec(2), false, f.na)
+	}
+
+	noGSize := t.GenomeSize == 0
+	refsize := strconv.FormatUint(t.GenomeSize, 10)
+	taxid := strconv.FormatUint(uint64(t.Taxid), 10)
+	if f.na {
+		if noGSize {
+			refsize = naValue
+		}
+		if t.Taxid == 0 {
+			taxid = naValue
+		}
+	}
+
+	var unionTCov, uniqFragsProp string
+	if f.tCov {
+		unionTCov = "\t" + strconv.FormatFloat(t.UnionTCov, 'f', f.prec(4), 64)
+	}
+	if f.uniqFragsProp {
+		uniqFragsProp = "\t" + strconv.FormatFloat(t.UniqFragsProp, 'f', f.prec(2), 64)
+	}
+
+	fmt.Fprintf(outfh, "%s\t%s\t%s\t%.*f\t%.*f\t%s\t%s\t%.0f\t%.0f\t%.0f\t%s\t%s\t%s\t%s\t%s\t%s\t%s%s%s\t%.*f\n",
+		t.Name,
+		formatFloatNA(t.Percentage, f.prec(6), false, f.na),
+		formatFloatNA(t.Coverage, f.prec(2), noGSize, f.na),
+		f.prec(2), t.Score,
+		f.prec(2), t.FragsProp, strings.Join(covs, ";"),
+		formatFloatNA(t.RelDepthStd, f.prec(2), len(t.RelDepth) < 2, f.na), // undefined for a single chunk
+		t.SumMatch, t.SumUniqMatch, t.SumUniqMatchHic, refsize,
+		stringNA(t.RefName, f.na),
+		taxid, stringNA(t.Rank, f.na), stringNA(t.TaxonName, f.na),
+		stringNA(strings.Join(t.LineageNames, f.separator), f.na),
+		stringNA(strings.Join(t.LineageTaxids, f.separator), f.na),
+		unionTCov, uniqFragsProp,
+		f.prec(2), t.Evenness)
+}
+
+// equivalenceClasses counts reads sharing the same set of references,
+// which is used to estimate abundances with the EM algorithm.
+type equivalenceClasses struct {
+	classes map[string]*equivalenceClass
+	buf     []byte
+}
+
+type equivalenceClass struct {
+	targets []uint64
+	count   float64
+}
+
+func newEquivalenceClasses() *equivalenceClasses {
+	return &equivalenceClasses{classes: make(map[string]*equivalenceClass, 1024)}
+}
+
+// Add adds a read matched to the given references (hashes of names).
+// The slice is sorted and deduplicated in place.
+func (ecs *equivalenceClasses) Add(targets []uint64) {
+	if len(targets) == 0 {
+		return
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i] < targets[j] })
+	j := 1
+	for i := 1; i < len(targets); i++ {
+		if targets[i] != targets[j-1] {
+			targets[j] = targets[i]
+			j++
+		}
+	}
+	targets = targets[:j]
+
+	ecs.buf = ecs.buf[:0]
+	for _, t := range targets {
+		ecs.buf = append(ecs.buf,
+			byte(t>>56), byte(t>>48), byte(t>>40), byte(t>>32),
+			byte(t>>24), byte(t>>16), byte(t>>8), byte(t))
+	}
+	if c, ok := ecs.classes[string(ecs.buf)]; ok {
+		c.count++
+		return
+	}
+	ecs.classes[string(ecs.buf)] = &equivalenceClass{
+		targets: append([]uint64{}, targets...),
+		count:   1,
+	}
+}
+
+// EM estimates the proportions of reads belonging to references with the
+// expectation-maximization algorithm: reads of every class are assigned to its
+// references in proportion to the current abundances, which are then
+// re-estimated from the assigned reads, until the maximal change of
+// abundances is smaller than tol or maxIter iterations are reached.
+// It returns the abundances, the number of iterations, and whether it converged.
+func (ecs *equivalenceClasses) EM(maxIter int, tol float64) (map[uint64]float64, int, bool) {
+	// index references
+	idx := make(map[uint64]int, 1024)
+	for _, c := range ecs.classes {
+		for _, t := range c.targets {
+			if _, ok := idx[t]; !ok {
+				idx[t] = len(idx)
+			}
+		}
+	}
+	n := len(idx)
+	if n == 0 {
+		return map[uint64]float64{}, 0, true
+	}
+
+	type class struct {
+		targets []int
+		count   float64
+	}
+	classes := make([]class, 0, len(ecs.classes))
+	var total float64
+	for _, c := range ecs.classes {
+		targets := make([]int, len(c.targets))
+		for i, t := range c.targets {
+			targets[i] = idx[t]
+		}
+		classes = append(classes, class{targets: targets, count: c.count})
+		total += c.count
+	}
+
+	theta := make([]float64, n)
+	counts := make([]float64, n)
+	for i := range theta {
+		theta[i] = 1 / float64(n)
+	}
+
+	var iter int
+	var converged bool
+	var sum, delta, v float64
+	for iter = 1; iter <= maxIter; iter++ {
+		for i := range counts {
+			counts[i] = 0
+		}
+
+		// E-step
+		for _, c := range classes {
+			if len(c.targets) == 1 {
+				counts[c.targets[0]] += c.count
+				continue
+			}
+			sum = 0
+			for _, i := range c.targets {
+				sum += theta[i]
+			}
+			if sum == 0 {
+				for _, i := range c.targets {
+					counts[i] += c.count / float64(len(c.targets))
+				}
+				continue
+			}
+			for _, i := range c.targets {
+				counts[i] += c.count * theta[i] / sum
+			}
+		}
+
+		// M-step
+		delta = 0
+		for i := range theta {
+			v = counts[i] / total
+			delta = math.Max(delta, math.Abs(v-theta[i]))
+			theta[i] = v
+		}
+
+		if delta < tol {
+			converged = true
+			break
+		}
+	}
+	if iter > maxIter {
+		iter = maxIter
+	}
+
+	abund := make(map[uint64]float64, n)
+	for t, i := range idx {
+		abund[t] = theta[i]
+	}
+	return abund, iter, converged
+}
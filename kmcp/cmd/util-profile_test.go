@@ -0,0 +1,186 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeTestTaxdump writes nodes.dmp and names.dmp of a small taxonomy.
+func writeTestTaxdump(dir string, nodes [][3]string) error {
+	var bNodes, bNames bytes.Buffer
+	for _, node := range nodes { // taxid, parent, rank
+		fmt.Fprintf(&bNodes, "%s\t|\t%s\t|\t%s\t|\n", node[0], node[1], node[2])
+		fmt.Fprintf(&bNames, "%s\t|\ttaxon%s\t|\t\t|\tscientific name\t|\n", node[0], node[0])
+	}
+	if err := os.WriteFile(filepath.Join(dir, "nodes.dmp"), bNodes.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "names.dmp"), bNames.Bytes(), 0644)
+}
+
+func TestCAMIProfileNormalizedByRank(t *testing.T) {
+	dir := t.TempDir()
+	err := writeTestTaxdump(dir, [][3]string{
+		{"1", "1", "no rank"},
+		{"2", "1", "superkingdom"},
+		{"10", "2", "phylum"},
+		{"11", "2", "phylum"},
+		{"20", "10", "class"},
+		{"30", "20", "order"},
+		{"40", "30", "family"},
+		{"50", "40", "genus"},
+		{"51", "40", "genus"},
+		{"60", "50", "species"},
+		{"61", "50", "species"},
+		{"62", "51", "species"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	taxdb := loadTaxonomy(&Options{}, dir)
+
+	showRanks := []string{"superkingdom", "phylum", "class", "order", "family", "genus", "species"}
+	showRanksMap := make(map[string]interface{}, len(showRanks))
+	rankOrder := make(map[string]int, len(showRanks))
+	for i, rank := range showRanks {
+		showRanksMap[rank] = struct{}{}
+		rankOrder[rank] = i
+	}
+
+	// references assigned to taxa at different ranks,
+	// so percentages at lower ranks sum up to < 100 before normalization.
+	refs := []struct {
+		taxid      uint32
+		percentage float64
+	}{
+		{60, 30},
+		{61, 20},
+		{62, 25},
+		{51, 15}, // genus
+		{11, 10}, // phylum
+	}
+	targets := make([]*Target, len(refs))
+	for i, ref := range refs {
+		targets[i] = &Target{Name: fmt.Sprintf("ref%d", i+1), Percentage: ref.percentage}
+		targets[i].AddTaxonomy(taxdb, showRanksMap, ref.taxid)
+	}
+
+	profile := generateProfile(taxdb, targets)
+	nodes := make([]*ProfileNode, 0, len(profile))
+	for _, node := range profile {
+		nodes = append(nodes, node)
+	}
+
+	for _, test := range []struct {
+		name      string
+		nodes     []*ProfileNode
+		normalize bool
+	}{
+		{"raw", nodes, false},
+		{"normalized", normalizeProfileByRank(nodes, rankOrder), true},
+	} {
+		var buf bytes.Buffer
+		outfh := bufio.NewWriter(&buf)
+		writeCAMIProfile(outfh, taxdb, test.nodes, showRanksMap, "sample", "NCBI", 6)
+		outfh.Flush()
+
+		sums, err := sumCAMIPercentagesByRank(&buf)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if len(sums) != len(showRanks) {
+			t.Errorf("%s: %d ranks in the profile, want %d", test.name, len(sums), len(showRanks))
+		}
+
+		for _, rank := range showRanks {
+			sum := sums[rank]
+			if test.normalize && math.Abs(sum-100) > 1e-4 {
+				t.Errorf("%s: percentages at rank %s sum up to %f, want 100", test.name, rank, sum)
+			}
+			if !test.normalize && rank == "species" && math.Abs(sum-75) > 1e-4 {
+				t.Errorf("%s: percentages at rank %s sum up to %f, want 75", test.name, rank, sum)
+			}
+		}
+	}
+}
+
+// sumCAMIPercentagesByRank parses a profile in the CAMI format,
+// and sums up percentages of taxa at each rank.
+func sumCAMIPercentagesByRank(buf *bytes.Buffer) (map[string]float64, error) {
+	sums := make(map[string]float64, 8)
+	scanner := bufio.NewScanner(buf)
+	var items []string
+	var pct float64
+	var err error
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "@") {
+			continue
+		}
+		items = strings.Split(scanner.Text(), "\t")
+		if len(items) != 5 {
+			return nil, fmt.Errorf("invalid CAMI row: %s", scanner.Text())
+		}
+		pct, err = strconv.ParseFloat(items[4], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid percentage: %s", items[4])
+		}
+		sums[items[1]] += pct
+	}
+	return sums, scanner.Err()
+}
+
+func TestEvictLeastAbundantTargets(t *testing.T) {
+	newProfile := func() map[uint64]*Target {
+		profile := make(map[uint64]*Target)
+		for i, c := range []float64{5, 1, 1, 1, 3} { // ties of the least abundant ones
+			profile[uint64(i)] = &Target{Name: fmt.Sprintf("ref%d", i), Match: []float64{c}}
+		}
+		return profile
+	}
+
+	for i := 0; i < 10; i++ { // evicted references do not depend on the order of map iteration
+		profile := newProfile()
+		if n := evictLeastAbundantTargets(profile, 4); n != 2 {
+			t.Fatalf("evictLeastAbundantTargets() evicted %d references, want 2", n)
+		}
+		for _, h := range []uint64{1, 2} {
+			if _, ok := profile[h]; ok {
+				t.Errorf("evictLeastAbundantTargets() kept ref%d, want it evicted by the name order", h)
+			}
+		}
+	}
+
+	// at least one reference is kept for --max-targets < 10
+	profile := newProfile()
+	evictLeastAbundantTargets(profile, 1)
+	if _, ok := profile[0]; len(profile) != 1 || !ok {
+		t.Errorf("evictLeastAbundantTargets() kept %d references, want the most abundant one", len(profile))
+	}
+}
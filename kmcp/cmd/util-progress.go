@@ -0,0 +1,115 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// SearchProgress is a machine-readable progress record of searching.
+type SearchProgress struct {
+	Processed uint64  `json:"processed"` // number of queries searched
+	Total     uint64  `json:"total"`     // number of queries read, it's final only when Done is true
+	Matched   uint64  `json:"matched"`   // number of queries with matches
+	Speed     float64 `json:"speed"`     // million queries per minute
+	Elapsed   float64 `json:"elapsed"`   // seconds
+	Done      bool    `json:"done"`
+}
+
+// openProgressOutput opens the destination of progress records,
+// a non-negative integer is treated as a file descriptor, e.g., 3,
+// otherwise as a file path.
+func openProgressOutput(value string) (*os.File, error) {
+	if fd, err := strconv.Atoi(value); err == nil {
+		if fd < 0 {
+			return nil, fmt.Errorf("invalid file descriptor: %d", fd)
+		}
+		fh := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+		if fh == nil {
+			return nil, fmt.Errorf("invalid file descriptor: %d", fd)
+		}
+		return fh, nil
+	}
+	return os.Create(value)
+}
+
+// ProgressReporter writes progress records in JSON Lines format periodically.
+type ProgressReporter struct {
+	fh       *os.File
+	enc      *json.Encoder
+	read     func() SearchProgress
+	start    time.Time
+	interval time.Duration
+
+	stop chan int
+	done chan int
+}
+
+// NewProgressReporter starts writing a record returned by read every interval.
+func NewProgressReporter(fh *os.File, interval time.Duration, start time.Time, read func() SearchProgress) *ProgressReporter {
+	r := &ProgressReporter{
+		fh:       fh,
+		enc:      json.NewEncoder(fh),
+		read:     read,
+		start:    start,
+		interval: interval,
+		stop:     make(chan int),
+		done:     make(chan int),
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.write(false)
+			case <-r.stop:
+				r.done <- 1
+				return
+			}
+		}
+	}()
+	return r
+}
+
+func (r *ProgressReporter) write(done bool) {
+	p := r.read()
+	p.Elapsed = time.Since(r.start).Seconds()
+	if p.Elapsed > 0 {
+		p.Speed = float64(p.Processed) / 1000000 / (p.Elapsed / 60)
+	}
+	p.Done = done
+	// errors are ignored, as the progress should not break searching.
+	r.enc.Encode(p)
+}
+
+// Close writes the final record and closes the output.
+func (r *ProgressReporter) Close() error {
+	r.stop <- 1
+	<-r.done
+	r.write(true)
+	return r.fh.Close()
+}
@@ -0,0 +1,98 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/kmcp/kmcp/search"
+	"github.com/shenwei356/unik/v5"
+)
+
+// readUnikQuery reads k-mers (hashes) of a .unik file created by "kmcp compute",
+// for searching them as a query, after checking k-mer parameters with the database.
+// The genome size recorded in the file is returned as the query length.
+func readUnikQuery(file string, info search.UnikIndexDBInfo) ([]uint64, Meta, error) {
+	var meta Meta
+
+	infh, r, _, err := inStream(file)
+	if err != nil {
+		return nil, meta, err
+	}
+	defer r.Close()
+
+	reader, err := unik.NewReader(infh)
+	if err != nil {
+		return nil, meta, errors.Wrap(err, file)
+	}
+
+	if len(reader.Description) > 0 {
+		if err = json.Unmarshal(reader.Description, &meta); err != nil {
+			return nil, meta, fmt.Errorf("unsupported metadata: %s", reader.Description)
+		}
+	}
+
+	if !reader.IsHashed() {
+		return nil, meta, fmt.Errorf(`flag 'hashed' is supposed to be true, is the file created by 'kmcp compute'? %s`, file)
+	}
+	if reader.IsCanonical() != info.Canonical {
+		return nil, meta, fmt.Errorf("'canonical' flags of the query (%v) and the database (%v) are different: %s",
+			reader.IsCanonical(), info.Canonical, file)
+	}
+	if len(meta.Ks) != 1 || len(info.Ks) != 1 || meta.Ks[0] != info.Ks[0] {
+		return nil, meta, fmt.Errorf("k-mer sizes of the query (%v) and the database (%v) should be the same single value: %s",
+			meta.Ks, info.Ks, file)
+	}
+	if reader.IsScaled() != info.Scaled || (info.Scaled && reader.GetScale() != info.Scale) {
+		return nil, meta, fmt.Errorf("scales of the query (%v, %d) and the database (%v, %d) are different: %s",
+			reader.IsScaled(), reader.GetScale(), info.Scaled, info.Scale, file)
+	}
+	if !info.MixedSketches { // databases of mixed sketches contain plain k-mers and any sketches
+		if meta.Syncmer != info.Syncmer || (info.Syncmer && uint32(meta.SyncmerS) != info.SyncmerS) {
+			return nil, meta, fmt.Errorf("syncmer parameters of the query and the database are different: %s", file)
+		}
+		if meta.Minimizer != info.Minimizer || (info.Minimizer && uint32(meta.MinimizerW) != info.MinimizerW) {
+			return nil, meta, fmt.Errorf("minimizer parameters of the query and the database are different: %s", file)
+		}
+	}
+	if !search.SameAlphabet(meta.Alphabet, info.Alphabet) {
+		return nil, meta, fmt.Errorf("alphabets of the query (%s) and the database (%s) are different: %s",
+			meta.Alphabet, info.Alphabet, file)
+	}
+
+	codes := make([]uint64, 0, 1024)
+	var code uint64
+	for {
+		code, _, err = reader.ReadCodeWithTaxid()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, meta, errors.Wrap(err, file)
+		}
+		codes = append(codes, code)
+	}
+
+	return codes, meta, nil
+}
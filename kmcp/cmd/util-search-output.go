@@ -0,0 +1,542 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/shenwei356/bio/taxdump"
+	"github.com/shenwei356/kmcp/kmcp/index"
+	"github.com/shenwei356/kmcp/kmcp/search"
+)
+
+// searchRowWriter formats rows of search results into a reusable buffer,
+// and writes each row with a single call, which is much faster than
+// writing fields one by one for outputs with lots of matches.
+type searchRowWriter struct {
+	OutputTaxid       bool
+	OutputChunksKmers bool
+	Lineages          map[string]string // target -> lineage, nil for not outputting lineages
+	KmerSketchScale   int               // scale of sampled matched k-mers, 0 for not outputting them
+	OutputContainment bool              // output the containment relative to the smaller k-mer set, and the standard error of qCov
+	ErrorRate         float64           // sequencing error rate for the expected and normalized qCov, 0 for not outputting them
+	OutputMargin      bool              // output the gap between qCov of the best and the second-best targets
+	BED               *bufio.Writer     // extra output of matches in BED format, nil for not outputting them
+	Precision         int               // number of digits after the decimal point of float columns
+	OutputDBHits      bool              // output the numbers of databases queried and hit, only for multiple databases
+	EmitBlock         bool              // output the index file producing each match, for debugging
+	EstimateANI       bool              // output ANI estimated from qCov
+	NoScaledSketch    bool              // the database is not built with scaled sketches, ANI is outputted as NA
+	ReportPositions   bool              // output positions of matched k-mers in the query
+	JSONL             bool              // output one JSON object per query instead of tab-separated rows, see writeJSON
+
+	buf         []byte
+	fpr         []byte
+	margin      []byte
+	chunksKmers map[string]string
+
+	columns []*searchColumn // active optional columns
+}
+
+// searchColumn is a group of optional columns of search results,
+// which are appended after the basic columns if enabled.
+type searchColumn struct {
+	Names   []string
+	Enabled func(w *searchRowWriter) bool
+
+	// AppendMatch appends values of a match, each value is preceded by a tab.
+	AppendMatch func(w *searchRowWriter, result *search.QueryResult, match *search.Match)
+	// AppendUnmatched appends values of an unmatched query, each value is preceded by a tab.
+	AppendUnmatched func(w *searchRowWriter, result *search.QueryResult)
+}
+
+// searchBasicColumns are columns always outputted.
+var searchBasicColumns = []string{"query", "qLen", "qKmers", "FPR", "hits",
+	"target", "chunkIdx", "chunks", "tLen", "kSize", "mKmers", "qCov", "tCov", "jacc", "queryIdx"}
+
+// searchColumns are optional columns in the order of output.
+// Both the header row and data rows are generated from it, so they never drift apart.
+var searchColumns = []*searchColumn{
+	{
+		Names:   []string{"taxid"},
+		Enabled: func(w *searchRowWriter) bool { return w.OutputTaxid },
+		AppendMatch: func(w *searchRowWriter, result *search.QueryResult, match *search.Match) {
+			w.buf = append(w.buf, '\t')
+			w.buf = strconv.AppendUint(w.buf, uint64(match.Taxid[0]), 10)
+		},
+		AppendUnmatched: func(w *searchRowWriter, result *search.QueryResult) {
+			w.buf = append(w.buf, "\t0"...)
+		},
+	},
+	{
+		Names:   []string{"chunksKmers"},
+		Enabled: func(w *searchRowWriter) bool { return w.OutputChunksKmers },
+		AppendMatch: func(w *searchRowWriter, result *search.QueryResult, match *search.Match) {
+			w.buf = append(w.buf, '\t')
+			w.buf = append(w.buf, w.chunksKmers[match.Target[0]]...)
+		},
+		AppendUnmatched: appendEmptyColumn,
+	},
+	{
+		Names:   []string{"lineage"},
+		Enabled: func(w *searchRowWriter) bool { return w.Lineages != nil },
+		AppendMatch: func(w *searchRowWriter, result *search.QueryResult, match *search.Match) {
+			w.buf = append(w.buf, '\t')
+			w.buf = append(w.buf, w.Lineages[match.Target[0]]...)
+		},
+		AppendUnmatched: appendEmptyColumn,
+	},
+	{
+		Names:   []string{"kmerSketch"},
+		Enabled: func(w *searchRowWriter) bool { return w.KmerSketchScale > 0 },
+		AppendMatch: func(w *searchRowWriter, result *search.QueryResult, match *search.Match) {
+			w.buf = append(w.buf, '\t')
+			w.appendKmerSketch(match)
+		},
+		AppendUnmatched: appendEmptyColumn,
+	},
+	{
+		Names:   []string{"maxCont", "qCovSE"},
+		Enabled: func(w *searchRowWriter) bool { return w.OutputContainment },
+		AppendMatch: func(w *searchRowWriter, result *search.QueryResult, match *search.Match) {
+			w.buf = append(w.buf, '\t')
+			w.appendContainment(result, match)
+		},
+		AppendUnmatched: func(w *searchRowWriter, result *search.QueryResult) {
+			w.buf = append(w.buf, "\t0\t0"...)
+		},
+	},
+	{
+		Names:   []string{"expQCov", "normQCov"},
+		Enabled: func(w *searchRowWriter) bool { return w.ErrorRate > 0 },
+		AppendMatch: func(w *searchRowWriter, result *search.QueryResult, match *search.Match) {
+			w.buf = append(w.buf, '\t')
+			w.appendExpectedQCov(result, match.QCov)
+		},
+		AppendUnmatched: func(w *searchRowWriter, result *search.QueryResult) {
+			w.buf = append(w.buf, '\t')
+			w.appendExpectedQCov(result, 0)
+		},
+	},
+	{
+		Names:   []string{"margin"},
+		Enabled: func(w *searchRowWriter) bool { return w.OutputMargin },
+		AppendMatch: func(w *searchRowWriter, result *search.QueryResult, match *search.Match) {
+			w.buf = append(w.buf, '\t')
+			w.buf = append(w.buf, w.margin...)
+		},
+		AppendUnmatched: func(w *searchRowWriter, result *search.QueryResult) {
+			w.buf = append(w.buf, "\t0"...)
+		},
+	},
+	{
+		Names:   []string{"nDBs", "nDBsHit"},
+		Enabled: func(w *searchRowWriter) bool { return w.OutputDBHits },
+		AppendMatch: func(w *searchRowWriter, result *search.QueryResult, match *search.Match) {
+			w.appendDBHits(result)
+		},
+		AppendUnmatched: func(w *searchRowWriter, result *search.QueryResult) {
+			w.appendDBHits(result)
+		},
+	},
+	{
+		Names:   []string{"ani"},
+		Enabled: func(w *searchRowWriter) bool { return w.EstimateANI },
+		AppendMatch: func(w *searchRowWriter, result *search.QueryResult, match *search.Match) {
+			w.buf = append(w.buf, '\t')
+			w.appendANI(result, match.QCov)
+		},
+		AppendUnmatched: func(w *searchRowWriter, result *search.QueryResult) {
+			w.buf = append(w.buf, '\t')
+			w.appendANI(result, 0)
+		},
+	},
+	{
+		Names:   []string{"positions"},
+		Enabled: func(w *searchRowWriter) bool { return w.ReportPositions },
+		AppendMatch: func(w *searchRowWriter, result *search.QueryResult, match *search.Match) {
+			w.buf = append(w.buf, '\t')
+			for i, pos := range match.Positions {
+				if i > 0 {
+					w.buf = append(w.buf, ',')
+				}
+				w.buf = strconv.AppendInt(w.buf, int64(pos), 10)
+			}
+		},
+		AppendUnmatched: appendEmptyColumn,
+	},
+	{
+		Names:   []string{"block"},
+		Enabled: func(w *searchRowWriter) bool { return w.EmitBlock },
+		AppendMatch: func(w *searchRowWriter, result *search.QueryResult, match *search.Match) {
+			w.buf = append(w.buf, '\t')
+			w.buf = append(w.buf, match.Block...)
+		},
+		AppendUnmatched: appendEmptyColumn,
+	},
+}
+
+// appendEmptyColumn appends an empty value.
+func appendEmptyColumn(w *searchRowWriter, result *search.QueryResult) {
+	w.buf = append(w.buf, '\t')
+}
+
+// activeColumns returns optional columns enabled by the options of the writer.
+func (w *searchRowWriter) activeColumns() []*searchColumn {
+	if w.columns == nil {
+		w.columns = make([]*searchColumn, 0, len(searchColumns))
+		for _, c := range searchColumns {
+			if c.Enabled(w) {
+				w.columns = append(w.columns, c)
+			}
+		}
+	}
+	return w.columns
+}
+
+// Header returns the header row of the basic and active optional columns.
+func (w *searchRowWriter) Header() string {
+	names := make([]string, 0, len(searchBasicColumns)+len(searchColumns))
+	names = append(names, searchBasicColumns...)
+	for _, c := range w.activeColumns() {
+		names = append(names, c.Names...)
+	}
+	return "#" + strings.Join(names, "\t") + "\n"
+}
+
+// appendQueryFields appends the first five columns of a query.
+func (w *searchRowWriter) appendQueryFields(result *search.QueryResult, fpr []byte, hits int) {
+	w.buf = append(w.buf, result.QueryID...)
+	w.buf = append(w.buf, '\t')
+	w.buf = strconv.AppendInt(w.buf, int64(result.QueryLen), 10)
+	w.buf = append(w.buf, '\t')
+	w.buf = strconv.AppendInt(w.buf, int64(result.NumKmers), 10)
+	w.buf = append(w.buf, '\t')
+	w.buf = append(w.buf, fpr...)
+	w.buf = append(w.buf, '\t')
+	w.buf = strconv.AppendInt(w.buf, int64(hits), 10)
+	w.buf = append(w.buf, '\t')
+}
+
+// WriteUnmatched writes the row of an unmatched query.
+// The FPR of the query is written if withFPR is true, otherwise 0.
+func (w *searchRowWriter) WriteUnmatched(fh *bufio.Writer, result *search.QueryResult, withFPR bool) {
+	if w.JSONL {
+		w.writeJSON(fh, result, withFPR)
+		return
+	}
+
+	w.buf = w.buf[:0]
+	if withFPR {
+		w.fpr = strconv.AppendFloat(w.fpr[:0], result.FPR, 'e', w.Precision, 64)
+		w.appendQueryFields(result, w.fpr, 0)
+	} else {
+		w.appendQueryFields(result, []byte{'0'}, 0)
+	}
+
+	w.buf = append(w.buf, "\t-1\t0\t0\t"...) // target, chunkIdx, chunks, tLen
+	w.buf = strconv.AppendInt(w.buf, int64(result.K), 10)
+	w.buf = append(w.buf, "\t0\t0\t0\t0\t"...) // mKmers, qCov, tCov, jacc
+	w.buf = strconv.AppendUint(w.buf, result.QueryIdx, 10)
+	for _, c := range w.activeColumns() {
+		c.AppendUnmatched(w, result)
+	}
+	w.buf = append(w.buf, '\n')
+
+	fh.Write(w.buf)
+}
+
+// WriteMatches writes rows of all matches of a query.
+func (w *searchRowWriter) WriteMatches(fh *bufio.Writer, result *search.QueryResult) {
+	if w.JSONL {
+		w.writeJSON(fh, result, true)
+		if w.BED != nil {
+			for _, match := range *result.Matches {
+				w.buf = appendBED(w.buf[:0], result, match)
+				w.BED.Write(w.buf)
+			}
+		}
+		return
+	}
+
+	if w.OutputChunksKmers {
+		w.chunksKmers = matchedKmersOfChunks(*result.Matches)
+	}
+	columns := w.activeColumns()
+
+	hits := len(*result.Matches)
+	if w.OutputMargin {
+		w.margin = strconv.AppendFloat(w.margin[:0], qcovMargin(*result.Matches), 'f', w.Precision, 64)
+	}
+	var _chunkIdx, _chunks uint32
+	var target string
+	for _, match := range *result.Matches {
+		target = match.Target[0]
+		_chunkIdx, _chunks = index.DecodeChunkIdx(match.TargetIdx[0])
+
+		w.buf = w.buf[:0]
+		w.fpr = strconv.AppendFloat(w.fpr[:0], match.FPR, 'e', w.Precision, 64)
+		w.appendQueryFields(result, w.fpr, hits)
+
+		w.buf = append(w.buf, target...)
+		w.buf = append(w.buf, '\t')
+		w.buf = strconv.AppendUint(w.buf, uint64(_chunkIdx), 10)
+		w.buf = append(w.buf, '\t')
+		w.buf = strconv.AppendUint(w.buf, uint64(_chunks), 10)
+		w.buf = append(w.buf, '\t')
+		w.buf = strconv.AppendUint(w.buf, match.GenomeSize[0], 10)
+		w.buf = append(w.buf, '\t')
+		w.buf = strconv.AppendInt(w.buf, int64(result.K), 10)
+		w.buf = append(w.buf, '\t')
+
+		w.buf = strconv.AppendInt(w.buf, int64(match.NumKmers), 10)
+		w.buf = append(w.buf, '\t')
+		w.buf = strconv.AppendFloat(w.buf, match.QCov, 'f', w.Precision, 64)
+		w.buf = append(w.buf, '\t')
+		w.buf = strconv.AppendFloat(w.buf, match.TCov, 'f', w.Precision, 64)
+		w.buf = append(w.buf, '\t')
+		w.buf = strconv.AppendFloat(w.buf, match.JaccardIndex, 'f', w.Precision, 64)
+		w.buf = append(w.buf, '\t')
+		w.buf = strconv.AppendUint(w.buf, result.QueryIdx, 10)
+		for _, c := range columns {
+			c.AppendMatch(w, result, match)
+		}
+		w.buf = append(w.buf, '\n')
+
+		fh.Write(w.buf)
+
+		if w.BED != nil {
+			w.buf = appendBED(w.buf[:0], result, match)
+			w.BED.Write(w.buf)
+		}
+	}
+}
+
+// searchJSONResult is a query and its matches in the JSON Lines format.
+type searchJSONResult struct {
+	Query    string             `json:"query"`
+	QLen     int                `json:"qLen"`
+	QKmers   int                `json:"qKmers"`
+	FPR      json.Number        `json:"FPR"`
+	QueryIdx uint64             `json:"queryIdx"`
+	Matches  []*searchJSONMatch `json:"matches"`
+}
+
+// searchJSONMatch is a match in the JSON Lines format.
+type searchJSONMatch struct {
+	Target  string      `json:"target"`
+	FragIdx uint32      `json:"fragIdx"`
+	Frags   uint32      `json:"frags"`
+	TLen    uint64      `json:"tLen"`
+	KSize   int         `json:"kSize"`
+	FPR     json.Number `json:"FPR"`
+	MKmers  int         `json:"mKmers"`
+	QCov    json.Number `json:"qCov"`
+	TCov    json.Number `json:"tCov"`
+	Jacc    json.Number `json:"jacc"`
+}
+
+// writeJSON writes a query and its matches as a JSON object in a single line.
+// The matches array is empty for an unmatched query, the FPR of which is written
+// if withFPR is true, otherwise 0. Floats are formatted with the same precision of tsv.
+func (w *searchRowWriter) writeJSON(fh *bufio.Writer, result *search.QueryResult, withFPR bool) {
+	r := searchJSONResult{
+		Query:    string(result.QueryID),
+		QLen:     result.QueryLen,
+		QKmers:   result.NumKmers,
+		FPR:      "0",
+		QueryIdx: result.QueryIdx,
+		Matches:  []*searchJSONMatch{},
+	}
+	if withFPR {
+		r.FPR = w.jsonFloat(result.FPR, 'e')
+	}
+
+	if result.Matches != nil {
+		r.Matches = make([]*searchJSONMatch, 0, len(*result.Matches))
+		var _chunkIdx, _chunks uint32
+		for _, match := range *result.Matches {
+			_chunkIdx, _chunks = index.DecodeChunkIdx(match.TargetIdx[0])
+			r.Matches = append(r.Matches, &searchJSONMatch{
+				Target:  match.Target[0],
+				FragIdx: _chunkIdx,
+				Frags:   _chunks,
+				TLen:    match.GenomeSize[0],
+				KSize:   result.K,
+				FPR:     w.jsonFloat(match.FPR, 'e'),
+				MKmers:  match.NumKmers,
+				QCov:    w.jsonFloat(match.QCov, 'f'),
+				TCov:    w.jsonFloat(match.TCov, 'f'),
+				Jacc:    w.jsonFloat(match.JaccardIndex, 'f'),
+			})
+		}
+	}
+
+	data, err := json.Marshal(r)
+	checkError(err)
+	fh.Write(data)
+	fh.WriteByte('\n')
+}
+
+// jsonFloat formats a float with the precision of the writer.
+func (w *searchRowWriter) jsonFloat(v float64, format byte) json.Number {
+	return json.Number(strconv.FormatFloat(v, format, w.Precision, 64))
+}
+
+// appendDBHits appends the numbers of databases queried and databases with any matches.
+func (w *searchRowWriter) appendDBHits(result *search.QueryResult) {
+	w.buf = append(w.buf, '\t')
+	w.buf = strconv.AppendInt(w.buf, int64(result.NumDBs), 10)
+	w.buf = append(w.buf, '\t')
+	w.buf = strconv.AppendInt(w.buf, int64(result.NumDBsHit), 10)
+}
+
+// appendKmerSketch appends sampled matched k-mers of a match in the format of
+// "<k-mers of the target chunk>:<scale>:<k-mer>,<k-mer>,...", k-mers are in hexadecimal.
+func (w *searchRowWriter) appendKmerSketch(match *search.Match) {
+	w.buf = strconv.AppendUint(w.buf, match.TargetKmers, 10)
+	w.buf = append(w.buf, ':')
+	w.buf = strconv.AppendInt(w.buf, int64(w.KmerSketchScale), 10)
+	w.buf = append(w.buf, ':')
+	for i, kmer := range match.Kmers {
+		if i > 0 {
+			w.buf = append(w.buf, ',')
+		}
+		w.buf = strconv.AppendUint(w.buf, kmer, 16)
+	}
+}
+
+// appendContainment appends the containment relative to the smaller k-mer set of
+// the query and the target chunk, i.e., mKmers / min(qKmers, tKmers), and the standard
+// error of qCov. Matched k-mers are Bernoulli trials of query k-mers, so the standard error
+// is sqrt(qCov*(1-qCov)/qKmers), which equals to that of bootstrapping query k-mers.
+func (w *searchRowWriter) appendContainment(result *search.QueryResult, match *search.Match) {
+	size := float64(result.NumKmers)
+	if match.TCov > 0 {
+		if tKmers := float64(match.NumKmers) / match.TCov; tKmers < size {
+			size = tKmers
+		}
+	}
+	var cont, se float64
+	if size > 0 {
+		cont = math.Min(float64(match.NumKmers)/size, 1)
+	}
+	if result.NumKmers > 0 {
+		se = math.Sqrt(match.QCov * math.Max(1-match.QCov, 0) / float64(result.NumKmers))
+	}
+	w.buf = strconv.AppendFloat(w.buf, cont, 'f', w.Precision, 64)
+	w.buf = append(w.buf, '\t')
+	w.buf = strconv.AppendFloat(w.buf, se, 'e', w.Precision, 64)
+}
+
+// qcovMargin returns the gap between qCov of the best and the second-best targets,
+// other chunks of the best target are not counted as the second best.
+// The margin equals to the best qCov if only one target is matched.
+func qcovMargin(matches []*search.Match) float64 {
+	var best, second float64
+	var bestTarget string
+	for _, m := range matches {
+		if m.QCov > best {
+			best, bestTarget = m.QCov, m.Target[0]
+		}
+	}
+	for _, m := range matches {
+		if m.Target[0] != bestTarget && m.QCov > second {
+			second = m.QCov
+		}
+	}
+	return best - second
+}
+
+// appendExpectedQCov appends the expected qCov of a query from the reference genome,
+// given the sequencing error rate e, and the normalized qCov (observed / expected).
+// A k-mer could only be matched if all its k bases are free of errors, the probability of which is (1-e)^k.
+func (w *searchRowWriter) appendExpectedQCov(result *search.QueryResult, qcov float64) {
+	exp := math.Pow(1-w.ErrorRate, float64(result.K))
+	w.buf = strconv.AppendFloat(w.buf, exp, 'f', w.Precision, 64)
+	w.buf = append(w.buf, '\t')
+	w.buf = strconv.AppendFloat(w.buf, qcov/exp, 'f', w.Precision, 64)
+}
+
+// appendANI appends the average nucleotide identity estimated from the containment (qCov)
+// with the formula of Mash: ANI = 1 + ln(C) / k, as a k-mer is conserved with a probability of ANI^k.
+// The estimation assumes k-mers are sampled independently of mutations, i.e., sketches of scaled
+// databases, so NA is appended for other databases.
+func (w *searchRowWriter) appendANI(result *search.QueryResult, qcov float64) {
+	if w.NoScaledSketch {
+		w.buf = append(w.buf, "NA"...)
+		return
+	}
+	var ani float64
+	if qcov > 0 && result.K > 0 {
+		ani = math.Max(1+math.Log(math.Min(qcov, 1))/float64(result.K), 0)
+	}
+	w.buf = strconv.AppendFloat(w.buf, ani, 'f', w.Precision, 64)
+}
+
+// targetLineages formats lineages of targets in the TaxId mapping, e.g.,
+// "k__Bacteria;p__Firmicutes;...;s__Bacillus subtilis".
+// Only taxa at the given ranks are kept, and their names are prefixed
+// with the corresponding prefixes.
+// Targets renamed to TaxIds by the collapser are also included.
+func targetLineages(taxdb *taxdump.Taxonomy, taxidMap map[string]uint32,
+	ranks []string, prefixes []string, collapser *search.TaxonCollapser) map[string]string {
+
+	prefixOfRank := make(map[string]string, len(ranks))
+	for i, rank := range ranks {
+		prefixOfRank[rank] = prefixes[i]
+	}
+
+	cache := make(map[uint32]string, 1024) // taxid -> lineage
+	names := make([]string, 0, len(ranks))
+	lineage := func(taxid uint32) string {
+		if l, ok := cache[taxid]; ok {
+			return l
+		}
+
+		names = names[:0]
+		var prefix string
+		var ok bool
+		for _, t := range taxdb.LineageTaxIds(taxid) {
+			if prefix, ok = prefixOfRank[taxdb.Rank(t)]; ok {
+				names = append(names, prefix+taxdb.Name(t))
+			}
+		}
+		l := strings.Join(names, ";")
+		cache[taxid] = l
+		return l
+	}
+
+	lineages := make(map[string]string, len(taxidMap))
+	for target, taxid := range taxidMap {
+		lineages[target] = lineage(taxid)
+	}
+	if collapser != nil {
+		for _, taxid := range collapser.Taxids() {
+			lineages[strconv.Itoa(int(taxid))] = lineage(taxid)
+		}
+	}
+	return lineages
+}
@@ -0,0 +1,329 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// sqliteColumnTypes are SQL types of columns of search results,
+// columns not listed here are stored as TEXT.
+var sqliteColumnTypes = map[string]string{
+	"qLen":     "INTEGER",
+	"qKmers":   "INTEGER",
+	"FPR":      "REAL",
+	"hits":     "INTEGER",
+	"chunkIdx": "INTEGER",
+	"chunks":   "INTEGER",
+	"tLen":     "INTEGER",
+	"kSize":    "INTEGER",
+	"mKmers":   "INTEGER",
+	"qCov":     "REAL",
+	"tCov":     "REAL",
+	"jacc":     "REAL",
+	"queryIdx": "INTEGER",
+	"taxid":    "INTEGER",
+	"maxCont":  "REAL",
+	"qCovSE":   "REAL",
+	"expQCov":  "REAL",
+	"normQCov": "REAL",
+	"margin":   "REAL",
+	"nDBs":     "INTEGER",
+	"nDBsHit":  "INTEGER",
+}
+
+// errSQLiteSinkClosed means writing to a closed sqliteSink.
+var errSQLiteSinkClosed = errors.New("sqlite: the database is closed")
+
+// sqliteIndexedColumns are columns to create indexes on.
+var sqliteIndexedColumns = []string{"query", "target", "qCov"}
+
+// sqliteSink receives tab-delimited rows of search results and inserts them
+// into a table of an SQLite database, via the command-line program sqlite3,
+// so no database driver (and cgo) is needed.
+// Rows are inserted in batches, each in a transaction, which is much faster
+// than committing every row. Indexes are created after all rows are inserted.
+//
+// The sink is an io.Writer of rows formatted by searchRowWriter, rather than
+// formatting QueryResult itself, so all columns, including optional ones
+// and NA values, are defined in one place (searchColumns), and the database
+// always has the same columns as the TSV output.
+//
+// Values of numeric columns are checked: empty and non-finite values (NaN, Inf)
+// are stored as NULL, and values failing to be parsed are stored as text,
+// so a malformed value does not abort the whole import.
+type sqliteSink struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	w      *bufio.Writer
+	stderr *bytes.Buffer // outputs of sqlite3, for reporting SQL errors
+	err    error         // error of sqlite3, after which nothing is written
+
+	table     string
+	columns   []string
+	numeric   []bool
+	integer   []bool
+	batchSize int
+
+	rows int  // rows in the current transaction
+	inTx bool // in a transaction
+
+	line []byte // incomplete line of the last Write
+	stmt []byte
+}
+
+// newSQLiteSink starts sqlite3 on the database file and creates the table.
+// The columns are the names in the header row of search results.
+// Existing table is dropped unless appendTable is true.
+func newSQLiteSink(file string, table string, columns []string, appendTable bool, batchSize int) (*sqliteSink, error) {
+	bin, err := exec.LookPath("sqlite3")
+	if err != nil {
+		return nil, fmt.Errorf("the program sqlite3 is needed for writing results into SQLite databases: %s", err)
+	}
+	if batchSize <= 0 {
+		batchSize = 10000
+	}
+
+	cmd := exec.Command(bin, "-batch", "-bail", file)
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = stderr
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start sqlite3: %s", err)
+	}
+
+	s := &sqliteSink{
+		cmd:       cmd,
+		stdin:     stdin,
+		w:         bufio.NewWriterSize(stdin, os.Getpagesize()*64),
+		stderr:    stderr,
+		table:     table,
+		columns:   columns,
+		numeric:   make([]bool, len(columns)),
+		integer:   make([]bool, len(columns)),
+		batchSize: batchSize,
+	}
+
+	s.w.WriteString("PRAGMA synchronous = OFF;\n")
+	if !appendTable {
+		fmt.Fprintf(s.w, "DROP TABLE IF EXISTS %s;\n", sqliteQuoteName(table))
+	}
+	fmt.Fprintf(s.w, "CREATE TABLE IF NOT EXISTS %s (", sqliteQuoteName(table))
+	for i, col := range columns {
+		if i > 0 {
+			s.w.WriteString(", ")
+		}
+		_type, ok := sqliteColumnTypes[col]
+		if !ok {
+			_type = "TEXT"
+		}
+		s.numeric[i] = _type != "TEXT"
+		s.integer[i] = _type == "INTEGER"
+		fmt.Fprintf(s.w, "%s %s", sqliteQuoteName(col), _type)
+	}
+	s.w.WriteString(");\n")
+
+	return s, nil
+}
+
+// Write parses complete lines of tab-delimited rows and inserts them.
+// Lines could be split into multiple calls, e.g., by a bufio.Writer.
+func (s *sqliteSink) Write(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	n := len(p)
+	var i int
+	for len(p) > 0 {
+		i = bytes.IndexByte(p, '\n')
+		if i < 0 {
+			s.line = append(s.line, p...)
+			break
+		}
+		if len(s.line) > 0 {
+			s.line = append(s.line, p[:i]...)
+			if err := s.insert(s.line); err != nil {
+				return 0, err
+			}
+			s.line = s.line[:0]
+		} else if err := s.insert(p[:i]); err != nil {
+			return 0, err
+		}
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+func (s *sqliteSink) insert(line []byte) error {
+	if len(line) == 0 || line[0] == '#' { // header row
+		return nil
+	}
+
+	if !s.inTx {
+		s.w.WriteString("BEGIN;\n")
+		s.inTx = true
+	}
+
+	s.stmt = append(s.stmt[:0], "INSERT INTO "...)
+	s.stmt = append(s.stmt, sqliteQuoteName(s.table)...)
+	s.stmt = append(s.stmt, " VALUES ("...)
+	var field []byte
+	var i, j int
+	for i = range s.columns {
+		if line == nil {
+			return fmt.Errorf("sqlite: too few columns (%d < %d)", i, len(s.columns))
+		}
+		j = bytes.IndexByte(line, '\t')
+		if j < 0 {
+			field, line = line, nil
+		} else {
+			field, line = line[:j], line[j+1:]
+		}
+
+		if i > 0 {
+			s.stmt = append(s.stmt, ',')
+		}
+		if s.numeric[i] {
+			s.stmt = sqliteAppendNumber(s.stmt, field, s.integer[i])
+			continue
+		}
+		s.stmt = sqliteAppendText(s.stmt, field)
+	}
+	s.stmt = append(s.stmt, ");\n"...)
+
+	if _, err := s.w.Write(s.stmt); err != nil {
+		return s.exit(err)
+	}
+
+	s.rows++
+	if s.rows == s.batchSize {
+		s.w.WriteString("COMMIT;\n")
+		s.inTx = false
+		s.rows = 0
+	}
+	return nil
+}
+
+// Close inserts the remaining rows, creates indexes, and waits for sqlite3 to exit.
+func (s *sqliteSink) Close() error {
+	if s.err != nil {
+		return s.err
+	}
+	if len(s.line) > 0 {
+		if err := s.insert(s.line); err != nil {
+			return err
+		}
+		s.line = s.line[:0]
+	}
+	if s.inTx {
+		s.w.WriteString("COMMIT;\n")
+		s.inTx = false
+	}
+
+	var name string
+	for _, col := range sqliteIndexedColumns {
+		for _, c := range s.columns {
+			if c != col {
+				continue
+			}
+			name = sqliteQuoteName(fmt.Sprintf("idx_%s_%s", s.table, strings.ToLower(col)))
+			fmt.Fprintf(s.w, "CREATE INDEX IF NOT EXISTS %s ON %s (%s);\n",
+				name, sqliteQuoteName(s.table), sqliteQuoteName(col))
+			break
+		}
+	}
+
+	if err := s.w.Flush(); err != nil {
+		return s.exit(err)
+	}
+	return s.exit(nil)
+}
+
+// exit closes the input of sqlite3 and waits for it to exit.
+// When sqlite3 exits early, e.g., for an SQL error with -bail, writing to it
+// fails with a broken pipe, so the error message of sqlite3 is returned instead.
+func (s *sqliteSink) exit(err error) error {
+	s.stdin.Close()
+	errWait := s.cmd.Wait()
+
+	if err == nil && errWait == nil {
+		s.err = errSQLiteSinkClosed
+		return nil
+	}
+
+	if msg := strings.TrimSpace(s.stderr.String()); msg != "" {
+		s.err = fmt.Errorf("sqlite3 failed: %s", msg)
+	} else if errWait != nil {
+		s.err = fmt.Errorf("sqlite3 failed: %s", errWait)
+	} else {
+		s.err = fmt.Errorf("sqlite: %s", err)
+	}
+	return s.err
+}
+
+// sqliteAppendNumber appends a value of a numeric column to an SQL statement.
+// Empty and non-finite values are written as NULL,
+// and values that can not be parsed are quoted as text.
+func sqliteAppendNumber(stmt []byte, field []byte, integer bool) []byte {
+	if len(field) == 0 {
+		return append(stmt, "NULL"...)
+	}
+	if integer {
+		if v, err := strconv.ParseInt(string(field), 10, 64); err == nil {
+			return strconv.AppendInt(stmt, v, 10)
+		}
+	}
+	v, err := strconv.ParseFloat(string(field), 64)
+	if err != nil {
+		if errors.Is(err, strconv.ErrRange) { // out of the range of float64
+			return append(stmt, "NULL"...)
+		}
+		return sqliteAppendText(stmt, field)
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return append(stmt, "NULL"...)
+	}
+	return strconv.AppendFloat(stmt, v, 'g', -1, 64)
+}
+
+// sqliteAppendText appends a quoted string to an SQL statement.
+func sqliteAppendText(stmt []byte, field []byte) []byte {
+	stmt = append(stmt, '\'')
+	stmt = append(stmt, bytes.ReplaceAll(field, []byte{'\''}, []byte("''"))...)
+	return append(stmt, '\'')
+}
+
+func sqliteQuoteName(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
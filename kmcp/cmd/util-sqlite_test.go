@@ -0,0 +1,87 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// skipWithoutSQLite3 skips a test when the program sqlite3 is not installed.
+func skipWithoutSQLite3(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+}
+
+func TestSQLiteSink(t *testing.T) {
+	skipWithoutSQLite3(t)
+
+	file := filepath.Join(t.TempDir(), "test.db")
+	s, err := newSQLiteSink(file, "matches", []string{"query", "target", "qCov"}, false, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a row split into two writes, and a non-finite value
+	for _, data := range []string{"#query\ttarget\tqCov\n", "r1\tg1\t0.9\nr2\tg", "2\t0.8\nr3\tg1\tNaN\n"} {
+		if _, err = s.Write([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command("sqlite3", file, `SELECT query, target, IFNULL(qCov, 'NULL') FROM matches ORDER BY query;`).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "r1|g1|0.9\nr2|g2|0.8\nr3|g1|NULL\n"
+	if string(out) != want {
+		t.Errorf("rows in the database: %q, want %q", out, want)
+	}
+}
+
+func TestSQLiteSinkError(t *testing.T) {
+	skipWithoutSQLite3(t)
+
+	file := filepath.Join(t.TempDir(), "test.db")
+	if err := exec.Command("sqlite3", file, `CREATE TABLE matches (query TEXT);`).Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// appending rows with more columns to the existing table
+	s, err := newSQLiteSink(file, "matches", []string{"query", "target"}, true, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Write([]byte("r1\tg1\n")); err == nil {
+		err = s.Close()
+	}
+	if err == nil {
+		t.Fatal("sqliteSink: no error for inserting rows with more columns than the table")
+	}
+	if !strings.Contains(err.Error(), "values were supplied") {
+		t.Errorf("sqliteSink: the error of sqlite3 is not reported: %s", err)
+	}
+}
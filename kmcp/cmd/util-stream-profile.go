@@ -0,0 +1,222 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package cmd
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/shenwei356/kmcp/kmcp/index"
+	"github.com/shenwei356/kmcp/kmcp/search"
+)
+
+// StreamProfiler aggregates search results into a quick profile on the fly,
+// without writing and re-parsing the intermediate search results.
+// Matches are counted as the stage 1/4 of "kmcp profile" (see Target.CountMatches),
+// but ambiguous reads are not reassigned, i.e., they are counted for all matched references.
+// So it's only for a quick look, please use "kmcp profile" for accurate profiles.
+type StreamProfiler struct {
+	MinQcov      float64 // minimal query coverage of a match
+	MaxFPR       float64 // maximal FPR of a match
+	MinReads     float64 // minimal number of reads of a reference chunk
+	MinUReads    float64 // minimal number of uniquely matched reads of a reference
+	MinFragsProp float64 // minimal fraction of reference chunks with enough reads
+
+	NumReads float64 // number of reads with matches passing the thresholds
+
+	profile map[string]*Target
+
+	// matches of a query grouped by targets, only groups of touched targets
+	// are reset for the next query.
+	groups  map[string]*[]*MatchResult
+	touched []string
+
+	// reused MatchResults converted from search.Match
+	results  []*MatchResult
+	nResults int
+}
+
+// NewStreamProfiler creates a StreamProfiler.
+func NewStreamProfiler(minQcov, maxFPR, minReads, minUReads, minFragsProp float64) *StreamProfiler {
+	return &StreamProfiler{
+		MinQcov:      minQcov,
+		MaxFPR:       maxFPR,
+		MinReads:     minReads,
+		MinUReads:    minUReads,
+		MinFragsProp: minFragsProp,
+
+		profile: make(map[string]*Target, 1024),
+		groups:  make(map[string]*[]*MatchResult, 1024),
+		touched: make([]string, 0, 32),
+		results: make([]*MatchResult, 0, 32),
+	}
+}
+
+// matchResult returns a reused MatchResult converted from a search.Match.
+func (p *StreamProfiler) matchResult(result *search.QueryResult, m *search.Match) *MatchResult {
+	if p.nResults == len(p.results) {
+		p.results = append(p.results, &MatchResult{})
+	}
+	r := p.results[p.nResults]
+	p.nResults++
+
+	idx, n := index.DecodeChunkIdx(m.TargetIdx[0])
+	*r = MatchResult{
+		QLen:    result.QueryLen,
+		FPR:     m.FPR,
+		Target:  m.Target[0],
+		FragIdx: int(idx),
+		IdxNum:  int(n),
+		GSize:   m.GenomeSize[0],
+		MKmers:  m.NumKmers,
+		QCov:    m.QCov,
+		TCov:    m.TCov,
+	}
+	return r
+}
+
+// Add counts matches of a query. It's not thread-safe.
+func (p *StreamProfiler) Add(result *search.QueryResult) {
+	if result.Matches == nil {
+		return
+	}
+
+	for _, target := range p.touched {
+		*p.groups[target] = (*p.groups[target])[:0]
+	}
+	p.touched = p.touched[:0]
+	p.nResults = 0
+
+	var ms *[]*MatchResult
+	var ok bool
+	for _, m := range *result.Matches {
+		if m.QCov < p.MinQcov || m.FPR > p.MaxFPR {
+			continue
+		}
+		if ms, ok = p.groups[m.Target[0]]; !ok {
+			tmp := make([]*MatchResult, 0, 1)
+			ms = &tmp
+			p.groups[m.Target[0]] = ms
+		}
+		if len(*ms) == 0 {
+			p.touched = append(p.touched, m.Target[0])
+		}
+		*ms = append(*ms, p.matchResult(result, m))
+	}
+	if len(p.touched) == 0 {
+		return
+	}
+	p.NumReads++
+
+	var t *Target
+	for _, target := range p.touched {
+		ms = p.groups[target]
+		if t, ok = p.profile[target]; !ok {
+			t = newTarget((*ms)[0])
+			t.QLen = make([]float64, len(t.Match))
+			p.profile[target] = t
+		}
+		t.CountMatches(*ms, len(p.touched) == 1, hicUreadsMinQcov0)
+	}
+}
+
+// Targets returns references passing the filters, sorted by relative abundances.
+func (p *StreamProfiler) Targets() []*Target {
+	targets := make([]*Target, 0, len(p.profile))
+	var totalCoverage float64
+	for _, t := range p.profile {
+		t.SumUniqMatch, t.SumUniqMatchHic, t.SumMatch, t.FragsProp, t.Qlens = 0, 0, 0, 0, 0
+		for _, c := range t.UniqMatch {
+			t.SumUniqMatch += c
+		}
+		if t.SumUniqMatch < p.MinUReads {
+			continue
+		}
+		for _, c := range t.UniqMatchHic {
+			t.SumUniqMatchHic += c
+		}
+		for _, c := range t.Match {
+			if c >= p.MinReads {
+				t.FragsProp++
+			}
+			t.SumMatch += c
+		}
+		t.FragsProp /= float64(len(t.Match))
+		if t.FragsProp < p.MinFragsProp {
+			continue
+		}
+
+		for _, c := range t.QLen {
+			t.Qlens += c
+		}
+		if t.RelDepth == nil {
+			t.RelDepth = make([]float64, len(t.QLen))
+		}
+		for i, c := range t.QLen {
+			t.RelDepth[i] = c / t.Qlens * float64(len(t.QLen))
+		}
+		_, t.RelDepthStd = MeanStdev(t.RelDepth)
+		t.Evenness = Evenness(t.RelDepth)
+
+		if t.GenomeSize > 0 {
+			t.Coverage = t.Qlens / float64(t.GenomeSize)
+		}
+		t.Score = t.StatsA.Percentile(90) * 100
+
+		totalCoverage += t.Coverage
+		targets = append(targets, t)
+	}
+	for _, t := range targets {
+		if totalCoverage > 0 {
+			t.Percentage = t.Coverage / totalCoverage * 100
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Percentage == targets[j].Percentage {
+			return targets[i].Name < targets[j].Name
+		}
+		return targets[i].Percentage > targets[j].Percentage
+	})
+	return targets
+}
+
+// WriteTo writes the profile in KMCP format to a file, and returns the number of references.
+// Columns of taxonomy information are left empty.
+func (p *StreamProfiler) WriteTo(file string, compressionLevel int) (int, error) {
+	outfh, gw, w, err := outStream(file, strings.HasSuffix(strings.ToLower(file), ".gz"), compressionLevel)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		outfh.Flush()
+		if gw != nil {
+			gw.Close()
+		}
+		w.Close()
+	}()
+
+	targets := p.Targets()
+	format := &kmcpProfileFormat{precision: -1}
+	outfh.WriteString(format.header())
+	for _, t := range targets {
+		format.write(outfh, t)
+	}
+	return len(targets), nil
+}
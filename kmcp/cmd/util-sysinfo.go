@@ -0,0 +1,149 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// availableCPUs returns the number of CPUs available to the process,
+// i.e., the number of logical CPUs, limited by the CPU quota of cgroup (v2 or v1),
+// which is common in containers and job schedulers.
+func availableCPUs() int {
+	n := runtime.NumCPU()
+	if quota := cgroupCPUQuota(); quota > 0 && quota < n {
+		return quota
+	}
+	return n
+}
+
+// cgroupCPUQuota returns the CPU quota (rounded up) of cgroup, 0 for no limit or unknown.
+func cgroupCPUQuota() int {
+	var quota, period float64
+	var err error
+
+	// cgroup v2: "<quota> <period>" or "max <period>"
+	if data, err2 := os.ReadFile("/sys/fs/cgroup/cpu.max"); err2 == nil {
+		items := strings.Fields(string(data))
+		if len(items) != 2 || items[0] == "max" {
+			return 0
+		}
+		if quota, err = strconv.ParseFloat(items[0], 64); err != nil {
+			return 0
+		}
+		if period, err = strconv.ParseFloat(items[1], 64); err != nil || period <= 0 {
+			return 0
+		}
+		return int((quota + period - 1) / period)
+	}
+
+	// cgroup v1
+	data, err := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	if err != nil {
+		return 0
+	}
+	if quota, err = strconv.ParseFloat(strings.TrimSpace(string(data)), 64); err != nil || quota <= 0 { // -1 for no limit
+		return 0
+	}
+	data, err = os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err != nil {
+		return 0
+	}
+	if period, err = strconv.ParseFloat(strings.TrimSpace(string(data)), 64); err != nil || period <= 0 {
+		return 0
+	}
+	return int((quota + period - 1) / period)
+}
+
+// availableMemory returns the available memory in bytes, read from /proc/meminfo.
+// The second returned value is false if it's unknown, e.g., not in Linux.
+func availableMemory() (uint64, bool) {
+	fh, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+	defer fh.Close()
+
+	prefix := []byte("MemAvailable:")
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if !bytes.HasPrefix(line, prefix) {
+			continue
+		}
+		items := strings.Fields(string(line[len(prefix):])) // "12345678 kB"
+		if len(items) == 0 {
+			return 0, false
+		}
+		kb, err := strconv.ParseUint(items[0], 10, 64)
+		if err != nil {
+			return 0, false
+		}
+		return kb << 10, true
+	}
+	return 0, false
+}
+
+// tuneMaxOpenFiles caps the maximum number of simultaneously opened files
+// below the soft limit of open file descriptors (ulimit -n), with some descriptors
+// reserved for other files. A warning is printed if the value is given by the user.
+func tuneMaxOpenFiles(maxOpenFiles int, reserved int, userGiven bool) int {
+	limit, ok := openFilesLimit()
+	if !ok {
+		return maxOpenFiles
+	}
+	capacity := int(limit) - reserved
+	if capacity < 1 {
+		capacity = 1
+	}
+	if maxOpenFiles <= capacity {
+		return maxOpenFiles
+	}
+	if userGiven {
+		log.Warningf("the value of -F/--max-open-files (%d) exceeds the limit of open files (ulimit -n: %d) minus %d reserved, reset to %d. "+
+			"You may increase the limit with 'ulimit -n'", maxOpenFiles, limit, reserved, capacity)
+	}
+	return capacity
+}
+
+// indexFilesSize returns the number and the total size of index files in a database directory.
+func indexFilesSize(dbDir string) (int, int64, error) {
+	files, err := filepath.Glob(filepath.Join(dbDir, "*"+extIndex))
+	if err != nil {
+		return 0, 0, err
+	}
+	var size int64
+	var info os.FileInfo
+	for _, file := range files {
+		info, err = os.Stat(file)
+		if err != nil {
+			return 0, 0, err
+		}
+		size += info.Size()
+	}
+	return len(files), size, nil
+}
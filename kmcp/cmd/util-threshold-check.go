@@ -0,0 +1,138 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"sort"
+
+	"github.com/shenwei356/kmcp/kmcp/search"
+)
+
+// ThresholdChecker detects contradictory thresholds with lengths of the
+// first queries, e.g., -c/--min-kmers is too big for k-mers of short reads,
+// which would produce no matches.
+type ThresholdChecker struct {
+	sampleSize int
+	k          int
+	density    float64 // expected fraction of k-mers kept by sketching or scaling
+
+	minLen   int
+	minCount int
+	minQcov  float64
+
+	lens    []int // lengths of queries
+	checked bool
+}
+
+// NewThresholdChecker creates a ThresholdChecker with k-mer parameters of the database.
+func NewThresholdChecker(sampleSize int, k int, info search.UnikIndexDBInfo,
+	minLen int, minCount int, minQcov float64) *ThresholdChecker {
+	density := 1.0
+	if info.Minimizer && info.MinimizerW > 1 {
+		density = 2 / float64(info.MinimizerW+1)
+	} else if info.Syncmer && info.SyncmerS > 0 && int(info.SyncmerS) < k {
+		density = 2 / float64(k-int(info.SyncmerS)+1)
+	}
+	if info.Scaled && info.Scale > 1 {
+		density /= float64(info.Scale)
+	}
+	return &ThresholdChecker{
+		sampleSize: sampleSize,
+		k:          k,
+		density:    density,
+		minLen:     minLen,
+		minCount:   minCount,
+		minQcov:    minQcov,
+		lens:       make([]int, 0, sampleSize),
+	}
+}
+
+// SetReadScale accounts for k-mers of queries subsampled with search --read-scale.
+func (c *ThresholdChecker) SetReadScale(scale int) {
+	if scale > 1 {
+		c.density /= float64(scale)
+	}
+}
+
+// Add adds the lengths of a query, and checks the thresholds when enough queries are collected.
+// For paired-end reads, k-mers are computed from both reads.
+func (c *ThresholdChecker) Add(lens ...int) {
+	if c.checked {
+		return
+	}
+	var l int
+	for _, _l := range lens {
+		l += _l
+	}
+	c.lens = append(c.lens, l)
+	if len(c.lens) >= c.sampleSize {
+		c.Check()
+	}
+}
+
+// expectedKmers returns the expected number of k-mers of a query of length l.
+func (c *ThresholdChecker) expectedKmers(l int) float64 {
+	if l < c.k {
+		return 0
+	}
+	return float64(l-c.k+1) * c.density
+}
+
+// Check warns about contradictory thresholds, it only runs once.
+func (c *ThresholdChecker) Check() {
+	if c.checked || len(c.lens) == 0 {
+		return
+	}
+	c.checked = true
+
+	sort.Ints(c.lens)
+	n := len(c.lens)
+	median := c.lens[n/2]
+	max := c.lens[n-1]
+
+	var nShort, nFewKmers int
+	for _, l := range c.lens {
+		if l < c.minLen {
+			nShort++
+		} else if c.expectedKmers(l) < float64(c.minCount) {
+			nFewKmers++
+		}
+	}
+
+	if nShort == n {
+		log.Warningf("all the first %d queries (max length: %d) are shorter than -m/--min-query-len (%d), no queries would be matched",
+			n, max, c.minLen)
+	} else if nShort*2 >= n {
+		log.Warningf("%.2f%% of the first %d queries (median length: %d) are shorter than -m/--min-query-len (%d), they would not be matched",
+			float64(nShort)/float64(n)*100, n, median, c.minLen)
+	}
+
+	if nFewKmers == 0 {
+		return
+	}
+	if nShort+nFewKmers == n {
+		log.Warningf("none of the first %d queries (max length: %d, expected k-mers: %.0f, k=%d) have enough k-mers to reach -c/--min-kmers (%d), no queries would be matched. Please decrease -c/--min-kmers",
+			n, max, c.expectedKmers(max), c.k, c.minCount)
+	} else if nFewKmers*2 >= n {
+		log.Warningf("%.2f%% of the first %d queries (median length: %d, expected k-mers: %.0f, k=%d) have fewer k-mers than -c/--min-kmers (%d), they would not be matched even with a query coverage of %.2f (-t/--min-query-cov). Please decrease -c/--min-kmers",
+			float64(nFewKmers)/float64(n)*100, n, median, c.expectedKmers(median), c.k, c.minCount, c.minQcov)
+	}
+}
@@ -29,6 +29,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -56,12 +57,14 @@ type Options struct {
 func getOptions(cmd *cobra.Command) *Options {
 	threads := getFlagNonNegativeInt(cmd, "threads")
 	if threads == 0 {
-		threads = runtime.NumCPU()
+		threads = availableCPUs()
 	}
 
 	sorts.MaxProcs = threads
 	runtime.GOMAXPROCS(threads)
 
+	setLogFormat(getFlagString(cmd, "log-format"))
+
 	logfile := getFlagString(cmd, "log")
 	return &Options{
 		NumCPUs: threads,
@@ -306,24 +309,6 @@ func Combinations(set []uint64, n int) (subsets [][]uint64) {
 	return subsets
 }
 
-type Uint64Slice []uint64
-
-func (s Uint64Slice) Len() int           { return len(s) }
-func (s Uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
-func (s Uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
-
-func (s *Uint64Slice) Push(x interface{}) {
-	*s = append(*s, x.(uint64))
-}
-
-func (s *Uint64Slice) Pop() interface{} {
-	old := *s
-	n := len(old)
-	x := old[n-1]
-	*s = old[0 : n-1]
-	return x
-}
-
 // Note: set should not have duplicates
 func Combinations2(set []uint64) [][2]uint64 {
 	if len(set) < 2 {
@@ -376,6 +361,41 @@ func IntSlice2StringSlice(vals []int) []string {
 	return s
 }
 
+// Evenness returns the fraction of values within 2X of the median,
+// i.e., in the range of [median/2, median*2].
+// Real genomes get fairly even coverage, while false hits from conserved regions are spiky.
+func Evenness(values []float64) float64 {
+	n := len(values)
+	if n == 0 {
+		return 0
+	}
+	if n == 1 {
+		return 1
+	}
+
+	sorted := make([]float64, n)
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	var median float64
+	if n&1 == 1 {
+		median = sorted[n>>1]
+	} else {
+		median = (sorted[n>>1-1] + sorted[n>>1]) / 2
+	}
+	if median == 0 {
+		return 0
+	}
+
+	var m int
+	lower, upper := median/2, median*2
+	for _, v := range values {
+		if v >= lower && v <= upper {
+			m++
+		}
+	}
+	return float64(m) / float64(n)
+}
+
 func MeanStdev(values []float64) (float64, float64) {
 	n := len(values)
 
@@ -0,0 +1,144 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/shenwei356/kmcp/kmcp/search"
+	"github.com/shenwei356/util/pathutil"
+	"github.com/spf13/cobra"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify a database with its recorded hash",
+	Long: `Verify a database with its recorded hash
+
+The hash of a database is computed by "kmcp index" over key parameters
+and contents of all index files, and saved in the database information
+file (__db.yml). This command recomputes the hash and compares it with
+the recorded one, to confirm two copies of a database are identical
+and a search used the intended one.
+
+Output format:
+    1. db,        Database directory
+    2. recorded,  Recorded hash
+    3. computed,  Computed hash
+    4. status,    "ok", "mismatch" or "no-hash" for databases without hash
+
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		opt := getOptions(cmd)
+
+		var err error
+
+		dbDir := getFlagString(cmd, "db-dir")
+		if dbDir == "" {
+			checkError(fmt.Errorf("flag -d/--db-dir needed"))
+		}
+		outFile := getFlagString(cmd, "out-file")
+
+		subFiles, err := ioutil.ReadDir(dbDir)
+		if err != nil {
+			checkError(fmt.Errorf("read database error: %s", err))
+		}
+
+		dbDirs := make([]string, 0, 8)
+		for _, file := range subFiles {
+			if !file.IsDir() {
+				continue
+			}
+			path := filepath.Join(dbDir, file.Name())
+			existed, err := pathutil.Exists(filepath.Join(path, search.DBInfoFile))
+			if err != nil {
+				checkError(fmt.Errorf("read database error: %s", err))
+			}
+			if existed {
+				dbDirs = append(dbDirs, path)
+			}
+		}
+		if len(dbDirs) == 0 {
+			checkError(fmt.Errorf("invalid kmcp database: %s", dbDir))
+		}
+
+		outfh, gw, w, err := outStream(outFile, strings.HasSuffix(strings.ToLower(outFile), ".gz"), opt.CompressionLevel)
+		checkError(err)
+		defer func() {
+			outfh.Flush()
+			if gw != nil {
+				gw.Close()
+			}
+			w.Close()
+		}()
+
+		outfh.WriteString("db\trecorded\tcomputed\tstatus\n")
+
+		var nMismatch int
+		var status, hash string
+		for _, path := range dbDirs {
+			if opt.Verbose {
+				log.Infof("verifying database: %s", path)
+			}
+
+			info, err := search.UnikIndexDBInfoFromFile(filepath.Join(path, search.DBInfoFile))
+			checkError(err)
+			checkError(info.Check())
+
+			hash, err = info.ComputeHash()
+			checkError(err)
+
+			switch {
+			case info.DBHash == "":
+				status = "no-hash"
+			case info.DBHash == hash:
+				status = "ok"
+			default:
+				status = "mismatch"
+				nMismatch++
+			}
+
+			outfh.WriteString(fmt.Sprintf("%s\t%s\t%s\t%s\n", path, info.DBHash, hash, status))
+			outfh.Flush()
+		}
+
+		if nMismatch > 0 {
+			checkError(fmt.Errorf("%d of %d database(s) do not match the recorded hashes", nMismatch, len(dbDirs)))
+		}
+		if opt.Verbose {
+			log.Infof("%d database(s) verified", len(dbDirs))
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().StringP("db-dir", "d", "",
+		formatFlagUsage(`Database directory created by "kmcp index".`))
+	verifyCmd.Flags().StringP("out-file", "o", "-",
+		formatFlagUsage(`Out file, supports and recommends a ".gz" suffix ("-" for stdout).`))
+
+	verifyCmd.SetUsageTemplate(usageTemplate("-d <kmcp db> [-o <out.tsv>]"))
+}
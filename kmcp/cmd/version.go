@@ -25,12 +25,13 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/shenwei356/kmcp/kmcp/search"
 	"github.com/shenwei356/util/cliutil"
 	"github.com/spf13/cobra"
 )
 
-// VERSION is the version
-var VERSION = "0.8.3-alpha2"
+// VERSION is the version, it is updated in kmcp/search/version.go.
+var VERSION = search.VERSION
 
 // versionCmd represents the version command
 var versionCmd = &cobra.Command{
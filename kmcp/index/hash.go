@@ -18,7 +18,7 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
 // THE SOFTWARE.
 
-package cmd
+package index
 
 import (
 	"math"
@@ -47,6 +47,7 @@ func CalcSignatureSize(numElements uint64, numHashes int, falsePositiveRate floa
 	return uint64(math.Ceil(float64(numElements) * ratio))
 }
 
+// MaxFPR returns the maximal false positive rate of a query.
 /*
 p, fpr of single bloom filter.
 k, theshold of query coverage.
@@ -57,22 +58,23 @@ fpr = lambda p,k,l: math.exp(-l * (k - p) * (k - p) / (2 * (1 - p))
 
 fpr(0.3, 0.8, 60)
 */
-func maxFPR(p float64, k float64, l int) float64 {
+func MaxFPR(p float64, k float64, l int) float64 {
 	return math.Exp(-float64(l) * (k - p) * (k - p) / (2 * (1 - p)))
 }
 
-func maxFPRf(p float64, k float64, l float64) float64 {
+// MaxFPRf is similar to MaxFPR, but l is a float64.
+func MaxFPRf(p float64, k float64, l float64) float64 {
 	return math.Exp(-l * (k - p) * (k - p) / (2 * (1 - p)))
 }
 
-// get the two basic hash function values for data.
+// BaseHashes gets the two basic hash function values for data.
 // Based on early version of https://github.com/willf/bloom/blob/master/bloom.go .
-func baseHashes(hash uint64) (uint32, uint32) {
+func BaseHashes(hash uint64) (uint32, uint32) {
 	return uint32(hash >> 32), uint32(hash)
 }
 
-// return locations in bitset for a hash
-func hashLocations(hash uint64, numHashes int, numSigs uint64) []int {
+// HashLocations returns locations in bitset for a hash.
+func HashLocations(hash uint64, numHashes int, numSigs uint64) []int {
 	if numHashes < 1 {
 		return nil
 	}
@@ -83,15 +85,15 @@ func hashLocations(hash uint64, numHashes int, numSigs uint64) []int {
 		return locs
 	}
 
-	a, b := baseHashes(hash)
+	a, b := BaseHashes(hash)
 	for i := uint32(0); i < uint32(numHashes); i++ {
 		locs[i] = int(uint64(a+b*i) % numSigs)
 	}
 	return locs
 }
 
-// return locations in bitset for a hash, faster with AND operation
-func hashLocationsFaster(hash uint64, numHashes int, numSigsM1 uint64) []int {
+// HashLocationsFaster returns locations in bitset for a hash, faster with AND operation.
+func HashLocationsFaster(hash uint64, numHashes int, numSigsM1 uint64) []int {
 	if numHashes < 1 {
 		return nil
 	}
@@ -102,15 +104,15 @@ func hashLocationsFaster(hash uint64, numHashes int, numSigsM1 uint64) []int {
 		return locs
 	}
 
-	a, b := baseHashes(hash)
+	a, b := BaseHashes(hash)
 	for i := uint32(0); i < uint32(numHashes); i++ {
 		locs[i] = int(uint64(a+b*i) & numSigsM1)
 	}
 	return locs
 }
 
-// return hashes for a hash
-func hashValues(hash uint64, numHashes int) []uint64 {
+// HashValues returns hashes for a hash.
+func HashValues(hash uint64, numHashes int) []uint64 {
 	if numHashes < 1 {
 		return nil
 	}
@@ -122,16 +124,43 @@ func hashValues(hash uint64, numHashes int) []uint64 {
 		return hashes
 	}
 
-	a, b := baseHashes(hash)
+	a, b := BaseHashes(hash)
 	for i := uint32(0); i < uint32(numHashes); i++ {
 		hashes[i] = uint64(a + b*i)
 	}
 	return hashes
 }
 
+// AppendHashValues is similar to HashValues, but it reuses the []uint64
+// objects remaining in the underlying array of hashes to reduce GC.
+func AppendHashValues(hashes [][]uint64, hash uint64, numHashes int) [][]uint64 {
+	n := len(hashes)
+	var values []uint64
+	if n < cap(hashes) {
+		values = hashes[:n+1][n]
+	}
+	if cap(values) < numHashes {
+		values = make([]uint64, numHashes)
+	} else {
+		values = values[:numHashes]
+	}
+
+	if numHashes == 1 {
+		values[0] = hash
+		return append(hashes, values)
+	}
+
+	a, b := BaseHashes(hash)
+	for i := uint32(0); i < uint32(numHashes); i++ {
+		values[i] = uint64(a + b*i)
+	}
+	return append(hashes, values)
+}
+
+// Hash64 is an integer hash function of 64-bit keys.
 // https://gist.github.com/badboy/6267743 .
 // version with mask: https://gist.github.com/lh3/974ced188be2f90422cc .
-func hash64(key uint64) uint64 {
+func Hash64(key uint64) uint64 {
 	key = (^key) + (key << 21) // key = (key << 21) - key - 1
 	key = key ^ (key >> 24)
 	key = (key + (key << 3)) + (key << 8) // key * 265
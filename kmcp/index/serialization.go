@@ -29,7 +29,29 @@ import (
 )
 
 // Version is the version of index format
-const Version uint8 = 4
+const Version uint8 = 5
+
+// Version4 is the last version with chunk indices stored in uint32,
+// i.e., lower 16 bits for chunk index and upper 16 bits for the number of chunks,
+// which are still readable and are converted to the current scheme.
+const Version4 uint8 = 4
+
+// ChunkIdxBits is the number of lower bits for storing the chunk index
+// in an element of Indices, the upper bits store the number of chunks.
+const ChunkIdxBits = 32
+
+// ChunkIdxMask is the mask for extracting the chunk index.
+const ChunkIdxMask = 1<<ChunkIdxBits - 1
+
+// EncodeChunkIdx packs the chunk index and the number of chunks.
+func EncodeChunkIdx(idx uint32, n uint32) uint64 {
+	return uint64(idx) | uint64(n)<<ChunkIdxBits
+}
+
+// DecodeChunkIdx returns the chunk index and the number of chunks.
+func DecodeChunkIdx(v uint64) (uint32, uint32) {
+	return uint32(v & ChunkIdxMask), uint32(v >> ChunkIdxBits)
+}
 
 // Magic number of index file.
 var Magic = [8]byte{'.', 'k', 'm', 'c', 'p', 'i', 'd', 'x'}
@@ -49,17 +71,24 @@ var ErrWrongWriteDataSize = errors.New("kmcp: write data with wrong size")
 // ErrVersionMismatch means version mismatch between files and program
 var ErrVersionMismatch = errors.New("kmcp: version mismatch")
 
+// ErrNewerVersion means the file is created by a newer version of kmcp.
+var ErrNewerVersion = errors.New("kmcp: index format created by a newer version of kmcp, please update kmcp")
+
 // ErrNameAndSizeMismatch means size of names and sizes are not equal.
 var ErrNameAndSizeMismatch = errors.New("kmcp: size of names and sizes unequal")
 
 // ErrNameAndIndexMismatch means size of names and sizes are not equal.
 var ErrNameAndIndexMismatch = errors.New("kmcp: size of names and indices unequal")
 
+// ErrNameAndTaxidMismatch means size of names and taxids are not equal.
+var ErrNameAndTaxidMismatch = errors.New("kmcp: size of names and taxids unequal")
+
 var be = binary.BigEndian
 
 const (
 	CANONICAL = 1 << iota
 	COMPACT
+	TAXIDS
 )
 
 // Header contains metadata
@@ -69,14 +98,16 @@ type Header struct {
 	flag      uint8 //uint8
 	Canonical bool
 	Compact   bool
+	HasTaxids bool
 	NumHashes uint8 // uint8
 	NumSigs   uint64
 
 	Names  [][]string // one bloom filter contains union of multiple sets
 	GSizes [][]uint64 // genome sizes
 	// Kmers   [][]uint64 // kmer numbers
-	Indices [][]uint32 // coresponding chunk indices of all sets.
+	Indices [][]uint64 // coresponding chunk indices of all sets, see EncodeChunkIdx.
 	Sizes   []uint64
+	Taxids  [][]uint32 // optional taxids of all sets, only available when HasTaxids is true.
 
 	NumRowBytes int // length of bytes for storing one row of signiture for n names
 }
@@ -113,7 +144,7 @@ type Writer struct {
 // func NewWriter(w io.Writer, k int, canonical bool, compact bool, numHashes uint8, numSigs uint64,
 // 	names [][]string, gsizes [][]uint64, kmers [][]uint64, indices [][]uint32, sizes []uint64) (*Writer, error) {
 func NewWriter(w io.Writer, k int, canonical bool, compact bool, numHashes uint8, numSigs uint64,
-	names [][]string, gsizes [][]uint64, indices [][]uint32, sizes []uint64) (*Writer, error) {
+	names [][]string, gsizes [][]uint64, indices [][]uint64, sizes []uint64) (*Writer, error) {
 	if len(names) != len(sizes) {
 		return nil, ErrNameAndSizeMismatch
 	}
@@ -149,6 +180,24 @@ func NewWriter(w io.Writer, k int, canonical bool, compact bool, numHashes uint8
 	return writer, nil
 }
 
+// SetTaxids sets taxids of all sets, which are written after Sizes.
+// It must be called before writing the header.
+func (writer *Writer) SetTaxids(taxids [][]uint32) error {
+	if len(taxids) != len(writer.Names) {
+		return ErrNameAndTaxidMismatch
+	}
+	for i, names := range writer.Names {
+		if len(taxids[i]) != len(names) {
+			return ErrNameAndTaxidMismatch
+		}
+	}
+
+	writer.Taxids = taxids
+	writer.HasTaxids = true
+	writer.flag |= TAXIDS
+	return nil
+}
+
 // WriteHeader writes file header
 func (writer *Writer) WriteHeader() (err error) {
 	if writer.wroteHeader {
@@ -275,7 +324,7 @@ func (writer *Writer) WriteHeader() (err error) {
 		if err != nil {
 			return err
 		}
-		// N += 4 * len(indices)
+		// N += 8 * len(indices)
 	}
 
 	// Sizes
@@ -285,6 +334,16 @@ func (writer *Writer) WriteHeader() (err error) {
 	}
 	// N += 8 * len(writer.Sizes)
 
+	// Taxids, in the same layout of Names
+	if writer.HasTaxids {
+		for _, taxids := range writer.Taxids {
+			err = binary.Write(w, be, taxids)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	// // padding to 64X
 	// nPadding := 56 - (N % 64)
 	// err = binary.Write(w, be, uint64(nPadding))
@@ -406,7 +465,10 @@ func (reader *Reader) readHeader() (err error) {
 		return err
 	}
 	// check compatibility
-	if Version != buf[0] {
+	if buf[0] > Version {
+		return ErrNewerVersion
+	}
+	if Version != buf[0] && Version4 != buf[0] {
 		return ErrVersionMismatch
 	}
 	reader.Version = buf[0]
@@ -418,6 +480,9 @@ func (reader *Reader) readHeader() (err error) {
 	if buf[2]&COMPACT > 0 {
 		reader.Compact = true
 	}
+	if buf[2]&TAXIDS > 0 {
+		reader.HasTaxids = true
+	}
 
 	reader.NumHashes = buf[3]
 
@@ -538,24 +603,38 @@ func (reader *Reader) readHeader() (err error) {
 		return err
 	}
 	n = be.Uint32(buf[:4])
-	indices := make([][]uint32, n)
+	indices := make([][]uint64, n)
 
+	var v uint32
 	for i := 0; i < int(n); i++ {
 		_, err = io.ReadFull(r, buf[:4])
 		if err != nil {
 			return err
 		}
 		_n = int(be.Uint32(buf[:4]))
-		buf2 = make([]byte, _n<<2)
-		_, err = io.ReadFull(r, buf2)
-		if err != nil {
-			return err
-		}
 
-		indicesData := make([]uint32, _n)
-		for j = 0; j < _n; j++ {
-			k = j << 2
-			indicesData[j] = be.Uint32(buf2[k : k+4])
+		indicesData := make([]uint64, _n)
+		if reader.Version == Version4 { // uint32, lower 16 bits for index, upper 16 bits for number
+			buf2 = make([]byte, _n<<2)
+			_, err = io.ReadFull(r, buf2)
+			if err != nil {
+				return err
+			}
+			for j = 0; j < _n; j++ {
+				k = j << 2
+				v = be.Uint32(buf2[k : k+4])
+				indicesData[j] = EncodeChunkIdx(v&65535, v>>16)
+			}
+		} else {
+			buf2 = make([]byte, _n<<3)
+			_, err = io.ReadFull(r, buf2)
+			if err != nil {
+				return err
+			}
+			for j = 0; j < _n; j++ {
+				k = j << 3
+				indicesData[j] = be.Uint64(buf2[k : k+8])
+			}
 		}
 		indices[i] = indicesData
 	}
@@ -576,6 +655,26 @@ func (reader *Reader) readHeader() (err error) {
 
 	reader.Sizes = sizesData
 
+	// Taxids
+	if reader.HasTaxids {
+		taxids := make([][]uint32, len(names))
+		for i, _names := range names {
+			buf2 = make([]byte, len(_names)<<2)
+			_, err = io.ReadFull(r, buf2)
+			if err != nil {
+				return err
+			}
+
+			taxidsData := make([]uint32, len(_names))
+			for j = 0; j < len(_names); j++ {
+				k = j << 2
+				taxidsData[j] = be.Uint32(buf2[k : k+4])
+			}
+			taxids[i] = taxidsData
+		}
+		reader.Taxids = taxids
+	}
+
 	// // 8 bytes padding size
 	// _, err = io.ReadFull(r, buf[:8])
 	// if err != nil {
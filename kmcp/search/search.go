@@ -0,0 +1,211 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package search searches sequences against kmcp databases,
+// it is used by "kmcp search" and could also be used as a library.
+//
+//	opt := search.DefaultSearchOptions()
+//	opt.MinQueryCov = 0.7
+//	s, err := search.Open([]string{"refseq.kmcp"}, opt)
+//	if err != nil {
+//		return err
+//	}
+//	defer s.Close()
+//
+//	matches, err := s.Query(read)
+//	if err != nil {
+//		return err
+//	}
+//	for _, m := range matches {
+//		fmt.Println(m.Target[0], m.QCov)
+//	}
+//
+// For searching a large number of queries in parallel, see Searcher.
+package search
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+
+	"github.com/shenwei356/bio/seq"
+	"github.com/shenwei356/go-logging"
+	"github.com/shenwei356/util/pathutil"
+)
+
+var log = logging.MustGetLogger("kmcp")
+
+// DefaultSearchOptions returns search options with the default values of "kmcp search".
+func DefaultSearchOptions() SearchOptions {
+	return SearchOptions{
+		UseMMap: true,
+		Threads: runtime.NumCPU(),
+
+		DeduplicateThreshold: 256,
+
+		SortBy: "qcov",
+
+		MinQLen:     30,
+		MinMatched:  10,
+		MinQueryCov: 0.55,
+		MaxFPR:      0.05,
+	}
+}
+
+// Open opens databases created by "kmcp index" for searching.
+// A database directory could contain multiple repetitions (R001, R002, ...),
+// or be one of the repetitions. For multiple databases or repetitions,
+// only targets matched in all of them are returned.
+func Open(dbDirs []string, opt SearchOptions) (*Searcher, error) {
+	if len(dbDirs) == 0 {
+		return nil, fmt.Errorf("no databases given")
+	}
+	if opt.Threads <= 0 {
+		opt.Threads = runtime.NumCPU()
+	}
+
+	dirs := make([]string, 0, len(dbDirs))
+	for _, dbDir := range dbDirs {
+		existed, err := pathutil.Exists(filepath.Join(dbDir, DBInfoFile))
+		if err != nil {
+			return nil, fmt.Errorf("read database error: %s", err)
+		}
+		if existed {
+			dirs = append(dirs, dbDir)
+			continue
+		}
+
+		_dirs, err := DBRepeatDirs(dbDir)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, _dirs...)
+	}
+
+	sg, err := newSearcher(opt, dirs...)
+	if err != nil {
+		return nil, err
+	}
+	for _, db := range sg.DBs {
+		if !SameAlphabet(db.Info.Alphabet, sg.DBs[0].Info.Alphabet) {
+			sg.Close()
+			return nil, fmt.Errorf("databases of different alphabets can not be searched together: %s, %s", sg.DBs[0].Path, db.Path)
+		}
+	}
+
+	sg.alphabet = seq.DNAredundant
+	if !IsDNAAlphabet(sg.DBs[0].Info.Alphabet) {
+		sg.alphabet = seq.Protein
+	}
+
+	return sg, nil
+}
+
+// Query searches a sequence and returns matches passing the thresholds
+// of search options, sorted by the metric of SortBy.
+// A nil slice is returned if no targets are matched.
+//
+// Queries are searched one at a time, Query should not be mixed with
+// sending queries to InCh.
+func (sg *Searcher) Query(sequence []byte) ([]Match, error) {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+
+	if sg.closed {
+		return nil, fmt.Errorf("searcher closed")
+	}
+
+	clone := NewSeq()
+	clone.Alphabet = sg.alphabet
+	clone.Seq = append(clone.Seq[:0], sequence...)
+
+	query := NewQuery()
+	query.Idx = sg.idx
+	query.ID = []byte("query")
+	query.Seq = clone
+	sg.idx++
+
+	sg.InCh <- query
+	result := <-sg.OutCh
+	defer RecycleQueryResult(result)
+
+	if result.Err != nil {
+		return nil, result.Err
+	}
+
+	var matches []Match
+	if result.Matches != nil {
+		matches = make([]Match, len(*result.Matches))
+		for i, m := range *result.Matches {
+			matches[i] = copyMatch(m)
+		}
+	}
+
+	return matches, nil
+}
+
+// copyMatch returns a copy of a match, as Match objects are recycled.
+func copyMatch(m *Match) Match {
+	m2 := Match{
+		NumKmers:     m.NumKmers,
+		FPR:          m.FPR,
+		QCov:         m.QCov,
+		TCov:         m.TCov,
+		JaccardIndex: m.JaccardIndex,
+		TargetKmers:  m.TargetKmers,
+		Block:        m.Block,
+	}
+	m2.Target = append([]string{}, m.Target...)
+	m2.TargetIdx = append([]uint64{}, m.TargetIdx...)
+	m2.GenomeSize = append([]uint64{}, m.GenomeSize...)
+	if m.Taxid != nil {
+		m2.Taxid = append([]uint32{}, m.Taxid...)
+	}
+	if m.Kmers != nil {
+		m2.Kmers = append([]uint64{}, m.Kmers...)
+	}
+	if m.Positions != nil {
+		m2.Positions = append([]int{}, m.Positions...)
+	}
+	return m2
+}
+
+// NewQuery returns an empty query from a pool, it is recycled after being searched.
+func NewQuery() *Query {
+	query := poolQuery.Get().(*Query)
+	*query = Query{}
+	return query
+}
+
+// NewSeq returns a sequence from a pool for Query.Seq and Query.Seq2,
+// it is recycled after the query being searched.
+// Note that the sequence is not empty, please reset or overwrite it.
+func NewSeq() *seq.Seq {
+	return poolSeq.Get().(*seq.Seq)
+}
+
+// RecycleQueryResult recycles a query result and its matches,
+// they should not be used after this.
+func RecycleQueryResult(result *QueryResult) {
+	if result.Matches != nil {
+		recycleMatches(result.Matches)
+	}
+	poolQueryResult.Put(result)
+}
@@ -0,0 +1,158 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package search
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/bio/seq"
+	"github.com/shenwei356/bio/seqio/fastx"
+	"github.com/shenwei356/bio/sketches"
+)
+
+// builtinAdapters are common Illumina adapter sequences.
+var builtinAdapters = [][]byte{
+	[]byte("AGATCGGAAGAGCACACGTCTGAACTCCAGTCA"),  // TruSeq read 1
+	[]byte("AGATCGGAAGAGCGTCGTGTAGGGAAAGAGTGT"),  // TruSeq read 2
+	[]byte("CTGTCTCTTATACACATCTCCGAGCCCACGAGAC"), // Nextera read 1
+	[]byte("CTGTCTCTTATACACATCTGACGCTGCCGACGA"),  // Nextera read 2
+	[]byte("TGGAATTCTCGGGTGCCAAGG"),              // TruSeq small RNA
+}
+
+// AdapterScreener detects queries dominated by adapter k-mers,
+// e.g., adapter dimers.
+type AdapterScreener struct {
+	K       int
+	MinProp float64 // minimal proportion of adapter k-mers
+
+	kmers map[uint64]interface{}
+
+	n uint64 // number of queries flagged
+}
+
+// NewAdapterScreener creates an AdapterScreener from a (gzipped) FASTA/Q file
+// of adapter sequences, or built-in adapters if the file is "builtin".
+func NewAdapterScreener(file string, k int, minProp float64) (*AdapterScreener, error) {
+	s := &AdapterScreener{K: k, MinProp: minProp, kmers: make(map[uint64]interface{}, 1024)}
+
+	if file == "builtin" {
+		for _, adapter := range builtinAdapters {
+			sequence, err := seq.NewSeq(seq.DNAredundant, adapter)
+			if err != nil {
+				return nil, err
+			}
+			if err = s.addSeq(sequence); err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	}
+
+	fastxReader, err := fastx.NewDefaultReader(file)
+	if err != nil {
+		return nil, errors.Wrap(err, file)
+	}
+	var record *fastx.Record
+	for {
+		record, err = fastxReader.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, errors.Wrap(err, file)
+		}
+		if err = s.addSeq(record.Seq); err != nil {
+			return nil, errors.Wrap(err, file)
+		}
+	}
+
+	if len(s.kmers) == 0 {
+		return nil, fmt.Errorf("no k-mers found in adapter file: %s", file)
+	}
+	return s, nil
+}
+
+func (s *AdapterScreener) addSeq(sequence *seq.Seq) error {
+	iter, err := sketches.NewHashIterator(sequence, s.K, true, false)
+	if err != nil {
+		if err == sketches.ErrShortSeq {
+			return nil
+		}
+		return err
+	}
+	var code uint64
+	var ok bool
+	for {
+		code, ok = iter.NextHash()
+		if !ok {
+			break
+		}
+		s.kmers[code] = struct{}{}
+	}
+	return nil
+}
+
+// NumKmers returns the number of adapter k-mers.
+func (s *AdapterScreener) NumKmers() int {
+	return len(s.kmers)
+}
+
+// NumFlagged returns the number of queries flagged as adapters.
+func (s *AdapterScreener) NumFlagged() uint64 {
+	return atomic.LoadUint64(&s.n)
+}
+
+// Screen checks whether a query is dominated by adapter k-mers.
+// It's safe for concurrent use.
+func (s *AdapterScreener) Screen(query *Query) bool {
+	var n, hits int
+	s.count(query.Seq, &n, &hits)
+	if query.Seq2 != nil {
+		s.count(query.Seq2, &n, &hits)
+	}
+	if n == 0 || float64(hits)/float64(n) < s.MinProp {
+		return false
+	}
+	atomic.AddUint64(&s.n, 1)
+	return true
+}
+
+func (s *AdapterScreener) count(sequence *seq.Seq, n *int, hits *int) {
+	iter, err := sketches.NewHashIterator(sequence, s.K, true, false)
+	if err != nil {
+		return
+	}
+	var code uint64
+	var ok bool
+	for {
+		code, ok = iter.NextHash()
+		if !ok {
+			break
+		}
+		*n++
+		if _, ok = s.kmers[code]; ok {
+			*hits++
+		}
+	}
+}
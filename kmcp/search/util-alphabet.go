@@ -0,0 +1,174 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package search
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/shenwei356/bio/seq"
+	"github.com/zeebo/xxh3"
+)
+
+// AlphabetDNA is the default alphabet of k-mers, i.e., nucleotides hashed with ntHash.
+const AlphabetDNA = "dna"
+
+// reducedAlphabets are groups of amino acids, residues in a group are
+// treated as the same letter.
+var reducedAlphabets = map[string][]string{
+	// the 20 standard amino acids, no reduction
+	"protein": {"A", "C", "D", "E", "F", "G", "H", "I", "K", "L",
+		"M", "N", "P", "Q", "R", "S", "T", "V", "W", "Y"},
+	// Murphy et al. 2000, https://doi.org/10.1093/protein/13.3.149
+	"murphy15": {"LVIM", "C", "A", "G", "S", "T", "P", "FY", "W", "E", "D", "N", "Q", "KR", "H"},
+	"murphy10": {"LVIM", "C", "A", "G", "ST", "P", "FYW", "EDNQ", "KR", "H"},
+	// Dayhoff 6-letter groups
+	"dayhoff6": {"AGPST", "C", "DENQ", "FWY", "HKR", "ILMV"},
+}
+
+// availableAlphabets returns names of all supported alphabets.
+func availableAlphabets() []string {
+	names := make([]string, 0, len(reducedAlphabets)+1)
+	for name := range reducedAlphabets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{AlphabetDNA}, names...)
+}
+
+// IsDNAAlphabet tells whether the alphabet name refers to nucleotides.
+// An empty name is for databases created by previous versions.
+func IsDNAAlphabet(name string) bool {
+	return name == "" || name == AlphabetDNA
+}
+
+// SameAlphabet tells whether two alphabet names are the same.
+func SameAlphabet(a, b string) bool {
+	if IsDNAAlphabet(a) {
+		return IsDNAAlphabet(b)
+	}
+	return a == b
+}
+
+// AlphabetTable maps amino acids to the representative letter of their groups,
+// 0 for unknown letters.
+type AlphabetTable [256]byte
+
+// NewAlphabetTable creates a AlphabetTable from the name of a reduced alphabet.
+func NewAlphabetTable(name string) (*AlphabetTable, error) {
+	groups, ok := reducedAlphabets[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported alphabet: %s, available: %s",
+			name, strings.Join(availableAlphabets(), ", "))
+	}
+	var t AlphabetTable
+	for _, g := range groups {
+		for i := 0; i < len(g); i++ {
+			t[g[i]] = g[0]
+			t[g[i]+32] = g[0] // lower case
+		}
+	}
+	return &t, nil
+}
+
+// AppendProteinKmers reduces the amino acid sequence and appends hashes of all
+// k-mers to kmers. K-mers containing unknown letters (X, *, B, Z, etc.) are skipped.
+func (t *AlphabetTable) AppendProteinKmers(kmers []uint64, s []byte, k int,
+	scaled bool, maxHash uint64) []uint64 {
+	return t.appendProteinKmersAndPositions(kmers, nil, s, k, scaled, maxHash)
+}
+
+// appendProteinKmersAndPositions is like AppendProteinKmers, and also appends
+// 0-based positions of k-mers to positions if it's not nil.
+func (t *AlphabetTable) appendProteinKmersAndPositions(kmers []uint64, positions *[]int, s []byte, k int,
+	scaled bool, maxHash uint64) []uint64 {
+	if len(s) < k {
+		return kmers
+	}
+
+	pbuf := poolProteinBuf.Get().(*[]byte)
+	if cap(*pbuf) < len(s) {
+		*pbuf = make([]byte, len(s))
+	}
+	buf := (*pbuf)[:len(s)]
+	defer poolProteinBuf.Put(pbuf)
+
+	var b byte
+	var valid int // number of continuous valid letters
+	var code uint64
+	for i := 0; i < len(s); i++ {
+		b = t[s[i]]
+		if b == 0 {
+			valid = 0
+			continue
+		}
+		buf[i] = b
+		valid++
+		if valid < k {
+			continue
+		}
+
+		code = xxh3.Hash(buf[i+1-k : i+1])
+		if scaled && code > maxHash {
+			continue
+		}
+		if code > 0 {
+			kmers = append(kmers, code)
+			if positions != nil {
+				*positions = append(*positions, i+1-k)
+			}
+		}
+	}
+	return kmers
+}
+
+// poolProteinBuf holds buffers of reduced sequences, shared by all workers.
+// Letters of a buffer are overwritten before being hashed, so it needs no resetting.
+var poolProteinBuf = &sync.Pool{New: func() interface{} {
+	tmp := make([]byte, 0, 1024)
+	return &tmp
+}}
+
+// CheckQueryAlphabet returns an error if the alphabet of query sequences,
+// guessed from the first record, differs from that of the database.
+func CheckQueryAlphabet(dbAlphabet string, alphabet *seq.Alphabet, file string) error {
+	var isProtein, isNucleotide bool
+	switch alphabet {
+	case seq.Protein:
+		isProtein = true
+	case seq.DNA, seq.DNAredundant, seq.RNA, seq.RNAredundant:
+		isNucleotide = true
+	default: // can not tell
+		return nil
+	}
+	if IsDNAAlphabet(dbAlphabet) {
+		if isProtein {
+			return fmt.Errorf("query alphabet (protein) differs from that of the database (%s): %s", AlphabetDNA, file)
+		}
+		return nil
+	}
+	if isNucleotide {
+		return fmt.Errorf("query alphabet (%s) differs from that of the database (%s): %s", alphabet, dbAlphabet, file)
+	}
+	return nil
+}
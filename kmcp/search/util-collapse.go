@@ -0,0 +1,133 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package search
+
+import (
+	"strconv"
+
+	"github.com/shenwei356/bio/taxdump"
+)
+
+// TaxonCollapser merges matches of targets sharing the same taxon at a rank,
+// e.g., strains of a species.
+type TaxonCollapser struct {
+	Rank string
+
+	taxids  map[string]uint32   // target -> taxid at the rank
+	names   map[uint32][]string // taxid at the rank -> new target name
+	taxids2 map[uint32][]uint32 // taxid at the rank -> new taxid list
+}
+
+// NewTaxonCollapser creates a TaxonCollapser from a target-taxid mapping.
+// Targets with no ancestors at the rank are not collapsed.
+func NewTaxonCollapser(taxdb *taxdump.Taxonomy, taxidMap map[string]uint32, rank string) *TaxonCollapser {
+	c := &TaxonCollapser{
+		Rank:    rank,
+		taxids:  make(map[string]uint32, len(taxidMap)),
+		names:   make(map[uint32][]string, 1024),
+		taxids2: make(map[uint32][]uint32, 1024),
+	}
+
+	cache := make(map[uint32]uint32, 1024) // taxid -> taxid at the rank
+	var t, t2 uint32
+	var ok bool
+	for target, taxid := range taxidMap {
+		if t, ok = cache[taxid]; !ok {
+			t = 0
+			for _, t2 = range taxdb.LineageTaxIds(taxid) {
+				if taxdb.Rank(t2) == rank {
+					t = t2
+					break
+				}
+			}
+			cache[taxid] = t
+		}
+		if t == 0 {
+			continue
+		}
+
+		c.taxids[target] = t
+		if _, ok = c.names[t]; !ok {
+			c.names[t] = []string{strconv.Itoa(int(t))}
+			c.taxids2[t] = []uint32{t}
+		}
+	}
+
+	return c
+}
+
+// NumTargets returns the number of targets which could be collapsed.
+func (c *TaxonCollapser) NumTargets() int { return len(c.taxids) }
+
+// NumTaxa returns the number of taxa at the rank.
+func (c *TaxonCollapser) NumTaxa() int { return len(c.names) }
+
+// Taxids returns taxids at the rank, i.e., names of collapsed targets.
+func (c *TaxonCollapser) Taxids() []uint32 {
+	taxids := make([]uint32, 0, len(c.names))
+	for t := range c.names {
+		taxids = append(taxids, t)
+	}
+	return taxids
+}
+
+// Collapse merges matches of targets sharing the same taxon, in place.
+// The best match (judged by better) of a taxon is kept and renamed to the taxid,
+// its matched k-mers and coverages are kept as strains share most k-mers,
+// and summing them would overestimate the query coverage.
+// It returns the number of removed matches.
+func (c *TaxonCollapser) Collapse(matches *[]*Match, better func(a, b *Match) bool) int {
+	ms := *matches
+	groups := make(map[uint32]int, len(ms)) // taxid -> index in ms
+	var t uint32
+	var ok bool
+	var i, j int
+	for _, m := range ms {
+		if t, ok = c.taxids[m.Target[0]]; !ok {
+			ms[j] = m
+			j++
+			continue
+		}
+
+		m.Target = c.names[t]
+		if m.Taxid != nil {
+			m.Taxid = c.taxids2[t]
+		}
+
+		if i, ok = groups[t]; ok {
+			if better(m, ms[i]) {
+				poolMatch.Put(ms[i])
+				ms[i] = m
+			} else {
+				poolMatch.Put(m)
+			}
+			continue
+		}
+
+		groups[t] = j
+		ms[j] = m
+		j++
+	}
+
+	n := len(ms) - j
+	*matches = ms[:j]
+	return n
+}
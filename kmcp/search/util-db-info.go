@@ -0,0 +1,353 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package search
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/shenwei356/kmcp/kmcp/index"
+	"github.com/shenwei356/util/pathutil"
+	"gopkg.in/yaml.v2"
+)
+
+// DBInfoFile is the name of the database information file.
+const DBInfoFile = "__db.yml"
+
+// DBNameMappingFile is the name of the default name mapping file of a database.
+const DBNameMappingFile = "__name_mapping.tsv"
+
+// NameMappingFile returns the path of the name mapping file of a database,
+// the gzipped one is preferred if existed.
+func NameMappingFile(path string) (string, bool, error) {
+	file := filepath.Join(path, DBNameMappingFile+".gz")
+	existed, err := pathutil.Exists(file)
+	if err != nil || existed {
+		return file, existed, err
+	}
+	file = filepath.Join(path, DBNameMappingFile)
+	existed, err = pathutil.Exists(file)
+	return file, existed, err
+}
+
+// DBRepeatDirs returns the repetition directories (R001, R002, ...) of a database.
+func DBRepeatDirs(dbDir string) ([]string, error) {
+	subFiles, err := ioutil.ReadDir(dbDir)
+	if err != nil {
+		return nil, fmt.Errorf("read database error: %s", err)
+	}
+
+	dirs := make([]string, 0, 8)
+	for _, file := range subFiles {
+		if !file.IsDir() {
+			continue
+		}
+		path := filepath.Join(dbDir, file.Name())
+		existed, err := pathutil.Exists(filepath.Join(path, DBInfoFile))
+		if err != nil {
+			return nil, fmt.Errorf("read database error: %s", err)
+		}
+		if existed {
+			dirs = append(dirs, path)
+		}
+	}
+	if len(dirs) == 0 {
+		return nil, fmt.Errorf("invalid kmcp database: %s", dbDir)
+	}
+	return dirs, nil
+}
+
+// ErrVersionMismatch indicates mismatched version
+var ErrVersionMismatch = errors.New("kmcp/index: version mismatch")
+
+// UnikIndexDBVersion is the version of database.
+const UnikIndexDBVersion uint8 = 4
+
+// UnikIndexDBMinKmcpVersion is the first version of kmcp supporting
+// the current versions of database and index format.
+const UnikIndexDBMinKmcpVersion = "0.8.3"
+
+// UnikIndexDBInfo is the meta data of a database.
+type UnikIndexDBInfo struct {
+	Version      uint8  `yaml:"version"`
+	IndexVersion uint8  `yaml:"unikiVersion"`
+	Alias        string `yaml:"alias"`
+	K            int    `yaml:"k"`
+	Ks           []int  `yaml:"ks"`
+	Hashed       bool   `yaml:"hashed"`
+	Canonical    bool   `yaml:"canonical"`
+
+	Scaled     bool   `yaml:"scaled"`
+	Scale      uint32 `yaml:"scale"`
+	Minimizer  bool   `yaml:"minimizer"`
+	MinimizerW uint32 `yaml:"minimizer-w"`
+	Syncmer    bool   `yaml:"syncmer"`
+	SyncmerS   uint32 `yaml:"syncmer-s"`
+
+	// input files have different sketch information, created with --ignore-meta-mismatch,
+	// then minimizer and syncmer are false and queries are searched with all k-mers.
+	MixedSketches bool `yaml:"mixed-sketches,omitempty"`
+
+	SplitSeq     bool `yaml:"split-seq"`
+	SplitSize    int  `yaml:"split-size"`
+	SplitNum     int  `yaml:"split-num"`
+	SplitOverlap int  `yaml:"split-overlap"`
+
+	CompactSize bool `yaml:"compact-size"`
+
+	// alphabet of k-mers, empty for dna.
+	Alphabet string `yaml:"alphabet,omitempty"`
+
+	// number of bits for storing chunk index, the rest bits are for the number of chunks.
+	// it's 16 for databases created before, where the number of chunks can't exceed 65535.
+	ChunkIdxBits int `yaml:"chunk-idx-bits,omitempty"`
+
+	// taxids of targets are saved in index files.
+	Taxids bool `yaml:"taxids,omitempty"`
+
+	// realized false positive rates of blocks, only with --report-fpr.
+	RealizedFPR *RealizedFPR `yaml:"realized-fpr,omitempty"`
+
+	// SHA-256 hash of key parameters and contents of all index files, see ComputeHash.
+	DBHash string `yaml:"db-hash,omitempty"`
+
+	// version of kmcp creating the database, and the minimal version of kmcp to read it.
+	KmcpVersion    string `yaml:"kmcp-version,omitempty"`
+	MinKmcpVersion string `yaml:"min-kmcp-version,omitempty"`
+
+	NumHashes int      `yaml:"hashes"`
+	FPR       float64  `yaml:"fpr"`
+	NumNames  int      `yaml:"numNameGroups"`
+	BlockSize int      `yaml:"blocksize"`
+	Kmers     uint64   `yaml:"totalKmers"`
+	Files     []string `yaml:"files"`
+
+	Path         string            `yaml:"-"` // directory of the database, not saved
+	NameMapping  map[string]string `yaml:"name-mapping,omitempty"`
+	MappingNames bool              `yaml:"mapping-names,omitempty"`
+}
+
+// RealizedFPR is the summary of realized false positive rates of blocks,
+// estimated from the fractions of set bits in bloom filters.
+type RealizedFPR struct {
+	Min    float64 `yaml:"min"`
+	Median float64 `yaml:"median"`
+	Max    float64 `yaml:"max"`
+}
+
+// NewRealizedFPR summarizes realized false positive rates of blocks.
+func NewRealizedFPR(fprs []float64) *RealizedFPR {
+	_fprs := make([]float64, len(fprs))
+	copy(_fprs, fprs)
+	sort.Float64s(_fprs)
+	return &RealizedFPR{Min: _fprs[0], Median: _fprs[len(_fprs)/2], Max: _fprs[len(_fprs)-1]}
+}
+
+func (i UnikIndexDBInfo) String() string {
+	var ks []int
+	if len(i.Ks) > 0 {
+		ks = i.Ks
+	} else {
+		ks = []int{i.K}
+	}
+	_ks := make([]string, len(ks))
+	for j, k := range ks {
+		_ks[j] = strconv.Itoa(k)
+	}
+	return fmt.Sprintf("kmcp database (v%d): %s, k: %s, hashed: %v, canonical: %v, #hashes: %d, fpr:%f, #blocksize: %d, #blocks: %d, #k-mers: %d",
+		i.Version, i.Alias, strings.Join(_ks, ", "), i.Hashed, i.Canonical, i.NumHashes, i.FPR, i.BlockSize, len(i.Files), i.Kmers)
+}
+
+// NewUnikIndexDBInfo creates UnikIndexDBInfo from index files, but you have to manually assign other values.
+func NewUnikIndexDBInfo(files []string) UnikIndexDBInfo {
+	return UnikIndexDBInfo{Version: UnikIndexDBVersion, IndexVersion: index.Version,
+		ChunkIdxBits: index.ChunkIdxBits, Files: files,
+		KmcpVersion: VERSION, MinKmcpVersion: UnikIndexDBMinKmcpVersion}
+}
+
+// chunkIdxBits returns the number of bits for storing chunk index of a index format version.
+func chunkIdxBits(indexVersion uint8) int {
+	if indexVersion <= index.Version4 {
+		return 16
+	}
+	return index.ChunkIdxBits
+}
+
+// UnikIndexDBInfoFromFile creates UnikIndexDBInfo from files.
+func UnikIndexDBInfoFromFile(file string) (UnikIndexDBInfo, error) {
+	info := UnikIndexDBInfo{}
+
+	r, err := os.Open(file)
+	if err != nil {
+		return info, fmt.Errorf("fail to open kmcp database info file: %s", file)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return info, fmt.Errorf("fail to read kmcp database info file: %s", file)
+	}
+
+	err = yaml.Unmarshal(data, &info)
+	if err != nil {
+		return info, fmt.Errorf("fail to unmarshal kmcp database info")
+	}
+
+	r.Close()
+
+	if info.Version > UnikIndexDBVersion || info.IndexVersion > index.Version { // created by a newer kmcp
+		if info.MinKmcpVersion != "" {
+			return info, fmt.Errorf("database format v%d (index format v%d) requires kmcp >= v%s, current version: v%s: %s",
+				info.Version, info.IndexVersion, info.MinKmcpVersion, VERSION, file)
+		}
+		return info, fmt.Errorf("database format v%d (index format v%d) is not supported by kmcp v%s, please update kmcp: %s",
+			info.Version, info.IndexVersion, VERSION, file)
+	}
+	if info.Version != UnikIndexDBVersion {
+		return info, ErrVersionMismatch
+	}
+
+	p, _ := filepath.Abs(file)
+	info.Path = filepath.Dir(p)
+	if len(info.Ks) == 0 {
+		info.Ks = []int{info.K}
+	}
+	if info.ChunkIdxBits == 0 {
+		info.ChunkIdxBits = chunkIdxBits(info.IndexVersion)
+	}
+
+	return info, nil
+}
+
+// WriteTo dumps UnikIndexDBInfo to file.
+func (i UnikIndexDBInfo) WriteTo(file string) (int, error) {
+	data, err := yaml.Marshal(i)
+	if err != nil {
+		return 0, fmt.Errorf("fail to marshal database info")
+	}
+
+	dir := filepath.Dir(file)
+	dirExisted, err := pathutil.DirExists(dir)
+	if err != nil {
+		return 0, fmt.Errorf("fail to write kmcp database info file: %s", file)
+	}
+	if !dirExisted {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return 0, fmt.Errorf("fail to write kmcp database info file: %s", file)
+		}
+	}
+
+	w, err := os.Create(file)
+	if err != nil {
+		return 0, fmt.Errorf("fail to write kmcp database info file: %s", file)
+	}
+	var n int
+	n, err = w.Write(data)
+	if err != nil {
+		return 0, fmt.Errorf("fail to write kmcp database info file: %s", file)
+	}
+
+	w.Close()
+	return n, nil
+}
+
+// CompatibleWith checks whether two databases have the same parameters.
+func (i UnikIndexDBInfo) CompatibleWith(j UnikIndexDBInfo) bool {
+	if i.Version == j.Version &&
+		i.IndexVersion == j.IndexVersion &&
+		len(i.Ks) == len(j.Ks) &&
+		i.Hashed == j.Hashed &&
+		i.Canonical == j.Canonical &&
+		i.Scale == j.Scale &&
+		i.Scaled == j.Scaled &&
+		i.Minimizer == j.Minimizer &&
+		i.MinimizerW == j.MinimizerW &&
+		i.Syncmer == j.Syncmer &&
+		i.SyncmerS == j.SyncmerS &&
+		SameAlphabet(i.Alphabet, j.Alphabet) {
+
+		for _i := range i.Ks {
+			if i.Ks[_i] != j.Ks[_i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// Check check if all index files exist.
+func (i UnikIndexDBInfo) Check() error {
+	for _, file := range i.Files {
+		file = filepath.Join(i.Path, file)
+		ok, err := pathutil.Exists(file)
+		if err != nil {
+			return fmt.Errorf("error on checking kmcp index file: %s: %s", file, err)
+		}
+		if !ok {
+			return fmt.Errorf("kmcp index file missing: %s", file)
+		}
+	}
+	return nil
+}
+
+// ComputeHash computes a SHA-256 hash over key parameters and contents of all index files,
+// which is stable for identical databases, and independent of the alias and the location.
+func (i UnikIndexDBInfo) ComputeHash() (string, error) {
+	h := sha256.New()
+
+	fmt.Fprintf(h, "version: %d\nunikiVersion: %d\nks: %v\nhashed: %v\ncanonical: %v\n",
+		i.Version, i.IndexVersion, i.Ks, i.Hashed, i.Canonical)
+	fmt.Fprintf(h, "scaled: %v\nscale: %d\nminimizer: %v\nminimizer-w: %d\nsyncmer: %v\nsyncmer-s: %d\n",
+		i.Scaled, i.Scale, i.Minimizer, i.MinimizerW, i.Syncmer, i.SyncmerS)
+	if i.MixedSketches { // only written when true, so hashes of existing databases do not change
+		fmt.Fprintf(h, "mixed-sketches: %v\n", i.MixedSketches)
+	}
+	fmt.Fprintf(h, "alphabet: %s\ntaxids: %v\nhashes: %d\nfpr: %f\nnumNameGroups: %d\n",
+		i.Alphabet, i.Taxids, i.NumHashes, i.FPR, i.NumNames)
+
+	for _, file := range i.Files {
+		fmt.Fprintf(h, "file: %s\n", file)
+
+		file = filepath.Join(i.Path, file)
+		fh, err := os.Open(file)
+		if err != nil {
+			return "", fmt.Errorf("fail to open kmcp index file: %s: %s", file, err)
+		}
+		_, err = io.Copy(h, fh)
+		fh.Close()
+		if err != nil {
+			return "", fmt.Errorf("fail to read kmcp index file: %s: %s", file, err)
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
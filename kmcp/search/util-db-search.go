@@ -18,26 +18,29 @@
 // OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
 // THE SOFTWARE.
 
-package cmd
+package search
 
 import (
 	"fmt"
 	"io"
 	"math"
+	"math/bits"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/clausecker/pospop"
 	"github.com/edsrzf/mmap-go"
 	"github.com/pkg/errors"
 	"github.com/shenwei356/bio/seq"
 	"github.com/shenwei356/bio/sketches"
-	"github.com/shenwei356/kmcp/kmcp/cmd/index"
+	"github.com/shenwei356/kmcp/kmcp/index"
 	"github.com/shenwei356/pand"
 	"github.com/shenwei356/util/cliutil"
-	"github.com/shenwei356/util/pathutil"
 	"github.com/twotwotwo/sorts"
 	"github.com/twotwotwo/sorts/sortutil"
 )
@@ -52,6 +55,13 @@ type Query struct {
 	Seq  *seq.Seq
 	Seq2 *seq.Seq
 
+	// hashes of k-mers read from a .unik file, k-mers are not computed from Seq if given,
+	// where Seq is empty and KmersLen is the length of the original sequence.
+	Kmers    []uint64
+	KmersLen int
+
+	Explain *QueryExplanation // only for the query given by --explain-query
+
 	Ch chan *QueryResult // result chanel
 }
 
@@ -70,6 +80,14 @@ type QueryResult struct {
 	// Kmers    []uint64 // hashes of k-mers (sketch), for alignment vs target
 
 	Matches *[]*Match // all matches
+
+	// only for multiple databases
+	NumDBs    int // number of databases queried
+	NumDBsHit int // number of databases with any matches
+
+	Explain *QueryExplanation
+
+	Err error // error of computing k-mers of the query, e.g., with an invalid k
 }
 
 // Name2Idx is a struct of name and index
@@ -81,14 +99,25 @@ type Name2Idx struct {
 // Match is the struct of matching detail.
 type Match struct {
 	Target     []string // target name
-	TargetIdx  []uint32
+	TargetIdx  []uint64 // chunk index and number of chunks, see index.EncodeChunkIdx
 	GenomeSize []uint64
-	NumKmers   int // matched k-mers
+	Taxid      []uint32 // taxids of targets, nil if not saved in the database
+	NumKmers   int      // matched k-mers
 	FPR        float64
 
 	QCov         float64 // |A∩B|/|A|, coverage of query. i.e., Containment Index
 	TCov         float64 // |A∩B|/|B|, coverage of target
 	JaccardIndex float64 // |A∩B|/|A∪B|, i.e., JaccardIndex
+
+	TargetKmers uint64   // number of k-mers of the target chunk, only for --output-kmer-sketch
+	Kmers       []uint64 // sampled matched k-mers, only for --output-kmer-sketch
+
+	Block string // index file producing the match, only for --emit-block
+
+	Positions []int // 0-based positions of matched k-mers in the query, only for --report-positions
+
+	col      int      // column of the target in the index file
+	kmerBits []uint64 // bit vector of matched k-mers of the query, only for --idf
 }
 
 // Matches is list of Matches, for sorting.
@@ -143,6 +172,37 @@ func (ms SortByJacc) Less(i int, j int) bool {
 	return ms.Matches[i].NumKmers > ms.Matches[j].NumKmers
 }
 
+// matchScore returns the score of a match used for sorting, i.e., qcov, tcov or jacc.
+func matchScore(m *Match, sortBy string) float64 {
+	switch sortBy {
+	case "tcov":
+		return m.TCov
+	case "jacc":
+		return m.JaccardIndex
+	default: // qcov
+		return m.QCov
+	}
+}
+
+// numTopNScores returns the number of leading matches with the top N distinct scores,
+// the matches should have been sorted by the same metric of sortBy.
+func numTopNScores(matches []*Match, topN int, sortBy string) int {
+	var n int
+	var score float64
+	pScore := math.Inf(1)
+	for i, m := range matches {
+		score = matchScore(m, sortBy)
+		if score < pScore {
+			n++
+			if n > topN {
+				return i
+			}
+			pScore = score
+		}
+	}
+	return len(matches)
+}
+
 // ---------------------------------------------------------------
 // messenging between databases and indices
 
@@ -152,6 +212,12 @@ type IndexQuery struct {
 	Hashes  *[][]uint64 // related to database
 	Hashes1 *[]uint64
 
+	Sketch []uint64 // sampled k-mers, only for --output-kmer-sketch
+
+	DF []uint32 // numbers of targets containing each k-mer in all index files, only for --idf
+
+	Explain *QueryExplanation
+
 	Ch chan *[]*Match // result chanel
 }
 
@@ -165,7 +231,13 @@ type SearchOptions struct {
 	Threads int
 	Verbose bool
 
-	DeduplicateThreshold int // deduplicate k-mers only number of kmers > this threshold
+	DeduplicateThreshold int             // deduplicate k-mers only number of kmers > this threshold
+	NoDeduplicate        bool            // do not deduplicate k-mers at all
+	DedupStats           *KmerDedupStats // numbers of k-mers before and after deduplication
+
+	MaxKmersPerQuery int     // sample k-mers of queries with more k-mers than this, 0 for no limit
+	Seed             uint64  // seed for sampling k-mers
+	CappedQueries    *uint64 // number of queries with k-mers sampled
 
 	KeepUnmatched bool
 	TopN          int
@@ -179,24 +251,68 @@ type SearchOptions struct {
 	MinTargetCov float64
 	MaxFPR       float64
 
+	MinRun int // minimal number of consecutive matched k-mers of a target, 0 or 1 for no limit
+
+	KmerSketchScale int // sample 1/scale of matched k-mers of each match, 0 for disabled
+	ReadScale       int // only search 1/scale of k-mers of each query, 0 or 1 for all k-mers
+
+	IDF bool // weight matched k-mers by inverse document frequency when computing query coverages
+
+	SkipMasked bool // skip k-mers overlapping lowercase (soft-masked) bases
+
+	TCovOfGenome bool // use the number of k-mers of the whole genome rather than the chunk as the denominator of tCov
+
+	EmitBlock bool // record the index file producing each match, for debugging
+
+	ReportPositions bool // record query positions of matched k-mers, k-mers are not deduplicated
+
 	LoadDefaultNameMap bool
 	NameMap            map[string]string
 
 	TrySingleEnd bool // when no target found for paired end reads, retry searching with Single Ends.
+
+	Adapters *AdapterScreener // for skipping queries dominated by adapter k-mers
+
+	NameMapCollisions *NameMappingCollisions // for counting matches of source names
+
+	TargetWhitelist map[string]struct{} // only search index files containing these targets, and only output them
+
+	Shards int // number of shards of index files, 0 or 1 for searching all index files
+	Shard  int // the 1-based shard of index files to search
+
+	MaxTargets int // keep at most N best matches of a query before sorting, 0 for all. For multiple databases, it's applied after merging
+
+	Collapser *TaxonCollapser // merge matches of targets sharing the same taxon at a rank
+
+	KmerCacheSize  int             // maximal number of k-mers cached by each searching goroutine of an index, 0 for disabled
+	KmerCacheStats *KmerCacheStats // hit rate of k-mer caches
 }
 
-// UnikIndexDBSearchEngine search sequence on multiple database
-type UnikIndexDBSearchEngine struct {
+// Searcher searches sequences on one or more databases.
+//
+// Besides searching queries one by one with Query, a large number of queries
+// could be searched in parallel: queries created by NewQuery are sent to InCh,
+// and results are received from OutCh in another goroutine, in a different order.
+// Call Done after sending all queries, OutCh is closed after all results being sent.
+// Results should be recycled with RecycleQueryResult after being used.
+type Searcher struct {
 	Options SearchOptions
 
 	DBs     []*UnikIndexDB
 	DBNames []string
 
-	wg   sync.WaitGroup
-	done chan int
+	wg       sync.WaitGroup
+	done     chan int
+	doneOnce sync.Once
 
 	InCh  chan *Query // queries
 	OutCh chan *QueryResult
+
+	// only for Query
+	alphabet *seq.Alphabet
+	mu       sync.Mutex
+	idx      uint64
+	closed   bool
 }
 
 func channelBuffSize(v int) int {
@@ -215,20 +331,30 @@ func extraWorkers(nIdxFiles int, threads int) int {
 	return n
 }
 
-// NewUnikIndexDBSearchEngine returns a search engine based on multiple engines
-func NewUnikIndexDBSearchEngine(opt SearchOptions, dbPaths ...string) (*UnikIndexDBSearchEngine, error) {
+// newSearcher returns a searcher of databases, i.e., repetition directories of databases.
+func newSearcher(opt SearchOptions, dbPaths ...string) (*Searcher, error) {
 	dbs := make([]*UnikIndexDB, 0, len(dbPaths))
 	names := make([]string, 0, len(dbPaths))
+
+	// for multiple databases, matches are capped once after the merging,
+	// capping in each database would drop targets ranking in the top N overall.
+	dbOpt := opt
+	if len(dbPaths) > 1 {
+		dbOpt.MaxTargets = 0
+	}
 	for i, path := range dbPaths {
-		db, err := NewUnikIndexDB(path, opt, i)
+		db, err := NewUnikIndexDB(path, dbOpt, i)
 		if err != nil {
+			for _, _db := range dbs {
+				_db.Close()
+			}
 			return nil, errors.Wrapf(err, "open kmcp db: %s", path)
 		} // for returning target name by (DBId, nameIdx)
 		dbs = append(dbs, db)
 		names = append(names, filepath.Base(path))
 	}
 
-	sg := &UnikIndexDBSearchEngine{Options: opt, DBs: dbs, DBNames: names}
+	sg := &Searcher{Options: opt, DBs: dbs, DBNames: names}
 	sg.done = make(chan int)
 	sg.InCh = make(chan *Query, channelBuffSize(opt.Threads)*(1+dbs[0].ExtraWorkers))
 	sg.OutCh = make(chan *QueryResult, 2*channelBuffSize(opt.Threads)*(1+dbs[0].ExtraWorkers))
@@ -249,12 +375,80 @@ func NewUnikIndexDBSearchEngine(opt SearchOptions, dbPaths ...string) (*UnikInde
 		topNScore := opt.TopNScores
 		onlyTopNScore := topNScore > 0 && !doNotSort
 
+		maxTargets := opt.MaxTargets
+		capTargets := maxTargets > 0
+
+		collapsing := opt.Collapser != nil
+		better := matchBetter(sortBy)
+
 		var poolChanQueryResult = &sync.Pool{New: func() interface{} {
 			return make(chan *QueryResult, nDBs)
 		}}
 
+		// shared target names for mapped names, so the names in indices are not modified,
+		// and the source names are kept for counting collisions.
+		mappedNames := make(map[string][]string, len(nameMap))
+		for _, v := range nameMap {
+			mappedNames[v] = []string{v}
+		}
+		if opt.LoadDefaultNameMap {
+			for _, db := range dbs {
+				for _, v := range db.Info.NameMapping {
+					if _, ok := mappedNames[v]; !ok {
+						mappedNames[v] = []string{v}
+					}
+				}
+			}
+		}
+		countCollisions := opt.NameMapCollisions != nil
+
+		// queries dominated by adapter k-mers are not searched,
+		// a result without matches is returned.
+		screenAdapters := opt.Adapters != nil
+		var kAdapter int // the biggest k
+		for _, k := range dbs[0].Info.Ks {
+			if k > kAdapter {
+				kAdapter = k
+			}
+		}
+		handleAdapterQuery := func(query *Query) {
+			queryResult := poolQueryResult.Get().(*QueryResult)
+			queryResult.QueryIdx = query.Idx
+			queryResult.QueryID = query.ID
+			queryResult.QueryLen = len(query.Seq.Seq)
+			if query.Seq2 != nil {
+				queryResult.QueryLen += len(query.Seq2.Seq)
+			}
+			queryResult.K = kAdapter
+			queryResult.NumKmers = 0
+			queryResult.Matches = nil
+			queryResult.NumDBs = 0
+			queryResult.NumDBsHit = 0
+			queryResult.Explain = query.Explain
+			queryResult.Err = nil
+			if query.Explain != nil {
+				query.Explain.Notef("skipped: dominated by adapter k-mers")
+			}
+
+			sg.OutCh <- queryResult
+
+			poolSeq.Put(query.Seq)
+			if query.Seq2 != nil {
+				poolSeq.Put(query.Seq2)
+			}
+			poolQuery.Put(query)
+
+			wg.Done()
+			<-tokens
+		}
+
 		if !multipleDBs {
 			handleQuerySingleDB := func(query *Query) {
+				if screenAdapters && opt.Adapters.Screen(query) {
+					handleAdapterQuery(query)
+					return
+				}
+
 				// query.Ch = make(chan *QueryResult, nDBs)
 				query.Ch = poolChanQueryResult.Get().(chan *QueryResult)
 
@@ -267,6 +461,12 @@ func NewUnikIndexDBSearchEngine(opt SearchOptions, dbPaths ...string) (*UnikInde
 				poolChanQueryResult.Put(query.Ch)
 
 				if _queryResult.Matches != nil {
+					if collapsing {
+						if n := opt.Collapser.Collapse(_queryResult.Matches, better); n > 0 && query.Explain != nil {
+							query.Explain.Notef("%d matches merged into taxa at rank %s", n, opt.Collapser.Rank)
+						}
+					}
+
 					if len(*_queryResult.Matches) > 1 && !doNotSort {
 						switch sortBy {
 						case "qcov":
@@ -280,31 +480,11 @@ func NewUnikIndexDBSearchEngine(opt SearchOptions, dbPaths ...string) (*UnikInde
 
 					// filter by scores
 					if onlyTopNScore {
-						var n, i int
-						var score, pScore float64
-						pScore = 1024
-						var m *Match
-						for i, m = range *(_queryResult.Matches) {
-							switch sortBy {
-							case "qcov":
-								score = m.QCov
-							case "tcov":
-								score = m.TCov
-							case "jacc":
-								score = m.JaccardIndex
-							}
-
-							if score < pScore {
-								n++
-								if n > topNScore {
-									break
-								}
-
-								pScore = score
-							}
-
+						n := numTopNScores(*_queryResult.Matches, topNScore, sortBy)
+						if query.Explain != nil && n < len(*_queryResult.Matches) {
+							query.Explain.Notef("%d matches removed by -n/--keep-top-scores", len(*_queryResult.Matches)-n)
 						}
-						(*_queryResult.Matches) = (*(_queryResult.Matches))[:i+1]
+						(*_queryResult.Matches) = (*(_queryResult.Matches))[:n]
 					}
 
 					// if onlyTopN && len(*_queryResult.Matches) > topN {
@@ -319,10 +499,16 @@ func NewUnikIndexDBSearchEngine(opt SearchOptions, dbPaths ...string) (*UnikInde
 						for _, _match := range *_queryResult.Matches {
 							_m = _match
 							if t, ok = nameMap[_match.Target[0]]; ok {
-								_m.Target[0] = t
+								if countCollisions {
+									opt.NameMapCollisions.Add(_match.Target[0])
+								}
+								_m.Target = mappedNames[t]
 							} else if opt.LoadDefaultNameMap {
 								if t, ok = _dbInfo.NameMapping[_match.Target[0]]; ok {
-									_m.Target[0] = t
+									if countCollisions {
+										opt.NameMapCollisions.Add(_match.Target[0])
+									}
+									_m.Target = mappedNames[t]
 								}
 							}
 						}
@@ -354,6 +540,11 @@ func NewUnikIndexDBSearchEngine(opt SearchOptions, dbPaths ...string) (*UnikInde
 
 		// may not be updated in time
 		handleQueryMultiDBs := func(query *Query) {
+			if screenAdapters && opt.Adapters.Screen(query) {
+				handleAdapterQuery(query)
+				return
+			}
+
 			query.Ch = make(chan *QueryResult, nDBs)
 
 			// send to all databases
@@ -376,15 +567,25 @@ func NewUnikIndexDBSearchEngine(opt SearchOptions, dbPaths ...string) (*UnikInde
 			toDelete = make([]Name2Idx, 1024)
 			firstDB = true
 			var noInter bool
+			var nDBsHit int
+			var err error
 			for i := 0; i < nDBs; i++ {
 				// block to read
 				_queryResult := <-query.Ch
 
+				if _queryResult.Err != nil && err == nil {
+					err = _queryResult.Err
+				}
+
+				// databases with matches are counted even if there's no intersection
+				if _queryResult.Matches != nil && len(*_queryResult.Matches) > 0 {
+					nDBsHit++
+				}
+
 				if noInter { // skip
 					// recycle matches
 					if _queryResult.Matches != nil {
-						(*_queryResult.Matches) = (*(_queryResult.Matches))[:0]
-						poolMatches.Put(_queryResult.Matches)
+						recycleMatches(_queryResult.Matches)
 					}
 					continue
 				}
@@ -399,6 +600,7 @@ func NewUnikIndexDBSearchEngine(opt SearchOptions, dbPaths ...string) (*UnikInde
 					queryResult.FPR = _queryResult.FPR
 					queryResult.K = _queryResult.K
 					queryResult.NumKmers = _queryResult.NumKmers
+					queryResult.Explain = query.Explain
 				}
 
 				if _queryResult.Matches == nil { // one of the database does not found any matches
@@ -418,11 +620,12 @@ func NewUnikIndexDBSearchEngine(opt SearchOptions, dbPaths ...string) (*UnikInde
 
 				for _, _match := range *_queryResult.Matches {
 					for j, _name = range _match.Target {
-						key = Name2Idx{Name: _name, Index: _match.TargetIdx[j] & 65535}
+						key = Name2Idx{Name: _name, Index: uint32(_match.TargetIdx[j] & index.ChunkIdxMask)}
 						if firstDB {
-							m[key] = &Match{
+							_match0 = poolMatch.Get().(*Match)
+							*_match0 = Match{
 								Target:     []string{_match.Target[j]},
-								TargetIdx:  []uint32{_match.TargetIdx[j]},
+								TargetIdx:  []uint64{_match.TargetIdx[j]},
 								GenomeSize: []uint64{_match.GenomeSize[j]},
 								NumKmers:   _match.NumKmers,
 								FPR:        _match.FPR,
@@ -430,7 +633,22 @@ func NewUnikIndexDBSearchEngine(opt SearchOptions, dbPaths ...string) (*UnikInde
 								QCov:         _match.QCov,
 								TCov:         _match.TCov,
 								JaccardIndex: _match.JaccardIndex,
+
+								TargetKmers: _match.TargetKmers,
+
+								Block: _match.Block,
+							}
+							if _match.Taxid != nil {
+								_match0.Taxid = []uint32{_match.Taxid[j]}
+							}
+							// _match is recycled below, do not share its slices.
+							if _match.Kmers != nil {
+								_match0.Kmers = append([]uint64{}, _match.Kmers...)
 							}
+							if _match.Positions != nil {
+								_match0.Positions = append([]int{}, _match.Positions...)
+							}
+							m[key] = _match0
 							continue
 						}
 
@@ -446,8 +664,7 @@ func NewUnikIndexDBSearchEngine(opt SearchOptions, dbPaths ...string) (*UnikInde
 				}
 
 				// recycle matches
-				(*_queryResult.Matches) = (*(_queryResult.Matches))[:0]
-				poolMatches.Put(_queryResult.Matches)
+				recycleMatches(_queryResult.Matches)
 
 				if firstDB {
 					firstDB = false
@@ -468,8 +685,15 @@ func NewUnikIndexDBSearchEngine(opt SearchOptions, dbPaths ...string) (*UnikInde
 				if len(m) == 0 {
 					noInter = true
 				}
+				if noInter && query.Explain != nil {
+					query.Explain.Notef("no targets matched in all databases")
+				}
 			}
 
+			queryResult.NumDBs = nDBs
+			queryResult.NumDBsHit = nDBsHit
+			queryResult.Err = err
+
 			if noInter {
 				queryResult.Matches = nil
 				sg.OutCh <- queryResult
@@ -490,6 +714,12 @@ func NewUnikIndexDBSearchEngine(opt SearchOptions, dbPaths ...string) (*UnikInde
 				*_matches2 = append(*_matches2, _match)
 			}
 
+			if collapsing {
+				if n := opt.Collapser.Collapse(_matches2, better); n > 0 && query.Explain != nil {
+					query.Explain.Notef("%d matches merged into taxa at rank %s", n, opt.Collapser.Rank)
+				}
+			}
+
 			if len(*_matches2) > 1 {
 				switch sortBy {
 				case "qcov":
@@ -503,33 +733,20 @@ func NewUnikIndexDBSearchEngine(opt SearchOptions, dbPaths ...string) (*UnikInde
 
 			queryResult.Matches = _matches2
 
+			// keep at most N best matches of all databases
+			if capTargets && len(*queryResult.Matches) > maxTargets {
+				for _, _match := range (*queryResult.Matches)[maxTargets:] {
+					poolMatch.Put(_match)
+				}
+				if query.Explain != nil {
+					query.Explain.Notef("%d matches removed by --max-target-seqs", len(*queryResult.Matches)-maxTargets)
+				}
+				(*queryResult.Matches) = (*(queryResult.Matches))[:maxTargets]
+			}
+
 			// filter by scores
 			if onlyTopNScore {
-				var n, i int
-				var score, pScore float64
-				pScore = 1024
-				var m *Match
-				for i, m = range *queryResult.Matches {
-					switch sortBy {
-					case "qcov":
-						score = m.QCov
-					case "tcov":
-						score = m.TCov
-					case "jacc":
-						score = m.JaccardIndex
-					}
-
-					if score < pScore {
-						n++
-						if n > topNScore {
-							break
-						}
-
-						pScore = score
-					}
-
-				}
-				(*queryResult.Matches) = (*(queryResult.Matches))[:i+1]
+				(*queryResult.Matches) = (*(queryResult.Matches))[:numTopNScores(*queryResult.Matches, topNScore, sortBy)]
 			}
 
 			// if onlyTopN && len(*queryResult.Matches) > topN {
@@ -544,10 +761,16 @@ func NewUnikIndexDBSearchEngine(opt SearchOptions, dbPaths ...string) (*UnikInde
 				for _, _match := range *queryResult.Matches {
 					_m = _match
 					if t, ok = nameMap[_match.Target[0]]; ok {
-						_m.Target[0] = t
+						if countCollisions {
+							opt.NameMapCollisions.Add(_match.Target[0])
+						}
+						_m.Target = mappedNames[t]
 					} else if opt.LoadDefaultNameMap {
 						if t, ok = _dbInfo.NameMapping[_match.Target[0]]; ok {
-							_m.Target[0] = t
+							if countCollisions {
+								opt.NameMapCollisions.Add(_match.Target[0])
+							}
+							_m.Target = mappedNames[t]
 						}
 					}
 				}
@@ -577,15 +800,29 @@ func NewUnikIndexDBSearchEngine(opt SearchOptions, dbPaths ...string) (*UnikInde
 	return sg, nil
 }
 
-// Wait waits
-func (sg *UnikIndexDBSearchEngine) Wait() {
-	<-sg.done       // confirm inCh being closed
-	sg.wg.Wait()    // wait all results being sent
-	close(sg.OutCh) // close OutCh
+// Done tells the searcher that no more queries will be sent to InCh,
+// and waits all results being sent to OutCh, which is closed then.
+func (sg *Searcher) Done() {
+	sg.doneOnce.Do(func() {
+		close(sg.InCh)  // close InCh
+		<-sg.done       // confirm inCh being closed
+		sg.wg.Wait()    // wait all results being sent
+		close(sg.OutCh) // close OutCh
+	})
 }
 
-// Close closes the search engine.
-func (sg *UnikIndexDBSearchEngine) Close() error {
+// Close stops searching and closes the databases.
+func (sg *Searcher) Close() error {
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+
+	if sg.closed {
+		return nil
+	}
+	sg.closed = true
+
+	sg.Done()
+
 	var err0 error
 
 	ch := make(chan error)
@@ -619,7 +856,7 @@ func (sg *UnikIndexDBSearchEngine) Close() error {
 // UnikIndexDB is database for multiple .unik indices.
 type UnikIndexDB struct {
 	Options SearchOptions
-	path    string
+	Path    string
 
 	DBId int // id for current database
 
@@ -634,22 +871,24 @@ type UnikIndexDB struct {
 	Indices []*UnikIndex
 
 	ExtraWorkers int
+
+	abTable *AlphabetTable // for amino acid alphabets
 }
 
 func (db *UnikIndexDB) String() string {
 	return fmt.Sprintf("kmcp database v%d: name: %s, path: %s, #blocksize: %d, #blocks: %d, #%d-mers: %d, #hashes: %d",
-		db.Info.Version, db.Info.Alias, db.path, db.Info.BlockSize, len(db.Info.Files), db.Header.K, db.Info.Kmers, db.Header.NumHashes)
+		db.Info.Version, db.Info.Alias, db.Path, db.Info.BlockSize, len(db.Info.Files), db.Header.K, db.Info.Kmers, db.Header.NumHashes)
 }
 
 // NewUnikIndexDB opens and read from database directory.
 func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, error) {
-	info, err := UnikIndexDBInfoFromFile(filepath.Join(path, dbInfoFile))
+	info, err := UnikIndexDBInfoFromFile(filepath.Join(path, DBInfoFile))
 	if err != nil {
 		return nil, err
 	}
 
 	if len(info.Files) == 0 {
-		checkError(fmt.Errorf("no index files"))
+		return nil, fmt.Errorf("no index files")
 	}
 
 	err = info.Check()
@@ -658,16 +897,46 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 	}
 
 	if opt.LoadDefaultNameMap {
-		fileNameMapping := filepath.Join(path, dbNameMappingFile)
+		var fileNameMapping string
 		var existed bool
-		existed, err = pathutil.Exists(fileNameMapping)
+		fileNameMapping, existed, err = NameMappingFile(path)
+		if err != nil {
+			return nil, err
+		}
 		if existed {
 			info.NameMapping, err = cliutil.ReadKVs(fileNameMapping, false)
-			checkError(err)
+			if err != nil {
+				return nil, errors.Wrap(err, fileNameMapping)
+			}
 		}
 		info.MappingNames = len(info.NameMapping) > 0
 	}
 
+	if opt.TargetWhitelist != nil {
+		var nFound int
+		info.Files, nFound, err = filterIndexFilesByTargets(path, info.Files, opt.TargetWhitelist)
+		if err != nil {
+			return nil, err
+		}
+		if len(info.Files) == 0 {
+			return nil, fmt.Errorf("none of the %d targets in the whitelist found in the database", len(opt.TargetWhitelist))
+		}
+		if opt.Verbose {
+			log.Infof("  %d/%d targets in the whitelist found in %d index files", nFound, len(opt.TargetWhitelist), len(info.Files))
+		}
+	}
+
+	if opt.Shards > 1 {
+		n := len(info.Files)
+		info.Files = shardIndexFiles(info.Files, opt.Shards, opt.Shard)
+		if len(info.Files) == 0 {
+			return nil, fmt.Errorf("no index files in shard %d/%d, the database only has %d index files", opt.Shard, opt.Shards, n)
+		}
+		if opt.Verbose {
+			log.Infof("  %d/%d index files in shard %d/%d", len(info.Files), n, opt.Shard, opt.Shards)
+		}
+	}
+
 	indices := make([]*UnikIndex, 0, len(info.Files))
 
 	nextraWorkers := extraWorkers(len(info.Files), opt.Threads)
@@ -678,19 +947,31 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 
 	// the first idx
 	idx1, err := NewUnikIndex(filepath.Join(path, info.Files[0]), opt, info.FPR, nextraWorkers)
-	checkError(errors.Wrap(err, filepath.Join(path, info.Files[0])))
+	if err != nil {
+		return nil, errors.Wrap(err, filepath.Join(path, info.Files[0]))
+	}
 
 	if info.IndexVersion == idx1.Header.Version &&
+		info.ChunkIdxBits == chunkIdxBits(idx1.Header.Version) &&
 		info.Ks[len(info.Ks)-1] == idx1.Header.K &&
 		info.Canonical == idx1.Header.Canonical &&
 		info.NumHashes == int(idx1.Header.NumHashes) {
 	} else {
-		checkError(fmt.Errorf("index files not compatible"))
+		idx1.Close()
+		return nil, fmt.Errorf("index files not compatible")
 	}
 
 	indices = append(indices, idx1)
 
-	db := &UnikIndexDB{Options: opt, Info: info, Header: idx1.Header, path: path}
+	db := &UnikIndexDB{Options: opt, Info: info, Header: idx1.Header, Path: path}
+
+	if !IsDNAAlphabet(info.Alphabet) {
+		db.abTable, err = NewAlphabetTable(info.Alphabet)
+		if err != nil {
+			idx1.Close()
+			return nil, err
+		}
+	}
 
 	db.ExtraWorkers = nextraWorkers
 	db.InCh = make(chan *Query, channelBuffSize(opt.Threads)*(1+nextraWorkers))
@@ -712,6 +993,8 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 		}()
 
 		var wg sync.WaitGroup
+		var mu sync.Mutex
+		var err0 error // the first error
 		for _, f := range info.Files[1:] {
 			f = filepath.Join(path, f)
 
@@ -720,10 +1003,17 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 				defer wg.Done()
 
 				idx, err := NewUnikIndex(f, opt, info.FPR, nextraWorkers)
-				checkError(errors.Wrap(err, f))
-
-				if !idx.Header.Compatible(idx1.Header) {
-					checkError(fmt.Errorf("index files not compatible"))
+				if err == nil && !idx.Header.Compatible(idx1.Header) {
+					idx.Close()
+					err = fmt.Errorf("index files not compatible")
+				}
+				if err != nil {
+					mu.Lock()
+					if err0 == nil {
+						err0 = errors.Wrap(err, f)
+					}
+					mu.Unlock()
+					return
 				}
 
 				ch <- idx
@@ -732,6 +1022,13 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 		wg.Wait()
 		close(ch)
 		<-done
+
+		if err0 != nil {
+			for _, idx := range indices {
+				idx.Close()
+			}
+			return nil, err0
+		}
 	}
 
 	db.Indices = indices
@@ -742,6 +1039,15 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 		numHashes := db.Info.NumHashes
 		singleHash := numHashes == 1
 		indices := db.Indices
+		sketchScale := db.Options.KmerSketchScale
+		var sketchMaxHash uint64
+		if sketchScale > 0 {
+			sketchMaxHash = ^uint64(0) / uint64(sketchScale)
+		}
+		var readMaxHash uint64 // 0 for searching all k-mers
+		if db.Options.ReadScale > 1 {
+			readMaxHash = ^uint64(0) / uint64(db.Options.ReadScale)
+		}
 		numIndices := len(indices)
 		ks := db.Info.Ks
 		sortutil.Ints(ks)
@@ -753,8 +1059,27 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 		lastIk := len(ks) - 1
 
 		trySE := db.Options.TrySingleEnd
+		whitelist := db.Options.TargetWhitelist
+		useIDF := db.Options.IDF
+		reportPositions := db.Options.ReportPositions
+		poolIDFWeights := &sync.Pool{New: func() interface{} {
+			tmp := make([]float64, 0, 256)
+			return &tmp
+		}}
+
+		// keeping at most N best matches with a bounded heap, before sorting.
+		// With --idf, matches are capped after query coverages being reweighted.
+		maxTargets := db.Options.MaxTargets
+		capTargets := maxTargets > 0 && !useIDF
+		capAfterIDF := maxTargets > 0 && useIDF
+		sortBy := db.Options.SortBy
+		poolMatchHeap := &sync.Pool{New: func() interface{} {
+			return newMatchHeap(maxTargets, sortBy)
+		}}
 
 		handleQuery := func(query *Query) {
+			explain := query.Explain
+			var err error
 			for _ik, k := range ks {
 				queryResult := poolQueryResult.Get().(*QueryResult)
 
@@ -766,12 +1091,20 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 				} else {
 					trySE = false // just ensure
 				}
+				if query.Kmers != nil {
+					queryResult.QueryLen = query.KmersLen
+				}
 				queryResult.K = k
 				queryResult.Matches = nil
+				queryResult.Explain = explain
+				queryResult.Err = nil
 
-				if len(query.Seq.Seq) < minLen { // skip short query
+				if query.Kmers == nil && len(query.Seq.Seq) < minLen { // skip short query
 					if !(query.Seq2 != nil && len(query.Seq2.Seq) >= minLen) {
 						queryResult.NumKmers = 0
+						if explain != nil {
+							explain.Notef("database #%d: skipped: query length < %d (-m/--min-query-len)", db.DBId+1, minLen)
+						}
 
 						query.Ch <- queryResult
 						<-tokens
@@ -779,31 +1112,57 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 					}
 				}
 
+				// positions of k-mers in the query, only for --report-positions
+				var positions *[]int
+				if reportPositions {
+					positions = &[]int{}
+				}
+
 				// compute kmers
 				// reuse []uint64 object, to reduce GC
 				var kmers *[]uint64
-				kmers = poolKmers.Get().(*[]uint64)
-				*kmers = (*kmers)[:0]
-				kmers, err = db.generateKmers(query.Seq, k, kmers)
-				if err != nil {
-					checkError(err)
+				kmers = getKmers(queryResult.QueryLen)
+				if query.Kmers != nil {
+					*kmers = append(*kmers, query.Kmers...)
+				} else if kmers, err = db.generateKmers(query.Seq, k, kmers, positions, opt.SkipMasked); err != nil {
+					queryResult.NumKmers = 0
+					queryResult.Err = err
+					query.Ch <- queryResult
+					<-tokens
+					return
+				}
+
+				if readMaxHash > 0 {
+					*kmers = subsampleKmers(*kmers, 0, readMaxHash)
 				}
 
 				n1 := len(*kmers) //  only for TrySingleEnd
 
 				if query.Seq2 != nil { // append to kmers of Seq2
-					kmers, err = db.generateKmers(query.Seq2, k, kmers)
-					if err != nil {
-						checkError(err)
+					if kmers, err = db.generateKmers(query.Seq2, k, kmers, positions, opt.SkipMasked); err != nil {
+						queryResult.NumKmers = 0
+						queryResult.Err = err
+						query.Ch <- queryResult
+						<-tokens
+						return
+					}
+					if reportPositions { // positions in read2 follow read1
+						for i := n1; i < len(*positions); i++ {
+							(*positions)[i] += len(query.Seq.Seq)
+						}
+					}
+					if readMaxHash > 0 {
+						*kmers = subsampleKmers(*kmers, n1, readMaxHash)
 					}
 				}
 
 				// -------------- only for TrySingleEnd --------------
 				tries := 0
 				var kmers1 *[]uint64 // copy of kmers1
+				var posOffset int    // offset of positions of the k-mers, only for --report-positions
 
 				if trySE { // copy kmers for later use
-					kmers1 = poolKmers.Get().(*[]uint64)
+					kmers1 = getKmers(len(*kmers))
 					// *kmers1 = (*kmers1)[:0]
 					// *kmers1 = append(*kmers1, *kmers...)
 
@@ -840,21 +1199,36 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 
 						*kmers = (*kmers1)[n1:]
 						queryResult.QueryLen = len(query.Seq2.Seq)
+						posOffset = n1
 					}
 				}
 				//  --------------------------------------------------
 
+				if explain != nil {
+					switch tries {
+					case 0:
+						explain.Notef("database #%d, k=%d: %d k-mers", db.DBId+1, k, len(*kmers))
+					case 1:
+						explain.Notef("database #%d, k=%d: retry with read 1: %d k-mers", db.DBId+1, k, len(*kmers))
+					case 2:
+						explain.Notef("database #%d, k=%d: retry with read 2: %d k-mers", db.DBId+1, k, len(*kmers))
+					}
+				}
+
 				// sequence shorter than k, or too few k-mer sketchs.
 				if len(*kmers) < db.Options.MinMatched {
+					if explain != nil {
+						explain.Notef("  skipped: #k-mers < %d (-c/--min-kmers)", db.Options.MinMatched)
+					}
 					if !trySE {
-						poolKmers.Put(kmers)
+						putKmers(kmers)
 					} else {
 						if tries == 0 {
-							poolKmers.Put(kmers)
+							putKmers(kmers)
 						} else {
 							poolKmers2.Put(kmers)
 						}
-						poolKmers.Put(kmers1)
+						putKmers(kmers1)
 					}
 
 					query.Ch <- queryResult // still send result!
@@ -865,7 +1239,9 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 				nKmers := len(*kmers)
 				queryResult.NumKmers = nKmers
 
-				if nKmers > opt.DeduplicateThreshold {
+				// k-mers are kept in their positional order for checking runs of matched k-mers,
+				// and for reporting positions of matched k-mers.
+				if !opt.NoDeduplicate && nKmers > opt.DeduplicateThreshold && opt.MinRun <= 1 && !reportPositions {
 					// map is slower than sorting
 
 					// sortutil.Uint64s(*kmers)
@@ -899,22 +1275,47 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 						nKmers = j
 					}
 
+					if opt.DedupStats != nil && db.DBId == 0 {
+						opt.DedupStats.add(queryResult.NumKmers, nKmers)
+					}
+
+				}
+
+				// bound the cost of pathological queries with a huge number of (distinct) k-mers
+				if opt.MaxKmersPerQuery > 0 && nKmers > opt.MaxKmersPerQuery {
+					*kmers = sampleKmers(*kmers, opt.MaxKmersPerQuery, opt.Seed)
+					nKmers = len(*kmers)
+
+					if opt.CappedQueries != nil && db.DBId == 0 {
+						atomic.AddUint64(opt.CappedQueries, 1)
+					}
 				}
 
 				queryResult.NumKmers = nKmers
 
+				// sample k-mers with hash values in the smallest 1/scale of all values,
+				// so the same k-mers are sampled for all queries.
+				var sketch []uint64
+				if sketchScale > 0 {
+					for _, kmer := range *kmers {
+						if index.Hash64(kmer) <= sketchMaxHash {
+							sketch = append(sketch, kmer)
+						}
+					}
+				}
+
 				// compute hashes
 				// reuse [][]uint64 object, to reduce GC
 				var hashes *[][]uint64
 				if !singleHash {
 					hashes = poolHashes.Get().(*[][]uint64)
 					for _, kmer := range *kmers {
-						*hashes = append(*hashes, hashValues(kmer, numHashes))
+						*hashes = index.AppendHashValues(*hashes, kmer, numHashes)
 					}
 
 					// recycle kmer-sketch ([]uint64) object
 					if !trySE {
-						poolKmers.Put(kmers)
+						putKmers(kmers)
 					}
 				}
 
@@ -929,6 +1330,13 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 					iquery.Hashes1 = kmers
 				}
 				iquery.Ch = chMatches
+				iquery.Explain = explain
+				iquery.Sketch = sketch
+				if useIDF {
+					iquery.DF = make([]uint32, nKmers)
+				} else {
+					iquery.DF = nil
+				}
 
 				for i := numIndices - 1; i >= 0; i-- { // start from bigger files
 					indices[i].InCh <- iquery
@@ -938,6 +1346,11 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 				// reuse []Match object
 				// matches := poolMatches.Get().(*[]*Match)
 				var matches *[]*Match
+				var mh *matchHeap
+				var nDiscarded int
+				if capTargets {
+					mh = poolMatchHeap.Get().(*matchHeap)
+				}
 				first := true
 				for i := 0; i < numIndices; i++ {
 					// block to read
@@ -948,6 +1361,23 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 						continue
 					}
 
+					if capTargets {
+						for _, m := range *_matches {
+							if whitelist != nil && !inTargetWhitelist(m, whitelist) {
+								poolMatch.Put(m)
+								continue
+							}
+							if m = mh.Add(m); m != nil {
+								poolMatch.Put(m)
+								nDiscarded++
+							}
+						}
+
+						*_matches = (*_matches)[:0]
+						poolMatches.Put(_matches)
+						continue
+					}
+
 					if first {
 						matches = _matches
 						first = false
@@ -955,6 +1385,87 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 					}
 
 					*matches = append(*matches, (*_matches)...)
+
+					// the Match objects are moved to matches, only recycle the list
+					*_matches = (*_matches)[:0]
+					poolMatches.Put(_matches)
+				}
+
+				if capTargets {
+					if mh.Len() > 0 {
+						matches = poolMatches.Get().(*[]*Match)
+						*matches = append((*matches)[:0], mh.matches...)
+					}
+					if explain != nil && nDiscarded > 0 {
+						explain.Notef("%d matches removed by --max-target-seqs", nDiscarded)
+					}
+					mh.Reset()
+					poolMatchHeap.Put(mh)
+				}
+
+				if explain != nil {
+					explain.flushTargets()
+				}
+
+				// only keep targets in the whitelist
+				if matches != nil && whitelist != nil {
+					var j int
+					for _, m := range *matches {
+						if inTargetWhitelist(m, whitelist) {
+							(*matches)[j] = m
+							j++
+						} else {
+							poolMatch.Put(m)
+						}
+					}
+					*matches = (*matches)[:j]
+					if j == 0 {
+						poolMatches.Put(matches)
+						matches = nil
+					}
+				}
+
+				// reweight query coverages with IDF of k-mers
+				if matches != nil && useIDF {
+					weights := poolIDFWeights.Get().(*[]float64)
+					var sumWeights float64
+					*weights, sumWeights = idfWeights(iquery.DF, db.Info.NumNames, db.Info.FPR, *weights)
+					var j int
+					for _, m := range *matches {
+						m.QCov = weightedQCov(m, *weights, sumWeights)
+						if m.QCov >= db.Options.MinQueryCov {
+							(*matches)[j] = m
+							j++
+						} else {
+							poolMatch.Put(m)
+						}
+					}
+					*matches = (*matches)[:j]
+					if j == 0 {
+						poolMatches.Put(matches)
+						matches = nil
+					}
+					poolIDFWeights.Put(weights)
+
+					if explain != nil {
+						explain.Notef("query coverages weighted by IDF of k-mers (--idf), %d matches left", j)
+					}
+
+					if matches != nil && capAfterIDF {
+						mh := poolMatchHeap.Get().(*matchHeap)
+						nDiscarded := mh.Cap(matches)
+						poolMatchHeap.Put(mh)
+						if explain != nil && nDiscarded > 0 {
+							explain.Notef("%d matches removed by --max-target-seqs", nDiscarded)
+						}
+					}
+				}
+
+				// positions of matched k-mers, from the bit vectors of matched k-mers
+				if matches != nil && reportPositions {
+					for _, m := range *matches {
+						m.Positions = matchedKmerPositions(m.kmerBits, (*positions)[posOffset:], m.Positions[:0])
+					}
 				}
 
 				// recycle objects
@@ -966,7 +1477,7 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 					poolHashes.Put(hashes)
 				} else {
 					if !trySE {
-						poolKmers.Put(kmers)
+						putKmers(kmers)
 					}
 				}
 
@@ -974,15 +1485,15 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 				if matches != nil {
 					if trySE {
 						if tries == 0 {
-							poolKmers.Put(kmers)
+							putKmers(kmers)
 						} else {
 							poolKmers2.Put(kmers)
 						}
-						poolKmers.Put(kmers1)
+						putKmers(kmers1)
 					}
 
 					// send result
-					// queryResult.FPR = maxFPR(db.Info.FPR, opt.MinQueryCov, nKmers)
+					// queryResult.FPR = index.MaxFPR(db.Info.FPR, opt.MinQueryCov, nKmers)
 					queryResult.DBId = db.DBId
 					queryResult.Matches = matches
 
@@ -994,7 +1505,7 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 				// -------------- only for TrySingleEnd --------------
 				if trySE {
 					if tries == 0 {
-						poolKmers.Put(kmers)
+						putKmers(kmers)
 					} else {
 						poolKmers2.Put(kmers)
 					}
@@ -1004,7 +1515,7 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 						goto RETRY
 					}
 
-					poolKmers.Put(kmers1)
+					putKmers(kmers1)
 				}
 
 				//  --------------------------------------------------
@@ -1028,7 +1539,90 @@ func NewUnikIndexDB(path string, opt SearchOptions, dbID int) (*UnikIndexDB, err
 	return db, nil
 }
 
-func (db *UnikIndexDB) generateKmers(sequence *seq.Seq, k int, kmers *[]uint64) (*[]uint64, error) {
+// filterIndexFilesByTargets returns index files containing any of the given targets,
+// and the number of targets found. Only headers of index files are read.
+func filterIndexFilesByTargets(path string, files []string, targets map[string]struct{}) ([]string, int, error) {
+	files2 := make([]string, 0, len(files))
+	found := make(map[string]struct{}, len(targets))
+	var hit, ok bool
+	for _, f := range files {
+		file := filepath.Join(path, f)
+		fh, err := os.Open(file)
+		if err != nil {
+			return nil, 0, err
+		}
+		reader, err := index.NewReader(fh)
+		if err != nil {
+			fh.Close()
+			return nil, 0, errors.Wrap(err, file)
+		}
+		fh.Close()
+
+		hit = false
+		for _, names := range reader.Names {
+			for _, name := range names {
+				if _, ok = targets[name]; ok {
+					found[name] = struct{}{}
+					hit = true
+				}
+			}
+		}
+		if hit {
+			files2 = append(files2, f)
+		}
+	}
+	return files2, len(found), nil
+}
+
+// ParseShard parses the value of --shards in the format of "N/M", i.e., the Mth of N shards.
+func ParseShard(s string) (shards int, shard int, err error) {
+	i := strings.IndexByte(s, '/')
+	if i < 0 {
+		return 0, 0, fmt.Errorf("invalid shard: %s, the format should be N/M", s)
+	}
+	if shards, err = strconv.Atoi(s[:i]); err != nil || shards < 1 {
+		return 0, 0, fmt.Errorf("invalid number of shards: %s", s)
+	}
+	if shard, err = strconv.Atoi(s[i+1:]); err != nil || shard < 1 || shard > shards {
+		return 0, 0, fmt.Errorf("invalid shard: %s, M should be in range of [1, N]", s)
+	}
+	return shards, shard, nil
+}
+
+// shardIndexFiles returns index files of the 1-based shard of all shards.
+// Index files are assigned to shards in a round-robin way, as neighbouring files
+// have similar sizes.
+func shardIndexFiles(files []string, shards int, shard int) []string {
+	files2 := make([]string, 0, len(files)/shards+1)
+	for i, f := range files {
+		if i%shards == shard-1 {
+			files2 = append(files2, f)
+		}
+	}
+	return files2
+}
+
+// inTargetWhitelist checks if any target of a match is in the whitelist.
+func inTargetWhitelist(m *Match, whitelist map[string]struct{}) bool {
+	for _, t := range m.Target {
+		if _, ok := whitelist[t]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// generateKmers appends hashes of k-mers of a sequence to kmers,
+// and their 0-based positions to positions if it's not nil.
+func (db *UnikIndexDB) generateKmers(sequence *seq.Seq, k int, kmers *[]uint64, positions *[]int, skipMasked bool) (*[]uint64, error) {
+	if skipMasked && hasSoftMasked(sequence.Seq) {
+		// the query might be shared by multiple databases, so we mask a copy of it.
+		masked := make([]byte, len(sequence.Seq))
+		copy(masked, sequence.Seq)
+		HardMask(masked, db.abTable != nil)
+		sequence = &seq.Seq{Alphabet: sequence.Alphabet, Seq: masked}
+	}
+
 	scaled := db.Info.Scaled
 	scale := db.Info.Scale
 	maxHash := ^uint64(0)
@@ -1036,6 +1630,11 @@ func (db *UnikIndexDB) generateKmers(sequence *seq.Seq, k int, kmers *[]uint64)
 		maxHash = uint64(float64(^uint64(0)) / float64(scale))
 	}
 
+	if db.abTable != nil {
+		*kmers = db.abTable.appendProteinKmersAndPositions(*kmers, positions, sequence.Seq, k, scaled, maxHash)
+		return kmers, nil
+	}
+
 	var err error
 	var iter *sketches.Iterator
 	var sketch *sketches.Sketch
@@ -1068,6 +1667,9 @@ func (db *UnikIndexDB) generateKmers(sequence *seq.Seq, k int, kmers *[]uint64)
 			}
 			if code > 0 {
 				*kmers = append(*kmers, code)
+				if positions != nil {
+					*positions = append(*positions, sketch.Index())
+				}
 			}
 		}
 	} else if db.Info.Minimizer {
@@ -1081,6 +1683,9 @@ func (db *UnikIndexDB) generateKmers(sequence *seq.Seq, k int, kmers *[]uint64)
 			}
 			if code > 0 {
 				*kmers = append(*kmers, code)
+				if positions != nil {
+					*positions = append(*positions, sketch.Index())
+				}
 			}
 		}
 	} else {
@@ -1094,6 +1699,9 @@ func (db *UnikIndexDB) generateKmers(sequence *seq.Seq, k int, kmers *[]uint64)
 			}
 			if code > 0 {
 				*kmers = append(*kmers, code)
+				if positions != nil {
+					*positions = append(*positions, iter.Index())
+				}
 			}
 		}
 	}
@@ -1103,7 +1711,8 @@ func (db *UnikIndexDB) generateKmers(sequence *seq.Seq, k int, kmers *[]uint64)
 // CompatibleWith has loose restric tions for enabling searching from database of different perameters.
 func (db *UnikIndexDB) CompatibleWith(db2 *UnikIndexDB) bool {
 	if db.Info.Version == db2.Info.Version &&
-		db.Info.IndexVersion == db2.Info.IndexVersion {
+		db.Info.IndexVersion == db2.Info.IndexVersion &&
+		SameAlphabet(db.Info.Alphabet, db2.Info.Alphabet) {
 		return true
 	}
 	return false
@@ -1280,6 +1889,10 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 		names := h.Names
 		gsizes := h.GSizes
 		indices := h.Indices
+		taxids := h.Taxids
+		if !h.HasTaxids {
+			taxids = make([][]uint32, len(names))
+		}
 		// numNames := len(h.Names)
 		numRowBytes := h.NumRowBytes
 		numSigs := h.NumSigs
@@ -1300,6 +1913,13 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 		targetCov := opt.MinTargetCov
 		minMatched := opt.MinMatched
 		maxFPR := opt.MaxFPR
+		minRun := opt.MinRun
+		sketchScale := opt.KmerSketchScale
+		useIDF := opt.IDF
+		reportPositions := opt.ReportPositions
+		emitBlock := opt.EmitBlock
+		// index file relative to the database directory, e.g., R001/_block001.kmcp
+		blockName := filepath.Join(filepath.Base(filepath.Dir(idx.Path)), filepath.Base(idx.Path))
 		// compactSize := idx.Header.Compact
 
 		// bit matrix
@@ -1392,6 +2012,19 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 		for i, s := range sizes {
 			sizesFloat[i] = float64(s)
 		}
+		if opt.TCovOfGenome {
+			// k-mers of a genome are estimated as those of a chunk times the number of chunks
+			var chunks uint32
+			for i := range sizesFloat {
+				if len(indices[i]) == 0 {
+					continue
+				}
+				_, chunks = index.DecodeChunkIdx(indices[i][0])
+				if chunks > 1 {
+					sizesFloat[i] *= float64(chunks)
+				}
+			}
+		}
 
 		var offset int
 		var offset2 int64
@@ -1417,9 +2050,144 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 		counts0 := make([][8]int, numRowBytes)
 		counts := make([][8]int, numRowBytes)
 
+		// cache of k-mer -> AND-ed row, not needed for mmaped data with one hash function.
+		var cache *kmerRowCache
+		useCache := opt.KmerCacheSize > 0 && (moreThanOneHash || !useMmap)
+		if useCache {
+			cache = newKmerRowCache(opt.KmerCacheSize, numRowBytes, opt.KmerCacheStats)
+		}
+		var key uint64
+		var cached []byte
+		var hit bool
+
 		// buf := make([]byte, PosPopCountBufSize)
 		var buf [PosPopCountBufSize]byte
 
+		// for checking runs of consecutive matched k-mers, i.e., --min-run
+		var runRow []byte
+		var runCols, runLens, maxRuns []int
+		if minRun > 1 || sketchScale > 0 || useIDF || reportPositions {
+			runRow = make([]byte, numRowBytes)
+		}
+
+		// rowOfHashes returns the AND-ed row of hash values of a k-mer.
+		rowOfHashes := func(hs []uint64) []byte {
+			if moreThanOneHash {
+				for j, _h := range hs {
+					loc := int(_h % numSigsUint)
+					if useMmap {
+						offset := offset0 + loc*numRowBytes
+						data[j] = sigs[offset : offset+numRowBytes]
+					} else {
+						fh.Seek(int64(offset0+loc*numRowBytes), 0)
+						io.ReadFull(fh, data[j])
+					}
+				}
+
+				pand.AndUnsafe(runRow, data[0], data[1])
+				if moreThanTwoHashes {
+					for _, row := range data[2:] {
+						pand.AndUnsafeInplace(runRow, row)
+					}
+				}
+				return runRow
+			}
+
+			loc := int(hs[0] % numSigsUint)
+			if useMmap {
+				offset := offset0 + loc*numRowBytes
+				return sigs[offset : offset+numRowBytes]
+			}
+			fh.Seek(int64(offset0+loc*numRowBytes), 0)
+			io.ReadFull(fh, runRow)
+			return runRow
+		}
+
+		// rowOfKmer returns the AND-ed row of the ith k-mer of a query.
+		rowOfKmer := func(query *IndexQuery, ith int) []byte {
+			if moreThanOneHash {
+				return rowOfHashes((*query.Hashes)[ith])
+			}
+			return rowOfHashes((*query.Hashes1)[ith : ith+1])
+		}
+
+		// addKmerSketches adds sampled k-mers of the query to the matches containing them.
+		var sketchHashes [][]uint64
+		addKmerSketches := func(query *IndexQuery, matches []*Match) {
+			for _, m := range matches {
+				m.TargetKmers = sizes[m.col]
+			}
+
+			var row []byte
+			for _, kmer := range query.Sketch {
+				sketchHashes = index.AppendHashValues(sketchHashes[:0], kmer, int(numHashes))
+				row = rowOfHashes(sketchHashes[0])
+				for _, m := range matches {
+					if row[m.col>>3]&(0x80>>(m.col&7)) != 0 {
+						m.Kmers = append(m.Kmers, kmer)
+					}
+				}
+			}
+		}
+
+		// filterCountsByRun clears counts of targets without minRun consecutive
+		// matched k-mers along the query, so they would not be reported.
+		// Only targets passing the count threshold are checked.
+		filterCountsByRun := func(query *IndexQuery) {
+			runCols = runCols[:0]
+			var col, j int
+			for i, _counts := range counts {
+				for j = 0; j < 8; j++ {
+					if _counts[7-j] >= minRun && _counts[7-j] >= minMatched {
+						runCols = append(runCols, i<<3+j)
+					}
+				}
+			}
+			if len(runCols) == 0 {
+				return
+			}
+
+			if cap(runLens) < len(runCols) {
+				runLens = make([]int, len(runCols))
+				maxRuns = make([]int, len(runCols))
+			} else {
+				runLens = runLens[:len(runCols)]
+				maxRuns = maxRuns[:len(runCols)]
+				for j = range runLens {
+					runLens[j] = 0
+					maxRuns[j] = 0
+				}
+			}
+
+			var nKmers int
+			if moreThanOneHash {
+				nKmers = len(*query.Hashes)
+			} else {
+				nKmers = len(*query.Hashes1)
+			}
+
+			var row []byte
+			for i := 0; i < nKmers; i++ {
+				row = rowOfKmer(query, i)
+				for j, col = range runCols {
+					if row[col>>3]&(0x80>>(col&7)) == 0 {
+						runLens[j] = 0
+						continue
+					}
+					runLens[j]++
+					if runLens[j] > maxRuns[j] {
+						maxRuns[j] = runLens[j]
+					}
+				}
+			}
+
+			for j, col = range runCols {
+				if maxRuns[j] < minRun {
+					counts[col>>3][7-(col&7)] = 0
+				}
+			}
+		}
+
 		// counters for < 64 hashes
 
 		countKmers63 := func() {
@@ -6598,21 +7366,34 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 					nHashes = float64(len(*hashes))
 
 					for _, hs = range *hashes {
-						for i, _h = range hs {
-							loc = int(_h % numSigsUint)
-							// loc = int(_h & numSigsUintM1) // & X is faster than % X when X is power of 2
-							offset = offset0 + loc*numRowBytes
-
-							data[i] = sigs[offset : offset+numRowBytes]
+						hit = false
+						if useCache {
+							key = kmerCacheKey(hs)
+							cached, hit = cache.Get(key)
 						}
+						if hit {
+							copy(buffs[bufIdx], cached)
+						} else {
+							for i, _h = range hs {
+								loc = int(_h % numSigsUint)
+								// loc = int(_h & numSigsUintM1) // & X is faster than % X when X is power of 2
+								offset = offset0 + loc*numRowBytes
+
+								data[i] = sigs[offset : offset+numRowBytes]
+							}
 
-						// first two rows
-						pand.AndUnsafe(buffs[bufIdx], data[0], data[1])
+							// first two rows
+							pand.AndUnsafe(buffs[bufIdx], data[0], data[1])
+
+							// more rows
+							if moreThanTwoHashes {
+								for _, row = range data[2:] {
+									pand.AndUnsafeInplace(buffs[bufIdx], row)
+								}
+							}
 
-						// more rows
-						if moreThanTwoHashes {
-							for _, row = range data[2:] {
-								pand.AndUnsafeInplace(buffs[bufIdx], row)
+							if useCache {
+								cache.Put(key, buffs[bufIdx])
 							}
 						}
 
@@ -6946,25 +7727,38 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 					nHashes = float64(len(*hashes))
 
 					for _, hs = range *hashes {
-						for i, _h = range hs {
-							loc = int(_h % numSigsUint)
-							// loc = int(_h & numSigsUintM1) // & X is faster than % X when X is power of 2
-							// offset = offset0 + loc*numRowBytes
+						hit = false
+						if useCache {
+							key = kmerCacheKey(hs)
+							cached, hit = cache.Get(key)
+						}
+						if hit {
+							copy(buffs[bufIdx], cached)
+						} else {
+							for i, _h = range hs {
+								loc = int(_h % numSigsUint)
+								// loc = int(_h & numSigsUintM1) // & X is faster than % X when X is power of 2
+								// offset = offset0 + loc*numRowBytes
 
-							// data[i] = sigs[offset : offset+numRowBytes]
+								// data[i] = sigs[offset : offset+numRowBytes]
 
-							offset2 = int64(offset0 + loc*numRowBytes)
-							fh.Seek(offset2, 0)
-							io.ReadFull(fh, data[i])
-						}
+								offset2 = int64(offset0 + loc*numRowBytes)
+								fh.Seek(offset2, 0)
+								io.ReadFull(fh, data[i])
+							}
 
-						// first two rows
-						pand.AndUnsafe(buffs[bufIdx], data[0], data[1])
+							// first two rows
+							pand.AndUnsafe(buffs[bufIdx], data[0], data[1])
 
-						// more rows
-						if moreThanTwoHashes {
-							for _, row = range data[2:] {
-								pand.AndUnsafeInplace(buffs[bufIdx], row)
+							// more rows
+							if moreThanTwoHashes {
+								for _, row = range data[2:] {
+									pand.AndUnsafeInplace(buffs[bufIdx], row)
+								}
+							}
+
+							if useCache {
+								cache.Put(key, buffs[bufIdx])
 							}
 						}
 
@@ -7133,9 +7927,21 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 						// loc = int(_h & numSigsUintM1) // & X is faster than % X when X is power of 2
 						// offset = offset0 + loc*numRowBytes
 
-						offset2 = int64(offset0 + loc*numRowBytes)
-						fh.Seek(offset2, 0)
-						io.ReadFull(fh, buffs[bufIdx])
+						hit = false
+						if useCache {
+							cached, hit = cache.Get(_h)
+						}
+						if hit {
+							copy(buffs[bufIdx], cached)
+						} else {
+							offset2 = int64(offset0 + loc*numRowBytes)
+							fh.Seek(offset2, 0)
+							io.ReadFull(fh, buffs[bufIdx])
+
+							if useCache {
+								cache.Put(_h, buffs[bufIdx])
+							}
+						}
 
 						// add to buffer for counting
 						bufIdx++
@@ -7296,6 +8102,10 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 				}
 			}
 
+			if useCache {
+				cache.Flush()
+			}
+
 			// -------------------------------------------------------------------------
 			// check counts
 
@@ -7370,9 +8180,18 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 				countKmerss[bufIdx]()
 			}
 
+			if minRun > 1 {
+				filterCountsByRun(query)
+			}
+
+			if query.Explain != nil {
+				query.Explain.addCounts(counts, names, indices, sizesFloat, nHashes, fpr, opt)
+			}
+
 			// results := make([]Match, 0, 8)
 			results := poolMatches.Get().(*[]*Match)
 			var _fpr float64 // FPR for a query
+			var _match *Match
 
 			for i, _counts = range counts {
 				ix8 = i << 3
@@ -7403,7 +8222,7 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 				// 		continue
 				// 	}
 
-				// _fpr = maxFPRf(fpr, t, nHashes)
+				// _fpr = index.MaxFPRf(fpr, t, nHashes)
 				// if _fpr > maxFPR {
 				// 	continue
 				// }
@@ -7433,11 +8252,13 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 						nHashesTarget = sizesFloat[k]
 						T = c / nHashesTarget
 						if T >= targetCov {
-							_fpr = maxFPRf(fpr, t, nHashes)
+							_fpr = index.MaxFPRf(fpr, t, nHashes)
 							if _fpr <= maxFPR {
-								*results = append(*results, &Match{
+								_match = poolMatch.Get().(*Match)
+								*_match = Match{
 									Target:     names[k],
 									GenomeSize: gsizes[k],
+									Taxid:      taxids[k],
 									TargetIdx:  indices[k],
 									NumKmers:   count,
 									FPR:        _fpr,
@@ -7445,7 +8266,10 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 									TCov:       T,
 
 									JaccardIndex: c / (nHashes + nHashesTarget - c), // Jaccard Index
-								})
+
+									col: k,
+								}
+								*results = append(*results, _match)
 							}
 						}
 					}
@@ -7464,11 +8288,13 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 						nHashesTarget = sizesFloat[k]
 						T = c / nHashesTarget
 						if T >= targetCov {
-							_fpr = maxFPRf(fpr, t, nHashes)
+							_fpr = index.MaxFPRf(fpr, t, nHashes)
 							if _fpr <= maxFPR {
-								*results = append(*results, &Match{
+								_match = poolMatch.Get().(*Match)
+								*_match = Match{
 									Target:     names[k],
 									GenomeSize: gsizes[k],
+									Taxid:      taxids[k],
 									TargetIdx:  indices[k],
 									NumKmers:   count,
 									FPR:        _fpr,
@@ -7476,7 +8302,10 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 									TCov:       T,
 
 									JaccardIndex: c / (nHashes + nHashesTarget - c), // Jaccard Index
-								})
+
+									col: k,
+								}
+								*results = append(*results, _match)
 							}
 						}
 					}
@@ -7495,11 +8324,13 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 						nHashesTarget = sizesFloat[k]
 						T = c / nHashesTarget
 						if T >= targetCov {
-							_fpr = maxFPRf(fpr, t, nHashes)
+							_fpr = index.MaxFPRf(fpr, t, nHashes)
 							if _fpr <= maxFPR {
-								*results = append(*results, &Match{
+								_match = poolMatch.Get().(*Match)
+								*_match = Match{
 									Target:     names[k],
 									GenomeSize: gsizes[k],
+									Taxid:      taxids[k],
 									TargetIdx:  indices[k],
 									NumKmers:   count,
 									FPR:        _fpr,
@@ -7507,7 +8338,10 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 									TCov:       T,
 
 									JaccardIndex: c / (nHashes + nHashesTarget - c), // Jaccard Index
-								})
+
+									col: k,
+								}
+								*results = append(*results, _match)
 							}
 						}
 					}
@@ -7526,11 +8360,13 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 						nHashesTarget = sizesFloat[k]
 						T = c / nHashesTarget
 						if T >= targetCov {
-							_fpr = maxFPRf(fpr, t, nHashes)
+							_fpr = index.MaxFPRf(fpr, t, nHashes)
 							if _fpr <= maxFPR {
-								*results = append(*results, &Match{
+								_match = poolMatch.Get().(*Match)
+								*_match = Match{
 									Target:     names[k],
 									GenomeSize: gsizes[k],
+									Taxid:      taxids[k],
 									TargetIdx:  indices[k],
 									NumKmers:   count,
 									FPR:        _fpr,
@@ -7538,7 +8374,10 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 									TCov:       T,
 
 									JaccardIndex: c / (nHashes + nHashesTarget - c), // Jaccard Index
-								})
+
+									col: k,
+								}
+								*results = append(*results, _match)
 							}
 						}
 					}
@@ -7557,11 +8396,13 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 						nHashesTarget = sizesFloat[k]
 						T = c / nHashesTarget
 						if T >= targetCov {
-							_fpr = maxFPRf(fpr, t, nHashes)
+							_fpr = index.MaxFPRf(fpr, t, nHashes)
 							if _fpr <= maxFPR {
-								*results = append(*results, &Match{
+								_match = poolMatch.Get().(*Match)
+								*_match = Match{
 									Target:     names[k],
 									GenomeSize: gsizes[k],
+									Taxid:      taxids[k],
 									TargetIdx:  indices[k],
 									NumKmers:   count,
 									FPR:        _fpr,
@@ -7569,7 +8410,10 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 									TCov:       T,
 
 									JaccardIndex: c / (nHashes + nHashesTarget - c), // Jaccard Index
-								})
+
+									col: k,
+								}
+								*results = append(*results, _match)
 							}
 						}
 					}
@@ -7588,11 +8432,13 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 						nHashesTarget = sizesFloat[k]
 						T = c / nHashesTarget
 						if T >= targetCov {
-							_fpr = maxFPRf(fpr, t, nHashes)
+							_fpr = index.MaxFPRf(fpr, t, nHashes)
 							if _fpr <= maxFPR {
-								*results = append(*results, &Match{
+								_match = poolMatch.Get().(*Match)
+								*_match = Match{
 									Target:     names[k],
 									GenomeSize: gsizes[k],
+									Taxid:      taxids[k],
 									TargetIdx:  indices[k],
 									NumKmers:   count,
 									FPR:        _fpr,
@@ -7600,7 +8446,10 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 									TCov:       T,
 
 									JaccardIndex: c / (nHashes + nHashesTarget - c), // Jaccard Index
-								})
+
+									col: k,
+								}
+								*results = append(*results, _match)
 							}
 						}
 					}
@@ -7619,11 +8468,13 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 						nHashesTarget = sizesFloat[k]
 						T = c / nHashesTarget
 						if T >= targetCov {
-							_fpr = maxFPRf(fpr, t, nHashes)
+							_fpr = index.MaxFPRf(fpr, t, nHashes)
 							if _fpr <= maxFPR {
-								*results = append(*results, &Match{
+								_match = poolMatch.Get().(*Match)
+								*_match = Match{
 									Target:     names[k],
 									GenomeSize: gsizes[k],
+									Taxid:      taxids[k],
 									TargetIdx:  indices[k],
 									NumKmers:   count,
 									FPR:        _fpr,
@@ -7631,7 +8482,10 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 									TCov:       T,
 
 									JaccardIndex: c / (nHashes + nHashesTarget - c), // Jaccard Index
-								})
+
+									col: k,
+								}
+								*results = append(*results, _match)
 							}
 						}
 					}
@@ -7650,11 +8504,13 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 						nHashesTarget = sizesFloat[k]
 						T = c / nHashesTarget
 						if T >= targetCov {
-							_fpr = maxFPRf(fpr, t, nHashes)
+							_fpr = index.MaxFPRf(fpr, t, nHashes)
 							if _fpr <= maxFPR {
-								*results = append(*results, &Match{
+								_match = poolMatch.Get().(*Match)
+								*_match = Match{
 									Target:     names[k],
 									GenomeSize: gsizes[k],
+									Taxid:      taxids[k],
 									TargetIdx:  indices[k],
 									NumKmers:   count,
 									FPR:        _fpr,
@@ -7662,7 +8518,10 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 									TCov:       T,
 
 									JaccardIndex: c / (nHashes + nHashesTarget - c), // Jaccard Index
-								})
+
+									col: k,
+								}
+								*results = append(*results, _match)
 							}
 						}
 					}
@@ -7670,11 +8529,44 @@ func NewUnikIndex(file string, opt SearchOptions, fpr float64, nextraWorkers int
 
 			}
 
+			// document frequencies of k-mers are needed even if no matches found.
+			if useIDF {
+				var nKmers int
+				if moreThanOneHash {
+					nKmers = len(*query.Hashes)
+				} else {
+					nKmers = len(*query.Hashes1)
+				}
+				resetKmerBits(*results, nKmers)
+				for i = 0; i < nKmers; i++ {
+					addKmerRowToIDF(rowOfKmer(query, i), i, query.DF, *results)
+				}
+			} else if reportPositions && len(*results) > 0 {
+				var nKmers int
+				if moreThanOneHash {
+					nKmers = len(*query.Hashes)
+				} else {
+					nKmers = len(*query.Hashes1)
+				}
+				resetKmerBits(*results, nKmers)
+				for i = 0; i < nKmers; i++ {
+					addKmerRowToBits(rowOfKmer(query, i), i, *results)
+				}
+			}
+
 			// not found
 			if len(*results) == 0 {
 				poolMatches.Put(results)
 				query.Ch <- nil
 			} else {
+				if sketchScale > 0 {
+					addKmerSketches(query, *results)
+				}
+				if emitBlock {
+					for _, _match = range *results {
+						_match.Block = blockName
+					}
+				}
 				query.Ch <- results
 			}
 		}
@@ -7717,10 +8609,48 @@ func (idx *UnikIndex) Close() error {
 	return idx.fh.Close()
 }
 
-var poolKmers = &sync.Pool{New: func() interface{} {
-	tmp := make([]uint64, 0, 512)
-	return &tmp
-}}
+// k-mer lists are pooled by capacity, so that the big lists of long queries
+// are not reused by the short ones, and vice versa.
+const (
+	kmersPoolMinBits = 9  // 512
+	kmersPoolMaxBits = 26 // 64M
+)
+
+var poolKmersBySize = func() []*sync.Pool {
+	pools := make([]*sync.Pool, kmersPoolMaxBits+1)
+	for i := kmersPoolMinBits; i <= kmersPoolMaxBits; i++ {
+		size := 1 << uint(i)
+		pools[i] = &sync.Pool{New: func() interface{} {
+			tmp := make([]uint64, 0, size)
+			return &tmp
+		}}
+	}
+	return pools
+}()
+
+// getKmers returns an empty k-mer list with a capacity of at least n.
+func getKmers(n int) *[]uint64 {
+	i := kmersPoolMinBits
+	if n > 1<<kmersPoolMinBits {
+		i = bits.Len(uint(n - 1)) // ceil(log2(n))
+		if i > kmersPoolMaxBits {
+			tmp := make([]uint64, 0, n)
+			return &tmp
+		}
+	}
+	kmers := poolKmersBySize[i].Get().(*[]uint64)
+	*kmers = (*kmers)[:0]
+	return kmers
+}
+
+// putKmers recycles a k-mer list returned by getKmers.
+func putKmers(kmers *[]uint64) {
+	i := bits.Len(uint(cap(*kmers))) - 1 // floor(log2(cap))
+	if i < kmersPoolMinBits || i > kmersPoolMaxBits {
+		return
+	}
+	poolKmersBySize[i].Put(kmers)
+}
 
 var poolKmers2 = &sync.Pool{New: func() interface{} {
 	tmp := make([]uint64, 0, 512)
@@ -7737,6 +8667,59 @@ var poolMatches = &sync.Pool{New: func() interface{} {
 	return &tmp
 }}
 
+// subsampleKmers keeps k-mers from the start position with hash values <= maxHash in place,
+// i.e., a FracMinHash sketch of the query, k-mers before start are kept as they are.
+func subsampleKmers(kmers []uint64, start int, maxHash uint64) []uint64 {
+	j := start
+	for _, kmer := range kmers[start:] {
+		if index.Hash64(kmer) <= maxHash {
+			kmers[j] = kmer
+			j++
+		}
+	}
+	return kmers[:j]
+}
+
+// sampleKmers deterministically samples n k-mers, i.e., those with the n smallest hash values
+// of the k-mers mixed with the seed, and the positional order of k-mers is kept.
+func sampleKmers(kmers []uint64, n int, seed uint64) []uint64 {
+	if n <= 0 || len(kmers) <= n {
+		return kmers
+	}
+
+	seed = index.Hash64(seed)
+	hashes := make([]uint64, len(kmers))
+	for i, kmer := range kmers {
+		hashes[i] = index.Hash64(kmer ^ seed)
+	}
+	sorted := make([]uint64, len(hashes))
+	copy(sorted, hashes)
+	sort.Sort(Uint64Slice(sorted))
+	max := sorted[n-1]
+
+	var j int
+	for i, kmer := range kmers {
+		if hashes[i] <= max && j < n {
+			kmers[j] = kmer
+			j++
+		}
+	}
+	return kmers[:j]
+}
+
+var poolMatch = &sync.Pool{New: func() interface{} {
+	return &Match{}
+}}
+
+// recycleMatches recycles all the Match objects and the list itself.
+func recycleMatches(matches *[]*Match) {
+	for _, m := range *matches {
+		poolMatch.Put(m)
+	}
+	*matches = (*matches)[:0]
+	poolMatches.Put(matches)
+}
+
 var poolChanMatches = &sync.Pool{New: func() interface{} {
 	return make(chan *[]*Match, 1024)
 }}
@@ -7752,3 +8735,26 @@ var poolQueryResult = &sync.Pool{New: func() interface{} {
 var poolQuery = &sync.Pool{New: func() interface{} {
 	return &Query{}
 }}
+
+var poolSeq = &sync.Pool{New: func() interface{} {
+	return &seq.Seq{}
+}}
+
+// Uint64Slice is a slice of uint64, for sorting and heap.
+type Uint64Slice []uint64
+
+func (s Uint64Slice) Len() int           { return len(s) }
+func (s Uint64Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s Uint64Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (s *Uint64Slice) Push(x interface{}) {
+	*s = append(*s, x.(uint64))
+}
+
+func (s *Uint64Slice) Pop() interface{} {
+	old := *s
+	n := len(old)
+	x := old[n-1]
+	*s = old[0 : n-1]
+	return x
+}
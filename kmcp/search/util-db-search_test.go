@@ -0,0 +1,200 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package search
+
+import (
+	"github.com/shenwei356/kmcp/kmcp/index"
+	"testing"
+)
+
+func TestNumTopNScores(t *testing.T) {
+	// matches sorted by qcov, tcov and jacc respectively, with ties
+	byQcov := []*Match{
+		{QCov: 0.9, TCov: 0.1, JaccardIndex: 0.1},
+		{QCov: 0.9, TCov: 0.2, JaccardIndex: 0.2},
+		{QCov: 0.8, TCov: 0.3, JaccardIndex: 0.3},
+		{QCov: 0.7, TCov: 0.4, JaccardIndex: 0.4},
+		{QCov: 0.7, TCov: 0.5, JaccardIndex: 0.5},
+	}
+	byTcov := []*Match{
+		{QCov: 0.1, TCov: 0.6, JaccardIndex: 0.1},
+		{QCov: 0.2, TCov: 0.5, JaccardIndex: 0.2},
+		{QCov: 0.3, TCov: 0.5, JaccardIndex: 0.3},
+		{QCov: 0.4, TCov: 0.5, JaccardIndex: 0.4},
+		{QCov: 0.5, TCov: 0.4, JaccardIndex: 0.5},
+	}
+	byJacc := []*Match{
+		{QCov: 0.1, TCov: 0.1, JaccardIndex: 0.3},
+		{QCov: 0.2, TCov: 0.2, JaccardIndex: 0.3},
+		{QCov: 0.3, TCov: 0.3, JaccardIndex: 0.3},
+		{QCov: 0.4, TCov: 0.4, JaccardIndex: 0.2},
+		{QCov: 0.5, TCov: 0.5, JaccardIndex: 0.1},
+	}
+
+	tests := []struct {
+		name    string
+		matches []*Match
+		sortBy  string
+		topN    int
+		want    int
+	}{
+		{"qcov top1 with ties", byQcov, "qcov", 1, 2},
+		{"qcov top2", byQcov, "qcov", 2, 3},
+		{"qcov top3 all scores", byQcov, "qcov", 3, 5},
+		{"qcov topN > distinct scores", byQcov, "qcov", 10, 5},
+
+		{"tcov top1", byTcov, "tcov", 1, 1},
+		{"tcov top2 with ties", byTcov, "tcov", 2, 4},
+		{"tcov top3 all scores", byTcov, "tcov", 3, 5},
+		{"tcov topN > distinct scores", byTcov, "tcov", 4, 5},
+
+		{"jacc top1 with ties", byJacc, "jacc", 1, 3},
+		{"jacc top2", byJacc, "jacc", 2, 4},
+		{"jacc topN = distinct scores", byJacc, "jacc", 3, 5},
+		{"jacc topN > distinct scores", byJacc, "jacc", 100, 5},
+
+		{"unknown metric uses qcov", byQcov, "", 1, 2},
+		{"no matches", nil, "qcov", 1, 0},
+	}
+
+	for _, test := range tests {
+		if got := numTopNScores(test.matches, test.topN, test.sortBy); got != test.want {
+			t.Errorf("%s: numTopNScores(topN=%d, sortBy=%q) = %d, want %d",
+				test.name, test.topN, test.sortBy, got, test.want)
+		}
+	}
+}
+
+func TestMatchHeapCap(t *testing.T) {
+	qcovs := []float64{0.6, 0.9, 0.7, 0.8, 0.5}
+	matches := make([]*Match, len(qcovs))
+	for i, qcov := range qcovs {
+		matches[i] = &Match{QCov: qcov}
+	}
+
+	mh := newMatchHeap(3, "qcov")
+	if n := mh.Cap(&matches); n != 2 {
+		t.Errorf("matchHeap.Cap() discarded %d matches, want 2", n)
+	}
+	if len(matches) != 3 {
+		t.Fatalf("matchHeap.Cap() kept %d matches, want 3", len(matches))
+	}
+	for _, m := range matches {
+		if m.QCov < 0.7 {
+			t.Errorf("matchHeap.Cap() kept a match with qcov %.1f, want the top 3", m.QCov)
+		}
+	}
+	if mh.Len() != 0 {
+		t.Errorf("matchHeap.Cap() did not reset the heap")
+	}
+}
+
+// Benchmarks of reusing objects in searching, run with
+//
+//	go test -run NONE -bench . -benchmem ./kmcp/search
+//
+// to compare allocs/op of allocating new objects and reusing pooled ones.
+
+// sinks of benchmarks, to keep objects escaping to the heap as in searching.
+var benchKmers []uint64
+var benchMatches []*Match
+
+func BenchmarkKmersMake(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		kmers := make([]uint64, 0, 150)
+		for j := 0; j < 150; j++ {
+			kmers = append(kmers, uint64(j))
+		}
+		benchKmers = kmers
+	}
+}
+
+func BenchmarkKmersPool(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		kmers := getKmers(150)
+		for j := 0; j < 150; j++ {
+			*kmers = append(*kmers, uint64(j))
+		}
+		putKmers(kmers)
+	}
+}
+
+func BenchmarkHashValues(b *testing.B) {
+	b.ReportAllocs()
+	hashes := make([][]uint64, 0, 150)
+	for i := 0; i < b.N; i++ {
+		hashes = hashes[:0]
+		for j := 0; j < 150; j++ {
+			hashes = append(hashes, index.HashValues(index.Hash64(uint64(j)), 3))
+		}
+	}
+}
+
+func BenchmarkAppendHashValues(b *testing.B) {
+	b.ReportAllocs()
+	hashes := make([][]uint64, 0, 150)
+	for i := 0; i < b.N; i++ {
+		hashes = hashes[:0]
+		for j := 0; j < 150; j++ {
+			hashes = index.AppendHashValues(hashes, index.Hash64(uint64(j)), 3)
+		}
+	}
+}
+
+func BenchmarkMatchesNew(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		matches := make([]*Match, 0, 16)
+		for j := 0; j < 16; j++ {
+			matches = append(matches, &Match{NumKmers: j})
+		}
+		benchMatches = matches
+	}
+}
+
+func BenchmarkMatchesPool(b *testing.B) {
+	b.ReportAllocs()
+	var m *Match
+	for i := 0; i < b.N; i++ {
+		matches := poolMatches.Get().(*[]*Match)
+		for j := 0; j < 16; j++ {
+			m = poolMatch.Get().(*Match)
+			*m = Match{NumKmers: j}
+			*matches = append(*matches, m)
+		}
+		recycleMatches(matches)
+	}
+}
+
+func BenchmarkAppendProteinKmers(b *testing.B) {
+	b.ReportAllocs()
+	t, err := NewAlphabetTable("murphy10")
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := []byte("MKRISTTITTTITITTGNGAGLVKLAAQLGPWQLALLGRS")
+	kmers := make([]uint64, 0, len(s))
+	for i := 0; i < b.N; i++ {
+		kmers = t.AppendProteinKmers(kmers[:0], s, 10, false, 0)
+	}
+}
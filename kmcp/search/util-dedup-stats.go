@@ -0,0 +1,55 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package search
+
+import "sync/atomic"
+
+// KmerDedupStats records numbers of k-mers before and after deduplication,
+// only for queries with more k-mers than -u/--kmer-dedup-threshold.
+type KmerDedupStats struct {
+	queries uint64
+	kmers   uint64
+	uniq    uint64
+}
+
+func (s *KmerDedupStats) add(kmers, uniq int) {
+	atomic.AddUint64(&s.queries, 1)
+	atomic.AddUint64(&s.kmers, uint64(kmers))
+	atomic.AddUint64(&s.uniq, uint64(uniq))
+}
+
+// Queries returns the number of deduplicated queries.
+func (s *KmerDedupStats) Queries() uint64 { return atomic.LoadUint64(&s.queries) }
+
+// Kmers returns the number of k-mers of deduplicated queries.
+func (s *KmerDedupStats) Kmers() uint64 { return atomic.LoadUint64(&s.kmers) }
+
+// Uniq returns the number of distinct k-mers of deduplicated queries.
+func (s *KmerDedupStats) Uniq() uint64 { return atomic.LoadUint64(&s.uniq) }
+
+// DupRate returns the proportion of duplicated k-mers.
+func (s *KmerDedupStats) DupRate() float64 {
+	kmers := s.Kmers()
+	if kmers == 0 {
+		return 0
+	}
+	return float64(kmers-s.Uniq()) / float64(kmers)
+}
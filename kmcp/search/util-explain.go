@@ -0,0 +1,183 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package search
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/shenwei356/kmcp/kmcp/index"
+)
+
+// explainTopN is the maximal number of targets to show for every search round.
+const explainTopN = 10
+
+// QueryExplanation records why a query is or isn't matched to targets,
+// for diagnosing with "kmcp search --explain-query".
+// It's shared by all databases and index files searching the query.
+type QueryExplanation struct {
+	mu sync.Mutex
+
+	notes   []string
+	targets []targetExplanation // targets with at least one matched k-mer in current round
+}
+
+type targetExplanation struct {
+	target   string
+	chunkIdx uint64
+	numKmers int
+	qCov     float64
+	tCov     float64
+	fpr      float64
+	failed   string // the first failed threshold, empty for passing all thresholds
+}
+
+// NewQueryExplanation creates a QueryExplanation.
+func NewQueryExplanation() *QueryExplanation {
+	return &QueryExplanation{notes: make([]string, 0, 16)}
+}
+
+// Notef adds a note.
+func (e *QueryExplanation) Notef(format string, a ...interface{}) {
+	e.mu.Lock()
+	e.notes = append(e.notes, fmt.Sprintf(format, a...))
+	e.mu.Unlock()
+}
+
+// addCounts checks all targets with matched k-mers in an index file against
+// the thresholds, counts are in the order of package pospop.
+func (e *QueryExplanation) addCounts(counts [][8]int, names [][]string, indices [][]uint64,
+	sizes []float64, nHashes float64, fpr float64, opt SearchOptions) {
+
+	var k, count int
+	var c, t, T, _fpr float64
+	var failed string
+	targets := make([]targetExplanation, 0, 8)
+	for i, _counts := range counts {
+		for j := 0; j < 8; j++ {
+			k = i<<3 + j
+			if k >= len(names) {
+				break
+			}
+			count = _counts[7-j]
+			if count == 0 {
+				continue
+			}
+
+			c = float64(count)
+			t = c / nHashes
+			T = c / sizes[k]
+			_fpr = index.MaxFPRf(fpr, t, nHashes)
+
+			switch {
+			case count < opt.MinMatched:
+				failed = fmt.Sprintf("matched k-mers < %d (-c/--min-kmers)", opt.MinMatched)
+			case t < opt.MinQueryCov:
+				failed = fmt.Sprintf("qCov < %v (-t/--min-query-cov)", opt.MinQueryCov)
+			case T < opt.MinTargetCov:
+				failed = fmt.Sprintf("tCov < %v (-T/--min-target-cov)", opt.MinTargetCov)
+			case _fpr > opt.MaxFPR:
+				failed = fmt.Sprintf("FPR > %v (-f/--max-fpr)", opt.MaxFPR)
+			default:
+				failed = ""
+			}
+
+			targets = append(targets, targetExplanation{
+				target:   names[k][0],
+				chunkIdx: indices[k][0],
+				numKmers: count,
+				qCov:     t,
+				tCov:     T,
+				fpr:      _fpr,
+				failed:   failed,
+			})
+		}
+	}
+
+	e.mu.Lock()
+	e.targets = append(e.targets, targets...)
+	e.mu.Unlock()
+}
+
+// flushTargets summarizes targets of current search round into notes.
+func (e *QueryExplanation) flushTargets() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var passed int
+	for _, t := range e.targets {
+		if t.failed == "" {
+			passed++
+		}
+	}
+	e.notes = append(e.notes, fmt.Sprintf("  %d targets with matched k-mers, %d passed all thresholds",
+		len(e.targets), passed))
+
+	sort.Slice(e.targets, func(i, j int) bool {
+		return e.targets[i].numKmers > e.targets[j].numKmers
+	})
+
+	var idx, n uint32
+	var status string
+	for i, t := range e.targets {
+		if i == explainTopN {
+			e.notes = append(e.notes, fmt.Sprintf("    ... %d more targets", len(e.targets)-explainTopN))
+			break
+		}
+		if t.failed == "" {
+			status = "passed"
+		} else {
+			status = "failed: " + t.failed
+		}
+		idx, n = index.DecodeChunkIdx(t.chunkIdx)
+		e.notes = append(e.notes, fmt.Sprintf("    %s (chunk %d/%d): matched k-mers: %d, qCov: %.4f, tCov: %.4f, FPR: %.4e, %s",
+			t.target, idx, n, t.numKmers, t.qCov, t.tCov, t.fpr, status))
+	}
+	e.targets = e.targets[:0]
+}
+
+// Write outputs the explanation along with the final result of the query.
+func (e *QueryExplanation) Write(w io.Writer, result *QueryResult) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[explain] query: %s, length: %d\n", result.QueryID, result.QueryLen)
+	for _, note := range e.notes {
+		fmt.Fprintf(&b, "[explain] %s\n", note)
+	}
+	if result.Matches == nil || len(*result.Matches) == 0 {
+		fmt.Fprintf(&b, "[explain] result: unmatched\n")
+	} else {
+		fmt.Fprintf(&b, "[explain] result: matched to %d target(s) with k=%d:\n", len(*result.Matches), result.K)
+		var idx, n uint32
+		for _, m := range *result.Matches {
+			idx, n = index.DecodeChunkIdx(m.TargetIdx[0])
+			fmt.Fprintf(&b, "[explain]   %s (chunk %d/%d): matched k-mers: %d, qCov: %.4f, tCov: %.4f\n",
+				m.Target[0], idx, n, m.NumKmers, m.QCov, m.TCov)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
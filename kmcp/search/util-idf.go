@@ -0,0 +1,96 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package search
+
+import (
+	"math"
+	"math/bits"
+	"sync/atomic"
+)
+
+// With --idf, matched k-mers are weighted by their inverse document frequency (IDF)
+// when computing query coverages, so discriminative k-mers shared by few targets count more
+// than ubiquitous ones.
+//
+// The document frequency of a k-mer, i.e., the number of targets (chunks) containing it,
+// is the number of set bits of its row in the bloom filter matrices of all index files,
+// so no extra data is needed in the database. The expected number of false positive
+// bits, i.e., FPR * #targets, is subtracted.
+
+// addKmerRowToIDF adds the document frequency of the ith k-mer of a query in a row,
+// and marks the k-mer for matches whose targets are in the row.
+func addKmerRowToIDF(row []byte, ith int, df []uint32, matches []*Match) {
+	var n int
+	for _, b := range row {
+		n += bits.OnesCount8(b)
+	}
+	atomic.AddUint32(&df[ith], uint32(n)) // rows of the same k-mer in different index files
+
+	addKmerRowToBits(row, ith, matches)
+}
+
+// resetKmerBits prepares the bit vectors of matched k-mers of matches.
+func resetKmerBits(matches []*Match, nKmers int) {
+	n := (nKmers + 63) >> 6
+	for _, m := range matches {
+		if cap(m.kmerBits) < n {
+			m.kmerBits = make([]uint64, n)
+			continue
+		}
+		m.kmerBits = m.kmerBits[:n]
+		for i := range m.kmerBits {
+			m.kmerBits[i] = 0
+		}
+	}
+}
+
+// idfWeights computes smoothed IDF weights of k-mers, i.e., ln((1+N)/(1+df)) + 1,
+// where N is the number of targets, and df is corrected for false positives.
+// It returns the weights and their sum.
+func idfWeights(df []uint32, nTargets int, fpr float64, weights []float64) ([]float64, float64) {
+	weights = weights[:0]
+	N := float64(nTargets)
+	nFP := fpr * N
+	var d, w, sum float64
+	for _, v := range df {
+		d = float64(v) - nFP
+		if d < 0 {
+			d = 0
+		}
+		w = math.Log((1+N)/(1+d)) + 1
+		weights = append(weights, w)
+		sum += w
+	}
+	return weights, sum
+}
+
+// weightedQCov returns the IDF-weighted query coverage of a match.
+func weightedQCov(m *Match, weights []float64, sum float64) float64 {
+	var s float64
+	var word uint64
+	var j int
+	for i, v := range m.kmerBits {
+		for word = v; word != 0; word &= word - 1 {
+			j = i<<6 + bits.TrailingZeros64(word)
+			s += weights[j]
+		}
+	}
+	return s / sum
+}
@@ -0,0 +1,132 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package search
+
+import (
+	"container/list"
+	"sync/atomic"
+)
+
+// KmerCacheStats records lookups and hits of k-mer caches of all index files.
+type KmerCacheStats struct {
+	lookups uint64
+	hits    uint64
+}
+
+func (s *KmerCacheStats) add(lookups, hits uint64) {
+	atomic.AddUint64(&s.lookups, lookups)
+	atomic.AddUint64(&s.hits, hits)
+}
+
+// Lookups returns the number of k-mers looked up in caches.
+func (s *KmerCacheStats) Lookups() uint64 { return atomic.LoadUint64(&s.lookups) }
+
+// Hits returns the number of k-mers found in caches.
+func (s *KmerCacheStats) Hits() uint64 { return atomic.LoadUint64(&s.hits) }
+
+// HitRate returns the proportion of cache hits.
+func (s *KmerCacheStats) HitRate() float64 {
+	lookups := s.Lookups()
+	if lookups == 0 {
+		return 0
+	}
+	return float64(s.Hits()) / float64(lookups)
+}
+
+// kmerRowCache is a bounded LRU cache of k-mer -> bit-sliced row of an index,
+// i.e., the AND result of the rows of all hash functions, which stores the
+// matched targets of a k-mer. It is not safe for concurrent use, every
+// searching goroutine of an index file should have its own cache.
+type kmerRowCache struct {
+	capacity int
+	rowBytes int
+
+	ll *list.List
+	m  map[uint64]*list.Element
+
+	lookups, hits uint64 // not flushed to stats
+	stats         *KmerCacheStats
+}
+
+type kmerRowEntry struct {
+	key uint64
+	row []byte
+}
+
+// newKmerRowCache creates a cache holding at most capacity rows.
+func newKmerRowCache(capacity int, rowBytes int, stats *KmerCacheStats) *kmerRowCache {
+	return &kmerRowCache{
+		capacity: capacity,
+		rowBytes: rowBytes,
+		ll:       list.New(),
+		m:        make(map[uint64]*list.Element, capacity),
+		stats:    stats,
+	}
+}
+
+// Get returns the cached row of a k-mer, the row should not be modified.
+func (c *kmerRowCache) Get(key uint64) ([]byte, bool) {
+	c.lookups++
+	if e, ok := c.m[key]; ok {
+		c.hits++
+		c.ll.MoveToFront(e)
+		return e.Value.(*kmerRowEntry).row, true
+	}
+	return nil, false
+}
+
+// Put saves a copy of the row of a k-mer, the least recently used one
+// is evicted when the cache is full.
+func (c *kmerRowCache) Put(key uint64, row []byte) {
+	if e, ok := c.m[key]; ok {
+		copy(e.Value.(*kmerRowEntry).row, row)
+		c.ll.MoveToFront(e)
+		return
+	}
+
+	var entry *kmerRowEntry
+	if c.ll.Len() >= c.capacity { // reuse the oldest one
+		e := c.ll.Back()
+		entry = e.Value.(*kmerRowEntry)
+		delete(c.m, entry.key)
+		c.ll.Remove(e)
+	} else {
+		entry = &kmerRowEntry{row: make([]byte, c.rowBytes)}
+	}
+
+	entry.key = key
+	copy(entry.row, row)
+	c.m[key] = c.ll.PushFront(entry)
+}
+
+// Flush adds the numbers of lookups and hits to the shared stats.
+func (c *kmerRowCache) Flush() {
+	if c.stats != nil && c.lookups > 0 {
+		c.stats.add(c.lookups, c.hits)
+	}
+	c.lookups, c.hits = 0, 0
+}
+
+// kmerCacheKey returns the key of a k-mer from its hash values of a
+// bloom filter, which are generated from the two halves of the k-mer hash.
+func kmerCacheKey(hs []uint64) uint64 {
+	return hs[0]<<32 | (hs[1]-hs[0])&0xffffffff
+}
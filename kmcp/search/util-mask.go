@@ -0,0 +1,46 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package search
+
+// hasSoftMasked tells if a sequence contains lowercase (soft-masked) letters.
+func hasSoftMasked(s []byte) bool {
+	for _, b := range s {
+		if b >= 'a' && b <= 'z' {
+			return true
+		}
+	}
+	return false
+}
+
+// HardMask replaces lowercase (soft-masked) letters with 'N',
+// or 'X' for amino acid sequences, in place.
+// K-mers containing these letters are skipped when computing k-mers.
+func HardMask(s []byte, protein bool) {
+	var m byte = 'N'
+	if protein {
+		m = 'X'
+	}
+	for i, b := range s {
+		if b >= 'a' && b <= 'z' {
+			s[i] = m
+		}
+	}
+}
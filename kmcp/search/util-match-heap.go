@@ -0,0 +1,112 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package search
+
+import "container/heap"
+
+// matchBetter returns a function judging if match a ranks before match b,
+// consistent with the sorting of matches by qcov, tcov or jacc.
+func matchBetter(sortBy string) func(a, b *Match) bool {
+	switch sortBy {
+	case "tcov":
+		return func(a, b *Match) bool {
+			if a.TCov != b.TCov {
+				return a.TCov > b.TCov
+			}
+			return a.NumKmers > b.NumKmers
+		}
+	case "jacc":
+		return func(a, b *Match) bool {
+			if a.JaccardIndex != b.JaccardIndex {
+				return a.JaccardIndex > b.JaccardIndex
+			}
+			return a.NumKmers > b.NumKmers
+		}
+	default: // qcov
+		return func(a, b *Match) bool {
+			if a.QCov != b.QCov {
+				return a.QCov > b.QCov
+			}
+			return a.TCov > b.TCov
+		}
+	}
+}
+
+// matchHeap is a min-heap of matches with the worst one on the top,
+// it's used for keeping at most N best matches of a query without sorting all of them.
+type matchHeap struct {
+	n       int
+	better  func(a, b *Match) bool
+	matches []*Match
+}
+
+func newMatchHeap(n int, sortBy string) *matchHeap {
+	return &matchHeap{n: n, better: matchBetter(sortBy), matches: make([]*Match, 0, n)}
+}
+
+func (h *matchHeap) Len() int           { return len(h.matches) }
+func (h *matchHeap) Less(i, j int) bool { return h.better(h.matches[j], h.matches[i]) }
+func (h *matchHeap) Swap(i, j int)      { h.matches[i], h.matches[j] = h.matches[j], h.matches[i] }
+
+func (h *matchHeap) Push(x interface{}) { h.matches = append(h.matches, x.(*Match)) }
+
+func (h *matchHeap) Pop() interface{} {
+	n := len(h.matches)
+	m := h.matches[n-1]
+	h.matches = h.matches[:n-1]
+	return m
+}
+
+// Add adds a match, and returns the discarded match or nil,
+// the discarded one could be recycled.
+func (h *matchHeap) Add(m *Match) *Match {
+	if len(h.matches) < h.n {
+		heap.Push(h, m)
+		return nil
+	}
+	if !h.better(m, h.matches[0]) {
+		return m
+	}
+	worst := h.matches[0]
+	h.matches[0] = m
+	heap.Fix(h, 0)
+	return worst
+}
+
+// Cap keeps at most N best matches of a list in place, discarded matches are recycled.
+// It returns the number of discarded matches, and the heap is reset for reusing.
+func (h *matchHeap) Cap(matches *[]*Match) int {
+	var n int
+	for _, m := range *matches {
+		if m = h.Add(m); m != nil {
+			poolMatch.Put(m)
+			n++
+		}
+	}
+	*matches = append((*matches)[:0], h.matches...)
+	h.Reset()
+	return n
+}
+
+// Reset clears the heap for reusing.
+func (h *matchHeap) Reset() {
+	h.matches = h.matches[:0]
+}
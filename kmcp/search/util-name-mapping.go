@@ -0,0 +1,116 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package search
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+)
+
+// NameMappingCollisions records source names mapped to the same value,
+// and the number of matches each source name contributed,
+// for surfacing unintended merges of references.
+type NameMappingCollisions struct {
+	Groups map[string][]string // mapped value -> source names
+
+	counts map[string]*uint64 // source name -> number of matches
+}
+
+// NewNameMappingCollisions finds collisions in name mappings.
+// For a source name existing in multiple mappings, the former one is used.
+func NewNameMappingCollisions(maps ...map[string]string) *NameMappingCollisions {
+	merged := make(map[string]string, 1024)
+	for _, m := range maps {
+		for k, v := range m {
+			if _, ok := merged[k]; !ok {
+				merged[k] = v
+			}
+		}
+	}
+
+	groups := make(map[string][]string, 1024)
+	for k, v := range merged {
+		groups[v] = append(groups[v], k)
+	}
+
+	c := &NameMappingCollisions{
+		Groups: make(map[string][]string, 128),
+		counts: make(map[string]*uint64, 1024),
+	}
+	for v, ks := range groups {
+		if len(ks) < 2 {
+			continue
+		}
+		sort.Strings(ks)
+		c.Groups[v] = ks
+		for _, k := range ks {
+			var n uint64
+			c.counts[k] = &n
+		}
+	}
+	return c
+}
+
+// Add increases the count of a source name, it's safe for concurrent use.
+func (c *NameMappingCollisions) Add(source string) {
+	if n, ok := c.counts[source]; ok {
+		atomic.AddUint64(n, 1)
+	}
+}
+
+// AddN increases the count of a source name by n, it's safe for concurrent use.
+func (c *NameMappingCollisions) AddN(source string, n uint64) {
+	if v, ok := c.counts[source]; ok {
+		atomic.AddUint64(v, n)
+	}
+}
+
+// Count returns the count of a source name.
+func (c *NameMappingCollisions) Count(source string) uint64 {
+	if n, ok := c.counts[source]; ok {
+		return atomic.LoadUint64(n)
+	}
+	return 0
+}
+
+// Write writes the collisions in tab-delimited format with three columns:
+// mapped value, source name, and the number of matches.
+func (c *NameMappingCollisions) Write(w io.Writer) error {
+	values := make([]string, 0, len(c.Groups))
+	for v := range c.Groups {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+
+	if _, err := io.WriteString(w, "#value\tsource\tmatches\n"); err != nil {
+		return err
+	}
+	for _, v := range values {
+		for _, k := range c.Groups[v] {
+			if _, err := fmt.Fprintf(w, "%s\t%s\t%d\n", v, k, c.Count(k)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
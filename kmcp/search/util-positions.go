@@ -0,0 +1,54 @@
+// Copyright © 2020-2022 Wei Shen <shenwei356@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package search
+
+import (
+	"math/bits"
+)
+
+// With --report-positions, positions of matched k-mers in a query are reported.
+// Positions of k-mers are recorded when generating k-mers of the query, and k-mers
+// matched by a target are marked in a bit vector of the match when checking rows
+// of the k-mers in index files.
+
+// addKmerRowToBits marks the ith k-mer as matched in the bit vectors of matches containing it.
+func addKmerRowToBits(row []byte, ith int, matches []*Match) {
+	for _, m := range matches {
+		if row[m.col>>3]&(0x80>>(m.col&7)) != 0 {
+			m.kmerBits[ith>>6] |= 1 << uint(ith&63)
+		}
+	}
+}
+
+// matchedKmerPositions appends positions of k-mers marked in the bit vector of matched k-mers.
+func matchedKmerPositions(kmerBits []uint64, positions []int, matched []int) []int {
+	var i int
+	for j, b := range kmerBits {
+		for b != 0 {
+			i = j<<6 + bits.TrailingZeros64(b)
+			if i < len(positions) {
+				matched = append(matched, positions[i])
+			}
+			b &= b - 1
+		}
+	}
+	return matched
+}